@@ -0,0 +1,400 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package alert evaluates rules over the metrics extracted from logs, and
+// calls a webhook or runs a command when one holds, so that hosts without
+// central alerting can react to conditions in their logs.
+package alert
+
+import (
+	"expvar"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+var (
+	// notifications counts the notifications sent for each alert.
+	notifications = expvar.NewMap("alert_notifications_total")
+	// notificationErrors counts the notifications for each alert that failed.
+	notificationErrors = expvar.NewMap("alert_notification_errors_total")
+	// notificationsSuppressed counts the times each alert would have fired
+	// again within its cooldown.
+	notificationsSuppressed = expvar.NewMap("alert_notifications_suppressed_total")
+)
+
+// DefaultInterval is how often rules are evaluated unless set by Interval.
+const DefaultInterval = 15 * time.Second
+
+// notifyTimeout bounds the time spent on a webhook call or command.
+const notifyTimeout = 10 * time.Second
+
+// Evaluator periodically evaluates alert rules over the metrics in a store.
+type Evaluator struct {
+	store    *metrics.Store
+	rules    []*Rule
+	interval time.Duration
+	client   *http.Client
+
+	mu     sync.Mutex             // protects alerts
+	alerts map[string]*alertState // by rule name and label values
+
+	done chan struct{} // closed to stop evaluation
+	wg   sync.WaitGroup
+}
+
+// alertState is the state of a rule for one label value set of its metric.
+type alertState struct {
+	rule    *Rule
+	labels  map[string]string
+	samples []sample // the values within the window, oldest first, for rate and increase
+	value   float64  // the last value compared with the threshold
+
+	seen         bool      // set if the value was found in the last evaluation
+	pendingSince time.Time // when the condition began to hold, or zero if it doesn't
+	firing       bool
+	suppressed   bool // set if the alert was held back by the cooldown since the condition began to hold
+	lastFired    time.Time
+}
+
+type sample struct {
+	t time.Time
+	v float64
+}
+
+// Notification describes an alert that fired or resolved.  It is posted to
+// webhooks as JSON.
+type Notification struct {
+	Alert  string            `json:"alert"`
+	State  string            `json:"state"` // "firing" or "resolved"
+	Expr   string            `json:"expr"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+	Time   time.Time         `json:"time"`
+
+	rule *Rule
+}
+
+// Interval sets how often the rules are evaluated.
+func Interval(d time.Duration) func(*Evaluator) error {
+	return func(e *Evaluator) error {
+		if d <= 0 {
+			return errors.New("alert interval must be positive")
+		}
+		e.interval = d
+		return nil
+	}
+}
+
+// New creates an Evaluator of rules over the metrics in store.
+func New(store *metrics.Store, rules []*Rule, options ...func(*Evaluator) error) (*Evaluator, error) {
+	if store == nil {
+		return nil, errors.New("alert evaluator needs a store")
+	}
+	e := &Evaluator{
+		store:    store,
+		rules:    rules,
+		interval: DefaultInterval,
+		client:   &http.Client{Timeout: notifyTimeout},
+		alerts:   make(map[string]*alertState),
+		done:     make(chan struct{}),
+	}
+	for _, option := range options {
+		if err := option(e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Start evaluates the rules each interval until the Evaluator is closed.
+func (e *Evaluator) Start() {
+	if len(e.rules) == 0 {
+		return
+	}
+	glog.Infof("Evaluating %d alert rules every %s", len(e.rules), e.interval)
+	ticker := time.NewTicker(e.interval)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				e.notify(e.evaluate(now))
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the evaluation of rules, waiting for any notifications in
+// progress.
+func (e *Evaluator) Close() error {
+	close(e.done)
+	e.wg.Wait()
+	return nil
+}
+
+// evaluate compares the metrics with the rules at time now, and returns the
+// notifications to send.
+func (e *Evaluator) evaluate(now time.Time) []*Notification {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, a := range e.alerts {
+		a.seen = false
+	}
+	e.store.RLock()
+	for _, r := range e.rules {
+		for _, m := range e.store.Metrics[r.Metric] {
+			m.RLock()
+			for _, lv := range m.LabelValues {
+				labels := make(map[string]string, len(m.Keys)+1)
+				for i, v := range lv.Labels {
+					labels[m.Keys[i]] = v
+				}
+				labels["prog"] = m.Program
+				if !matches(r.Labels, labels) {
+					continue
+				}
+				var v float64
+				switch d := lv.Value.(type) {
+				case *datum.IntDatum:
+					v = float64(d.Get())
+				case *datum.FloatDatum:
+					v = d.Get()
+				default:
+					continue
+				}
+				key := alertKey(r.Name, labels)
+				a, ok := e.alerts[key]
+				if !ok {
+					a = &alertState{rule: r, labels: labels}
+					e.alerts[key] = a
+				}
+				a.seen = true
+				a.observe(now, v)
+			}
+			m.RUnlock()
+		}
+	}
+	e.store.RUnlock()
+
+	var ns []*Notification
+	for key, a := range e.alerts {
+		holds := a.seen && a.holds()
+		if n := a.update(now, holds); n != nil {
+			ns = append(ns, n)
+		}
+		if !a.seen && !a.firing {
+			// The value has gone, perhaps expired by its program.
+			delete(e.alerts, key)
+		}
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].Alert < ns[j].Alert })
+	return ns
+}
+
+// observe records the value v of the metric at time now.
+func (a *alertState) observe(now time.Time, v float64) {
+	if a.rule.Func == "" {
+		a.value = v
+		a.samples = []sample{{now, v}}
+		return
+	}
+	a.samples = append(a.samples, sample{now, v})
+	// Keep the newest sample at or before the start of the window.
+	start := now.Add(-a.rule.Window)
+	for len(a.samples) > 1 && !a.samples[1].t.After(start) {
+		a.samples = a.samples[1:]
+	}
+	oldest := a.samples[0]
+	increase := v - oldest.v
+	if increase < 0 {
+		// The counter was reset.
+		increase = v
+	}
+	a.value = increase
+	if a.rule.Func == "rate" && len(a.samples) > 1 {
+		a.value = increase / now.Sub(oldest.t).Seconds()
+	}
+}
+
+// holds returns true if the rule's condition holds for the last observation.
+func (a *alertState) holds() bool {
+	if a.rule.Func != "" && len(a.samples) < 2 {
+		// Rate and increase need two observations.
+		return false
+	}
+	return a.rule.compare(a.value)
+}
+
+// update records whether the condition holds at time now, and returns the
+// notification to send, if any.  An alert fires once the condition has held
+// for the rule's For duration, and resolves when it stops holding.  It isn't
+// repeated while it fires, and doesn't fire again within the rule's Cooldown.
+func (a *alertState) update(now time.Time, holds bool) *Notification {
+	if !holds {
+		a.pendingSince = time.Time{}
+		a.suppressed = false
+		if !a.firing {
+			return nil
+		}
+		a.firing = false
+		return a.notification("resolved", now)
+	}
+	if a.pendingSince.IsZero() {
+		a.pendingSince = now
+	}
+	if a.firing || now.Sub(a.pendingSince) < a.rule.For {
+		return nil
+	}
+	if !a.lastFired.IsZero() && now.Sub(a.lastFired) < a.rule.Cooldown {
+		if !a.suppressed {
+			notificationsSuppressed.Add(a.rule.Name, 1)
+			a.suppressed = true
+		}
+		return nil
+	}
+	a.firing, a.suppressed = true, false
+	a.lastFired = now
+	return a.notification("firing", now)
+}
+
+func (a *alertState) notification(state string, now time.Time) *Notification {
+	labels := make(map[string]string, len(a.labels))
+	for k, v := range a.labels {
+		labels[k] = v
+	}
+	return &Notification{
+		Alert:  a.rule.Name,
+		State:  state,
+		Expr:   a.rule.String(),
+		Labels: labels,
+		Value:  a.value,
+		Time:   now,
+		rule:   a.rule,
+	}
+}
+
+// matches returns true if labels has each of the labels in want.
+func matches(want, labels map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func alertKey(name string, labels map[string]string) string {
+	s := []string{name}
+	for _, k := range sortedKeys(labels) {
+		s = append(s, k+"="+labels[k])
+	}
+	return strings.Join(s, "\x00")
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// notify sends each notification to the action of its rule.
+func (e *Evaluator) notify(ns []*Notification) {
+	for _, n := range ns {
+		glog.Infof("Alert %s %s: %s is %g, labels %v", n.Alert, n.State, n.Expr, n.Value, n.Labels)
+		notifications.Add(n.Alert, 1)
+		var err error
+		if n.rule.Webhook != "" {
+			err = e.postWebhook(n.rule.Webhook, n)
+		} else {
+			err = runCommand(n.rule.Command, n)
+		}
+		if err != nil {
+			glog.Infof("Notification of alert %s failed: %s", n.Alert, err)
+			notificationErrors.Add(n.Alert, 1)
+		}
+	}
+}
+
+const alertTemplate = `
+<h2 id="alerts">Alerts</h2>
+<table border=1>
+<tr>
+<th>alert</th>
+<th>condition</th>
+<th>labels</th>
+<th>value</th>
+<th>state</th>
+<th>last fired</th>
+</tr>
+{{range $a := .}}
+<tr>
+<td>{{$a.Name}}</td>
+<td><pre>{{$a.Expr}}</pre></td>
+<td>{{$a.Labels}}</td>
+<td>{{$a.Value}}</td>
+<td>{{$a.State}}</td>
+<td>{{if not $a.LastFired.IsZero}}{{$a.LastFired.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan=6>No alerts pending or firing</td></tr>
+{{end}}
+</table>
+`
+
+// WriteStatusHTML emits the alerts that are pending or firing, in HTML format,
+// to the io.Writer w.
+func (e *Evaluator) WriteStatusHTML(w io.Writer) error {
+	if len(e.rules) == 0 {
+		return nil
+	}
+	tpl, err := template.New("alert").Parse(alertTemplate)
+	if err != nil {
+		return err
+	}
+	type status struct {
+		Name, Expr, Labels, State string
+		Value                     float64
+		LastFired                 time.Time
+	}
+	var data []status
+	e.mu.Lock()
+	for _, a := range e.alerts {
+		state := "firing"
+		if !a.firing {
+			if a.pendingSince.IsZero() {
+				continue
+			}
+			state = "pending since " + a.pendingSince.Format(time.RFC3339)
+		}
+		var labels []string
+		for _, k := range sortedKeys(a.labels) {
+			labels = append(labels, k+"="+a.labels[k])
+		}
+		data = append(data, status{a.rule.Name, a.rule.String(), strings.Join(labels, ","), state, a.value, a.lastFired})
+	}
+	e.mu.Unlock()
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].Name != data[j].Name {
+			return data[i].Name < data[j].Name
+		}
+		return data[i].Labels < data[j].Labels
+	})
+	return tpl.Execute(w, data)
+}
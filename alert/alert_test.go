@@ -0,0 +1,117 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestEvaluate(t *testing.T) {
+	store := metrics.NewStore()
+	m := metrics.NewMetric("errors_total", "app.mtail", metrics.Counter, datum.Int, "code")
+	if err := store.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	d, err := m.GetDatum("500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := parseRule("errors when increase(errors_total{code=500}) > 5 over 1m for 20s cooldown 2m exec true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(store, []*Rule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		seconds  int
+		value    int64
+		expected string // the state notified, if any
+	}{
+		{0, 0, ""},
+		{10, 10, ""}, // the condition holds, pending
+		{30, 20, "firing"},
+		{40, 30, ""}, // still firing, not repeated
+		{100, 30, "resolved"},
+		{110, 40, ""}, // pending again
+		{130, 50, ""}, // held back by the cooldown
+		{150, 60, "firing"},
+	} {
+		datum.SetInt(d, tc.value, start)
+		ns := e.evaluate(start.Add(time.Duration(tc.seconds) * time.Second))
+		var got string
+		if len(ns) > 1 {
+			t.Errorf("at %ds: %d notifications", tc.seconds, len(ns))
+		}
+		if len(ns) == 1 {
+			got = ns[0].State
+			if ns[0].Labels["code"] != "500" || ns[0].Labels["prog"] != "app.mtail" {
+				t.Errorf("at %ds: labels %v", tc.seconds, ns[0].Labels)
+			}
+		}
+		if got != tc.expected {
+			t.Errorf("at %ds: notified %q, want %q", tc.seconds, got, tc.expected)
+		}
+	}
+	var b bytes.Buffer
+	if err := e.WriteStatusHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "firing") {
+		t.Errorf("status page doesn't show the firing alert:\n%s", b.String())
+	}
+}
+
+func TestNotify(t *testing.T) {
+	received := make(chan *Notification, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		received <- &n
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	e, err := New(metrics.NewStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"prog": "app.mtail"}
+	e.notify([]*Notification{
+		{Alert: "hook", State: "firing", Labels: labels, Value: 11, rule: &Rule{Webhook: ts.URL}},
+		{Alert: "cmd", State: "resolved", Labels: labels, Value: 1, rule: &Rule{Command: `echo "$MTAIL_ALERT $MTAIL_ALERT_STATE $MTAIL_ALERT_VALUE $MTAIL_ALERT_LABELS" > ` + out}},
+	})
+	n := <-received
+	if n.Alert != "hook" || n.State != "firing" || n.Value != 11 {
+		t.Errorf("webhook received %+v", n)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "cmd resolved 1 prog=app.mtail\n" {
+		t.Errorf("command wrote %q", b)
+	}
+}
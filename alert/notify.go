@@ -0,0 +1,64 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// postWebhook posts n as JSON to url.
+func (e *Evaluator) postWebhook(url string, n *Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// runCommand runs command with the shell, with n as JSON on its standard
+// input, and in the environment variables MTAIL_ALERT, MTAIL_ALERT_STATE,
+// MTAIL_ALERT_EXPR, MTAIL_ALERT_VALUE, and MTAIL_ALERT_LABELS.
+func runCommand(command string, n *Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	var labels []string
+	for _, k := range sortedKeys(n.Labels) {
+		labels = append(labels, k+"="+n.Labels[k])
+	}
+	cmd.Env = append(os.Environ(),
+		"MTAIL_ALERT="+n.Alert,
+		"MTAIL_ALERT_STATE="+n.State,
+		"MTAIL_ALERT_EXPR="+n.Expr,
+		"MTAIL_ALERT_VALUE="+strconv.FormatFloat(n.Value, 'g', -1, 64),
+		"MTAIL_ALERT_LABELS="+strings.Join(labels, ","))
+	cmd.Stdin = bytes.NewReader(b)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "command %q: %s", command, bytes.TrimSpace(out))
+	}
+	return nil
+}
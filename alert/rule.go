@@ -0,0 +1,202 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package alert
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for the optional clauses of a rule.
+const (
+	defaultWindow   = time.Minute
+	defaultCooldown = 10 * time.Minute
+)
+
+// Rule describes a condition over the values of a metric, and the action to
+// take when it holds.  Each label value set of the metric is alerted on
+// separately.
+type Rule struct {
+	Name      string
+	Func      string            // "rate" or "increase" over Window, or empty for the value itself
+	Metric    string            // name of the metric
+	Labels    map[string]string // labels a value must have, including prog for the program
+	Op        string            // comparison of the value with Threshold
+	Threshold float64
+
+	Window   time.Duration // the period over which rate and increase are computed
+	For      time.Duration // how long the condition must hold before the alert fires
+	Cooldown time.Duration // how long after an alert fires before it may fire again
+
+	Webhook string // URL to which notifications are posted, or
+	Command string // shell command run for each notification
+}
+
+// String returns the rule's condition, as it was written.
+func (r *Rule) String() string {
+	s := r.Metric
+	if len(r.Labels) > 0 {
+		var l []string
+		for _, k := range sortedKeys(r.Labels) {
+			l = append(l, k+"="+r.Labels[k])
+		}
+		s += "{" + strings.Join(l, ",") + "}"
+	}
+	if r.Func != "" {
+		s = r.Func + "(" + s + ")"
+	}
+	return s + " " + r.Op + " " + strconv.FormatFloat(r.Threshold, 'g', -1, 64)
+}
+
+// compare returns true if v satisfies the rule's comparison.
+func (r *Rule) compare(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	case "==":
+		return v == r.Threshold
+	case "!=":
+		return v != r.Threshold
+	}
+	return false
+}
+
+// ReadRules reads the alert rules in the file at path.
+func ReadRules(path string) ([]*Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRules(path, f)
+}
+
+// parseRules parses one rule per line of r.  Blank lines and lines starting
+// with # are ignored.  A rule looks like
+//
+//	NAME when [rate|increase(]METRIC[{LABEL=VALUE,...}][)] OP THRESHOLD
+//	  [over DURATION] [for DURATION] [cooldown DURATION]
+//	  (webhook URL | exec COMMAND...)
+//
+// all on one line.
+func parseRules(name string, r io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", name, n)
+		}
+		if names[rule.Name] {
+			return nil, errors.Errorf("%s:%d: duplicate alert name %q", name, n, rule.Name)
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+var ops = map[string]bool{">": true, ">=": true, "<": true, "<=": true, "==": true, "!=": true}
+
+func parseRule(line string) (*Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[1] != "when" {
+		return nil, errors.New("expected NAME when EXPRESSION")
+	}
+	r := &Rule{Name: fields[0], Window: defaultWindow, Cooldown: defaultCooldown}
+	if err := r.parseSelector(fields[2]); err != nil {
+		return nil, err
+	}
+	if r.Op = fields[3]; !ops[r.Op] {
+		return nil, errors.Errorf("unknown comparison %q", r.Op)
+	}
+	var err error
+	if r.Threshold, err = strconv.ParseFloat(fields[4], 64); err != nil {
+		return nil, errors.Errorf("bad threshold %q", fields[4])
+	}
+	for i := 5; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			return nil, errors.Errorf("expected a value after %q", fields[i])
+		}
+		switch fields[i] {
+		case "over", "for", "cooldown":
+			d, err := time.ParseDuration(fields[i+1])
+			if err != nil || d < 0 {
+				return nil, errors.Errorf("bad duration %q after %q", fields[i+1], fields[i])
+			}
+			switch fields[i] {
+			case "over":
+				if d == 0 {
+					return nil, errors.New("the window must be positive")
+				}
+				r.Window = d
+			case "for":
+				r.For = d
+			default:
+				r.Cooldown = d
+			}
+		case "webhook":
+			r.Webhook = fields[i+1]
+			if i+2 != len(fields) {
+				return nil, errors.New("unexpected text after the webhook URL")
+			}
+			return r, nil
+		case "exec":
+			r.Command = strings.Join(fields[i+1:], " ")
+			return r, nil
+		default:
+			return nil, errors.Errorf("unexpected %q", fields[i])
+		}
+	}
+	return nil, errors.New("expected a webhook or exec action")
+}
+
+// parseSelector parses a metric selector, like rate(errors_total{prog=app.mtail}).
+func (r *Rule) parseSelector(s string) error {
+	for _, f := range []string{"rate", "increase"} {
+		if strings.HasPrefix(s, f+"(") {
+			if !strings.HasSuffix(s, ")") {
+				return errors.Errorf("missing ) in %q", s)
+			}
+			r.Func, s = f, s[len(f)+1:len(s)-1]
+			break
+		}
+	}
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		if !strings.HasSuffix(s, "}") {
+			return errors.Errorf("missing } in %q", s)
+		}
+		r.Labels = make(map[string]string)
+		for _, l := range strings.Split(s[i+1:len(s)-1], ",") {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return errors.Errorf("bad label matcher %q", l)
+			}
+			r.Labels[kv[0]] = kv[1]
+		}
+		s = s[:i]
+	}
+	if s == "" || strings.ContainsAny(s, "(){}") {
+		return errors.Errorf("bad metric name %q", s)
+	}
+	r.Metric = s
+	return nil
+}
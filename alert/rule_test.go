@@ -0,0 +1,77 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package alert
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules("rules", strings.NewReader(`
+# Comments and blank lines are ignored.
+
+errors when rate(errors_total{prog=app.mtail,code=500}) > 10 over 5m for 1m cooldown 1h webhook http://localhost:9093/hook
+queue when queue_depth >= 1e3 exec logger -t mtail "queue is $MTAIL_ALERT_VALUE"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Rule{
+		{
+			Name:      "errors",
+			Func:      "rate",
+			Metric:    "errors_total",
+			Labels:    map[string]string{"prog": "app.mtail", "code": "500"},
+			Op:        ">",
+			Threshold: 10,
+			Window:    5 * time.Minute,
+			For:       time.Minute,
+			Cooldown:  time.Hour,
+			Webhook:   "http://localhost:9093/hook",
+		},
+		{
+			Name:      "queue",
+			Metric:    "queue_depth",
+			Op:        ">=",
+			Threshold: 1000,
+			Window:    defaultWindow,
+			Cooldown:  defaultCooldown,
+			Command:   `logger -t mtail "queue is $MTAIL_ALERT_VALUE"`,
+		},
+	}
+	if diff := cmp.Diff(expected, rules); diff != "" {
+		t.Errorf("rules differ:\n%s", diff)
+	}
+	if s := rules[0].String(); s != "rate(errors_total{code=500,prog=app.mtail}) > 10" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"errors",
+		"errors if errors_total > 1 exec true",
+		"errors when errors_total > 1",
+		"errors when errors_total ~ 1 exec true",
+		"errors when errors_total > x exec true",
+		"errors when rate(errors_total > 1 exec true",
+		"errors when errors_total{code} > 1 exec true",
+		"errors when errors_total > 1 over 0s exec true",
+		"errors when errors_total > 1 for -1m exec true",
+		"errors when errors_total > 1 every 1m exec true",
+		"errors when errors_total > 1 webhook http://a/ http://b/",
+		"errors when errors_total > 1 cooldown",
+	} {
+		if _, err := parseRule(line); err == nil {
+			t.Errorf("parseRule(%q) succeeded", line)
+		}
+	}
+	if _, err := parseRules("rules", strings.NewReader("a when x > 1 exec true\na when y > 1 exec true\n")); err == nil {
+		t.Error("duplicate alert names accepted")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package audit keeps an append-only log of the changes to the definitions of
+// the metrics mtail exports: the programs loaded and unloaded, with hashes of
+// their source, the metrics they create or redefine, and the export
+// configuration, so that it is known when the meaning of a reported metric
+// changed.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// auditRecords counts the events recorded in the audit log, by kind.
+var auditRecords = expvar.NewMap("audit_records_total")
+
+// The kinds of event recorded.
+const (
+	ProgramLoad   = "program_load"   // a program was loaded or reloaded
+	ProgramUnload = "program_unload" // a program was unloaded
+	MetricCreate  = "metric_create"  // a program defined a metric for the first time
+	MetricChange  = "metric_change"  // a program changed the definition of a metric
+	ExportConfig  = "export_config"  // the export configuration changed
+)
+
+// Event is a record in the audit log.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Program string    `json:"program,omitempty"`
+	Metric  string    `json:"metric,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"` // of the program source, or the export rules
+	Detail  string    `json:"detail,omitempty"` // the metric definition, or export configuration
+}
+
+// exportConfigKey is the key of the export configuration in the
+// definitions.
+const exportConfigKey = "\x00export"
+
+// Log is an append-only audit log file.
+type Log struct {
+	mu          sync.Mutex        // serialises writes to f, and guards definitions
+	f           *os.File          // open for reading and appending
+	definitions map[string]string // the last definition recorded of each metric, and of the export configuration
+}
+
+// Open opens the audit log file at path, creating it if it doesn't exist.
+// The file is kept open, so it can still be written and queried after mtail
+// changes user or root directory.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit log")
+	}
+	l := &Log{f: f, definitions: make(map[string]string)}
+	// Learn the definitions already recorded, so that they are only recorded
+	// again if they change.
+	if err := l.scan(func(e *Event) { l.learn(e) }); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Close closes the audit log file.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// definitionKey is the key of a metric of a program in the definitions.
+func definitionKey(program, metric string) string {
+	return program + "\x00" + metric
+}
+
+// learn remembers the definition recorded by e, if any.  The caller must hold
+// mu, or have the only reference to the Log.
+func (l *Log) learn(e *Event) {
+	switch e.Kind {
+	case MetricCreate, MetricChange:
+		l.definitions[definitionKey(e.Program, e.Metric)] = e.Detail
+	case ExportConfig:
+		l.definitions[exportConfigKey] = e.Detail + "\x00" + e.SHA256
+	}
+}
+
+// Record appends the event to the log, stamped with the current time if it
+// has none, and flushes it to disk.
+func (l *Log) Record(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.record(e)
+}
+
+// record is Record for a caller that holds mu.
+func (l *Log) record(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// A single write, so that concurrent writers to the file don't interleave.
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write audit log")
+	}
+	l.learn(&e)
+	auditRecords.Add(e.Kind, 1)
+	return l.f.Sync()
+}
+
+// DefineMetric records that the program defines the metric, unless the
+// definition is the one last recorded for it.
+func (l *Log) DefineMetric(program, metric, definition string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev, ok := l.definitions[definitionKey(program, metric)]
+	if ok && prev == definition {
+		return nil
+	}
+	kind := MetricCreate
+	if ok {
+		kind = MetricChange
+	}
+	return l.record(Event{Kind: kind, Program: program, Metric: metric, Detail: definition})
+}
+
+// SetExportConfig records the export configuration, and the hash of any
+// export rules, unless they are the ones last recorded.
+func (l *Log) SetExportConfig(config, sha256 string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.definitions[exportConfigKey] == config+"\x00"+sha256 {
+		return nil
+	}
+	return l.record(Event{Kind: ExportConfig, SHA256: sha256, Detail: config})
+}
+
+// scan calls f with each event in the log, in order.  Lines that aren't
+// events, such as one left incomplete by a crash, are skipped.
+func (l *Log) scan(f func(*Event)) error {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(l.f, 0, fi.Size()))
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			glog.Warningf("Skipping line %d of the audit log: %s", n, err)
+			continue
+		}
+		f(&e)
+	}
+	return errors.Wrap(scanner.Err(), "failed to read audit log")
+}
+
+// Filter selects events from the log.  Empty fields match every event.
+type Filter struct {
+	Kind    string
+	Program string
+	Metric  string
+	Since   time.Time // if set, only events at or after this time
+}
+
+func (f Filter) matches(e *Event) bool {
+	return (f.Kind == "" || f.Kind == e.Kind) &&
+		(f.Program == "" || f.Program == e.Program) &&
+		(f.Metric == "" || f.Metric == e.Metric) &&
+		!e.Time.Before(f.Since)
+}
+
+// Events returns the events in the log that match the filter, oldest first.
+func (l *Log) Events(f Filter) ([]Event, error) {
+	var events []Event
+	err := l.scan(func(e *Event) {
+		if f.matches(e) {
+			events = append(events, *e)
+		}
+	})
+	return events, err
+}
+
+// ServeHTTP writes the events in the log as JSON, one per line, oldest first.
+// The query parameters kind, program, metric, and since, a time in RFC 3339
+// format, select the events.
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f := Filter{
+		Kind:    r.FormValue("kind"),
+		Program: r.FormValue("program"),
+		Metric:  r.FormValue("metric"),
+	}
+	if since := r.FormValue("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "since must be a time like 2006-01-02T15:04:05Z", http.StatusBadRequest)
+			return
+		}
+		f.Since = t
+	}
+	events, err := l.Events(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			glog.Info(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package audit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+)
+
+func openTestLog(t *testing.T) (*Log, string, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return l, path, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// kinds returns the kinds of the events.
+func kinds(events []Event) []string {
+	var k []string
+	for _, e := range events {
+		k = append(k, e.Kind+" "+e.Program+" "+e.Metric)
+	}
+	return k
+}
+
+func TestDefinitionsRecordedOnChange(t *testing.T) {
+	l, path, cleanup := openTestLog(t)
+	defer cleanup()
+
+	for _, step := range []func() error{
+		func() error { return l.Record(Event{Kind: ProgramLoad, Program: "web", SHA256: "abc"}) },
+		func() error { return l.DefineMetric("web", "requests", "counter requests of type Int") },
+		func() error { return l.DefineMetric("web", "requests", "counter requests of type Int") },
+		func() error { return l.DefineMetric("web", "requests", "counter requests by code of type Int") },
+		func() error { return l.DefineMetric("db", "requests", "counter requests of type Int") },
+		func() error { return l.SetExportConfig("omit_prog_label", "") },
+		func() error { return l.SetExportConfig("omit_prog_label", "") },
+		func() error { return l.Record(Event{Kind: ProgramUnload, Program: "web"}) },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := l.Events(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"program_load web ",
+		"metric_create web requests",
+		"metric_change web requests",
+		"metric_create db requests",
+		"export_config  ",
+		"program_unload web ",
+	}
+	if diff := go_cmp.Diff(expected, kinds(events)); diff != "" {
+		t.Errorf("events differ:\n%s", diff)
+	}
+	for _, e := range events {
+		if e.Time.IsZero() {
+			t.Errorf("event %v has no time", e)
+		}
+	}
+
+	// Reopening the log remembers the definitions already recorded, and
+	// appends to it.
+	l.Close()
+	l2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	if err := l2.DefineMetric("web", "requests", "counter requests by code of type Int"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l2.SetExportConfig("", ""); err != nil {
+		t.Fatal(err)
+	}
+	events, err = l2.Events(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := go_cmp.Diff(append(expected, "export_config  "), kinds(events)); diff != "" {
+		t.Errorf("events after reopening differ:\n%s", diff)
+	}
+}
+
+func TestEventsFilter(t *testing.T) {
+	l, path, cleanup := openTestLog(t)
+	defer cleanup()
+
+	t0 := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range []Event{
+		{Time: t0, Kind: ProgramLoad, Program: "web"},
+		{Time: t0, Kind: MetricCreate, Program: "web", Metric: "requests"},
+		{Time: t0.Add(time.Hour), Kind: ProgramLoad, Program: "db"},
+		{Time: t0.Add(time.Hour), Kind: MetricCreate, Program: "db", Metric: "queries"},
+	} {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An incomplete last line, as a crash might leave, is skipped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2018-06-01T`)
+	f.Close()
+
+	for _, tc := range []struct {
+		filter   Filter
+		expected []string
+	}{
+		{Filter{Kind: ProgramLoad}, []string{"program_load web ", "program_load db "}},
+		{Filter{Program: "db"}, []string{"program_load db ", "metric_create db queries"}},
+		{Filter{Metric: "requests"}, []string{"metric_create web requests"}},
+		{Filter{Since: t0.Add(time.Minute)}, []string{"program_load db ", "metric_create db queries"}},
+		{Filter{Kind: MetricChange}, nil},
+	} {
+		events, err := l.Events(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := go_cmp.Diff(tc.expected, kinds(events)); diff != "" {
+			t.Errorf("events for %+v differ:\n%s", tc.filter, diff)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	l, _, cleanup := openTestLog(t)
+	defer cleanup()
+
+	t0 := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := l.Record(Event{Time: t0, Kind: ProgramLoad, Program: "web", SHA256: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(Event{Time: t0.Add(time.Hour), Kind: ProgramUnload, Program: "web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/auditz?since=2018-06-01T12:30:00Z", nil))
+	expected := `{"time":"2018-06-01T13:00:00Z","kind":"program_unload","program":"web"}
+`
+	if diff := go_cmp.Diff(expected, w.Body.String()); diff != "" {
+		t.Errorf("response differs:\n%s", diff)
+	}
+	if ct := w.Header().Get("Content-type"); ct != "application/x-ndjson" {
+		t.Errorf("content type %q", ct)
+	}
+
+	w = httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/auditz?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "since") {
+		t.Errorf("bad since: got %d %q", w.Code, w.Body.String())
+	}
+}
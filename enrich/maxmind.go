@@ -0,0 +1,379 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package enrich provides databases that programs can look up properties of
+// values from log lines in, such as the country an IP address is in.
+package enrich
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxMindMetadataStart marks the start of the metadata at the end of a
+// MaxMind database.
+var maxMindMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxMindDataSeparator is the size of the zeros between the search tree and
+// the data section.
+const maxMindDataSeparator = 16
+
+// MaxMindDB is a database in the MaxMind DB format, like the GeoIP2 and
+// GeoLite2 databases, read into memory.
+type MaxMindDB struct {
+	buf        []byte
+	tree       []byte // the search tree
+	data       []byte // the data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // the node at which IPv4 addresses are looked up in an IPv6 tree
+	dbType     string
+}
+
+// OpenMaxMindDB reads the MaxMind database at path.
+func OpenMaxMindDB(path string) (*MaxMindDB, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newMaxMindDB(buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad MaxMind database %q", path)
+	}
+	return db, nil
+}
+
+func newMaxMindDB(buf []byte) (*MaxMindDB, error) {
+	i := bytes.LastIndex(buf, maxMindMetadataStart)
+	if i < 0 {
+		return nil, errors.New("no metadata")
+	}
+	meta := buf[i+len(maxMindMetadataStart):]
+	v, _, err := (&maxMindDecoder{meta}).decode(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "metadata")
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata isn't a map")
+	}
+	db := &MaxMindDB{buf: buf}
+	for _, f := range []struct {
+		key string
+		v   *uint
+	}{{"node_count", &db.nodeCount}, {"record_size", &db.recordSize}, {"ip_version", &db.ipVersion}} {
+		n, ok := m[f.key].(uint64)
+		if !ok {
+			return nil, errors.Errorf("metadata has no %s", f.key)
+		}
+		*f.v = uint(n)
+	}
+	db.dbType, _ = m["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, errors.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, errors.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+maxMindDataSeparator > uint(i) {
+		return nil, errors.New("search tree is larger than the database")
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+maxMindDataSeparator : i]
+	if db.ipVersion == 6 {
+		// IPv4 addresses are in the IPv6 tree as ::a.b.c.d.
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// DatabaseType returns the type of the database, like "GeoLite2-Country".
+func (db *MaxMindDB) DatabaseType() string {
+	return db.dbType
+}
+
+// record returns the left (0) or right (1) record of the node.
+func (db *MaxMindDB) record(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// Lookup returns the record of the network ip is in, or nil if the database
+// has none.  Maps are returned as map[string]interface{}, arrays as
+// []interface{}, and numbers as uint64, int64 or float64.
+func (db *MaxMindDB) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-uint(i%8)))&1)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("search tree is too shallow")
+	}
+	v, _, err := (&maxMindDecoder{db.data}).decode(node - db.nodeCount - maxMindDataSeparator)
+	return v, err
+}
+
+// GeoIPCountry looks up the ISO 3166 code of the country that IP addresses
+// are in, in a MaxMind GeoIP2 or GeoLite2 Country or City database.
+type GeoIPCountry struct {
+	db *MaxMindDB
+}
+
+// NewGeoIPCountry reads the MaxMind database at path.
+func NewGeoIPCountry(path string) (*GeoIPCountry, error) {
+	db, err := OpenMaxMindDB(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIPCountry{db}, nil
+}
+
+// Lookup returns the country code of the IP address in key, which may be
+// followed by a port, or the empty string if key isn't an IP address or the
+// database doesn't know its country.  The country the address is registered
+// to is used if the country it is in is unknown.
+func (g *GeoIPCountry) Lookup(key string) (string, error) {
+	ip := parseIP(key)
+	if ip == nil {
+		return "", nil
+	}
+	v, err := g.db.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	r, _ := v.(map[string]interface{})
+	for _, field := range []string{"country", "registered_country"} {
+		if c, ok := r[field].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseIP returns the IP address in s, which may be followed by a port, or
+// nil if s isn't an IP address.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// The types of the fields in the data section.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// maxMindDecoder decodes fields from the data section of a MaxMind database.
+type maxMindDecoder struct {
+	b []byte
+}
+
+var errMaxMindTruncated = errors.New("truncated data")
+
+// decode returns the field at offset, and the offset after it.
+func (d *maxMindDecoder) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(d.b)) {
+		return nil, 0, errMaxMindTruncated
+	}
+	ctrl := d.b[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == mmdbExtended {
+		if offset >= uint(len(d.b)) {
+			return nil, 0, errMaxMindTruncated
+		}
+		typ = 7 + uint(d.b[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.Errorf("map key of type %T", k)
+			}
+			if v, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d.b)) {
+		return nil, 0, errMaxMindTruncated
+	}
+	b := d.b[offset : offset+size]
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.Errorf("float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errors.Errorf("unsigned integer of %d bytes", size)
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errors.Errorf("signed integer of %d bytes", size)
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(n)), offset, nil
+		}
+		return int64(n), offset, nil
+	case mmdbUint128:
+		return append([]byte(nil), b...), offset, nil
+	}
+	return nil, 0, errors.Errorf("unsupported data type %d", typ)
+}
+
+// size returns the payload size in the control byte ctrl, which may continue
+// in the bytes at offset, and the offset of the payload.
+func (d *maxMindDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.b)) {
+		return 0, 0, errMaxMindTruncated
+	}
+	var extra uint
+	for _, c := range d.b[offset : offset+n] {
+		extra = extra<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		size = 29 + extra
+	case 30:
+		size = 285 + extra
+	default:
+		size = 65821 + extra
+	}
+	return size, offset + n, nil
+}
+
+// pointer returns the offset a pointer with control byte ctrl points to, and
+// the offset after it.
+func (d *maxMindDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&0x3 + 1
+	if offset+n > uint(len(d.b)) {
+		return 0, 0, errMaxMindTruncated
+	}
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 0x7)
+	}
+	for _, c := range d.b[offset : offset+n] {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	return p, offset + n, nil
+}
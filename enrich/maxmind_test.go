@@ -0,0 +1,286 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package enrich
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testPointer is encoded as a pointer to the field at that offset in the data
+// section.
+type testPointer uint
+
+// encodeTestField appends v to b in the format of the data section.
+func encodeTestField(b *bytes.Buffer, v interface{}) {
+	ctrl := func(typ, size int) {
+		if typ < 8 {
+			b.WriteByte(byte(typ<<5 | size))
+		} else {
+			b.WriteByte(byte(size))
+			b.WriteByte(byte(typ - 7))
+		}
+	}
+	switch v := v.(type) {
+	case testPointer:
+		b.WriteByte(byte(mmdbPointer<<5) | byte(v>>8))
+		b.WriteByte(byte(v))
+	case string:
+		if len(v) < 29 {
+			ctrl(mmdbString, len(v))
+		} else {
+			ctrl(mmdbString, 29)
+			b.WriteByte(byte(len(v) - 29))
+		}
+		b.WriteString(v)
+	case uint16:
+		ctrl(mmdbUint16, 2)
+		binary.Write(b, binary.BigEndian, v)
+	case uint32:
+		ctrl(mmdbUint32, 4)
+		binary.Write(b, binary.BigEndian, v)
+	case float64:
+		ctrl(mmdbDouble, 8)
+		binary.Write(b, binary.BigEndian, v)
+	case bool:
+		if v {
+			ctrl(mmdbBool, 1)
+		} else {
+			ctrl(mmdbBool, 0)
+		}
+	case []interface{}:
+		ctrl(mmdbArray, len(v))
+		for _, e := range v {
+			encodeTestField(b, e)
+		}
+	case map[string]interface{}:
+		ctrl(mmdbMap, len(v))
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeTestField(b, k)
+			encodeTestField(b, v[k])
+		}
+	default:
+		panic(v)
+	}
+}
+
+type testNetwork struct {
+	cidr   string
+	record interface{}
+}
+
+// trieNode is a node of the search tree, with a child or a data offset on
+// each side.
+type trieNode struct {
+	child [2]*trieNode
+	data  [2]int // offset plus one, if nonzero
+	id    uint
+}
+
+// buildTestMaxMindDB returns a MaxMind database of the networks, which
+// mustn't overlap.
+func buildTestMaxMindDB(ipVersion uint16, recordSize uint, networks []testNetwork) []byte {
+	root := &trieNode{}
+	var data bytes.Buffer
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+		ip := ipnet.IP
+		ones, _ := ipnet.Mask.Size()
+		if ipVersion == 6 && len(ip.To4()) == net.IPv4len && strings.Contains(n.cidr, ".") {
+			ip = append(make(net.IP, 12), ip.To4()...)
+			ones += 96
+		}
+		offset := data.Len()
+		encodeTestField(&data, n.record)
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				node.data[bit] = offset + 1
+				break
+			}
+			if node.child[bit] == nil {
+				node.child[bit] = &trieNode{}
+			}
+			node = node.child[bit]
+		}
+	}
+	var nodes []*trieNode
+	for queue := []*trieNode{root}; len(queue) > 0; queue = queue[1:] {
+		n := queue[0]
+		n.id = uint(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := uint(len(nodes))
+	var tree bytes.Buffer
+	for _, n := range nodes {
+		var r [2]uint
+		for bit := range r {
+			switch {
+			case n.child[bit] != nil:
+				r[bit] = n.child[bit].id
+			case n.data[bit] != 0:
+				r[bit] = nodeCount + maxMindDataSeparator + uint(n.data[bit]-1)
+			default:
+				r[bit] = nodeCount
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree.Write([]byte{byte(r[0] >> 16), byte(r[0] >> 8), byte(r[0]), byte(r[1] >> 16), byte(r[1] >> 8), byte(r[1])})
+		case 28:
+			tree.Write([]byte{byte(r[0] >> 16), byte(r[0] >> 8), byte(r[0]), byte(r[0]>>20&0xf0 | r[1]>>24&0x0f), byte(r[1] >> 16), byte(r[1] >> 8), byte(r[1])})
+		case 32:
+			binary.Write(&tree, binary.BigEndian, uint32(r[0]))
+			binary.Write(&tree, binary.BigEndian, uint32(r[1]))
+		}
+	}
+	tree.Write(make([]byte, maxMindDataSeparator))
+	tree.Write(data.Bytes())
+	tree.Write(maxMindMetadataStart)
+	encodeTestField(&tree, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"database_type":               "Test-Country",
+		"ip_version":                  ipVersion,
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})
+	return tree.Bytes()
+}
+
+var testCountryNetworks = []testNetwork{
+	{"81.2.69.0/24", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "GB", "names": map[string]interface{}{"en": "United Kingdom"}}}},
+	{"216.160.83.56/29", map[string]interface{}{
+		"country":    map[string]interface{}{"iso_code": "US"},
+		"location":   map[string]interface{}{"latitude": 47.25, "longitude": -122.3},
+		"is_proxy":   false,
+		"continents": []interface{}{"NA"}}},
+	{"89.160.20.128/25", map[string]interface{}{
+		"registered_country": map[string]interface{}{"iso_code": "SE"},
+		"note":               "a string that is longer than twenty-nine bytes"}},
+	{"2001:218::/32", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "JP"}}},
+	// The same record as the first network.
+	{"202.196.224.0/20", testPointer(0)},
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	for _, recordSize := range []uint{24, 28, 32} {
+		db, err := newMaxMindDB(buildTestMaxMindDB(6, recordSize, testCountryNetworks))
+		if err != nil {
+			t.Fatalf("record size %d: %s", recordSize, err)
+		}
+		if db.DatabaseType() != "Test-Country" {
+			t.Errorf("record size %d: database type %q", recordSize, db.DatabaseType())
+		}
+		g := &GeoIPCountry{db}
+		for _, tc := range []struct {
+			key, want string
+		}{
+			{"81.2.69.142", "GB"},
+			{"81.2.69.142:443", "GB"},
+			{"216.160.83.60", "US"},
+			{"216.160.83.64", ""},
+			{"89.160.20.200", "SE"},
+			{"89.160.20.1", ""},
+			{"2001:218:85a3::8a2e", "JP"},
+			{"[2001:218::1]:80", "JP"},
+			{"2001:db8::1", ""},
+			{"202.196.230.1", "GB"},
+			{"-", ""},
+		} {
+			got, err := g.Lookup(tc.key)
+			if err != nil {
+				t.Errorf("record size %d: Lookup(%q) error %s", recordSize, tc.key, err)
+				continue
+			}
+			if got != tc.want {
+				t.Errorf("record size %d: Lookup(%q) = %q, want %q", recordSize, tc.key, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestMaxMindDBRecord(t *testing.T) {
+	db, err := newMaxMindDB(buildTestMaxMindDB(4, 24, testCountryNetworks[:3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Lookup(net.ParseIP("216.160.83.57"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := v.(map[string]interface{})
+	if lat := r["location"].(map[string]interface{})["latitude"]; lat != 47.25 {
+		t.Errorf("latitude %v", lat)
+	}
+	if c := r["continents"].([]interface{}); len(c) != 1 || c[0] != "NA" {
+		t.Errorf("continents %v", c)
+	}
+	if p := r["is_proxy"]; p != false {
+		t.Errorf("is_proxy %v", p)
+	}
+	v, err = db.Lookup(net.ParseIP("89.160.20.129"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := v.(map[string]interface{})["note"]; n != "a string that is longer than twenty-nine bytes" {
+		t.Errorf("note %q", n)
+	}
+	// An IPv4 database has no IPv6 addresses.
+	if v, err := db.Lookup(net.ParseIP("2001:218::1")); v != nil || err != nil {
+		t.Errorf("IPv6 lookup in IPv4 database = %v, %v", v, err)
+	}
+}
+
+func TestOpenMaxMindDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "country.mmdb")
+	if err := ioutil.WriteFile(path, buildTestMaxMindDB(6, 24, testCountryNetworks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGeoIPCountry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := g.Lookup("81.2.69.1"); c != "GB" || err != nil {
+		t.Errorf("Lookup = %q, %v", c, err)
+	}
+
+	bad := filepath.Join(dir, "bad.mmdb")
+	if err := ioutil.WriteFile(bad, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGeoIPCountry(bad); err == nil {
+		t.Error("expected error opening a file that isn't a database")
+	}
+	if _, err := NewGeoIPCountry(filepath.Join(dir, "missing.mmdb")); err == nil {
+		t.Error("expected error opening a missing database")
+	}
+}
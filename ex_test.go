@@ -155,7 +155,7 @@ func TestExamplePrograms(t *testing.T) {
 				t.Error(err)
 			}
 
-			diff := cmp.Diff(goldenStore, store, cmpopts.IgnoreUnexported(sync.RWMutex{}, datum.StringDatum{}))
+			diff := cmp.Diff(goldenStore, store, cmpopts.IgnoreUnexported(sync.RWMutex{}, datum.BaseDatum{}, datum.StringDatum{}, metrics.Store{}, metrics.Metric{}))
 
 			if diff != "" {
 				t.Error(diff)
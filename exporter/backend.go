@@ -0,0 +1,141 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+// Backend is a collector that the Exporter pushes metrics to each push
+// interval.  A push calls Export once for each set of labels of each metric,
+// then Flush.  Backends are only used by one goroutine at a time.
+type Backend interface {
+	// Init prepares the backend for the first push.
+	Init() error
+	// Export sends the value of the metric m with the labels in l.  The
+	// metric's lock is held.
+	Export(hostname string, m *metrics.Metric, l *metrics.LabelSet) error
+	// Flush completes a push, sending anything buffered by Export.
+	Flush() error
+	// Close releases the backend's resources when the Exporter is closed.
+	Close() error
+}
+
+// BackendFactory creates a Backend from its configuration, usually its
+// command line flags.  It returns a nil Backend if the backend isn't
+// configured to be used.
+type BackendFactory func() (Backend, error)
+
+var (
+	backendFactoriesMu sync.Mutex
+	backendFactories   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a push backend available to all Exporters under the
+// given name.  It is intended to be called from the init function of the
+// file implementing the backend, so that adding a backend only requires
+// adding a file.  Every registered backend that is configured is used.
+func RegisterBackend(name string, f BackendFactory) {
+	backendFactoriesMu.Lock()
+	defer backendFactoriesMu.Unlock()
+	if _, ok := backendFactories[name]; ok {
+		panic("exporter: RegisterBackend called twice for " + name)
+	}
+	backendFactories[name] = f
+}
+
+// configuredBackends returns the registered backends that are configured to
+// be used, sorted by name.
+func configuredBackends() ([]namedBackend, error) {
+	backendFactoriesMu.Lock()
+	defer backendFactoriesMu.Unlock()
+	var names []string
+	for name := range backendFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var r []namedBackend
+	for _, name := range names {
+		b, err := backendFactories[name]()
+		if err != nil {
+			return nil, errors.Wrapf(err, "creating %s backend", name)
+		}
+		if b != nil {
+			r = append(r, namedBackend{name, b})
+		}
+	}
+	return r, nil
+}
+
+type namedBackend struct {
+	name string
+	Backend
+}
+
+// socketBackend is a Backend that writes metrics in a line-based text
+// protocol to a stream or datagram socket, opening a new connection for each
+// push.
+type socketBackend struct {
+	net, addr      string
+	f              formatter
+	total, success *expvar.Int
+
+	conn net.Conn // connection for the push in progress, if any
+}
+
+func newSocketBackend(network, addr string, f formatter, total, success *expvar.Int) *socketBackend {
+	return &socketBackend{net: network, addr: addr, f: f, total: total, success: success}
+}
+
+func (s *socketBackend) String() string {
+	return s.net + ":" + s.addr
+}
+
+func (s *socketBackend) Init() error {
+	return nil
+}
+
+func (s *socketBackend) Export(hostname string, m *metrics.Metric, l *metrics.LabelSet) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.net, s.addr, *writeDeadline)
+		if err != nil {
+			return errors.Wrap(err, "dial error")
+		}
+		if err := conn.SetDeadline(time.Now().Add(*writeDeadline)); err != nil {
+			glog.Infof("Couldn't set deadline on connection: %s", err)
+		}
+		s.conn = conn
+	}
+	s.total.Add(1)
+	n, err := fmt.Fprint(s.conn, s.f(hostname, m, l))
+	glog.V(2).Infof("Sent %d bytes\n", n)
+	if err != nil {
+		return errors.Errorf("write error: %s\n", err)
+	}
+	s.success.Add(1)
+	return nil
+}
+
+// Flush closes the connection, ending the push.
+func (s *socketBackend) Flush() error {
+	return s.Close()
+}
+
+func (s *socketBackend) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+// recordingBackend records the calls made to it.
+type recordingBackend struct {
+	calls []string
+}
+
+func (r *recordingBackend) Init() error {
+	r.calls = append(r.calls, "Init")
+	return nil
+}
+
+func (r *recordingBackend) Export(hostname string, m *metrics.Metric, l *metrics.LabelSet) error {
+	r.calls = append(r.calls, "Export "+formatLabels(m.Name, l.Labels, "=", ",", "")+" "+l.Datum.ValueString())
+	return nil
+}
+
+func (r *recordingBackend) Flush() error {
+	r.calls = append(r.calls, "Flush")
+	return nil
+}
+
+func (r *recordingBackend) Close() error {
+	r.calls = append(r.calls, "Close")
+	return nil
+}
+
+func TestBackendLifecycle(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int, "a")
+	d, _ := m.GetDatum("1")
+	datum.SetInt(d, 37, time.Unix(0, 0))
+	ms.Add(m)
+	e, err := New(ms, Hostname("gunstar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recordingBackend{}
+	if err := e.AddBackend("recording", r); err != nil {
+		t.Fatal(err)
+	}
+	e.PushMetrics()
+	e.PushMetrics()
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"Init",
+		"Export foo,a=1 37",
+		"Flush",
+		"Export foo,a=1 37",
+		"Flush",
+		"Close",
+	}
+	if diff := cmp.Diff(expected, r.calls); diff != "" {
+		t.Error(diff)
+	}
+}
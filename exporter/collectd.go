@@ -26,6 +26,15 @@ var (
 	collectdExportSuccess = expvar.NewInt("collectd_export_success")
 )
 
+func init() {
+	RegisterBackend("collectd", func() (Backend, error) {
+		if *collectdSocketPath == "" {
+			return nil, nil
+		}
+		return newSocketBackend("unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess), nil
+	})
+}
+
 // metricToCollectd encodes the metric data in the collectd text protocol format.  The
 // metric lock is held before entering this function.
 func metricToCollectd(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
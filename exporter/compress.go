@@ -0,0 +1,93 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"compress/gzip"
+	"expvar"
+	"flag"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	pushCompression = flag.String("metric_push_compression", "",
+		"Compression of the metrics pushed to a metric_push_proto_address collector: gzip, or empty for none.  The other push protocols aren't compressed.")
+
+	// httpCompressedResponses counts the HTTP exports sent gzip-encoded.
+	httpCompressedResponses = expvar.NewInt("exporter_http_compressed_responses_total")
+)
+
+// checkPushCompression returns an error if the push compression flag names a
+// compression that isn't supported.
+func checkPushCompression() error {
+	switch *pushCompression {
+	case "", "gzip":
+		return nil
+	}
+	return errors.Errorf("unsupported metric_push_compression %q: only gzip is supported", *pushCompression)
+}
+
+// gzipWriters reuses gzip writers between responses, as each holds a large
+// compression state.
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// acceptsGzip reports whether the client making request r accepts a response
+// encoded with gzip, as described in RFC 7231 section 5.3.4.
+func acceptsGzip(r *http.Request) bool {
+	for _, h := range r.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(h, ",") {
+			params := strings.Split(coding, ";")
+			if name := strings.TrimSpace(params[0]); name != "gzip" && name != "*" {
+				continue
+			}
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				if strings.HasPrefix(p, "q=") {
+					if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body of a response with gzip.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	return g.w.Write(b)
+}
+
+// compressResponse returns a ResponseWriter that compresses the response body
+// written to it with gzip if the client making request r accepts it, or w if
+// it doesn't, and a function to call once the body is written.  It is called
+// after any errors that end the response early have been handled, as the
+// body of those isn't compressed.
+func compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+	httpCompressedResponses.Add(1)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return &gzipResponseWriter{w, gz}, func() {
+		gz.Close()
+		gzipWriters.Put(gz)
+	}
+}
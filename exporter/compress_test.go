@@ -0,0 +1,102 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, tc := range []struct {
+		acceptEncoding string
+		expected       bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"br,gzip", true},
+		{"gzip;q=0", false},
+		{"identity", false},
+		{"*", true},
+		{"x-gzip2", false},
+	} {
+		r := httptest.NewRequest("GET", "/csv", nil)
+		if tc.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		if got := acceptsGzip(r); got != tc.expected {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tc.acceptEncoding, got, tc.expected)
+		}
+	}
+}
+
+func TestHandleCSVGzip(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "web.mtail", metrics.Counter, datum.Int, "code")
+	d, err := m.GetDatum("200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	datum.SetInt(d, 3, time.Unix(1397586900, 0))
+	if err := ms.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(ms, Hostname("gunstar"))
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+
+	plain := httptest.NewRecorder()
+	e.HandleCSV(plain, httptest.NewRequest("GET", "/csv", nil))
+	if ce := plain.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("uncompressed response has Content-Encoding %q", ce)
+	}
+
+	r := httptest.NewRequest("GET", "/csv", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	compressed := httptest.NewRecorder()
+	e.HandleCSV(compressed, r)
+	if ce := compressed.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("Content-Encoding %q, want gzip", ce)
+	}
+	if v := compressed.Header().Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("Vary %q, want Accept-Encoding", v)
+	}
+	gz, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(plain.Body.String(), string(b)); diff != "" {
+		t.Errorf("decompressed response differs:\n%s", diff)
+	}
+}
+
+func TestCheckPushCompression(t *testing.T) {
+	defer func(c string) { *pushCompression = c }(*pushCompression)
+	for _, tc := range []struct {
+		compression string
+		ok          bool
+	}{
+		{"", true},
+		{"gzip", true},
+		{"zstd", false},
+	} {
+		*pushCompression = tc.compression
+		if err := checkPushCompression(); (err == nil) != tc.ok {
+			t.Errorf("checkPushCompression for %q: %v", tc.compression, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/csv"
+	"expvar"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	exportCSVErrors = expvar.NewInt("exporter_csv_errors")
+)
+
+// HandleCSV exports the metrics as CSV via HTTP.  The separator is a comma
+// unless another is given with the sep parameter, such as ?sep=; or ?sep=tab.
+func (e *Exporter) HandleCSV(w http.ResponseWriter, r *http.Request) {
+	sep := ','
+	if s := r.FormValue("sep"); s != "" {
+		var err error
+		if sep, err = parseSeparator(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w, done := compressResponse(w, r)
+	defer done()
+	if err := e.WriteCSVMetrics(w, sep); err != nil {
+		exportCSVErrors.Add(1)
+		glog.Info("error writing metrics as CSV: ", err)
+	}
+}
+
+// parseSeparator returns the CSV field separator named by s, which is a
+// single character or "tab".
+func parseSeparator(s string) (rune, error) {
+	if s == "tab" {
+		return '\t', nil
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	if n != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, errors.Errorf("invalid CSV separator %q", s)
+	}
+	return r, nil
+}
+
+// WriteCSVMetrics writes the metrics to w as CSV, quoted as described in RFC
+// 4180, with fields separated by sep.  The first row is a header.  Each datum
+// is a row, with the metric name, program, and kind, a column for each label
+// key of any metric, and the value and its timestamp.  Rows are sorted by
+// metric name and label values.
+func (e *Exporter) WriteCSVMetrics(w io.Writer, sep rune) error {
+	type row struct {
+		m *metrics.Metric
+		l *metrics.LabelSet
+	}
+	var rows []row
+	keys := make(map[string]bool)
+	store := e.snapshot()
+	for _, ml := range store.Metrics {
+		for _, m := range ml {
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			for l := range lc {
+				e.addShardLabel(l)
+				for k := range l.Labels {
+					keys[k] = true
+				}
+				rows = append(rows, row{m, l})
+			}
+			m.RUnlock()
+		}
+	}
+
+	var columns []string
+	for k := range keys {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	records := make([][]string, 0, len(rows))
+	for _, r := range rows {
+		record := []string{r.m.Name}
+		if !e.omitProgLabel {
+			record = append(record, r.m.Program)
+		}
+		record = append(record, strings.ToLower(r.m.Kind.String()))
+		for _, k := range columns {
+			record = append(record, r.l.Labels[k])
+		}
+		record = append(record, r.l.Datum.ValueString(), r.l.Datum.TimeUTC().Format(time.RFC3339Nano))
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	header := []string{"metric"}
+	if !e.omitProgLabel {
+		header = append(header, "prog")
+	}
+	header = append(header, "kind")
+	header = append(header, columns...)
+	header = append(header, "value", "timestamp")
+
+	cw := csv.NewWriter(w)
+	cw.Comma = sep
+	cw.UseCRLF = true
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(records); err != nil {
+		return err
+	}
+	return cw.Error()
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+var writeCSVTests = []struct {
+	name     string
+	metrics  []*metrics.Metric
+	sep      rune
+	expected string
+}{
+	{"empty",
+		[]*metrics.Metric{},
+		',',
+		"metric,prog,kind,value,timestamp\r\n",
+	},
+	{"label columns",
+		[]*metrics.Metric{
+			{
+				Name:    "foo",
+				Program: "test",
+				Kind:    metrics.Counter,
+				Keys:    []string{"b", "a"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"y", "2"}, Value: datum.MakeInt(2, time.Unix(1397586900, 0))},
+					{Labels: []string{"x", "1"}, Value: datum.MakeInt(1, time.Unix(1397586900, 0))},
+				},
+			},
+			{
+				Name:        "bar",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				Keys:        []string{"c"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"z"}, Value: datum.MakeFloat(0.5, time.Unix(1397586900, 0))}},
+			},
+		},
+		',',
+		"metric,prog,kind,a,b,c,value,timestamp\r\n" +
+			"bar,test,gauge,,,z,0.5,2014-04-15T18:35:00Z\r\n" +
+			"foo,test,counter,1,x,,1,2014-04-15T18:35:00Z\r\n" +
+			"foo,test,counter,2,y,,2,2014-04-15T18:35:00Z\r\n",
+	},
+	{"quoting",
+		[]*metrics.Metric{
+			{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Text,
+				Keys:        []string{"a"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"x,y"}, Value: datum.MakeString(`say "hi"`, time.Unix(1397586900, 0))}},
+			},
+		},
+		',',
+		"metric,prog,kind,a,value,timestamp\r\n" +
+			`foo,test,text,"x,y","say ""hi""",2014-04-15T18:35:00Z` + "\r\n",
+	},
+	{"separator",
+		[]*metrics.Metric{
+			{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				Keys:        []string{"a"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"x;y,z"}, Value: datum.MakeInt(3, time.Unix(1397586900, 0))}},
+			},
+		},
+		';',
+		"metric;prog;kind;a;value;timestamp\r\n" +
+			`foo;test;gauge;"x;y,z";3;2014-04-15T18:35:00Z` + "\r\n",
+	},
+}
+
+func TestWriteCSVMetrics(t *testing.T) {
+	for _, tc := range writeCSVTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ms := metrics.NewStore()
+			for _, metric := range tc.metrics {
+				ms.Add(metric)
+			}
+			e, err := New(ms, Hostname("gunstar"))
+			if err != nil {
+				t.Fatalf("couldn't make exporter: %s", err)
+			}
+			var b bytes.Buffer
+			if err := e.WriteCSVMetrics(&b, tc.sep); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, b.String()); diff != "" {
+				t.Errorf("CSV didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandleCSVSeparator(t *testing.T) {
+	e, err := New(metrics.NewStore(), Hostname("gunstar"))
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"", 200, "metric,prog,kind,value,timestamp\r\n"},
+		{"?sep=tab", 200, "metric\tprog\tkind\tvalue\ttimestamp\r\n"},
+		{"?sep=|", 200, "metric|prog|kind|value|timestamp\r\n"},
+		{"?sep=ab", 400, "invalid CSV separator \"ab\"\n"},
+		{"?sep=%22", 400, "invalid CSV separator \"\\\"\"\n"},
+	} {
+		w := httptest.NewRecorder()
+		e.HandleCSV(w, httptest.NewRequest("GET", "/csv"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%q: code %d, want %d", tc.query, w.Code, tc.code)
+		}
+		if diff := cmp.Diff(tc.expected, w.Body.String()); diff != "" {
+			t.Errorf("%q: body didn't match:\n%s", tc.query, diff)
+		}
+	}
+}
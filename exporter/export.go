@@ -6,13 +6,15 @@
 package exporter
 
 import (
-	"expvar"
 	"flag"
 	"fmt"
+	"html/template"
 	"io"
-	"net"
+	"net/rpc"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -32,7 +34,30 @@ type Exporter struct {
 	store         *metrics.Store
 	hostname      string
 	omitProgLabel bool
-	pushTargets   []pushOptions
+	shard         string         // if set, the value of a shard label added to all metrics
+	backends      []namedBackend // configured push backends
+	pushDone      chan struct{}  // closed to stop periodic pushes
+
+	snmpCommunity string         // community string SNMP requests must present
+	snmpBase      oid            // OID under which metrics are exported over SNMP
+	snmpNames     map[string]oid // OIDs of metrics, by name, that override those derived from snmpBase
+
+	rules []exportRule // if set, applied to the metrics before they are exported
+
+	snapshotMu       sync.Mutex     // protects lastSnapshot and lastSnapshotTime
+	lastSnapshot     *metrics.Store // the snapshot exports read, shared until snapshotTTL has passed
+	lastSnapshotTime time.Time      // when lastSnapshot was taken
+
+	rpc *rpc.Server // serves the MetricService
+
+	pushResultsMu sync.Mutex            // protects pushResults
+	pushResults   map[string]pushResult // outcome of the last push to each backend, by name
+}
+
+// pushResult records the outcome of a push to a target.
+type pushResult struct {
+	Time time.Time
+	Err  error
 }
 
 // Hostname is an option that specifies the mtail hostname to use in exported metrics.
@@ -49,12 +74,29 @@ func OmitProgLabel(e *Exporter) error {
 	return nil
 }
 
+// Shard sets the Exporter to add a label naming the shard of logs this
+// process is responsible for to exported metrics.
+func Shard(index int) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.shard = strconv.Itoa(index)
+		return nil
+	}
+}
+
+// PushBackend adds the push backend b to the Exporter under the given name,
+// alongside those configured by flags.
+func PushBackend(name string, b Backend) func(*Exporter) error {
+	return func(e *Exporter) error {
+		return e.AddBackend(name, b)
+	}
+}
+
 // New creates a new Exporter.
 func New(store *metrics.Store, options ...func(*Exporter) error) (*Exporter, error) {
 	if store == nil {
 		return nil, errors.New("exporter needs a Store")
 	}
-	e := &Exporter{store: store}
+	e := &Exporter{store: store, pushDone: make(chan struct{}), pushResults: make(map[string]pushResult)}
 	if err := e.SetOption(options...); err != nil {
 		return nil, err
 	}
@@ -66,18 +108,22 @@ func New(store *metrics.Store, options ...func(*Exporter) error) (*Exporter, err
 			return nil, errors.Wrap(err, "getting hostname")
 		}
 	}
-
-	if *collectdSocketPath != "" {
-		o := pushOptions{"unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess}
-		e.RegisterPushExport(o)
+	e.rpc = newRPCServer(e)
+	if e.snmpCommunity == "" {
+		e.snmpCommunity = defaultSNMPCommunity
 	}
-	if *graphiteHostPort != "" {
-		o := pushOptions{"tcp", *graphiteHostPort, metricToGraphite, graphiteExportTotal, graphiteExportSuccess}
-		e.RegisterPushExport(o)
+	if e.snmpBase == nil {
+		e.snmpBase, _ = parseOID(DefaultSNMPBaseOID)
 	}
-	if *statsdHostPort != "" {
-		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess}
-		e.RegisterPushExport(o)
+
+	backends, err := configuredBackends()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range backends {
+		if err := e.AddBackend(b.name, b.Backend); err != nil {
+			return nil, err
+		}
 	}
 
 	return e, nil
@@ -111,15 +157,22 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 	return r
 }
 
+// addShardLabel adds the shard label to l, if the exporter is sharded.
+func (e *Exporter) addShardLabel(l *metrics.LabelSet) {
+	if e.shard != "" {
+		l.Labels["shard"] = e.shard
+	}
+}
+
 // Format a LabelSet into a string to be written to one of the timeseries
 // sockets.
 type formatter func(string, *metrics.Metric, *metrics.LabelSet) string
 
-func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
-	e.store.RLock()
-	defer e.store.RUnlock()
+// exportTo sends every metric in the store to the backend b, as it is now.
+func (e *Exporter) exportTo(b Backend) error {
+	store := e.freshSnapshot()
 
-	for _, ml := range e.store.Metrics {
+	for _, ml := range store.Metrics {
 		for _, m := range ml {
 			m.RLock()
 			// Don't try to send text metrics to any push service.
@@ -127,72 +180,140 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 				m.RUnlock()
 				continue
 			}
-			exportTotal.Add(1)
 			lc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lc)
+			var err error
 			for l := range lc {
-				line := f(e.hostname, m, l)
-				n, err := fmt.Fprint(c, line)
-				glog.V(2).Infof("Sent %d bytes\n", n)
-				if err == nil {
-					exportSuccess.Add(1)
-				} else {
-					return errors.Errorf("write error: %s\n", err)
+				if err != nil {
+					// Drain the channel so EmitLabelSets can finish.
+					continue
 				}
+				e.addShardLabel(l)
+				err = b.Export(e.hostname, m, l)
 			}
 			m.RUnlock()
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-// PushMetrics sends metrics to each of the configured services.
+// PushMetrics sends metrics to each of the configured backends.
 func (e *Exporter) PushMetrics() {
-	for _, target := range e.pushTargets {
-		glog.V(2).Infof("pushing to %s", target.addr)
-		conn, err := net.DialTimeout(target.net, target.addr, *writeDeadline)
-		if err != nil {
-			glog.Infof("pusher dial error: %s", err)
-			continue
-		}
-		err = conn.SetDeadline(time.Now().Add(*writeDeadline))
-		if err != nil {
-			glog.Infof("Couldn't set deadline on connection: %s", err)
-		}
-		err = e.writeSocketMetrics(conn, target.f, target.total, target.success)
-		if err != nil {
-			glog.Infof("pusher write error: %s", err)
+	for _, b := range e.backends {
+		glog.V(2).Infof("pushing to %s", b.name)
+		err := e.exportTo(b)
+		if ferr := b.Flush(); err == nil {
+			err = ferr
 		}
-		err = conn.Close()
 		if err != nil {
-
-			glog.Infof("connection close failed: %s", err)
+			glog.Infof("push to %s failed: %s", b.name, err)
 		}
+		e.recordPush(b.name, err)
 	}
 }
 
-// StartMetricPush pushes metrics to the configured services each interval.
+func (e *Exporter) recordPush(name string, err error) {
+	e.pushResultsMu.Lock()
+	defer e.pushResultsMu.Unlock()
+	e.pushResults[name] = pushResult{time.Now(), err}
+}
+
+// StartMetricPush pushes metrics to the configured backends each interval,
+// until the Exporter is closed.
 func (e *Exporter) StartMetricPush() {
-	if len(e.pushTargets) > 0 {
+	if len(e.backends) > 0 {
 		glog.Info("Started metric push.")
 		ticker := time.NewTicker(time.Duration(*pushInterval) * time.Second)
 		go func() {
-			for range ticker.C {
-				e.PushMetrics()
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					e.PushMetrics()
+				case <-e.pushDone:
+					return
+				}
 			}
 		}()
 	}
 }
 
-type pushOptions struct {
-	net, addr      string
-	f              formatter
-	total, success *expvar.Int
+// AddBackend initialises the push backend b and adds it to the Exporter
+// under the given name.  Metrics are pushed to it each push interval.
+func (e *Exporter) AddBackend(name string, b Backend) error {
+	if err := b.Init(); err != nil {
+		return errors.Wrapf(err, "initialising %s backend", name)
+	}
+	e.backends = append(e.backends, namedBackend{name, b})
+	return nil
+}
+
+// Close stops periodic pushes and closes the push backends.  The Exporter
+// must not push metrics after it is closed.
+func (e *Exporter) Close() error {
+	close(e.pushDone)
+	var firstErr error
+	for _, b := range e.backends {
+		if err := b.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "closing %s backend", b.name)
+		}
+	}
+	return firstErr
 }
 
-// RegisterPushExport adds a push export connection to the Exporter.  Items in
-// the list must describe a Dial()able connection and will have all the metrics
-// pushed to each pushInterval.
-func (e *Exporter) RegisterPushExport(p pushOptions) {
-	e.pushTargets = append(e.pushTargets, p)
+const exporterTemplate = `
+<h2 id="exporter">Exporter</h2>
+<table border=1>
+<tr>
+<th>push backend</th>
+<th>last push</th>
+<th>result</th>
+</tr>
+{{range $target := $.Targets}}
+<tr>
+<td><pre>{{$target.Name}}{{with $target.Desc}} {{.}}{{end}}</pre></td>
+{{with index $.Results $target.Name}}
+<td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td>
+<td>{{if .Err}}{{.Err}}{{else}}OK{{end}}</td>
+{{else}}
+<td>never</td>
+<td></td>
+{{end}}
+</tr>
+{{else}}
+<tr><td colspan=3>No push backends configured</td></tr>
+{{end}}
+</table>
+`
+
+// WriteStatusHTML emits the Exporter's push backend state in HTML format to the io.Writer w.
+func (e *Exporter) WriteStatusHTML(w io.Writer) error {
+	tpl, err := template.New("exporter").Parse(exporterTemplate)
+	if err != nil {
+		return err
+	}
+	type target struct{ Name, Desc string }
+	data := struct {
+		Targets []target
+		Results map[string]*pushResult
+	}{
+		Results: make(map[string]*pushResult),
+	}
+	for _, b := range e.backends {
+		var desc string
+		if s, ok := b.Backend.(fmt.Stringer); ok {
+			desc = s.String()
+		}
+		data.Targets = append(data.Targets, target{b.name, desc})
+	}
+	e.pushResultsMu.Lock()
+	for k, v := range e.pushResults {
+		v := v
+		data.Results[k] = &v
+	}
+	e.pushResultsMu.Unlock()
+	return tpl.Execute(w, data)
 }
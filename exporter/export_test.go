@@ -4,8 +4,10 @@
 package exporter
 
 import (
+	"bytes"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -179,3 +181,53 @@ func TestMetricToStatsd(t *testing.T) {
 		t.Errorf("prefixed string didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
 }
+
+func TestShardLabel(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int, "a")
+	d, _ := m.GetDatum("1")
+	datum.SetInt(d, 37, time.Unix(0, 0))
+	ms.Add(m)
+	e, err := New(ms, Hostname("gunstar"), Shard(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := e.WriteTextMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("foo{a=1,shard=2,prog=prog} 37\n", b.String()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestPushStatus(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	if _, err := m.GetDatum(); err != nil {
+		t.Fatal(err)
+	}
+	ms.Add(m)
+	e, err := New(ms, Hostname("gunstar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddBackend("collectd", newSocketBackend("unix", "/nonexistent/socket", metricToCollectd, collectdExportTotal, collectdExportSuccess)); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := e.WriteStatusHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "never") {
+		t.Errorf("status before push doesn't say never pushed:\n%s", b.String())
+	}
+	e.PushMetrics()
+	b.Reset()
+	if err := e.WriteStatusHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "/nonexistent/socket: connect") {
+		t.Errorf("status after push doesn't contain dial error:\n%s", b.String())
+	}
+}
@@ -21,6 +21,15 @@ var (
 	graphiteExportSuccess = expvar.NewInt("graphite_export_success")
 )
 
+func init() {
+	RegisterBackend("graphite", func() (Backend, error) {
+		if *graphiteHostPort == "" {
+			return nil, nil
+		}
+		return newSocketBackend("tcp", *graphiteHostPort, metricToGraphite, graphiteExportTotal, graphiteExportSuccess), nil
+	})
+}
+
 // metricToGraphite encodes a metric in the graphite text protocol format.  The
 // metric lock is held before entering this function.
 func metricToGraphite(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
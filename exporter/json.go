@@ -17,7 +17,7 @@ var (
 
 // HandleJSON exports the metrics in JSON format via HTTP.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(e.store, "", "  ")
+	b, err := json.MarshalIndent(e.snapshot(), "", "  ")
 	if err != nil {
 		exportJSONErrors.Add(1)
 		glog.Info("error marshalling metrics into json:", err.Error())
@@ -25,6 +25,8 @@ func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("content-type", "application/json")
+	w, done := compressResponse(w, r)
+	defer done()
 	if _, err := w.Write(b); err != nil {
 		glog.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -4,13 +4,17 @@
 package exporter
 
 import (
+	"bytes"
 	"expvar"
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
 )
 
 var (
@@ -28,27 +32,31 @@ func noHyphens(s string) string {
 // HandlePrometheusMetrics exports the metrics in a format readable by
 // Prometheus via HTTP.
 func (e *Exporter) HandlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
-	e.store.RLock()
-	defer e.store.RUnlock()
-
 	w.Header().Add("Content-type", "text/plain; version=0.0.4")
+	w, done := compressResponse(w, r)
+	defer done()
+	e.WritePrometheusMetrics(w)
+}
 
-	for _, ml := range e.store.Metrics {
+// WritePrometheusMetrics writes the metrics in the Prometheus text exposition
+// format to w.
+func (e *Exporter) WritePrometheusMetrics(w io.Writer) {
+	store := e.snapshot()
+
+	for _, ml := range store.Metrics {
 		emittype := true
 		for _, m := range ml {
 			m.RLock()
-			// We don't have a way of converting text metrics to prometheus format.
-			if m.Kind == metrics.Text {
-				m.RUnlock()
-				continue
-			}
 			metricExportTotal.Add(1)
 
 			if emittype {
+				if help := prometheusHelp(m); help != "" {
+					fmt.Fprintf(w, "# HELP %s %s\n", prometheusName(m), help)
+				}
 				fmt.Fprintf(w,
 					"# TYPE %s %s\n",
-					noHyphens(m.Name),
-					kindToPrometheusType(m.Kind))
+					prometheusName(m),
+					prometheusType(m))
 				emittype = false
 			}
 
@@ -56,9 +64,17 @@ func (e *Exporter) HandlePrometheusMetrics(w http.ResponseWriter, r *http.Reques
 			go m.EmitLabelSets(lc)
 			for l := range lc {
 				if m.Source != "" {
-					fmt.Fprintf(w, "# %s defined at %s\n", noHyphens(m.Name), m.Source)
+					fmt.Fprintf(w, "# %s defined at %s\n", prometheusName(m), m.Source)
+				}
+				e.addShardLabel(l)
+				var line string
+				if m.Kind == metrics.Text {
+					line = infoToPrometheus(m, l, e.omitProgLabel)
+				} else if q := datum.GetQuantiles(l.Datum); q != nil {
+					line = summaryToPrometheus(m, l, q, e.omitProgLabel)
+				} else {
+					line = metricToPrometheus(m, l, e.omitProgLabel)
 				}
-				line := metricToPrometheus(m, l, e.omitProgLabel)
 				fmt.Fprint(w, line)
 			}
 			m.RUnlock()
@@ -66,22 +82,110 @@ func (e *Exporter) HandlePrometheusMetrics(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func metricToPrometheus(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool) string {
+// prometheusLabels returns the label=value pairs of a label set, sorted.
+func prometheusLabels(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool) []string {
 	var s []string
 	for k, v := range l.Labels {
 		// Prometheus quotes the value of each label=value pair.
-		s = append(s, fmt.Sprintf("%s=%q", k, v))
+		s = append(s, k+"="+prometheusLabelValue(v))
 	}
 	sort.Strings(s)
 	if !omitProgLabel {
 		s = append(s, fmt.Sprintf("prog=\"%s\"", m.Program))
 	}
+	return s
+}
+
+// labelValueEscaper escapes the only characters the exposition format
+// escapes in a label value.  Go's %q escapes more, such as tabs, which the
+// format doesn't allow.
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+// prometheusLabelValue returns v quoted as a label value.  The exposition
+// format is UTF-8, so invalid bytes are replaced with U+FFFD.
+func prometheusLabelValue(v string) string {
+	if !utf8.ValidString(v) {
+		var b bytes.Buffer
+		for _, r := range v {
+			b.WriteRune(r)
+		}
+		v = b.String()
+	}
+	return `"` + labelValueEscaper.Replace(v) + `"`
+}
+
+func metricToPrometheus(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool) string {
 	return fmt.Sprintf(prometheusFormat,
 		noHyphens(m.Name),
-		strings.Join(s, ","),
+		strings.Join(prometheusLabels(m, l, omitProgLabel), ","),
 		l.Datum.ValueString())
 }
 
+// infoToPrometheus formats the value of a text metric as the value label of
+// an info metric, whose value is always 1, in the style of Prometheus's
+// build_info metrics.  A label of the metric already named value is exported
+// as exported_value, as Prometheus renames a label that clashes with one it
+// adds.
+func infoToPrometheus(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool) string {
+	if v, ok := l.Labels["value"]; ok {
+		delete(l.Labels, "value")
+		l.Labels["exported_value"] = v
+	}
+	labels := append(prometheusLabels(m, l, omitProgLabel), "value="+prometheusLabelValue(l.Datum.ValueString()))
+	return fmt.Sprintf(prometheusFormat, prometheusName(m), strings.Join(labels, ","), "1")
+}
+
+// summaryToPrometheus formats the estimated quantiles of a timer, with the
+// sum and count of its values, as a Prometheus summary.
+func summaryToPrometheus(m *metrics.Metric, l *metrics.LabelSet, q *datum.Quantiles, omitProgLabel bool) string {
+	name := noHyphens(m.Name)
+	labels := prometheusLabels(m, l, omitProgLabel)
+	var b bytes.Buffer
+	for _, target := range q.Targets() {
+		ql := append([]string{fmt.Sprintf("quantile=\"%g\"", target)}, labels...)
+		fmt.Fprintf(&b, prometheusFormat, name, strings.Join(ql, ","), fmt.Sprintf("%g", q.Query(target)))
+	}
+	fmt.Fprintf(&b, prometheusFormat, name+"_sum", strings.Join(labels, ","), fmt.Sprintf("%g", q.Sum()))
+	fmt.Fprintf(&b, prometheusFormat, name+"_count", strings.Join(labels, ","), fmt.Sprintf("%d", q.Count()))
+	return b.String()
+}
+
+// prometheusName returns the name of a metric in Prometheus.  Text metrics
+// are exported as info metrics, whose names end in _info.
+func prometheusName(m *metrics.Metric) string {
+	name := noHyphens(m.Name)
+	if m.Kind == metrics.Text && !strings.HasSuffix(name, "_info") {
+		name += "_info"
+	}
+	return name
+}
+
+// prometheusHelp returns the HELP text of a metric: its description and
+// unit, escaped as the exposition format requires, or empty if it has
+// neither.
+func prometheusHelp(m *metrics.Metric) string {
+	help := m.Description
+	if m.Unit != "" {
+		if help != "" {
+			help += " "
+		}
+		help += "(unit: " + m.Unit + ")"
+	}
+	return strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help)
+}
+
+// prometheusType returns the Prometheus type of a metric; timers that
+// estimate quantiles are summaries, and text metrics are exported as gauges.
+func prometheusType(m *metrics.Metric) string {
+	if m.Kind == metrics.Timer && len(m.Quantiles) > 0 {
+		return "summary"
+	}
+	if m.Kind == metrics.Text {
+		return "gauge"
+	}
+	return kindToPrometheusType(m.Kind)
+}
+
 func kindToPrometheusType(kind metrics.Kind) string {
 	if kind != metrics.Timer {
 		return strings.ToLower(kind.String())
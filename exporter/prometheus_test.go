@@ -82,7 +82,54 @@ foo{} 1
 				Kind:        metrics.Text,
 				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeString("hi", time.Unix(0, 0))}}},
 		},
-		"",
+		`# TYPE foo_info gauge
+foo_info{value="hi"} 1
+`,
+	},
+	{"text with labels",
+		[]*metrics.Metric{
+			{
+				Name:    "last_error_info",
+				Program: "test",
+				Kind:    metrics.Text,
+				Keys:    []string{"host"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"db1"}, Value: datum.MakeString(`connection "refused"`, time.Unix(0, 0))},
+				},
+			},
+		},
+		`# TYPE last_error_info gauge
+last_error_info{host="db1",value="connection \"refused\""} 1
+`,
+	},
+	{"text with control characters and invalid UTF-8",
+		[]*metrics.Metric{
+			{
+				Name:    "last_error_info",
+				Program: "test",
+				Kind:    metrics.Text,
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{}, Value: datum.MakeString("a\tb\\c\nd\xffe\x00", time.Unix(0, 0))},
+				},
+			},
+		},
+		"# TYPE last_error_info gauge\nlast_error_info{value=\"a\tb\\\\c\\nd\uFFFDe\x00\"} 1\n",
+	},
+	{"text with a value label",
+		[]*metrics.Metric{
+			{
+				Name:    "last_error_info",
+				Program: "test",
+				Kind:    metrics.Text,
+				Keys:    []string{"value"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"db1"}, Value: datum.MakeString("refused", time.Unix(0, 0))},
+				},
+			},
+		},
+		`# TYPE last_error_info gauge
+last_error_info{exported_value="db1",value="refused"} 1
+`,
 	},
 	{"quotes",
 		[]*metrics.Metric{
@@ -135,6 +182,35 @@ foo{} 1
 foo{} 1
 # foo defined at different.mtail:37
 foo{} 1
+`,
+	},
+	{"described",
+		[]*metrics.Metric{
+			{
+				Name:        "requests_total",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				Description: "Total HTTP requests,\nby path\\method",
+				Unit:        "requests",
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}}},
+		},
+		`# HELP requests_total Total HTTP requests,\nby path\\method (unit: requests)
+# TYPE requests_total counter
+requests_total{} 1
+`,
+	},
+	{"unit only",
+		[]*metrics.Metric{
+			{
+				Name:        "latency",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				Unit:        "seconds",
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}}},
+		},
+		`# HELP latency (unit: seconds)
+# TYPE latency gauge
+latency{} 1
 `,
 	},
 }
@@ -168,3 +244,29 @@ func TestHandlePrometheus(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlePrometheusSummary(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("latency", "test", metrics.Timer, datum.Int)
+	m.Quantiles = []float64{0.5, 0.9}
+	d, _ := m.GetDatum()
+	for i := int64(1); i <= 9; i++ {
+		datum.SetInt(d, i, time.Unix(i, 0))
+	}
+	ms.Add(m)
+	e, err := New(ms, Hostname("gunstar"), OmitProgLabel)
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	response := httptest.NewRecorder()
+	e.HandlePrometheusMetrics(response, &http.Request{})
+	expected := `# TYPE latency summary
+latency{quantile="0.5"} 5
+latency{quantile="0.9"} 9
+latency_sum{} 45
+latency_count{} 9
+`
+	if diff := cmp.Diff(expected, response.Body.String()); diff != "" {
+		t.Error(diff)
+	}
+}
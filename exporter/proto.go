@@ -0,0 +1,259 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"expvar"
+	"flag"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+// The metrics are encoded in the protocol buffer wire format by hand, to the
+// schema in metrics.proto.
+
+var (
+	protoPushAddress = flag.String("metric_push_proto_address", "",
+		"Host:port of a collector to push metrics to in the protocol buffer format described in exporter/metrics.proto.")
+
+	protoExportTotal   = expvar.NewInt("proto_export_total")
+	protoExportSuccess = expvar.NewInt("proto_export_success")
+	exportProtoErrors  = expvar.NewInt("exporter_proto_errors")
+)
+
+func init() {
+	RegisterBackend("proto", func() (Backend, error) {
+		if *protoPushAddress == "" {
+			return nil, nil
+		}
+		if err := checkPushCompression(); err != nil {
+			return nil, err
+		}
+		return &protoBackend{addr: *protoPushAddress, compression: *pushCompression}, nil
+	})
+}
+
+// Field numbers and wire types from metrics.proto.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+
+	metricSetHostname = 1
+	metricSetMetric   = 2
+
+	metricName        = 1
+	metricProgram     = 2
+	metricKind        = 3
+	metricLabels      = 4
+	metricIntValue    = 5
+	metricFloatValue  = 6
+	metricStringValue = 7
+	metricTimestampNs = 8
+
+	mapEntryKey   = 1
+	mapEntryValue = 2
+)
+
+// protoBuffer accumulates a message in the protocol buffer wire format.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.varint(uint64(field<<3 | wireType))
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+// uint64Field appends a varint field, omitting it if it is zero as proto3
+// does.
+func (b *protoBuffer) uint64Field(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *protoBuffer) doubleField(field int, v float64) {
+	b.tag(field, wireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	*b = append(*b, buf[:]...)
+}
+
+func (b *protoBuffer) bytesField(field int, v []byte) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+// stringField appends a string field, omitting it if it is empty as proto3
+// does.
+func (b *protoBuffer) stringField(field int, v string) {
+	if v == "" {
+		return
+	}
+	b.bytesField(field, []byte(v))
+}
+
+// protoKind returns the value of the Metric.Kind enum for a metric kind.
+func protoKind(k metrics.Kind) uint64 {
+	switch k {
+	case metrics.Gauge:
+		return 1
+	case metrics.Timer:
+		return 2
+	case metrics.Text:
+		return 3
+	}
+	return 0
+}
+
+// metricToProto encodes one value of a metric as a Metric message.  The
+// metric lock is held before entering this function.
+func metricToProto(m *metrics.Metric, l *metrics.LabelSet) []byte {
+	var b protoBuffer
+	b.stringField(metricName, m.Name)
+	b.stringField(metricProgram, m.Program)
+	b.uint64Field(metricKind, protoKind(m.Kind))
+	keys := make([]string, 0, len(l.Labels))
+	for k := range l.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry protoBuffer
+		entry.stringField(mapEntryKey, k)
+		entry.stringField(mapEntryValue, l.Labels[k])
+		b.bytesField(metricLabels, entry)
+	}
+	switch d := l.Datum.(type) {
+	case *datum.IntDatum:
+		// A oneof field is sent even if it is zero.
+		b.tag(metricIntValue, wireVarint)
+		b.varint(uint64(d.Get()))
+	case *datum.FloatDatum:
+		b.doubleField(metricFloatValue, d.Get())
+	case *datum.StringDatum:
+		b.bytesField(metricStringValue, []byte(d.Get()))
+	}
+	b.uint64Field(metricTimestampNs, uint64(l.Datum.TimeUTC().UnixNano()))
+	return b
+}
+
+// WriteProtoMetrics writes every metric to w, encoded as a MetricSet message.
+func (e *Exporter) WriteProtoMetrics(w io.Writer) error {
+	var b protoBuffer
+	b.stringField(metricSetHostname, e.hostname)
+	store := e.snapshot()
+	var names []string
+	for name := range store.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, m := range store.Metrics[name] {
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			for l := range lc {
+				e.addShardLabel(l)
+				b.bytesField(metricSetMetric, metricToProto(m, l))
+			}
+			m.RUnlock()
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// HandleProto exports the metrics as a MetricSet protocol buffer via HTTP.
+func (e *Exporter) HandleProto(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-protobuf; proto=mtail.MetricSet")
+	w, done := compressResponse(w, r)
+	defer done()
+	if err := e.WriteProtoMetrics(w); err != nil {
+		exportProtoErrors.Add(1)
+		glog.Info("error writing metrics as protocol buffers: ", err)
+	}
+}
+
+// protoBackend pushes a MetricSet, preceded by its length, over a new TCP
+// connection each push.  If compression is gzip, the length and MetricSet are
+// sent as a gzip stream.
+type protoBackend struct {
+	addr        string
+	compression string      // "gzip", or empty for none
+	set         protoBuffer // the MetricSet of the push in progress
+}
+
+func (p *protoBackend) String() string {
+	return "tcp:" + p.addr
+}
+
+func (p *protoBackend) Init() error {
+	return nil
+}
+
+func (p *protoBackend) Export(hostname string, m *metrics.Metric, l *metrics.LabelSet) error {
+	if len(p.set) == 0 {
+		p.set.stringField(metricSetHostname, hostname)
+	}
+	p.set.bytesField(metricSetMetric, metricToProto(m, l))
+	return nil
+}
+
+// Flush sends the MetricSet built by Export.
+func (p *protoBackend) Flush() error {
+	if len(p.set) == 0 {
+		return nil
+	}
+	defer func() { p.set = p.set[:0] }()
+	protoExportTotal.Add(1)
+	conn, err := net.DialTimeout("tcp", p.addr, *writeDeadline)
+	if err != nil {
+		return errors.Wrap(err, "dial error")
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(*writeDeadline)); err != nil {
+		glog.Infof("Couldn't set deadline on connection: %s", err)
+	}
+	var msg protoBuffer
+	msg.varint(uint64(len(p.set)))
+	msg = append(msg, p.set...)
+	if p.compression == "gzip" {
+		gz := gzip.NewWriter(conn)
+		if _, err := gz.Write(msg); err != nil {
+			return errors.Wrap(err, "write error")
+		}
+		if err := gz.Close(); err != nil {
+			return errors.Wrap(err, "write error")
+		}
+	} else if _, err := conn.Write(msg); err != nil {
+		return errors.Wrap(err, "write error")
+	}
+	protoExportSuccess.Add(1)
+	return nil
+}
+
+func (p *protoBackend) Close() error {
+	return nil
+}
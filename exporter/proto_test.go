@@ -0,0 +1,234 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+type protoField struct {
+	Num   int
+	Value interface{} // uint64 for varint and fixed64 fields, else string
+}
+
+// decodeProto splits a message in the protocol buffer wire format into its
+// fields.
+func decodeProto(t *testing.T, b []byte) []protoField {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag in %x", b)
+		}
+		b = b[n:]
+		f := protoField{Num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint in %x", b)
+			}
+			f.Value, b = v, b[n:]
+		case wireFixed64:
+			f.Value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || int(l) > len(b)-n {
+				t.Fatalf("bad length in %x", b)
+			}
+			f.Value, b = string(b[n:n+int(l)]), b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestMetricToProto(t *testing.T) {
+	ts := time.Unix(1397586900, 0)
+	for _, tc := range []struct {
+		name     string
+		metric   *metrics.Metric
+		labels   map[string]string
+		d        datum.Datum
+		expected []protoField
+	}{
+		{"counter",
+			&metrics.Metric{Name: "requests", Program: "web.mtail", Kind: metrics.Counter},
+			map[string]string{"code": "200", "method": "GET"},
+			datum.MakeInt(37, ts),
+			[]protoField{
+				{metricName, "requests"},
+				{metricProgram, "web.mtail"},
+				{metricLabels, "\x0a\x04code\x12\x03200"},
+				{metricLabels, "\x0a\x06method\x12\x03GET"},
+				{metricIntValue, uint64(37)},
+				{metricTimestampNs, uint64(ts.UnixNano())},
+			},
+		},
+		{"zero gauge",
+			&metrics.Metric{Name: "queue", Program: "q.mtail", Kind: metrics.Gauge},
+			map[string]string{},
+			datum.MakeInt(0, ts),
+			[]protoField{
+				{metricName, "queue"},
+				{metricProgram, "q.mtail"},
+				{metricKind, uint64(1)},
+				{metricIntValue, uint64(0)},
+				{metricTimestampNs, uint64(ts.UnixNano())},
+			},
+		},
+		{"float timer",
+			&metrics.Metric{Name: "latency", Program: "web.mtail", Kind: metrics.Timer},
+			map[string]string{},
+			datum.MakeFloat(0.25, ts),
+			[]protoField{
+				{metricName, "latency"},
+				{metricProgram, "web.mtail"},
+				{metricKind, uint64(2)},
+				{metricFloatValue, math.Float64bits(0.25)},
+				{metricTimestampNs, uint64(ts.UnixNano())},
+			},
+		},
+		{"text",
+			&metrics.Metric{Name: "version", Program: "deploy.mtail", Kind: metrics.Text},
+			map[string]string{},
+			datum.MakeString("v1.2", ts),
+			[]protoField{
+				{metricName, "version"},
+				{metricProgram, "deploy.mtail"},
+				{metricKind, uint64(3)},
+				{metricStringValue, "v1.2"},
+				{metricTimestampNs, uint64(ts.UnixNano())},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := decodeProto(t, metricToProto(tc.metric, &metrics.LabelSet{Labels: tc.labels, Datum: tc.d}))
+			if diff := cmp.Diff(tc.expected, got); diff != "" {
+				t.Errorf("fields differ:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteProtoMetrics(t *testing.T) {
+	ms := metrics.NewStore()
+	for _, name := range []string{"b", "a"} {
+		m := metrics.NewMetric(name, "prog", metrics.Counter, datum.Int)
+		if _, err := m.GetDatum(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ms.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := New(ms, Hostname("gunstar"), Shard(2))
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	var b bytes.Buffer
+	if err := e.WriteProtoMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	fields := decodeProto(t, b.Bytes())
+	if len(fields) != 3 || fields[0].Num != metricSetHostname || fields[0].Value != "gunstar" {
+		t.Fatalf("unexpected MetricSet %v", fields)
+	}
+	for i, name := range []string{"a", "b"} {
+		metric := decodeProto(t, []byte(fields[i+1].Value.(string)))
+		if metric[0].Value != name {
+			t.Errorf("metric %d is %v, want %s", i, metric[0].Value, name)
+		}
+		if metric[2].Num != metricLabels || metric[2].Value != "\x0a\x05shard\x12\x012" {
+			t.Errorf("metric %d has no shard label: %v", i, metric)
+		}
+	}
+}
+
+func TestProtoBackendPush(t *testing.T) {
+	for _, compression := range []string{"", "gzip"} {
+		compression := compression
+		t.Run("compression "+compression, func(t *testing.T) {
+			testProtoBackendPush(t, compression)
+		})
+	}
+}
+
+func testProtoBackendPush(t *testing.T, compression string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var cr io.Reader = conn
+		if compression == "gzip" {
+			if cr, err = gzip.NewReader(conn); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		r := bufio.NewReader(cr)
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Error(err)
+		}
+		received <- msg
+	}()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "web.mtail", metrics.Counter, datum.Int)
+	if _, err := m.GetDatum(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(ms, Hostname("gunstar"))
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	if err := e.AddBackend("proto", &protoBackend{addr: l.Addr().String(), compression: compression}); err != nil {
+		t.Fatal(err)
+	}
+	e.PushMetrics()
+	var fields []protoField
+	select {
+	case msg := <-received:
+		fields = decodeProto(t, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics pushed")
+	}
+	if len(fields) != 2 || fields[0].Value != "gunstar" {
+		t.Fatalf("unexpected MetricSet %v", fields)
+	}
+	if metric := decodeProto(t, []byte(fields[1].Value.(string))); metric[0].Value != "requests" {
+		t.Errorf("unexpected metric %v", metric)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+var (
+	exportRPCTotal  = expvar.NewInt("exporter_rpc_total")
+	exportRPCErrors = expvar.NewInt("exporter_rpc_errors")
+)
+
+const (
+	// watchPollInterval is how often a Watch call checks the store for updates.
+	watchPollInterval = 250 * time.Millisecond
+	// defaultWatchTimeout and maxWatchTimeout bound how long a Watch call waits for updates.
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
+
+// MetricService is a JSON-RPC service, registered under the name "Metrics",
+// that lets tools query the metrics in the store and wait for them to change
+// rather than polling the HTTP endpoints.
+type MetricService struct {
+	e *Exporter
+}
+
+// MetricInfo describes a metric without its values.
+type MetricInfo struct {
+	Name    string
+	Program string
+	Kind    string
+	Type    string
+	Keys    []string `json:",omitempty"`
+}
+
+// MetricValue is the value of a metric for one set of labels.
+type MetricValue struct {
+	Name    string
+	Program string
+	Labels  map[string]string `json:",omitempty"`
+	Value   string
+	Time    time.Time // time of the last update to the value
+}
+
+// ListArgs are the arguments to Metrics.List.  If Program is not empty, only
+// the metrics of that program are listed.
+type ListArgs struct {
+	Program string
+}
+
+// GetArgs are the arguments to Metrics.Get.
+type GetArgs struct {
+	Name string
+}
+
+// WatchArgs are the arguments to Metrics.Watch.  Names lists the metrics to
+// watch, or all metrics if it is empty.  Since is the Seq from the previous
+// reply, or 0 for the first call.  TimeoutSeconds is how long to wait for an
+// update, or 0 for the default of 30 seconds.
+type WatchArgs struct {
+	Names          []string
+	Since          uint64
+	TimeoutSeconds int
+}
+
+// WatchReply is the result of Metrics.Watch.  Values holds the values
+// updated after Since, and is empty if the call timed out.  Seq counts the
+// updates made up to the latest of them, and should be passed as Since to
+// the next call.  Updates are ordered by when they were made, not by the
+// timestamps of their values, which may come from the log.
+type WatchReply struct {
+	Values []MetricValue
+	Seq    uint64
+}
+
+// List returns a description of each metric.
+func (s *MetricService) List(args *ListArgs, reply *[]MetricInfo) error {
+	r := []MetricInfo{}
+	for _, ml := range s.e.snapshot().Metrics {
+		for _, m := range ml {
+			if args.Program != "" && m.Program != args.Program {
+				continue
+			}
+			m.RLock()
+			r = append(r, MetricInfo{m.Name, m.Program, m.Kind.String(), m.Type.String(), m.Keys})
+			m.RUnlock()
+		}
+	}
+	*reply = r
+	return nil
+}
+
+// Get returns the values of the named metric.
+func (s *MetricService) Get(args *GetArgs, reply *[]MetricValue) error {
+	if _, ok := s.e.snapshot().Metrics[args.Name]; !ok {
+		return errors.Errorf("no metric named %q", args.Name)
+	}
+	*reply, _ = s.e.valuesSince([]string{args.Name}, 0)
+	return nil
+}
+
+// Watch waits until any of the watched metrics is updated after args.Since,
+// or the timeout passes, and returns the updated values.
+func (s *MetricService) Watch(args *WatchArgs, reply *WatchReply) error {
+	timeout := time.Duration(args.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultWatchTimeout
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		values, latest := s.e.valuesSince(args.Names, args.Since)
+		if len(values) > 0 || !time.Now().Before(deadline) {
+			reply.Values = values
+			reply.Seq = args.Since
+			if latest > args.Since {
+				reply.Seq = latest
+			}
+			return nil
+		}
+		time.Sleep(watchPollInterval)
+	}
+}
+
+// valuesSince returns the values of the named metrics, or all metrics if
+// names is empty, whose last update came after the update numbered since,
+// and the number of the latest update.
+func (e *Exporter) valuesSince(names []string, since uint64) ([]MetricValue, uint64) {
+	store := e.snapshot()
+	if len(names) == 0 {
+		for name := range store.Metrics {
+			names = append(names, name)
+		}
+	}
+	values := []MetricValue{}
+	var latest uint64
+	for _, name := range names {
+		for _, m := range store.Metrics[name] {
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			for l := range lc {
+				seq := datum.UpdateSeq(l.Datum)
+				if seq <= since {
+					continue
+				}
+				if seq > latest {
+					latest = seq
+				}
+				e.addShardLabel(l)
+				values = append(values, MetricValue{m.Name, m.Program, l.Labels, l.Datum.ValueString(), l.Datum.TimeUTC()})
+			}
+			m.RUnlock()
+		}
+	}
+	return values, latest
+}
+
+// httpConn adapts an HTTP request and response to the connection expected by
+// the JSON-RPC codec.
+type httpConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (httpConn) Close() error { return nil }
+
+// HandleRPC answers a JSON-RPC 1.0 request POSTed to it, such as
+// {"method": "Metrics.Get", "params": [{"Name": "foo"}], "id": 1}.
+func (e *Exporter) HandleRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	exportRPCTotal.Add(1)
+	w.Header().Set("Content-type", "application/json")
+	if err := e.rpc.ServeRequest(jsonrpc.NewServerCodec(httpConn{r.Body, w})); err != nil {
+		exportRPCErrors.Add(1)
+		glog.Info("error serving RPC:", err)
+	}
+}
+
+// newRPCServer returns an RPC server for the MetricService of e.
+func newRPCServer(e *Exporter) *rpc.Server {
+	s := rpc.NewServer()
+	if err := s.RegisterName("Metrics", &MetricService{e}); err != nil {
+		glog.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+// callRPC posts a JSON-RPC request to the handler and decodes the result into reply.
+func callRPC(t *testing.T, e *Exporter, method string, args, reply interface{}) string {
+	req, err := json.Marshal(map[string]interface{}{"method": method, "params": []interface{}{args}, "id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	e.HandleRPC(w, httptest.NewRequest("POST", "/rpc", strings.NewReader(string(req))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d", method, w.Code)
+	}
+	var resp struct {
+		Result json.RawMessage
+		Error  interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %s: %q", method, err, w.Body.String())
+	}
+	if resp.Error != nil {
+		return resp.Error.(string)
+	}
+	if err := json.Unmarshal(resp.Result, reply); err != nil {
+		t.Fatal(err)
+	}
+	return ""
+}
+
+func TestMetricServiceListAndGet(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, datum.Int, "code")
+	d, _ := m.GetDatum("200")
+	datum.SetInt(d, 3, time.Unix(10, 0))
+	if err := ms.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(ms, Hostname("gunstar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var infos []MetricInfo
+	if msg := callRPC(t, e, "Metrics.List", ListArgs{}, &infos); msg != "" {
+		t.Fatal(msg)
+	}
+	if len(infos) != 1 || infos[0].Name != "requests" || infos[0].Kind != "Counter" || infos[0].Type != "Int" {
+		t.Errorf("List returned %+v", infos)
+	}
+	if msg := callRPC(t, e, "Metrics.List", ListArgs{Program: "other"}, &infos); msg != "" || len(infos) != 0 {
+		t.Errorf("List(other) returned %+v, %q", infos, msg)
+	}
+
+	var values []MetricValue
+	if msg := callRPC(t, e, "Metrics.Get", GetArgs{"requests"}, &values); msg != "" {
+		t.Fatal(msg)
+	}
+	if len(values) != 1 || values[0].Value != "3" || values[0].Labels["code"] != "200" || !values[0].Time.Equal(time.Unix(10, 0)) {
+		t.Errorf("Get returned %+v", values)
+	}
+	if msg := callRPC(t, e, "Metrics.Get", GetArgs{"missing"}, &values); msg == "" {
+		t.Error("Get of a missing metric succeeded")
+	}
+
+	w := httptest.NewRecorder()
+	e.HandleRPC(w, httptest.NewRequest("GET", "/rpc", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %d", w.Code)
+	}
+}
+
+func TestMetricServiceWatch(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, datum.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(10, 0))
+	if err := ms.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(ms, Hostname("gunstar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MetricService{e}
+
+	var reply WatchReply
+	if err := s.Watch(&WatchArgs{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Values) != 1 || reply.Seq == 0 {
+		t.Fatalf("first Watch returned %+v", reply)
+	}
+
+	since := reply.Seq
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Watch(&WatchArgs{Names: []string{"requests"}, Since: since, TimeoutSeconds: 10}, &reply); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// An update from a log line older than the last one seen is still sent.
+	datum.IncIntBy(d, 1, time.Unix(5, 0))
+	<-done
+	if len(reply.Values) != 1 || reply.Values[0].Value != "2" || !reply.Values[0].Time.Equal(time.Unix(5, 0)) || reply.Seq <= since {
+		t.Errorf("Watch returned %+v", reply)
+	}
+
+	if err := s.Watch(&WatchArgs{Since: reply.Seq, TimeoutSeconds: 1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Values) != 0 {
+		t.Errorf("Watch without updates returned %+v", reply)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+// exportRule filters, renames, or relabels the exported metrics whose names
+// match a regular expression.
+type exportRule struct {
+	action string // one of the actions in exportRuleArgs
+	re     *regexp.Regexp
+	arg    string // the replacement name, or the label key
+	value  string // the label value
+}
+
+// exportRuleArgs is the number of arguments each action takes after its
+// regular expression.
+var exportRuleArgs = map[string]int{
+	"keep":       0,
+	"drop":       0,
+	"rename":     1,
+	"label":      1,
+	"drop_label": 1,
+}
+
+// ExportRules sets the Exporter to apply the rules in the file at path to the
+// metrics before they are exported, by every exporter.
+func ExportRules(path string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rules, err := parseExportRules(path, f)
+		if err != nil {
+			return err
+		}
+		e.rules = rules
+		return nil
+	}
+}
+
+// parseExportRules parses one rule per line of r.  Blank lines and lines
+// starting with # are ignored.  A rule looks like one of
+//
+//	keep REGEXP
+//	drop REGEXP
+//	rename REGEXP REPLACEMENT
+//	label REGEXP KEY=VALUE
+//	drop_label REGEXP KEY
+//
+// and applies to the metrics whose names match REGEXP, in the order of the
+// rules.
+func parseExportRules(name string, r io.Reader) ([]exportRule, error) {
+	var rules []exportRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseExportRule(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", name, n)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseExportRule(line string) (exportRule, error) {
+	fields := strings.Fields(line)
+	var r exportRule
+	args, ok := exportRuleArgs[fields[0]]
+	if !ok {
+		return r, errors.Errorf("unknown export rule %q", fields[0])
+	}
+	if len(fields) != 2+args {
+		return r, errors.Errorf("export rule %q takes a regular expression and %d more arguments", fields[0], args)
+	}
+	re, err := regexp.Compile(fields[1])
+	if err != nil {
+		return r, err
+	}
+	r.action, r.re = fields[0], re
+	if args > 0 {
+		r.arg = fields[2]
+	}
+	if r.action == "label" {
+		i := strings.Index(r.arg, "=")
+		if i < 1 {
+			return r, errors.Errorf("expected KEY=VALUE, not %q", r.arg)
+		}
+		r.arg, r.value = r.arg[:i], r.arg[i+1:]
+	}
+	return r, nil
+}
+
+// snapshotTTL is how long a snapshot of the store is reused by the exports
+// that follow it.  Taking a snapshot stops the programs while the whole store
+// is copied, so an SNMP walk, which asks for one variable at a time, or many
+// clients scraping at once, share one copy rather than each taking their own.
+var snapshotTTL = time.Second
+
+// snapshot returns a snapshot of the store, with the export rules applied,
+// taken at most snapshotTTL ago.  It is shared, so callers must not modify
+// it.
+func (e *Exporter) snapshot() *metrics.Store {
+	e.snapshotMu.Lock()
+	defer e.snapshotMu.Unlock()
+	now := time.Now()
+	if e.lastSnapshot == nil || now.Sub(e.lastSnapshotTime) >= snapshotTTL {
+		e.lastSnapshot, e.lastSnapshotTime = e.freshSnapshot(), now
+	}
+	return e.lastSnapshot
+}
+
+// freshSnapshot returns a new snapshot of the store, with the export rules
+// applied.
+func (e *Exporter) freshSnapshot() *metrics.Store {
+	s := e.store.Snapshot()
+	if len(e.rules) == 0 {
+		return s
+	}
+	r := metrics.NewStore()
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			if applyExportRules(e.rules, m) {
+				r.Metrics[m.Name] = append(r.Metrics[m.Name], m)
+			}
+		}
+	}
+	return r
+}
+
+// applyExportRules applies the rules to m, a copy of a metric that isn't
+// shared, and returns whether it is still exported.
+func applyExportRules(rules []exportRule, m *metrics.Metric) bool {
+	for _, r := range rules {
+		match := r.re.MatchString(m.Name)
+		switch r.action {
+		case "keep":
+			if !match {
+				return false
+			}
+		case "drop":
+			if match {
+				return false
+			}
+		case "rename":
+			if match {
+				m.Name = r.re.ReplaceAllString(m.Name, r.arg)
+			}
+		case "label":
+			if match {
+				addLabel(m, r.arg, r.value)
+			}
+		case "drop_label":
+			if match {
+				dropLabel(m, r.arg)
+			}
+		}
+	}
+	return true
+}
+
+// addLabel sets the label key of every value of m to value.  If m already has
+// the label, the values whose other labels are the same are added together.
+func addLabel(m *metrics.Metric, key, value string) {
+	dropLabel(m, key)
+	m.Keys = append(m.Keys[:len(m.Keys):len(m.Keys)], key)
+	for _, lv := range m.LabelValues {
+		lv.Labels = append(lv.Labels[:len(lv.Labels):len(lv.Labels)], value)
+	}
+}
+
+// dropLabel removes the label key from m, adding together the values whose
+// other labels are the same.
+func dropLabel(m *metrics.Metric, key string) {
+	i := -1
+	for j, k := range m.Keys {
+		if k == key {
+			i = j
+		}
+	}
+	if i < 0 {
+		return
+	}
+	m.Keys = append(m.Keys[:i:i], m.Keys[i+1:]...)
+	merged := make(map[string]*metrics.LabelValue)
+	lvs := m.LabelValues[:0]
+	for _, lv := range m.LabelValues {
+		labels := append(lv.Labels[:i:i], lv.Labels[i+1:]...)
+		id := strings.Join(labels, "\x00")
+		if prev, ok := merged[id]; ok {
+			prev.Value = mergeDatums(m.Type, prev.Value, lv.Value)
+			continue
+		}
+		nlv := &metrics.LabelValue{Labels: labels, Value: lv.Value}
+		merged[id] = nlv
+		lvs = append(lvs, nlv)
+	}
+	m.LabelValues = lvs
+}
+
+// mergeDatums returns a datum holding the sum of the values of a and b, or
+// for strings the latest value, stamped with the later of their timestamps.
+func mergeDatums(t datum.Type, a, b datum.Datum) datum.Datum {
+	ts := a.TimeUTC()
+	if b.TimeUTC().After(ts) {
+		ts = b.TimeUTC()
+	}
+	switch t {
+	case datum.Int:
+		return datum.MakeInt(datum.GetInt(a)+datum.GetInt(b), ts)
+	case datum.Float:
+		return datum.MakeFloat(datum.GetFloat(a)+datum.GetFloat(b), ts)
+	}
+	if b.TimeUTC().Before(a.TimeUTC()) {
+		b = a
+	}
+	return datum.MakeString(datum.GetString(b), ts)
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func testRulesStore() *metrics.Store {
+	ts := time.Unix(1397586900, 0)
+	ms := metrics.NewStore()
+	ms.Add(&metrics.Metric{
+		Name:    "http_requests",
+		Program: "web",
+		Kind:    metrics.Counter,
+		Keys:    []string{"code", "path"},
+		LabelValues: []*metrics.LabelValue{
+			{Labels: []string{"200", "/a"}, Value: datum.MakeInt(3, ts)},
+			{Labels: []string{"200", "/b"}, Value: datum.MakeInt(4, ts)},
+			{Labels: []string{"500", "/a"}, Value: datum.MakeInt(1, ts)},
+		},
+	})
+	ms.Add(&metrics.Metric{
+		Name:        "http_latency",
+		Program:     "web",
+		Kind:        metrics.Gauge,
+		Type:        metrics.Float,
+		LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeFloat(0.5, ts)}},
+	})
+	ms.Add(&metrics.Metric{
+		Name:        "debug_lines",
+		Program:     "web",
+		Kind:        metrics.Counter,
+		LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(9, ts)}},
+	})
+	return ms
+}
+
+var exportRulesTests = []struct {
+	name     string
+	rules    string
+	expected string
+}{
+	{"no rules",
+		"",
+		`debug_lines{prog=web} 9
+http_latency{prog=web} 0.5
+http_requests{code=200,path=/a,prog=web} 3
+http_requests{code=200,path=/b,prog=web} 4
+http_requests{code=500,path=/a,prog=web} 1
+`,
+	},
+	{"drop",
+		"# no debugging metrics\ndrop ^debug_\n",
+		`http_latency{prog=web} 0.5
+http_requests{code=200,path=/a,prog=web} 3
+http_requests{code=200,path=/b,prog=web} 4
+http_requests{code=500,path=/a,prog=web} 1
+`,
+	},
+	{"keep",
+		"keep _latency$\n",
+		`http_latency{prog=web} 0.5
+`,
+	},
+	{"rename",
+		"rename ^http_(.*)$ web_${1}_total\n",
+		`debug_lines{prog=web} 9
+web_latency_total{prog=web} 0.5
+web_requests_total{code=200,path=/a,prog=web} 3
+web_requests_total{code=200,path=/b,prog=web} 4
+web_requests_total{code=500,path=/a,prog=web} 1
+`,
+	},
+	{"label",
+		"label ^http_ team=frontend\nlabel ^http_requests$ code=any\n",
+		`debug_lines{prog=web} 9
+http_latency{team=frontend,prog=web} 0.5
+http_requests{code=any,path=/a,team=frontend,prog=web} 4
+http_requests{code=any,path=/b,team=frontend,prog=web} 4
+`,
+	},
+	{"drop label",
+		"drop_label ^http_requests$ path\n",
+		`debug_lines{prog=web} 9
+http_latency{prog=web} 0.5
+http_requests{code=200,prog=web} 7
+http_requests{code=500,prog=web} 1
+`,
+	},
+	{"in order",
+		"rename ^http_ web_\ndrop_label ^web_ code\ndrop ^http_\n",
+		`debug_lines{prog=web} 9
+web_latency{prog=web} 0.5
+web_requests{path=/a,prog=web} 4
+web_requests{path=/b,prog=web} 4
+`,
+	},
+}
+
+func TestExportRules(t *testing.T) {
+	for _, tc := range exportRulesTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := parseExportRules(tc.name, strings.NewReader(tc.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := testRulesStore()
+			e, err := New(store, Hostname("gunstar"))
+			if err != nil {
+				t.Fatalf("couldn't make exporter: %s", err)
+			}
+			e.rules = rules
+			var b bytes.Buffer
+			if err := e.WriteTextMetrics(&b); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, b.String()); diff != "" {
+				t.Error(diff)
+			}
+			// The store itself is unchanged.
+			if len(store.Metrics["http_requests"]) != 1 || len(store.Metrics["http_requests"][0].LabelValues) != 3 || len(store.Metrics["http_requests"][0].Keys) != 2 {
+				t.Errorf("rules changed the store: %v", store.Metrics["http_requests"])
+			}
+		})
+	}
+}
+
+func TestParseExportRulesErrors(t *testing.T) {
+	for _, rule := range []string{
+		"allow ^foo",
+		"drop",
+		"drop ^foo bar",
+		"rename ^foo",
+		"label ^foo team",
+		"label ^foo =x",
+		"drop_label ^foo",
+		"keep (",
+	} {
+		if _, err := parseExportRules("rules", strings.NewReader(rule)); err == nil {
+			t.Errorf("expected error parsing %q", rule)
+		}
+	}
+}
+
+func TestExportRulesOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.rules")
+	if err := ioutil.WriteFile(path, []byte("drop ^debug_\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(testRulesStore(), Hostname("gunstar"), ExportRules(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e.snapshot().Metrics["debug_lines"]; ok {
+		t.Error("debug_lines not dropped")
+	}
+	if _, err := New(testRulesStore(), ExportRules(filepath.Join(dir, "missing"))); err == nil {
+		t.Error("expected error for a missing rules file")
+	}
+}
+
+func TestSnapshotShared(t *testing.T) {
+	defer func(d time.Duration) { snapshotTTL = d }(snapshotTTL)
+	snapshotTTL = time.Hour
+
+	e, err := New(testRulesStore(), Hostname("gunstar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := e.snapshot()
+	if e.snapshot() != s {
+		t.Error("snapshot within the TTL not shared")
+	}
+	if e.freshSnapshot() == s {
+		t.Error("fresh snapshot shared")
+	}
+
+	snapshotTTL = 0
+	if e.snapshot() == s {
+		t.Error("snapshot after the TTL shared")
+	}
+}
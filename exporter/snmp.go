@@ -0,0 +1,525 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"expvar"
+	"hash/fnv"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+var (
+	snmpRequests      = expvar.NewInt("exporter_snmp_requests_total")
+	snmpRequestErrors = expvar.NewInt("exporter_snmp_request_errors_total")
+)
+
+// DefaultSNMPBaseOID is the OID under which metrics are exported over SNMP
+// unless another is configured.  It is in the experimental arc, and sites
+// should use an OID under their own enterprise number instead.
+const DefaultSNMPBaseOID = "1.3.6.1.3.1"
+
+// defaultSNMPCommunity is the community string SNMP requests must present
+// unless another is configured.
+const defaultSNMPCommunity = "public"
+
+// SNMPCommunity sets the community string that SNMP requests must present.
+func SNMPCommunity(community string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		e.snmpCommunity = community
+		return nil
+	}
+}
+
+// SNMPOIDs sets the OID under which metrics are exported over SNMP.  If
+// mapFile is not empty, it names a file of lines of a metric name and an
+// OID, which is used for that metric instead of one derived from its name.
+func SNMPOIDs(base, mapFile string) func(*Exporter) error {
+	return func(e *Exporter) error {
+		var err error
+		if e.snmpBase, err = parseOID(base); err != nil {
+			return err
+		}
+		if mapFile == "" {
+			return nil
+		}
+		e.snmpNames, err = readOIDMap(mapFile)
+		return err
+	}
+}
+
+// oid is an SNMP object identifier.
+type oid []uint32
+
+func parseOID(s string) (oid, error) {
+	var o oid
+	for _, arc := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(arc, 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid OID %q", s)
+		}
+		o = append(o, uint32(n))
+	}
+	if len(o) < 2 || o[0] > 2 || (o[0] < 2 && o[1] >= 40) {
+		return nil, errors.Errorf("invalid OID %q", s)
+	}
+	return o, nil
+}
+
+func (o oid) String() string {
+	s := make([]string, len(o))
+	for i, arc := range o {
+		s[i] = strconv.FormatUint(uint64(arc), 10)
+	}
+	return strings.Join(s, ".")
+}
+
+// compare returns -1, 0, or 1 as o sorts before, equal to, or after p in
+// lexicographic order.
+func (o oid) compare(p oid) int {
+	for i := 0; i < len(o) && i < len(p); i++ {
+		switch {
+		case o[i] < p[i]:
+			return -1
+		case o[i] > p[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(p):
+		return -1
+	case len(o) > len(p):
+		return 1
+	}
+	return 0
+}
+
+// readOIDMap reads a file mapping metric names to OIDs.  Blank lines and
+// lines starting with # are ignored.
+func readOIDMap(path string) (map[string]oid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := make(map[string]oid)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected a metric name and an OID", path, n)
+		}
+		o, err := parseOID(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, n)
+		}
+		names[fields[0]] = o
+	}
+	return names, scanner.Err()
+}
+
+// hashArc returns an OID arc derived from s, so that the same metric and
+// labels are found at the same OID across restarts.
+func hashArc(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32() & 0x7fffffff
+}
+
+// snmpVar is a variable binding that can be returned in a response.
+type snmpVar struct {
+	oid   oid
+	value []byte // BER encoded value
+}
+
+// snmpVars returns the variables for every metric in the store, sorted by
+// OID.  A metric's OID is the one given in the OID map, or else the base OID
+// followed by a hash of its name.  Each of its sets of labels is one further
+// arc, a hash of the labels.
+func (e *Exporter) snmpVars(v1 bool) []snmpVar {
+	store := e.snapshot()
+	var vars []snmpVar
+	for _, ml := range store.Metrics {
+		for _, m := range ml {
+			prefix, ok := e.snmpNames[m.Name]
+			if !ok {
+				prefix = append(append(oid{}, e.snmpBase...), hashArc(m.Name))
+			}
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			for l := range lc {
+				e.addShardLabel(l)
+				var s []string
+				for k, v := range l.Labels {
+					s = append(s, k+"="+v)
+				}
+				sort.Strings(s)
+				if !e.omitProgLabel {
+					s = append(s, "prog="+m.Program)
+				}
+				o := append(append(oid{}, prefix...), hashArc(strings.Join(s, ",")))
+				vars = append(vars, snmpVar{o, snmpValue(m.Kind, l.Datum, v1)})
+			}
+			m.RUnlock()
+		}
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].oid.compare(vars[j].oid) < 0 })
+	return vars
+}
+
+// snmpValue encodes a datum.  SNMP has no signed 64 bit or floating point
+// types, so counters are Counter64s, other integers are Integers if they fit
+// in 32 bits, and everything else is an OctetString of the value's text.
+func snmpValue(kind metrics.Kind, d datum.Datum, v1 bool) []byte {
+	if d.Type() == datum.Int {
+		v := datum.GetInt(d)
+		switch {
+		case kind == metrics.Counter && v >= 0 && !v1:
+			return berUint(tagCounter64, uint64(v))
+		case v >= math.MinInt32 && v <= math.MaxInt32:
+			return berInt(tagInteger, v)
+		}
+	}
+	return berTLV(tagOctetString, []byte(d.ValueString()))
+}
+
+// BER tags used by SNMP.
+const (
+	tagInteger        = 0x02
+	tagOctetString    = 0x04
+	tagNull           = 0x05
+	tagOID            = 0x06
+	tagSequence       = 0x30
+	tagCounter64      = 0x46
+	tagNoSuchObject   = 0x80
+	tagEndOfMibView   = 0x82
+	tagGetRequest     = 0xa0
+	tagGetNextRequest = 0xa1
+	tagGetResponse    = 0xa2
+	tagGetBulkRequest = 0xa5
+)
+
+const (
+	snmpVersion1  = 0
+	snmpVersion2c = 1
+
+	errNoSuchName = 2 // SNMPv1 error status for a missing variable
+
+	// maxBulkVars limits the size of a response to a GetBulk request.
+	maxBulkVars = 500
+)
+
+// ServeSNMP answers SNMPv1 and SNMPv2c Get, GetNext, and GetBulk requests for
+// the metrics in the store, received on conn, until conn is closed.
+func (e *Exporter) ServeSNMP(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		snmpRequests.Add(1)
+		resp, err := e.handleSNMP(buf[:n])
+		if err != nil {
+			snmpRequestErrors.Add(1)
+			glog.V(1).Infof("Bad SNMP request from %s: %s", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			glog.Infof("SNMP response to %s failed: %s", addr, err)
+		}
+	}
+}
+
+// handleSNMP returns the response to an SNMP request message.
+func (e *Exporter) handleSNMP(req []byte) ([]byte, error) {
+	tag, msg, _, err := readTLV(req)
+	if err != nil {
+		return nil, err
+	}
+	if tag != tagSequence {
+		return nil, errors.Errorf("message is not a sequence")
+	}
+	version, msg, err := readInt(msg)
+	if err != nil {
+		return nil, err
+	}
+	if version != snmpVersion1 && version != snmpVersion2c {
+		return nil, errors.Errorf("unsupported SNMP version %d", version)
+	}
+	tag, community, msg, err := readTLV(msg)
+	if err != nil {
+		return nil, err
+	}
+	if tag != tagOctetString || string(community) != e.snmpCommunity {
+		return nil, errors.New("wrong community")
+	}
+	pduTag, pdu, _, err := readTLV(msg)
+	if err != nil {
+		return nil, err
+	}
+	var reqID, arg1, arg2 int64
+	for _, v := range []*int64{&reqID, &arg1, &arg2} {
+		if *v, pdu, err = readInt(pdu); err != nil {
+			return nil, err
+		}
+	}
+	tag, bindings, _, err := readTLV(pdu)
+	if err != nil {
+		return nil, err
+	}
+	if tag != tagSequence {
+		return nil, errors.New("variable bindings are not a sequence")
+	}
+	var oids []oid
+	for len(bindings) > 0 {
+		var binding []byte
+		if tag, binding, bindings, err = readTLV(bindings); err != nil {
+			return nil, err
+		}
+		if tag, binding, _, err = readTLV(binding); err != nil {
+			return nil, err
+		}
+		if tag != tagOID {
+			return nil, errors.New("variable binding has no OID")
+		}
+		o, err := readOID(binding)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, o)
+	}
+
+	v1 := version == snmpVersion1
+	vars := e.snmpVars(v1)
+	var errStatus, errIndex int64
+	var results []snmpVar
+	switch pduTag {
+	case tagGetRequest:
+		for i, o := range oids {
+			j := sort.Search(len(vars), func(j int) bool { return vars[j].oid.compare(o) >= 0 })
+			if j < len(vars) && vars[j].oid.compare(o) == 0 {
+				results = append(results, vars[j])
+			} else if v1 {
+				errStatus, errIndex = errNoSuchName, int64(i+1)
+				break
+			} else {
+				results = append(results, snmpVar{o, berTLV(tagNoSuchObject, nil)})
+			}
+		}
+	case tagGetNextRequest:
+		for i, o := range oids {
+			r, ok := nextVar(vars, o)
+			if !ok && v1 {
+				errStatus, errIndex = errNoSuchName, int64(i+1)
+				break
+			}
+			results = append(results, r)
+		}
+	case tagGetBulkRequest:
+		if v1 {
+			return nil, errors.New("GetBulk request in SNMPv1")
+		}
+		nonRepeaters, maxRepetitions := int(arg1), int(arg2)
+		if nonRepeaters < 0 {
+			nonRepeaters = 0
+		}
+		if nonRepeaters > len(oids) {
+			nonRepeaters = len(oids)
+		}
+		for _, o := range oids[:nonRepeaters] {
+			r, _ := nextVar(vars, o)
+			results = append(results, r)
+		}
+		repeaters := append([]oid{}, oids[nonRepeaters:]...)
+		for n := 0; n < maxRepetitions && len(repeaters) > 0 && len(results) < maxBulkVars; n++ {
+			more := false
+			for i, o := range repeaters {
+				r, ok := nextVar(vars, o)
+				results = append(results, r)
+				repeaters[i] = r.oid
+				more = more || ok
+			}
+			if !more {
+				break
+			}
+		}
+	default:
+		return nil, errors.Errorf("unsupported PDU type 0x%x", pduTag)
+	}
+
+	if errStatus != 0 {
+		// A v1 error response returns the request's bindings unchanged.
+		results = results[:0]
+		for _, o := range oids {
+			results = append(results, snmpVar{o, berTLV(tagNull, nil)})
+		}
+	}
+	var encoded [][]byte
+	for _, r := range results {
+		encoded = append(encoded, berTLV(tagSequence, berOID(r.oid), r.value))
+	}
+	return berTLV(tagSequence,
+		berInt(tagInteger, version),
+		berTLV(tagOctetString, community),
+		berTLV(tagGetResponse,
+			berInt(tagInteger, reqID),
+			berInt(tagInteger, errStatus),
+			berInt(tagInteger, errIndex),
+			berTLV(tagSequence, encoded...))), nil
+}
+
+// nextVar returns the first variable after o, or endOfMibView and false if
+// there is none.
+func nextVar(vars []snmpVar, o oid) (snmpVar, bool) {
+	j := sort.Search(len(vars), func(j int) bool { return vars[j].oid.compare(o) > 0 })
+	if j == len(vars) {
+		return snmpVar{o, berTLV(tagEndOfMibView, nil)}, false
+	}
+	return vars[j], true
+}
+
+// readTLV reads a BER encoded value from the start of b, returning its tag,
+// its contents, and the rest of b.
+func readTLV(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated value")
+	}
+	tag, b = b[0], b[1:]
+	n := int(b[0])
+	b = b[1:]
+	if n&0x80 != 0 {
+		lenBytes := n & 0x7f
+		if lenBytes == 0 || lenBytes > 3 || len(b) < lenBytes {
+			return 0, nil, nil, errors.New("invalid length")
+		}
+		n = 0
+		for _, c := range b[:lenBytes] {
+			n = n<<8 | int(c)
+		}
+		b = b[lenBytes:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, errors.New("truncated value")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// readInt reads a BER encoded INTEGER from the start of b.
+func readInt(b []byte) (int64, []byte, error) {
+	tag, content, rest, err := readTLV(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != tagInteger || len(content) == 0 || len(content) > 8 {
+		return 0, nil, errors.New("invalid integer")
+	}
+	v := int64(int8(content[0]))
+	for _, c := range content[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, rest, nil
+}
+
+// readOID decodes the contents of a BER encoded OBJECT IDENTIFIER.
+func readOID(b []byte) (oid, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	var o oid
+	var arc uint32
+	for i, c := range b {
+		if arc > math.MaxUint32>>7 {
+			return nil, errors.New("OID arc overflows")
+		}
+		arc = arc<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return nil, errors.New("truncated OID")
+			}
+			continue
+		}
+		if len(o) == 0 {
+			if arc < 80 {
+				o = append(o, arc/40, arc%40)
+			} else {
+				o = append(o, 2, arc-80)
+			}
+		} else {
+			o = append(o, arc)
+		}
+		arc = 0
+	}
+	return o, nil
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var c []byte
+	for _, b := range contents {
+		c = append(c, b...)
+	}
+	return append(append([]byte{tag}, berLength(len(c))...), c...)
+}
+
+func berInt(tag byte, v int64) []byte {
+	b := []byte{byte(v)}
+	for v >= 0x80 || v < -0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berUint(tag byte, v uint64) []byte {
+	b := []byte{byte(v)}
+	for v >= 0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berOID(o oid) []byte {
+	var b []byte
+	for i, arc := range o {
+		if i == 0 {
+			continue
+		}
+		if i == 1 {
+			arc += o[0] * 40
+		}
+		enc := []byte{byte(arc & 0x7f)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			enc = append([]byte{byte(arc&0x7f) | 0x80}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return berTLV(tagOID, b)
+}
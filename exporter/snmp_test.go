@@ -0,0 +1,248 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestBERIntRoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, math.MaxInt32, math.MinInt32, math.MaxInt64, math.MinInt64} {
+		got, rest, err := readInt(berInt(tagInteger, v))
+		if err != nil || got != v || len(rest) != 0 {
+			t.Errorf("readInt(berInt(%d)) = %d, %v, %v", v, got, rest, err)
+		}
+	}
+}
+
+func TestOIDRoundTrip(t *testing.T) {
+	for _, s := range []string{"1.3", "1.3.6.1.4.1.2021.10.1.3.1", "2.999.3", "1.3.6.1.3.1.2147483647.128"} {
+		o, err := parseOID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, content, _, err := readTLV(berOID(o))
+		if err != nil || tag != tagOID {
+			t.Fatalf("readTLV(berOID(%s)) = %x, %v", s, tag, err)
+		}
+		got, err := readOID(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != s {
+			t.Errorf("readOID(berOID(%s)) = %s", s, got)
+		}
+	}
+	for _, s := range []string{"", "1", "3.1", "1.40", "1.3.x", "1.3.4294967296"} {
+		if _, err := parseOID(s); err == nil {
+			t.Errorf("parseOID(%q) succeeded", s)
+		}
+	}
+}
+
+func snmpRequest(version int64, community string, pduTag byte, arg1, arg2 int64, oids ...oid) []byte {
+	var bindings [][]byte
+	for _, o := range oids {
+		bindings = append(bindings, berTLV(tagSequence, berOID(o), berTLV(tagNull, nil)))
+	}
+	return berTLV(tagSequence,
+		berInt(tagInteger, version),
+		berTLV(tagOctetString, []byte(community)),
+		berTLV(pduTag,
+			berInt(tagInteger, 42),
+			berInt(tagInteger, arg1),
+			berInt(tagInteger, arg2),
+			berTLV(tagSequence, bindings...)))
+}
+
+// parseSNMPResponse returns the error status and variable bindings of a response.
+func parseSNMPResponse(t *testing.T, b []byte) (int64, []snmpVar) {
+	_, msg, _, err := readTLV(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err = readInt(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, msg, err = readTLV(msg); err != nil {
+		t.Fatal(err)
+	}
+	tag, pdu, _, err := readTLV(msg)
+	if err != nil || tag != tagGetResponse {
+		t.Fatalf("response PDU %x, %v", tag, err)
+	}
+	var reqID, errStatus int64
+	if reqID, pdu, err = readInt(pdu); err != nil || reqID != 42 {
+		t.Fatalf("request ID %d, %v", reqID, err)
+	}
+	if errStatus, pdu, err = readInt(pdu); err != nil {
+		t.Fatal(err)
+	}
+	if _, pdu, err = readInt(pdu); err != nil {
+		t.Fatal(err)
+	}
+	_, bindings, _, err := readTLV(pdu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vars []snmpVar
+	for len(bindings) > 0 {
+		var binding, content []byte
+		if _, binding, bindings, err = readTLV(bindings); err != nil {
+			t.Fatal(err)
+		}
+		if _, content, binding, err = readTLV(binding); err != nil {
+			t.Fatal(err)
+		}
+		o, err := readOID(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars = append(vars, snmpVar{o, binding})
+	}
+	return errStatus, vars
+}
+
+func newSNMPTestExporter(t *testing.T, options ...func(*Exporter) error) *Exporter {
+	ts := time.Unix(1397586900, 0)
+	ms := metrics.NewStore()
+	for _, m := range []*metrics.Metric{
+		{Name: "requests", Program: "test", Kind: metrics.Counter, Keys: []string{"code"},
+			LabelValues: []*metrics.LabelValue{
+				{Labels: []string{"200"}, Value: datum.MakeInt(10, ts)},
+				{Labels: []string{"500"}, Value: datum.MakeInt(1, ts)}}},
+		{Name: "latency", Program: "test", Kind: metrics.Gauge,
+			LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeFloat(0.25, ts)}}},
+	} {
+		if err := ms.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := New(ms, append([]func(*Exporter) error{Hostname("gunstar")}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestSNMPWalk(t *testing.T) {
+	e := newSNMPTestExporter(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.ServeSNMP(conn)
+	defer conn.Close()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	base, _ := parseOID(DefaultSNMPBaseOID)
+	next := base
+	var values [][]byte
+	for {
+		if _, err := client.Write(snmpRequest(snmpVersion2c, "public", tagGetNextRequest, 0, 0, next)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 65536)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, vars := parseSNMPResponse(t, buf[:n])
+		if len(vars) != 1 {
+			t.Fatalf("got %d bindings, want 1", len(vars))
+		}
+		if vars[0].value[0] == tagEndOfMibView {
+			break
+		}
+		if vars[0].oid.compare(next) <= 0 {
+			t.Fatalf("GetNext(%s) returned %s, not after it", next, vars[0].oid)
+		}
+		next = vars[0].oid
+		values = append(values, vars[0].value)
+	}
+	if len(values) != 3 {
+		t.Fatalf("walk returned %d values, want 3", len(values))
+	}
+	want := map[string]bool{
+		string(berUint(tagCounter64, 10)):              false,
+		string(berUint(tagCounter64, 1)):               false,
+		string(berTLV(tagOctetString, []byte("0.25"))): false,
+	}
+	for _, v := range values {
+		want[string(v)] = true
+	}
+	for v, seen := range want {
+		if !seen {
+			t.Errorf("walk didn't return %x", v)
+		}
+	}
+}
+
+func TestSNMPGet(t *testing.T) {
+	f, err := ioutil.TempFile("", "oidmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("# comment\n\nlatency 1.3.6.1.4.1.99999.7\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	e := newSNMPTestExporter(t, SNMPCommunity("secret"), SNMPOIDs(DefaultSNMPBaseOID, f.Name()))
+
+	latency, _ := parseOID("1.3.6.1.4.1.99999.7")
+	latency = append(latency, hashArc("prog=test"))
+	missing, _ := parseOID("1.3.6.1.4.1.99999.8")
+
+	if _, err := e.handleSNMP(snmpRequest(snmpVersion2c, "public", tagGetRequest, 0, 0, latency)); err == nil {
+		t.Error("request with wrong community answered")
+	}
+
+	resp, err := e.handleSNMP(snmpRequest(snmpVersion2c, "secret", tagGetRequest, 0, 0, latency, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errStatus, vars := parseSNMPResponse(t, resp)
+	if errStatus != 0 || len(vars) != 2 {
+		t.Fatalf("error status %d, %d bindings", errStatus, len(vars))
+	}
+	if !bytes.Equal(vars[0].value, berTLV(tagOctetString, []byte("0.25"))) {
+		t.Errorf("latency = %x", vars[0].value)
+	}
+	if vars[1].value[0] != tagNoSuchObject {
+		t.Errorf("missing = %x, want noSuchObject", vars[1].value)
+	}
+
+	resp, err = e.handleSNMP(snmpRequest(snmpVersion1, "secret", tagGetRequest, 0, 0, latency, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errStatus, _ = parseSNMPResponse(t, resp); errStatus != errNoSuchName {
+		t.Errorf("SNMPv1 error status = %d, want %d", errStatus, errNoSuchName)
+	}
+
+	resp, err = e.handleSNMP(snmpRequest(snmpVersion2c, "secret", tagGetBulkRequest, 0, 10, oid{1, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, vars = parseSNMPResponse(t, resp); len(vars) != 4 || vars[3].value[0] != tagEndOfMibView {
+		t.Errorf("GetBulk returned %d bindings: %v", len(vars), vars)
+	}
+}
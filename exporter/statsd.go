@@ -21,6 +21,15 @@ var (
 	statsdExportSuccess = expvar.NewInt("statsd_export_success")
 )
 
+func init() {
+	RegisterBackend("statsd", func() (Backend, error) {
+		if *statsdHostPort == "" {
+			return nil, nil
+		}
+		return newSocketBackend("udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess), nil
+	})
+}
+
 // metricToStatsd encodes a metric in the statsd text protocol format.  The
 // metric lock is held before entering this function.
 func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
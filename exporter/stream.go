@@ -0,0 +1,111 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	exportStreamClients = expvar.NewInt("exporter_stream_clients")
+)
+
+// streamInterval is how often changes to the metrics are sent to stream clients.
+const streamInterval = time.Second
+
+// HandleStream sends the metrics to the client as Server-Sent Events, first
+// the current value of every metric, then each change as it happens.  Each
+// change is an "update" event with a MetricValue as its JSON data, or a
+// "delete" event when a set of labels is removed from a metric.  The name
+// query parameter, which may be repeated, limits the stream to the named
+// metrics.
+func (e *Exporter) HandleStream(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	exportStreamClients.Add(1)
+	defer exportStreamClients.Add(-1)
+
+	w.Header().Set("Content-type", "text/event-stream")
+	w.Header().Set("Cache-control", "no-cache")
+	names := r.URL.Query()["name"]
+	s := newStreamState()
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	for {
+		values, _ := e.valuesSince(names, 0)
+		for _, ev := range s.changes(values) {
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.kind, ev.data); err != nil {
+				glog.V(1).Infof("stream client went away: %s", err)
+				return
+			}
+		}
+		f.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamEvent is an event to send to a stream client.
+type streamEvent struct {
+	kind string // "update" or "delete"
+	data []byte // JSON encoded MetricValue
+}
+
+// streamState holds the values last sent to a stream client, so that only
+// changes are sent.
+type streamState struct {
+	sent map[string]MetricValue // by streamKey
+}
+
+func newStreamState() *streamState {
+	return &streamState{sent: make(map[string]MetricValue)}
+}
+
+// streamKey identifies one set of labels of a metric.
+func streamKey(v MetricValue) string {
+	// encoding/json sorts map keys, so equal labels have equal encodings.
+	labels, _ := json.Marshal(v.Labels)
+	return v.Name + "\x00" + v.Program + "\x00" + string(labels)
+}
+
+// changes returns the events that bring a client up to date with values,
+// the current values of the metrics, and records them as sent.
+func (s *streamState) changes(values []MetricValue) []streamEvent {
+	var events []streamEvent
+	current := make(map[string]bool, len(values))
+	for _, v := range values {
+		key := streamKey(v)
+		current[key] = true
+		if last, ok := s.sent[key]; ok && last.Value == v.Value && last.Time.Equal(v.Time) {
+			continue
+		}
+		s.sent[key] = v
+		if b, err := json.Marshal(v); err == nil {
+			events = append(events, streamEvent{"update", b})
+		}
+	}
+	for key, v := range s.sent {
+		if current[key] {
+			continue
+		}
+		delete(s.sent, key)
+		v.Value = ""
+		if b, err := json.Marshal(v); err == nil {
+			events = append(events, streamEvent{"delete", b})
+		}
+	}
+	return events
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestStreamStateChanges(t *testing.T) {
+	ts := time.Unix(10, 0)
+	a := MetricValue{Name: "a", Program: "p", Labels: map[string]string{"x": "1", "y": "2"}, Value: "1", Time: ts}
+	b := MetricValue{Name: "b", Program: "p", Value: "1", Time: ts}
+	a2 := a
+	a2.Labels = map[string]string{"y": "2", "x": "1"}
+	a2.Value = "2"
+	a2.Time = ts.Add(time.Second)
+
+	steps := []struct {
+		values []MetricValue
+		want   []string // event kinds and metric names
+	}{
+		{[]MetricValue{a, b}, []string{"update a", "update b"}},
+		{[]MetricValue{a, b}, nil},
+		{[]MetricValue{a2, b}, []string{"update a"}},
+		{[]MetricValue{a2}, []string{"delete b"}},
+	}
+	s := newStreamState()
+	for i, step := range steps {
+		var got []string
+		for _, ev := range s.changes(step.values) {
+			var v MetricValue
+			if err := json.Unmarshal(ev.data, &v); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ev.kind+" "+v.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(step.want, ",") {
+			t.Errorf("step %d: events %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, datum.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(10, 0))
+	if err := ms.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(ms, Hostname("gunstar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(e.HandleStream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?name=requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-type"); ct != "text/event-stream" {
+		t.Errorf("content type %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	nextValue := func() MetricValue {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				var v MetricValue
+				if err := json.Unmarshal([]byte(line[len("data: "):]), &v); err != nil {
+					t.Fatal(err)
+				}
+				return v
+			}
+		}
+	}
+	if v := nextValue(); v.Name != "requests" || v.Value != "1" {
+		t.Errorf("first event %+v", v)
+	}
+	datum.IncIntBy(d, 1, time.Unix(20, 0))
+	if v := nextValue(); v.Value != "2" {
+		t.Errorf("second event %+v", v)
+	}
+}
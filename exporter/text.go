@@ -0,0 +1,57 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+)
+
+const textFormat = "%s{%s} %s\n"
+
+// WriteTextMetrics writes the metrics to w as plain text, one line per datum,
+// sorted so that the output of two runs can be compared.  Timestamps are
+// omitted for the same reason.
+func (e *Exporter) WriteTextMetrics(w io.Writer) error {
+	store := e.snapshot()
+	var lines []string
+	for _, ml := range store.Metrics {
+		for _, m := range ml {
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go m.EmitLabelSets(lc)
+			for l := range lc {
+				e.addShardLabel(l)
+				lines = append(lines, metricToText(m, l, e.omitProgLabel))
+			}
+			m.RUnlock()
+		}
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func metricToText(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool) string {
+	var s []string
+	for k, v := range l.Labels {
+		s = append(s, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(s)
+	if !omitProgLabel {
+		s = append(s, fmt.Sprintf("prog=%s", m.Program))
+	}
+	return fmt.Sprintf(textFormat,
+		m.Name,
+		strings.Join(s, ","),
+		l.Datum.ValueString())
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+var writeTextTests = []struct {
+	name     string
+	metrics  []*metrics.Metric
+	expected string
+}{
+	{"empty",
+		[]*metrics.Metric{},
+		"",
+	},
+	{"sorted",
+		[]*metrics.Metric{
+			{
+				Name:    "foo",
+				Program: "test",
+				Kind:    metrics.Counter,
+				Keys:    []string{"a"},
+				LabelValues: []*metrics.LabelValue{
+					{Labels: []string{"2"}, Value: datum.MakeInt(2, time.Unix(1397586900, 0))},
+					{Labels: []string{"1"}, Value: datum.MakeInt(1, time.Unix(1397586900, 0))},
+				},
+			},
+			{
+				Name:        "bar",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeFloat(0.5, time.Unix(1397586900, 0))}},
+			},
+		},
+		`bar{prog=test} 0.5
+foo{a=1,prog=test} 1
+foo{a=2,prog=test} 2
+`,
+	},
+	{"text",
+		[]*metrics.Metric{
+			{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Text,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeString("hi", time.Unix(1397586900, 0))}},
+			},
+		},
+		`foo{prog=test} hi
+`,
+	},
+}
+
+func TestWriteTextMetrics(t *testing.T) {
+	for _, tc := range writeTextTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ms := metrics.NewStore()
+			for _, metric := range tc.metrics {
+				ms.Add(metric)
+			}
+			e, err := New(ms, Hostname("gunstar"))
+			if err != nil {
+				t.Fatalf("couldn't make exporter: %s", err)
+			}
+			var b bytes.Buffer
+			if err := e.WriteTextMetrics(&b); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, b.String()); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
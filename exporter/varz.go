@@ -21,18 +21,20 @@ const varzFormat = "%s{%s} %s\n"
 
 // HandleVarz exports the metrics in Varz format via HTTP.
 func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
-	e.store.RLock()
-	defer e.store.RUnlock()
+	store := e.snapshot()
 
 	w.Header().Add("Content-type", "text/plain")
+	w, done := compressResponse(w, r)
+	defer done()
 
-	for _, ml := range e.store.Metrics {
+	for _, ml := range store.Metrics {
 		for _, m := range ml {
 			m.RLock()
 			exportVarzTotal.Add(1)
 			lc := make(chan *metrics.LabelSet)
 			go m.EmitLabelSets(lc)
 			for l := range lc {
+				e.addShardLabel(l)
 				line := metricToVarz(m, l, e.omitProgLabel, e.hostname)
 				fmt.Fprint(w, line)
 			}
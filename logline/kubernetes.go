@@ -0,0 +1,29 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logline
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ContainerLabels returns the pod, namespace, and container names encoded in
+// the name of a Kubernetes container log file, which the kubelet names
+// `<pod>_<namespace>_<container>-<container id>.log`.  If filename isn't in
+// that form, ok is false.
+func ContainerLabels(filename string) (pod, namespace, container string, ok bool) {
+	base := filepath.Base(filename)
+	if !strings.HasSuffix(base, ".log") {
+		return "", "", "", false
+	}
+	parts := strings.Split(strings.TrimSuffix(base, ".log"), "_")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	i := strings.LastIndex(parts[2], "-")
+	if i <= 0 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2][:i], true
+}
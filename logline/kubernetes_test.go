@@ -0,0 +1,26 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logline
+
+import "testing"
+
+func TestContainerLabels(t *testing.T) {
+	for _, tc := range []struct {
+		filename                  string
+		pod, namespace, container string
+		ok                        bool
+	}{
+		{"/var/log/containers/web-5d8f9c7b4-x2x9z_default_nginx-0123456789abcdef.log", "web-5d8f9c7b4-x2x9z", "default", "nginx", true},
+		{"kube-dns-1_kube-system_dns-side-car-abc.log", "kube-dns-1", "kube-system", "dns-side-car", true},
+		{"/var/log/syslog", "", "", "", false},
+		{"/var/log/a_b.log", "", "", "", false},
+		{"/var/log/a_b_c.log", "", "", "", false},
+	} {
+		pod, namespace, container, ok := ContainerLabels(tc.filename)
+		if pod != tc.pod || namespace != tc.namespace || container != tc.container || ok != tc.ok {
+			t.Errorf("ContainerLabels(%q) = %q, %q, %q, %v; want %q, %q, %q, %v", tc.filename,
+				pod, namespace, container, ok, tc.pod, tc.namespace, tc.container, tc.ok)
+		}
+	}
+}
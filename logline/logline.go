@@ -3,13 +3,17 @@
 
 package logline
 
+import "time"
+
 // LogLine contains all the information about a line just read from a log.
 type LogLine struct {
 	Filename string // The log filename that this line was read from
 	Line     string // The text of the log line itself up to the newline.
+
+	Time time.Time // The time the line was logged, if recorded by the log format; otherwise zero.
 }
 
 // NewLogLine creates a new LogLine object.
 func NewLogLine(filename string, line string) *LogLine {
-	return &LogLine{filename, line}
+	return &LogLine{Filename: filename, Line: line}
 }
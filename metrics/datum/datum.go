@@ -43,21 +43,32 @@ type Datum interface {
 
 	// TimeString returns the timestamp of a Datum as a string.
 	TimeString() string
+
+	// TimeUTC returns the timestamp of a Datum.
+	TimeUTC() time.Time
 }
 
 // BaseDatum is a struct used to record timestamps across all Datum implementations.
 type BaseDatum struct {
 	Time int64 // nanoseconds since unix epoch
+
+	seq uint64 // value of updateSeq after the last update
 }
 
 var zeroTime time.Time
 
+// updateSeq counts the updates to every datum, so that the order of updates
+// is known even when their timestamps, which may come from the log, are out
+// of order.
+var updateSeq uint64
+
 func (d *BaseDatum) stamp(timestamp time.Time) {
 	if timestamp.IsZero() {
 		atomic.StoreInt64(&d.Time, time.Now().UTC().UnixNano())
 	} else {
 		atomic.StoreInt64(&d.Time, timestamp.UnixNano())
 	}
+	atomic.StoreUint64(&d.seq, atomic.AddUint64(&updateSeq, 1))
 }
 
 // TimeString returns the timestamp of this Datum as a string.
@@ -65,6 +76,11 @@ func (d *BaseDatum) TimeString() string {
 	return fmt.Sprintf("%d", atomic.LoadInt64(&d.Time)/1e9)
 }
 
+// TimeUTC returns the timestamp of this Datum in UTC.
+func (d *BaseDatum) TimeUTC() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&d.Time)).UTC()
+}
+
 // NewInt creates a new zero integer datum.
 func NewInt() Datum {
 	return MakeInt(0, zeroTime)
@@ -101,6 +117,57 @@ func MakeString(v string, ts time.Time) Datum {
 	return d
 }
 
+// Copy returns a new datum with the value and timestamp of d.  The copy
+// shares the Quantiles of d, if any.
+func Copy(d Datum) Datum {
+	switch d := d.(type) {
+	case *IntDatum:
+		return &IntDatum{d.copyBase(), d.Get(), d.Quantiles}
+	case *FloatDatum:
+		return &FloatDatum{d.copyBase(), atomic.LoadUint64(&d.Valuebits), d.Quantiles}
+	case *StringDatum:
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return &StringDatum{BaseDatum: d.copyBase(), Value: d.Value}
+	default:
+		panic(fmt.Sprintf("datum %v has an unknown type", d))
+	}
+}
+
+func (d *BaseDatum) copyBase() BaseDatum {
+	return BaseDatum{Time: atomic.LoadInt64(&d.Time), seq: atomic.LoadUint64(&d.seq)}
+}
+
+// UpdateSeq returns the number of updates made to all datums when d was last
+// updated.  A datum updated later has a larger UpdateSeq, whatever the
+// timestamps of the two.
+func UpdateSeq(d Datum) uint64 {
+	switch d := d.(type) {
+	case *IntDatum:
+		return atomic.LoadUint64(&d.seq)
+	case *FloatDatum:
+		return atomic.LoadUint64(&d.seq)
+	case *StringDatum:
+		return atomic.LoadUint64(&d.seq)
+	default:
+		panic(fmt.Sprintf("datum %v has an unknown type", d))
+	}
+}
+
+// Stamp sets the timestamp of a datum to ts, leaving its value alone.
+func Stamp(d Datum, ts time.Time) {
+	switch d := d.(type) {
+	case *IntDatum:
+		d.stamp(ts)
+	case *FloatDatum:
+		d.stamp(ts)
+	case *StringDatum:
+		d.stamp(ts)
+	default:
+		panic(fmt.Sprintf("datum %v has an unknown type", d))
+	}
+}
+
 // GetInt returns the integer value of a datum, or error.
 func GetInt(d Datum) int64 {
 	switch d := d.(type) {
@@ -32,6 +32,9 @@ func TestDatumSetAndValue(t *testing.T) {
 	if r := d.TimeString(); r != "37" {
 		t.Errorf("d Time not correct, got %v", r)
 	}
+	if r := d.TimeUTC(); !r.Equal(time.Unix(37, 42)) {
+		t.Errorf("d TimeUTC not correct, got %v", r)
+	}
 }
 
 var datumJSONTests = []struct {
@@ -60,3 +63,32 @@ func TestMarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestCopy(t *testing.T) {
+	ts := time.Unix(37, 0).UTC()
+	for _, d := range []Datum{MakeInt(10, ts), MakeFloat(1.5, ts), MakeString("hi", ts)} {
+		c := Copy(d)
+		if c == d {
+			t.Errorf("Copy(%v) returned the same datum", d)
+		}
+		if c.ValueString() != d.ValueString() || c.TimeUTC() != d.TimeUTC() {
+			t.Errorf("Copy(%v) = %v", d, c)
+		}
+	}
+}
+
+func TestUpdateSeq(t *testing.T) {
+	a := MakeInt(1, time.Unix(20, 0))
+	b := MakeFloat(1, time.Unix(10, 0))
+	if UpdateSeq(b) <= UpdateSeq(a) {
+		t.Errorf("later update has seq %d, not after %d", UpdateSeq(b), UpdateSeq(a))
+	}
+	if c := Copy(b); UpdateSeq(c) != UpdateSeq(b) {
+		t.Errorf("copy has seq %d, want %d", UpdateSeq(c), UpdateSeq(b))
+	}
+	seq := UpdateSeq(a)
+	IncIntBy(a, 1, time.Unix(5, 0))
+	if UpdateSeq(a) <= seq {
+		t.Errorf("seq %d not after %d once updated", UpdateSeq(a), seq)
+	}
+}
@@ -15,6 +15,7 @@ import (
 type FloatDatum struct {
 	BaseDatum
 	Valuebits uint64
+	Quantiles *Quantiles // estimates quantiles of the values set, if not nil
 }
 
 // Type returns the Type of this Datum.
@@ -29,6 +30,9 @@ func (d *FloatDatum) ValueString() string {
 func (d *FloatDatum) Set(v float64, ts time.Time) {
 	atomic.StoreUint64(&d.Valuebits, math.Float64bits(v))
 	d.stamp(ts)
+	if d.Quantiles != nil {
+		d.Quantiles.Insert(v)
+	}
 }
 
 // Get returns the floating-point value.
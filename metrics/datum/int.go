@@ -13,7 +13,8 @@ import (
 // IntDatum describes an integer value at a given timestamp.
 type IntDatum struct {
 	BaseDatum
-	Value int64
+	Value     int64
+	Quantiles *Quantiles // estimates quantiles of the values set, if not nil
 }
 
 // Type returns the Type of an IntDatum, Int.
@@ -23,6 +24,9 @@ func (*IntDatum) Type() Type { return Int }
 func (d *IntDatum) Set(value int64, timestamp time.Time) {
 	atomic.StoreInt64(&d.Value, value)
 	d.stamp(timestamp)
+	if d.Quantiles != nil {
+		d.Quantiles.Insert(float64(value))
+	}
 }
 
 // IncBy increments the IntDatum's value by the value provided, at timestamp.
@@ -0,0 +1,221 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuantileWindow is the age of the oldest value used to estimate quantiles.
+// Quantiles estimated over all time would stop responding to changes in the
+// distribution of values.
+const QuantileWindow = 10 * time.Minute
+
+// Quantiles estimates quantiles of a stream of values, using the targeted
+// quantiles algorithm of Cormode, Korn, Muthukrishnan, and Srivastava,
+// "Effective Computation of Biased Quantiles over Data Streams", which keeps a
+// small summary of the values seen.  The quantiles are estimated from the
+// values seen in the last QuantileWindow; the sum and count are of all values.
+type Quantiles struct {
+	mu      sync.Mutex
+	targets []float64
+	streams [2]*quantileStream // streams[0] is the oldest, and is queried
+	rotated time.Time
+	now     func() time.Time // mockable clock
+	sum     float64
+	count   uint64
+}
+
+// NewQuantiles returns a Quantiles that estimates the given quantiles,
+// each of which must be between 0 and 1.  The error allowed in the rank of
+// each estimate is a tenth of the distance of the quantile from 1, so the
+// 0.5 quantile is within 5%, and the 0.99 quantile within 0.1%.
+func NewQuantiles(targets []float64) *Quantiles {
+	q := &Quantiles{targets: targets, now: time.Now}
+	q.streams[0] = newQuantileStream(targets)
+	q.streams[1] = newQuantileStream(targets)
+	q.rotated = q.now()
+	return q
+}
+
+// Targets returns the quantiles being estimated.
+func (q *Quantiles) Targets() []float64 {
+	return q.targets
+}
+
+// Insert adds a value to the stream.
+func (q *Quantiles) Insert(v float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rotate()
+	for _, s := range q.streams {
+		s.insert(v)
+	}
+	q.sum += v
+	q.count++
+}
+
+// rotate starts a new stream every half window, discarding the oldest, so
+// that the stream queried holds between a half and a whole window of values.
+func (q *Quantiles) rotate() {
+	for now := q.now(); now.Sub(q.rotated) >= QuantileWindow/2; q.rotated = q.rotated.Add(QuantileWindow / 2) {
+		q.streams[0], q.streams[1] = q.streams[1], newQuantileStream(q.targets)
+		if now.Sub(q.rotated) >= QuantileWindow {
+			// Idle for more than a window; skip the empty ones.
+			q.streams[0] = newQuantileStream(q.targets)
+			q.rotated = now.Add(-QuantileWindow / 2)
+		}
+	}
+}
+
+// Query returns the estimated value of the quantile, which should be one of
+// the targets, or NaN if there have been no values in the window.
+func (q *Quantiles) Query(quantile float64) float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rotate()
+	return q.streams[0].query(quantile)
+}
+
+// Sum returns the sum of all values inserted.
+func (q *Quantiles) Sum() float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.sum
+}
+
+// Count returns the number of values inserted.
+func (q *Quantiles) Count() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// compressInterval is the number of inserts between compressions of a stream.
+const compressInterval = 128
+
+type quantileSample struct {
+	value float64
+	width float64 // difference between the lowest rank of this sample and the previous
+	delta float64 // difference between the lowest and highest possible rank of this sample
+}
+
+type quantileStream struct {
+	targets []float64
+	samples []quantileSample // sorted by value
+	n       float64          // number of values inserted
+	inserts int              // since the last compression
+}
+
+func newQuantileStream(targets []float64) *quantileStream {
+	return &quantileStream{targets: targets}
+}
+
+// invariant returns the error allowed in the rank of a sample at rank r.
+// The errors from compressing the summary accumulate past the bound the
+// algorithm promises, so the invariant uses half the allowed error.
+func (s *quantileStream) invariant(r float64) float64 {
+	m := math.MaxFloat64
+	for _, q := range s.targets {
+		e := (1 - q) / 20
+		var f float64
+		if q*s.n <= r {
+			f = 2 * e * r / q
+		} else {
+			f = 2 * e * (s.n - r) / (1 - q)
+		}
+		if f < m {
+			m = f
+		}
+	}
+	return m
+}
+
+func (s *quantileStream) insert(v float64) {
+	i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].value > v })
+	var r float64
+	for _, c := range s.samples[:i] {
+		r += c.width
+	}
+	delta := 0.0
+	if i > 0 && i < len(s.samples) {
+		delta = math.Max(math.Floor(s.invariant(r))-1, 0)
+	}
+	s.samples = append(s.samples, quantileSample{})
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = quantileSample{v, 1, delta}
+	s.n++
+	if s.inserts++; s.inserts >= compressInterval {
+		s.compress()
+		s.inserts = 0
+	}
+}
+
+// compress merges adjacent samples whose combined rank error stays within
+// the invariant.
+func (s *quantileStream) compress() {
+	if len(s.samples) < 2 {
+		return
+	}
+	x := s.samples[len(s.samples)-1]
+	xi := len(s.samples) - 1
+	r := s.n - 1 - x.width
+	for i := len(s.samples) - 2; i >= 0; i-- {
+		c := s.samples[i]
+		if c.width+x.width+x.delta <= s.invariant(r) {
+			x.width += c.width
+			s.samples[xi] = x
+			s.samples = append(s.samples[:i], s.samples[i+1:]...)
+			xi--
+		} else {
+			x = c
+			xi = i
+		}
+		r -= c.width
+	}
+}
+
+func (s *quantileStream) query(q float64) float64 {
+	if len(s.samples) == 0 {
+		return math.NaN()
+	}
+	t := math.Ceil(q * s.n)
+	t += s.invariant(t) / 2
+	p := s.samples[0]
+	var r float64
+	for _, c := range s.samples[1:] {
+		r += p.width
+		if r+c.width+c.delta > t {
+			return p.value
+		}
+		p = c
+	}
+	return p.value
+}
+
+// WithQuantiles makes d estimate the given quantiles of the values it is
+// set to.
+func WithQuantiles(d Datum, targets []float64) {
+	switch d := d.(type) {
+	case *IntDatum:
+		d.Quantiles = NewQuantiles(targets)
+	case *FloatDatum:
+		d.Quantiles = NewQuantiles(targets)
+	}
+}
+
+// GetQuantiles returns the quantile estimates of the values d has been set
+// to, or nil if d is not estimating quantiles.
+func GetQuantiles(d Datum) *Quantiles {
+	switch d := d.(type) {
+	case *IntDatum:
+		return d.Quantiles
+	case *FloatDatum:
+		return d.Quantiles
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package datum
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestQuantilesEstimate(t *testing.T) {
+	targets := []float64{0.5, 0.9, 0.99}
+	q := NewQuantiles(targets)
+	const n = 100000
+	values := rand.New(rand.NewSource(1)).Perm(n)
+	for _, v := range values {
+		q.Insert(float64(v))
+	}
+	sort.Ints(values)
+	for _, target := range targets {
+		got := q.Query(target)
+		// The value is its own rank; the estimate must be within the error allowed for the target.
+		if err := math.Abs(got/n - target); err > (1-target)/10 {
+			t.Errorf("quantile %g: got %g, rank error %g", target, got, err)
+		}
+	}
+	if q.Count() != n {
+		t.Errorf("count %d", q.Count())
+	}
+	if q.Sum() != float64(n*(n-1)/2) {
+		t.Errorf("sum %g", q.Sum())
+	}
+	if len(q.streams[0].samples) > n/10 {
+		t.Errorf("summary kept %d samples", len(q.streams[0].samples))
+	}
+}
+
+func TestQuantilesWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := NewQuantiles([]float64{0.5})
+	q.now = func() time.Time { return now }
+	q.rotated = now
+	if v := q.Query(0.5); !math.IsNaN(v) {
+		t.Errorf("empty quantile %g", v)
+	}
+	q.Insert(1)
+	q.Insert(1)
+	q.Insert(1)
+	now = now.Add(QuantileWindow / 2)
+	q.Insert(2)
+	if v := q.Query(0.5); v != 1 {
+		t.Errorf("after half a window: %g", v)
+	}
+	now = now.Add(QuantileWindow / 2)
+	if v := q.Query(0.5); v != 2 {
+		t.Errorf("after a window: %g", v)
+	}
+	now = now.Add(3 * QuantileWindow)
+	if v := q.Query(0.5); !math.IsNaN(v) {
+		t.Errorf("after idle windows: %g", v)
+	}
+	if q.Count() != 4 || q.Sum() != 5 {
+		t.Errorf("count %d sum %g", q.Count(), q.Sum())
+	}
+}
+
+func TestSetWithQuantiles(t *testing.T) {
+	d := MakeFloat(0, time.Unix(0, 0))
+	if GetQuantiles(d) != nil {
+		t.Error("quantiles without WithQuantiles")
+	}
+	WithQuantiles(d, []float64{0.5})
+	SetFloat(d, 2.5, time.Unix(1, 0))
+	if q := GetQuantiles(d); q == nil || q.Count() != 1 || q.Query(0.5) != 2.5 {
+		t.Errorf("quantiles %v", q)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/google/mtail/metrics/datum"
+)
+
+// labelIndex finds the LabelValues of a Metric by their labels, without
+// comparing them to every other set, and keeps the labels of new sets
+// compactly.  The index is a hash table of positions in LabelValues, so it
+// costs a few bytes per set and no copy of the labels.  Labels taken from a
+// log line would keep the whole line in memory, so the labels of a new set
+// are copied: a label with few distinct values, like a method or status code,
+// is shared by the sets that have it, and the rest are copied together into
+// one string.  TestLabelValueMemory compares the heap used per set with the
+// layout before.
+type labelIndex struct {
+	slots []int32 // one more than a position in LabelValues, at the slot its labels hash to or the next free one; 0 if free
+	n     int     // the length of LabelValues when indexed
+
+	shared []map[string]string // the copies of the values of each label, while it has at most maxSharedLabels of them; nil after
+}
+
+// maxSharedLabels is the number of distinct values of a label whose copies are
+// shared by the sets that have them.  The values of a label with more, like a
+// path or an ID, are copied for each set.
+const maxSharedLabels = 64
+
+// minLabelSlots is the size of the smallest hash table of a labelIndex.
+const minLabelSlots = 8
+
+// newLabelIndex returns an index for the label value sets of a metric with
+// the given number of keys.
+func newLabelIndex(keys int) *labelIndex {
+	x := &labelIndex{shared: make([]map[string]string, keys)}
+	for i := range x.shared {
+		x.shared[i] = make(map[string]string)
+	}
+	return x
+}
+
+// rebuild indexes the label value sets lvs, in a hash table at most half full.
+func (x *labelIndex) rebuild(lvs []*LabelValue) {
+	size := minLabelSlots
+	for size < 2*len(lvs) {
+		size *= 2
+	}
+	x.slots = make([]int32, size)
+	x.n = 0
+	for i := range lvs {
+		x.insert(lvs, i)
+	}
+}
+
+// insert adds the set at position i of lvs, the label value sets being
+// indexed, to the hash table, growing it once it is three quarters full.
+func (x *labelIndex) insert(lvs []*LabelValue, i int) {
+	if 4*(x.n+1) > 3*len(x.slots) {
+		x.rebuild(lvs[:i+1])
+		return
+	}
+	mask := uint64(len(x.slots) - 1)
+	for s := hashLabels(lvs[i].Labels) & mask; ; s = (s + 1) & mask {
+		if x.slots[s] == 0 {
+			x.slots[s] = int32(i + 1)
+			x.n = i + 1
+			return
+		}
+	}
+}
+
+// find returns the position in lvs, the label value sets indexed, of the set
+// with the given labels, or -1 if there is none.
+func (x *labelIndex) find(lvs []*LabelValue, labels []string) int {
+	mask := uint64(len(x.slots) - 1)
+	for s := hashLabels(labels) & mask; ; s = (s + 1) & mask {
+		i := int(x.slots[s]) - 1
+		if i < 0 {
+			return -1
+		}
+		if i < len(lvs) && labelsEqual(lvs[i].Labels, labels) {
+			return i
+		}
+	}
+}
+
+// hashLabels returns the 64 bit FNV-1a hash of labels, each followed by a
+// byte that can't appear in UTF-8, so that the labels "a", "bc" and "ab",
+// "c" hash differently.
+func hashLabels(labels []string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for _, l := range labels {
+		for i := 0; i < len(l); i++ {
+			h ^= uint64(l[i])
+			h *= prime64
+		}
+		h ^= 0xff
+		h *= prime64
+	}
+	return h
+}
+
+// copyLabels returns a copy of labels that shares no memory with them.  The
+// values of a label with few distinct values are shared with the other sets
+// that have them; the rest are copied into one string.
+func (x *labelIndex) copyLabels(labels []string) []string {
+	if labels == nil {
+		return nil
+	}
+	r := make([]string, len(labels))
+	size := 0
+	for i, l := range labels {
+		if s, ok := x.share(i, l); ok {
+			r[i] = s
+		} else {
+			size += len(l)
+		}
+	}
+	if size == 0 {
+		return r
+	}
+	b := make([]byte, 0, size)
+	for i, l := range labels {
+		if r[i] == "" && l != "" {
+			b = append(b, l...)
+		}
+	}
+	s := string(b)
+	for i, l := range labels {
+		if r[i] == "" && l != "" {
+			r[i], s = s[:len(l)], s[len(l):]
+		}
+	}
+	return r
+}
+
+// share returns the shared copy of the value l of the label at position i, and
+// true, unless that label has more than maxSharedLabels values.
+func (x *labelIndex) share(i int, l string) (string, bool) {
+	if i >= len(x.shared) || x.shared[i] == nil {
+		return "", false
+	}
+	if s, ok := x.shared[i][l]; ok {
+		return s, true
+	}
+	if len(x.shared[i]) == maxSharedLabels {
+		// Stop sharing; the copies already made are kept by their sets.
+		x.shared[i] = nil
+		return "", false
+	}
+	s := string(append([]byte(nil), l...))
+	x.shared[i][s] = s
+	return s, true
+}
+
+// labelIndex returns the index of the LabelValues of m, building it if it
+// doesn't exist, sets have been removed, or LabelValues has changed length
+// since it was built.  The metric lock is held before entering this function.
+func (m *Metric) labelIndex() *labelIndex {
+	if m.index == nil {
+		m.index = newLabelIndex(len(m.Keys))
+	}
+	if m.index.slots == nil || m.index.n != len(m.LabelValues) {
+		m.index.rebuild(m.LabelValues)
+	}
+	return m.index
+}
+
+// findLabelValue returns the position in LabelValues of the set with the
+// given labels, or -1 if there is none.  The metric lock is held before
+// entering this function.
+func (m *Metric) findLabelValue(labelvalues []string) int {
+	return m.labelIndex().find(m.LabelValues, labelvalues)
+}
+
+func labelsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addLabelValue adds a new set with a copy of the given labels and a zero
+// datum to LabelValues, and returns the datum.  The metric lock is held
+// before entering this function.
+func (m *Metric) addLabelValue(labelvalues []string) datum.Datum {
+	var lv *LabelValue
+	switch m.Type {
+	case datum.Int:
+		c := &intLabelValue{}
+		c.cell.Set(0, time.Time{})
+		c.Value = &c.cell
+		lv = &c.LabelValue
+	case datum.Float:
+		c := &floatLabelValue{}
+		c.cell.Set(0, time.Time{})
+		c.Value = &c.cell
+		lv = &c.LabelValue
+	default:
+		lv = &LabelValue{Value: datum.NewString()}
+	}
+	x := m.labelIndex()
+	lv.Labels = x.copyLabels(labelvalues)
+	m.LabelValues = append(m.LabelValues, lv)
+	x.insert(m.LabelValues, len(m.LabelValues)-1)
+	return lv.Value
+}
+
+// intLabelValue is a LabelValue allocated together with its Int datum, so
+// that each set of an Int metric is one allocation.
+type intLabelValue struct {
+	LabelValue
+	cell datum.IntDatum
+}
+
+// floatLabelValue is a LabelValue allocated together with its Float datum.
+type floatLabelValue struct {
+	LabelValue
+	cell datum.FloatDatum
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestLabelIndex(t *testing.T) {
+	m := NewMetric("requests", "prog", Counter, Int, "method", "code", "path")
+	line := "GET 200 /index.html"
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/%d", i%100)
+		d, err := m.GetDatum([]string{"GET", "POST"}[i%2], []string{"200", "404", "500"}[i%3], path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datum.IncIntBy(d, 1, time.Unix(int64(i), 0))
+	}
+	// A set with labels sliced from a log line, as the programs make.
+	if _, err := m.GetDatum(line[:3], line[4:7], line[8:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(m.LabelValues); got != 301 {
+		t.Errorf("%d label value sets, want 301", got)
+	}
+	// The labels of the methods and codes are shared between sets, and none
+	// keep the log line.
+	if a, b := m.LabelValues[0].Labels[0], m.LabelValues[2].Labels[0]; !sameString(a, b) {
+		t.Errorf("method labels of sets 0 and 2 aren't shared")
+	}
+	if l := m.LabelValues[300].Labels[2]; l != "/index.html" || sameString(l, line[8:]) {
+		t.Errorf("path label %q keeps the log line", l)
+	}
+	var total int64
+	for _, lv := range m.LabelValues {
+		total += datum.GetInt(lv.Value)
+	}
+	if total != 1000 {
+		t.Errorf("total %d, want 1000", total)
+	}
+
+	lv := m.findLabelValueOrNil([]string{"POST", "404", "/1"})
+	if lv == nil || datum.GetInt(lv.Value) != 4 {
+		t.Errorf("POST 404 /1: got %v", lv)
+	}
+	if lv := m.findLabelValueOrNil([]string{"PUT", "404", "/1"}); lv != nil {
+		t.Errorf("found %v for labels never set", lv)
+	}
+
+	// Removing a set drops it from the index.
+	if err := m.RemoveDatum("GET", "200", "/index.html"); err != nil {
+		t.Fatal(err)
+	}
+	if lv := m.findLabelValueOrNil([]string{"GET", "200", "/index.html"}); lv != nil {
+		t.Errorf("found removed set %v", lv)
+	}
+	if lv := m.findLabelValueOrNil([]string{"GET", "200", "/0"}); lv == nil {
+		t.Error("couldn't find GET 200 /0 after removal")
+	}
+
+	// Sets added to LabelValues directly are found.
+	m.LabelValues = append(m.LabelValues, &LabelValue{Labels: []string{"PUT", "201", "/new"}, Value: datum.MakeInt(7, time.Unix(0, 0))})
+	if lv := m.findLabelValueOrNil([]string{"PUT", "201", "/new"}); lv == nil || datum.GetInt(lv.Value) != 7 {
+		t.Errorf("PUT 201 /new: got %v", lv)
+	}
+}
+
+func BenchmarkGetDatum(b *testing.B) {
+	for _, sets := range []int{10, 100000} {
+		b.Run(fmt.Sprintf("%d sets", sets), func(b *testing.B) {
+			m := NewMetric("requests", "prog", Counter, Int, "method", "code", "path")
+			labels := make([][]string, sets)
+			for i := range labels {
+				labels[i] = []string{[]string{"GET", "POST"}[i%2], []string{"200", "404", "500"}[i%3], fmt.Sprintf("/%d", i)}
+				if _, err := m.GetDatum(labels[i]...); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d, err := m.GetDatum(labels[i%sets]...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				datum.IncIntBy(d, 1, time.Time{})
+			}
+		})
+	}
+}
+
+// sameString returns true if a and b are the same bytes in memory.
+func sameString(a, b string) bool {
+	return (*reflect.StringHeader)(unsafe.Pointer(&a)).Data == (*reflect.StringHeader)(unsafe.Pointer(&b)).Data && len(a) == len(b)
+}
+
+// labelSets returns n distinct label sets for a metric with the keys method,
+// code and path.  If fromLines is true, the labels are sliced from log lines,
+// as the programs make them; otherwise each is allocated on its own.
+func labelSets(n int, fromLines bool) [][]string {
+	sets := make([][]string, n)
+	for i := range sets {
+		method, code := []string{"GET", "POST"}[i%2], []string{"200", "404", "500"}[i%3]
+		if fromLines {
+			line := fmt.Sprintf("%s - - [10/Oct/2018:13:55:36 +0000] \"%s /static/%d HTTP/1.1\" %s 2326", "127.0.0.1", method, i, code)
+			f := strings.Fields(line)
+			sets[i] = []string{f[5][1:], f[8], f[6]}
+		} else {
+			sets[i] = []string{string([]byte(method)), string([]byte(code)), fmt.Sprintf("/static/%d", i)}
+		}
+	}
+	return sets
+}
+
+// heapPerSet returns the heap kept in use by add, per set added, with n sets
+// made by labelSets.  The labels count only while add keeps them.
+func heapPerSet(n int, fromLines bool, add func([][]string) interface{}) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	kept := add(labelSets(n, fromLines))
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(kept)
+	if after.HeapAlloc < before.HeapAlloc {
+		return 0
+	}
+	return (after.HeapAlloc - before.HeapAlloc) / uint64(n)
+}
+
+// addSets adds sets to a new metric, and returns the metric.
+func addSets(sets [][]string) interface{} {
+	m := NewMetric("requests", "prog", Counter, Int, "method", "code", "path")
+	for _, labels := range sets {
+		if _, err := m.GetDatum(labels...); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// addSetsOldLayout adds sets as LabelValues were kept before they were
+// indexed: the labels as given, and the datum allocated on its own.
+func addSetsOldLayout(sets [][]string) interface{} {
+	var lvs []*LabelValue
+	for _, labels := range sets {
+		lvs = append(lvs, &LabelValue{Labels: labels, Value: datum.NewInt()})
+	}
+	return lvs
+}
+
+// TestLabelValueMemory checks that a metric with an index keeps no more heap
+// per label value set than LabelValues did without one.
+func TestLabelValueMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping heap measurement in short mode")
+	}
+	for _, fromLines := range []bool{true, false} {
+		old := heapPerSet(50000, fromLines, addSetsOldLayout)
+		got := heapPerSet(50000, fromLines, addSets)
+		t.Logf("labels from log lines %v: %d bytes per set, %d before the index", fromLines, got, old)
+		if got > old {
+			t.Errorf("labels from log lines %v: %d bytes per set, more than %d before the index", fromLines, got, old)
+		}
+	}
+}
+
+// BenchmarkAddLabelValues measures the allocations made adding label value
+// sets, sliced from log lines, to a metric.
+func BenchmarkAddLabelValues(b *testing.B) {
+	sets := labelSets(100000, true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		addSets(sets)
+	}
+}
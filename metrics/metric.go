@@ -7,10 +7,12 @@ package metrics
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/google/mtail/metrics/datum"
 	"github.com/pkg/errors"
 )
@@ -65,6 +67,9 @@ func (m Kind) String() string {
 type LabelValue struct {
 	Labels []string `json:",omitempty"`
 	Value  datum.Datum
+	// Expiry is how long the Value may go without an update before it is
+	// removed from the Metric by Store.Gc, or zero if it never expires.
+	Expiry time.Duration `json:",omitempty"`
 }
 
 func (lv *LabelValue) String() string {
@@ -85,8 +90,45 @@ type Metric struct {
 	Keys        []string      `json:",omitempty"`
 	LabelValues []*LabelValue `json:",omitempty"`
 	Source      string        `json:"-"`
+	Limit       int           `json:"-"` // Maximum number of label value sets, or 0 for no limit.
+	Quantiles   []float64     `json:"-"` // Quantiles of the values of a Timer to estimate, if any.
+	// Window, if nonzero, is the length of the time windows the values of the
+	// Metric are kept per, under its last key, WindowKey.
+	Window time.Duration `json:",omitempty"`
+	// WindowKeep is how long before the latest window older windows are
+	// kept, or zero to keep them all.
+	WindowKeep time.Duration `json:"-"`
+	// Refresh, if nonzero, is how long a value may go without being updated
+	// before its timestamp is set to the current time, so that it is exported
+	// as current during quiet periods.
+	Refresh time.Duration `json:"-"`
+	// Description says what the Metric measures, and Unit is the unit of its
+	// values, for the people reading the exported metrics.
+	Description string `json:",omitempty"`
+	Unit        string `json:",omitempty"`
+
+	index *labelIndex // finds LabelValues by their labels; built when first needed
+}
+
+// WindowKey is the key of the time window label of a windowed Metric.
+const WindowKey = "window"
+
+// WindowStart returns the label value of the time window of the Metric that
+// contains ts, the start of the window in RFC 3339 format.
+func (m *Metric) WindowStart(ts time.Time) string {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return ts.Truncate(m.Window).UTC().Format(time.RFC3339)
 }
 
+// OverflowLabel is the label value used for all label values of a Metric
+// that would exceed its Limit.
+const OverflowLabel = "_overflow_"
+
+// labelOverflows counts the label values folded into the overflow bucket, per metric.
+var labelOverflows = expvar.NewMap("metric_label_overflows_total")
+
 // NewMetric returns a new empty metric of dimension len(keys).
 func NewMetric(name string, prog string, kind Kind, typ datum.Type, keys ...string) *Metric {
 	m := newMetric(len(keys))
@@ -98,6 +140,33 @@ func NewMetric(name string, prog string, kind Kind, typ datum.Type, keys ...stri
 	return m
 }
 
+// copy returns a copy of the Metric, with copies of its datums.
+func (m *Metric) copy() *Metric {
+	m.RLock()
+	defer m.RUnlock()
+	c := &Metric{
+		Name:        m.Name,
+		Program:     m.Program,
+		Kind:        m.Kind,
+		Type:        m.Type,
+		Hidden:      m.Hidden,
+		Keys:        m.Keys,
+		LabelValues: make([]*LabelValue, 0, len(m.LabelValues)),
+		Source:      m.Source,
+		Limit:       m.Limit,
+		Quantiles:   m.Quantiles,
+		Window:      m.Window,
+		WindowKeep:  m.WindowKeep,
+		Refresh:     m.Refresh,
+		Description: m.Description,
+		Unit:        m.Unit,
+	}
+	for _, lv := range m.LabelValues {
+		c.LabelValues = append(c.LabelValues, &LabelValue{Labels: lv.Labels, Value: datum.Copy(lv.Value), Expiry: lv.Expiry})
+	}
+	return c
+}
+
 // newMetric returns a new empty Metric
 func newMetric(len int) *Metric {
 	return &Metric{Keys: make([]string, len),
@@ -105,13 +174,7 @@ func newMetric(len int) *Metric {
 }
 
 func (m *Metric) findLabelValueOrNil(labelvalues []string) *LabelValue {
-Loop:
-	for i, lv := range m.LabelValues {
-		for j := 0; j < len(lv.Labels); j++ {
-			if lv.Labels[j] != labelvalues[j] {
-				continue Loop
-			}
-		}
+	if i := m.findLabelValue(labelvalues); i >= 0 {
 		return m.LabelValues[i]
 	}
 	return nil
@@ -128,17 +191,90 @@ func (m *Metric) GetDatum(labelvalues ...string) (d datum.Datum, err error) {
 	if lv := m.findLabelValueOrNil(labelvalues); lv != nil {
 		d = lv.Value
 	} else {
+		if m.Limit > 0 && len(m.LabelValues) >= m.Limit {
+			// Fold new label values into the overflow bucket, to bound the
+			// memory used by a metric keyed on unbounded log content.
+			labelOverflows.Add(m.Name, 1)
+			overflow := make([]string, len(labelvalues))
+			for i := range overflow {
+				overflow[i] = OverflowLabel
+			}
+			if lv := m.findLabelValueOrNil(overflow); lv != nil {
+				return lv.Value, nil
+			}
+			labelvalues = overflow
+		}
+		d = m.addLabelValue(labelvalues)
+		if m.Kind == Timer && len(m.Quantiles) > 0 {
+			datum.WithQuantiles(d, m.Quantiles)
+		}
+		if m.Window > 0 && m.WindowKeep > 0 {
+			m.expireWindows()
+		}
+	}
+	return d, nil
+}
+
+// expireWindows removes the values of the time windows that started
+// WindowKeep or more before the latest, so that WindowKeep/Window windows are
+// kept.  The metric lock is held before entering
+// this function.
+func (m *Metric) expireWindows() {
+	last := len(m.Keys) - 1
+	var latest time.Time
+	starts := make([]time.Time, len(m.LabelValues))
+	for i, lv := range m.LabelValues {
+		// The overflow bucket has no window, and is kept.
+		if t, err := time.Parse(time.RFC3339, lv.Labels[last]); err == nil {
+			starts[i] = t
+			if t.After(latest) {
+				latest = t
+			}
+		}
+	}
+	lvs := m.LabelValues[:0]
+	for i, lv := range m.LabelValues {
+		if !starts[i].IsZero() && latest.Sub(starts[i]) >= m.WindowKeep {
+			glog.V(2).Infof("expiring window %s%v", m.Name, lv.Labels)
+			continue
+		}
+		lvs = append(lvs, lv)
+	}
+	m.removed(lvs)
+}
+
+// removed sets LabelValues to lvs, a prefix of it that has had label value
+// sets removed, and drops the hash table of the index if any were, so that it
+// is rebuilt without them.  The metric lock is held before entering this
+// function.
+func (m *Metric) removed(lvs []*LabelValue) {
+	if len(lvs) == len(m.LabelValues) {
+		return
+	}
+	for i := len(lvs); i < len(m.LabelValues); i++ {
+		m.LabelValues[i] = nil
+	}
+	m.LabelValues = lvs
+	if m.index != nil {
+		m.index.slots = nil
+	}
+}
+
+// Reset sets every value of the Metric to zero, or the empty string, at the
+// given time, keeping its label values.
+func (m *Metric) Reset(ts time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	for _, lv := range m.LabelValues {
 		switch m.Type {
 		case datum.Int:
-			d = datum.NewInt()
+			datum.SetInt(lv.Value, 0, ts)
 		case datum.Float:
-			d = datum.NewFloat()
+			datum.SetFloat(lv.Value, 0, ts)
 		case datum.String:
-			d = datum.NewString()
+			datum.SetString(lv.Value, "", ts)
 		}
-		m.LabelValues = append(m.LabelValues, &LabelValue{labelvalues, d})
 	}
-	return d, nil
 }
 
 // RemoveDatum removes the Datum described by labelvalues from the Metric m.
@@ -148,19 +284,55 @@ func (m *Metric) RemoveDatum(labelvalues ...string) error {
 	}
 	m.Lock()
 	defer m.Unlock()
-Loop:
-	for i, lv := range m.LabelValues {
-		for j := 0; j < len(lv.Labels); j++ {
-			if lv.Labels[j] != labelvalues[j] {
-				continue Loop
-			}
-		}
-		// remove from the slice
-		m.LabelValues = append(m.LabelValues[:i], m.LabelValues[i+1:]...)
+	if i := m.findLabelValue(labelvalues); i >= 0 {
+		m.removed(append(m.LabelValues[:i], m.LabelValues[i+1:]...))
 	}
 	return nil
 }
 
+// ExpireDatum sets the Datum described by labelvalues to be removed from the
+// Metric m once it has not been updated for the expiry duration.
+func (m *Metric) ExpireDatum(expiry time.Duration, labelvalues ...string) error {
+	if len(labelvalues) != len(m.Keys) {
+		return errors.Errorf("Label values requested (%q) not same length as keys for metric %q", labelvalues, m)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if lv := m.findLabelValueOrNil(labelvalues); lv != nil {
+		lv.Expiry = expiry
+	}
+	return nil
+}
+
+// expire removes from the Metric m each Datum that has an expiry and has not
+// been updated for that long at the time now.
+func (m *Metric) expire(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	lvs := m.LabelValues[:0]
+	for _, lv := range m.LabelValues {
+		if lv.Expiry > 0 && now.Sub(lv.Value.TimeUTC()) > lv.Expiry {
+			glog.V(2).Infof("expiring %s%v", m.Name, lv.Labels)
+			continue
+		}
+		lvs = append(lvs, lv)
+	}
+	m.removed(lvs)
+}
+
+// refresh sets the timestamp of each Datum of the Metric m that has not been
+// updated for its refresh interval to the time now.  Datums set to expire are
+// left alone, so that they still expire.
+func (m *Metric) refresh(now time.Time) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, lv := range m.LabelValues {
+		if lv.Expiry == 0 && now.Sub(lv.Value.TimeUTC()) >= m.Refresh {
+			datum.Stamp(lv.Value, now)
+		}
+	}
+}
+
 // LabelSet is an object that maps the keys of a Metric to the labels naming a
 // Datum, for use when enumerating Datums from a Metric.
 type LabelSet struct {
@@ -196,7 +196,7 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 			return false
 		}
 
-		if diff := cmp.Diff(m, r, cmpopts.IgnoreUnexported(sync.RWMutex{})); diff != "" {
+		if diff := cmp.Diff(m, r, cmpopts.IgnoreUnexported(sync.RWMutex{}, Metric{}, datum.BaseDatum{})); diff != "" {
 			t.Errorf("Round trip wasn't stable:\n%s", diff)
 			return false
 		}
@@ -214,7 +214,7 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 func TestTimer(t *testing.T) {
 	m := NewMetric("test", "prog", Timer, Int)
 	n := NewMetric("test", "prog", Timer, Int)
-	diff := cmp.Diff(m, n, cmpopts.IgnoreUnexported(sync.RWMutex{}))
+	diff := cmp.Diff(m, n, cmpopts.IgnoreUnexported(sync.RWMutex{}, Metric{}, datum.BaseDatum{}))
 	if diff != "" {
 		t.Errorf("Identical metrics not the same:\n%s", diff)
 	}
@@ -252,3 +252,132 @@ func TestRemoveMetricLabelValue(t *testing.T) {
 		t.Errorf("label value still exists")
 	}
 }
+
+func TestLabelValueLimit(t *testing.T) {
+	m := NewMetric("foo", "prog", Counter, Int, "a", "b")
+	m.Limit = 2
+	for _, l := range [][]string{{"1", "1"}, {"2", "2"}, {"3", "3"}, {"4", "4"}, {"1", "1"}} {
+		d, err := m.GetDatum(l...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datum.IncIntBy(d, 1, time.Unix(0, 0))
+	}
+	var labels [][]string
+	var values []int64
+	for _, lv := range m.LabelValues {
+		labels = append(labels, lv.Labels)
+		values = append(values, datum.GetInt(lv.Value))
+	}
+	expected := [][]string{{"1", "1"}, {"2", "2"}, {OverflowLabel, OverflowLabel}}
+	if diff := cmp.Diff(expected, labels); diff != "" {
+		t.Errorf("labels: %s", diff)
+	}
+	if diff := cmp.Diff([]int64{2, 1, 2}, values); diff != "" {
+		t.Errorf("values: %s", diff)
+	}
+}
+
+func TestResetMetric(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, Int, "a")
+	for _, l := range []string{"x", "y"} {
+		d, err := m.GetDatum(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datum.SetInt(d, 7, time.Unix(1, 0))
+	}
+	m.Reset(time.Unix(2, 0))
+	if len(m.LabelValues) != 2 {
+		t.Fatalf("label values removed: %v", m.LabelValues)
+	}
+	for _, lv := range m.LabelValues {
+		if v := datum.GetInt(lv.Value); v != 0 {
+			t.Errorf("%v not reset: %d", lv.Labels, v)
+		}
+		if ts := lv.Value.TimeString(); ts != "2" {
+			t.Errorf("%v reset at %s", lv.Labels, ts)
+		}
+	}
+}
+
+func TestExpireMetricLabelValue(t *testing.T) {
+	m := NewMetric("test", "prog", Gauge, Int, "a")
+	for _, l := range []string{"x", "y", "z"} {
+		d, err := m.GetDatum(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datum.SetInt(d, 1, time.Unix(100, 0))
+	}
+	if err := m.ExpireDatum(time.Minute, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ExpireDatum(time.Hour, "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ExpireDatum(time.Minute, "x", "extra"); err == nil {
+		t.Error("expire with wrong number of labels succeeded")
+	}
+	m.expire(time.Unix(100, 0).Add(time.Minute))
+	if len(m.LabelValues) != 3 {
+		t.Errorf("label values expired early: %v", m.LabelValues)
+	}
+	m.expire(time.Unix(100, 0).Add(2 * time.Minute))
+	if m.findLabelValueOrNil([]string{"x"}) != nil || m.findLabelValueOrNil([]string{"y"}) == nil || m.findLabelValueOrNil([]string{"z"}) == nil {
+		t.Errorf("wrong label values expired: %v", m.LabelValues)
+	}
+}
+
+func TestRefreshMetric(t *testing.T) {
+	m := NewMetric("test", "prog", Gauge, Int, "a")
+	m.Refresh = time.Minute
+	start := time.Unix(100, 0)
+	for _, l := range []string{"x", "y", "z"} {
+		d, err := m.GetDatum(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datum.SetInt(d, 1, start)
+	}
+	d, _ := m.GetDatum("y")
+	datum.SetInt(d, 2, start.Add(30*time.Second))
+	if err := m.ExpireDatum(time.Hour, "z"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.refresh(start.Add(59 * time.Second))
+	for _, l := range []string{"x", "y", "z"} {
+		if d, _ := m.GetDatum(l); d.TimeUTC().After(start.Add(30 * time.Second)) {
+			t.Errorf("%s refreshed early, at %s", l, d.TimeUTC())
+		}
+	}
+
+	now := start.Add(time.Minute)
+	m.refresh(now)
+	for l, want := range map[string]time.Time{"x": now, "y": start.Add(30 * time.Second), "z": start} {
+		d, _ := m.GetDatum(l)
+		if !d.TimeUTC().Equal(want) {
+			t.Errorf("%s stamped at %s, want %s", l, d.TimeUTC(), want)
+		}
+	}
+	if d, _ := m.GetDatum("x"); datum.GetInt(d) != 1 {
+		t.Errorf("refresh changed value to %d", datum.GetInt(d))
+	}
+}
+
+func TestWindowedMetric(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, Int, "code", WindowKey)
+	m.Window, m.WindowKeep = time.Minute, 2*time.Minute
+	if got, want := m.WindowStart(time.Unix(90, 0)), "1970-01-01T00:01:00Z"; got != want {
+		t.Errorf("WindowStart() = %q, want %q", got, want)
+	}
+	for _, ts := range []int64{0, 60, 120} {
+		if _, err := m.GetDatum("200", m.WindowStart(time.Unix(ts, 0))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.LabelValues) != 2 || m.findLabelValueOrNil([]string{"200", "1970-01-01T00:00:00Z"}) != nil {
+		t.Errorf("old window not expired: %v", m.LabelValues)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -16,6 +17,31 @@ import (
 type Store struct {
 	sync.RWMutex
 	Metrics map[string][]*Metric
+
+	// updateMu is held for reading by each program while it processes a log
+	// line, and for writing while a snapshot is taken, so that a snapshot
+	// has either all or none of the updates made by a program for a line.
+	updateMu sync.RWMutex
+
+	// hidden holds the hidden metrics of each program, which are not
+	// exported, but whose datums Gc still expires.
+	hidden map[string][]*Metric
+
+	now func() time.Time // if set, replaces time.Now for Gc and Refresh
+}
+
+// SetClock makes the Store use now instead of time.Now to find the current
+// time when it expires and refreshes datums, so that tests can control it.
+func (s *Store) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+// clock returns the current time.
+func (s *Store) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
 }
 
 // NewStore returns a new metric Store.
@@ -66,7 +92,7 @@ func (s *Store) Add(m *Metric) error {
 				d, err := v.GetDatum(oldLabel.Labels...)
 				if err == nil {
 					if err = m.RemoveDatum(oldLabel.Labels...); err == nil {
-						m.LabelValues = append(m.LabelValues, &LabelValue{oldLabel.Labels, d})
+						m.LabelValues = append(m.LabelValues, &LabelValue{Labels: oldLabel.Labels, Value: d, Expiry: oldLabel.Expiry})
 					}
 				}
 			}
@@ -80,11 +106,135 @@ func (s *Store) Add(m *Metric) error {
 	return nil
 }
 
+// SetHidden records the hidden metrics of the program named program, so that
+// Gc expires their datums.  It replaces any recorded before; pass nil when
+// the program is unloaded.
+func (s *Store) SetHidden(program string, ms []*Metric) {
+	s.Lock()
+	defer s.Unlock()
+	if len(ms) == 0 {
+		delete(s.hidden, program)
+		return
+	}
+	if s.hidden == nil {
+		s.hidden = make(map[string][]*Metric)
+	}
+	s.hidden[program] = ms
+}
+
+// ExportingPrograms returns the names of the programs other than program
+// that have added a metric with the given name to the Store.
+func (s *Store) ExportingPrograms(name, program string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	var progs []string
+	for _, m := range s.Metrics[name] {
+		if m.Program != program {
+			progs = append(progs, m.Program)
+		}
+	}
+	return progs
+}
+
+// Gc removes the expired datums from every metric in the Store, and from the
+// hidden metrics of each program.
+func (s *Store) Gc() {
+	s.RLock()
+	defer s.RUnlock()
+	now := s.clock()
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			m.expire(now)
+		}
+	}
+	for _, ml := range s.hidden {
+		for _, m := range ml {
+			m.expire(now)
+		}
+	}
+}
+
+// StartGcLoop runs Gc every interval, until the done channel is closed.
+func (s *Store) StartGcLoop(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Gc()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Refresh stamps the datums of every metric in the Store that has a refresh
+// interval, and that have not been updated for that long, with the current
+// time.
+func (s *Store) Refresh() {
+	s.RLock()
+	defer s.RUnlock()
+	now := s.clock()
+	for _, ml := range s.Metrics {
+		for _, m := range ml {
+			if m.Refresh > 0 {
+				m.refresh(now)
+			}
+		}
+	}
+}
+
+// StartRefreshLoop runs Refresh every interval, until the done channel is
+// closed.
+func (s *Store) StartRefreshLoop(interval time.Duration, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Refresh()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// UpdateLocker returns the lock a program holds while it updates metrics for
+// a single log line.  Many programs may hold it at once.
+func (s *Store) UpdateLocker() sync.Locker {
+	return s.updateMu.RLocker()
+}
+
+// Snapshot returns a copy of the Store, and of every metric in it, taken
+// between the log lines processed by the programs.  Exports read a snapshot
+// so that metrics updated together, such as the sum and count of a latency,
+// agree with each other.
+func (s *Store) Snapshot() *Store {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	s.RLock()
+	defer s.RUnlock()
+	c := &Store{Metrics: make(map[string][]*Metric, len(s.Metrics))}
+	for name, ml := range s.Metrics {
+		cl := make([]*Metric, 0, len(ml))
+		for _, m := range ml {
+			cl = append(cl, m.copy())
+		}
+		c.Metrics[name] = cl
+	}
+	return c
+}
+
 // ClearMetrics empties the store of all metrics.
 func (s *Store) ClearMetrics() {
 	s.Lock()
 	defer s.Unlock()
 	s.Metrics = make(map[string][]*Metric)
+	s.hidden = make(map[string][]*Metric)
 }
 
 // MarshalJSON returns a JSON byte string representing the Store.
@@ -3,7 +3,12 @@
 
 package metrics
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics/datum"
+)
 
 func TestMatchingKind(t *testing.T) {
 	s := NewStore()
@@ -88,3 +93,48 @@ func TestAddMetricDifferentType(t *testing.T) {
 		t.Fatalf("should have %d metrics of different Type: %s", expected, s.Metrics)
 	}
 }
+
+func TestSnapshot(t *testing.T) {
+	s := NewStore()
+	sum := NewMetric("latency_sum", "prog", Counter, datum.Int)
+	count := NewMetric("latency_count", "prog", Counter, datum.Int)
+	for _, m := range []*Metric{sum, count} {
+		if err := s.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sumDatum, _ := sum.GetDatum()
+	countDatum, _ := count.GetDatum()
+
+	// A program is part way through a line.
+	update := s.UpdateLocker()
+	update.Lock()
+	datum.IncIntBy(sumDatum, 250, time.Unix(1, 0))
+	snapshots := make(chan *Store)
+	go func() {
+		snapshots <- s.Snapshot()
+	}()
+	select {
+	case <-snapshots:
+		t.Fatal("snapshot taken during an update")
+	case <-time.After(10 * time.Millisecond):
+	}
+	datum.IncIntBy(countDatum, 1, time.Unix(1, 0))
+	update.Unlock()
+	snap := <-snapshots
+
+	// Later updates don't change the snapshot.
+	datum.IncIntBy(sumDatum, 100, time.Unix(2, 0))
+	for name, expected := range map[string]int64{"latency_sum": 250, "latency_count": 1} {
+		d, err := snap.Metrics[name][0].GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := datum.GetInt(d); v != expected {
+			t.Errorf("%s = %d, want %d", name, v, expected)
+		}
+	}
+	if snap.Metrics["latency_sum"][0] == sum {
+		t.Error("snapshot shares a metric with the store")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/tailer"
+)
+
+// requireAdmin wraps a handler so that it is only served to requests
+// presenting the configured admin token as a bearer token, or for forms
+// posted from the status page, in the token field.  If no admin token is
+// configured then the admin API is disabled.
+func (m *MtailServer) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.adminToken == "" {
+			http.Error(w, "admin API disabled; start mtail with -admin_token to enable", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" && r.Method == "POST" {
+			token = r.PostFormValue("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(m.adminToken)) != 1 {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// logsRequest is the body of a request to the /logs admin endpoint.
+type logsRequest struct {
+	Path string `json:"path"`
+}
+
+// handleLogs lists, adds, and removes the log path patterns being tailed.
+// GET returns the current list of patterns, POST starts tailing the pattern
+// in the request body, and DELETE stops tailing it.
+func (m *MtailServer) handleLogs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "DELETE":
+		var req logsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Path == "" {
+			http.Error(w, "no path given", http.StatusBadRequest)
+			return
+		}
+		if r.Method == "POST" {
+			glog.Infof("Admin request to tail %q", req.Path)
+			added := !m.t.HasPattern(req.Path)
+			// Files that don't exist yet are picked up when they're created,
+			// as at startup.
+			if err := m.t.TailPattern(req.Path); err != nil && !tailer.IsNoMatches(err) {
+				// Don't leave a half-registered pattern behind, but keep one
+				// that was already being tailed before this request.
+				if added {
+					if uerr := m.t.UntailPattern(req.Path); uerr != nil {
+						glog.Info(uerr)
+					}
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			glog.Infof("Admin request to stop tailing %q", req.Path)
+			if err := m.t.UntailPattern(req.Path); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		}
+	default:
+		w.Header().Add("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.t.Patterns()); err != nil {
+		glog.Info(err)
+	}
+}
+
+// resetRequest is the body of a request to the /reset admin endpoint.  If
+// Program is empty, the metric is reset in every program that exports it.
+type resetRequest struct {
+	Name    string `json:"name"`
+	Program string `json:"program"`
+}
+
+// handleReset sets every value of the metric named in the request body back
+// to zero.  The label values of the metric are kept.
+func (m *MtailServer) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req resetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "no metric name given", http.StatusBadRequest)
+		return
+	}
+	m.store.RLock()
+	var reset []string
+	now := time.Now()
+	for _, metric := range m.store.Metrics[req.Name] {
+		if req.Program != "" && metric.Program != req.Program {
+			continue
+		}
+		metric.Reset(now)
+		reset = append(reset, metric.Program)
+	}
+	m.store.RUnlock()
+	if len(reset) == 0 {
+		http.Error(w, "no such metric", http.StatusNotFound)
+		return
+	}
+	glog.Infof("Admin request reset metric %q in programs %q", req.Name, reset)
+	w.Header().Set("Content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(reset); err != nil {
+		glog.Info(err)
+	}
+}
+
+// maxDryRunProgramSize is the largest program accepted by /dryrun.
+const maxDryRunProgramSize = 1 << 20
+
+// handleDryRun compiles the program in the request body and runs it against
+// the most recent log lines, without loading it or adding its metrics to the
+// store.  The name parameter gives the program a name, and the lines
+// parameter limits how many recent lines it is run against.  The response
+// reports compile errors, how many lines matched, and the metrics the
+// program would have exported.
+func (m *MtailServer) handleDryRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = "dryrun.mtail"
+	}
+	var n int
+	if s := r.FormValue("lines"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, "invalid lines: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	glog.Infof("Admin request to dry run %q", name)
+	result := m.l.DryRun(name, http.MaxBytesReader(w, r.Body, maxDryRunProgramSize), n)
+	w.Header().Set("Content-type", "application/json")
+	if result.CompileErrors != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Info(err)
+	}
+}
+
+// handleLinez shows the most recent log lines from each source, for seeing
+// what the lines look like without logging in to the host.  The source
+// parameter is a glob pattern selecting the sources, the match parameter is a
+// regular expression selecting the lines, and the n parameter limits the
+// number of lines shown from each source.
+func (m *MtailServer) handleLinez(w http.ResponseWriter, r *http.Request) {
+	var re *regexp.Regexp
+	if s := r.FormValue("match"); s != "" {
+		var err error
+		if re, err = regexp.Compile(s); err != nil {
+			http.Error(w, "invalid match: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var n int
+	if s := r.FormValue("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, "invalid n: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	lines, err := m.l.RecentLines(r.FormValue("source"), re, n)
+	if err != nil {
+		http.Error(w, "invalid source: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sources := make([]string, 0, len(lines))
+	for source := range lines {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	w.Header().Set("Content-type", "text/plain; charset=utf-8")
+	for _, source := range sources {
+		fmt.Fprintf(w, "==> %s <==\n", source)
+		for _, line := range lines[source] {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// programsRequest is the body of a request to the /programs admin endpoint.
+type programsRequest struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+}
+
+// handlePrograms lists the loaded programs and whether each is paused, and
+// pauses and resumes them.  GET returns the list, and POST pauses or resumes
+// the program named in the request body.  A paused program keeps its
+// metrics, but isn't sent log lines.  The pause and resume buttons on the
+// status page post a form, and are redirected back to the status page.
+func (m *MtailServer) handlePrograms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req programsRequest
+		form := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+		if form {
+			req.Name = r.PostFormValue("name")
+			req.Paused = r.PostFormValue("action") == "pause"
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "no program name given", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if req.Paused {
+			glog.Infof("Admin request to pause %q", req.Name)
+			err = m.l.PauseProgram(req.Name)
+		} else {
+			glog.Infof("Admin request to resume %q", req.Name)
+			err = m.l.ResumeProgram(req.Name)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if form {
+			http.Redirect(w, r, "/#prog-"+req.Name, http.StatusSeeOther)
+			return
+		}
+	default:
+		w.Header().Add("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.l.Programs()); err != nil {
+		glog.Info(err)
+	}
+}
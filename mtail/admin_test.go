@@ -0,0 +1,262 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/google/mtail/vm"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, tc := range []struct {
+		name     string
+		token    string
+		auth     string
+		expected int
+	}{
+		{"disabled", "", "Bearer ", http.StatusForbidden},
+		{"no auth", "s3kr1t", "", http.StatusUnauthorized},
+		{"wrong auth", "s3kr1t", "Bearer nope", http.StatusUnauthorized},
+		{"ok", "s3kr1t", "Bearer s3kr1t", http.StatusOK},
+		{"wrong form token", "s3kr1t", "token=nope", http.StatusUnauthorized},
+		{"form token", "s3kr1t", "token=s3kr1t", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &MtailServer{adminToken: tc.token}
+			r := httptest.NewRequest("GET", "/logs", nil)
+			if strings.HasPrefix(tc.auth, "token=") {
+				r = httptest.NewRequest("POST", "/programs", strings.NewReader(tc.auth))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			m.requireAdmin(ok)(w, r)
+			if w.Code != tc.expected {
+				t.Errorf("status code: expected %d, received %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleLogs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+
+	logFilepath := path.Join(workdir, "log")
+	logFile, err := os.Create(logFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	nonexistent := path.Join(workdir, "nonexistent")
+
+	m := startMtailServer(t)
+	defer m.Close()
+
+	for _, tc := range []struct {
+		method   string
+		body     string
+		code     int
+		patterns string
+	}{
+		{"GET", "", http.StatusOK, "[]\n"},
+		{"POST", `{"path": "` + logFilepath + `"}`, http.StatusOK, `["` + logFilepath + `"]` + "\n"},
+		// Files that don't exist yet are tailed once they're created.
+		{"POST", `{"path": "` + nonexistent + `"}`, http.StatusOK, `["` + logFilepath + `","` + nonexistent + `"]` + "\n"},
+		{"DELETE", `{"path": "` + nonexistent + `"}`, http.StatusOK, `["` + logFilepath + `"]` + "\n"},
+		{"POST", `{"path": "` + path.Join(workdir, "[") + `"}`, http.StatusBadRequest, ""},
+		// Re-adding a pattern leaves it tailed.
+		{"POST", `{"path": "` + logFilepath + `"}`, http.StatusOK, `["` + logFilepath + `"]` + "\n"},
+		{"DELETE", `{"path": "` + logFilepath + `"}`, http.StatusOK, "[]\n"},
+		{"DELETE", `{"path": "` + logFilepath + `"}`, http.StatusNotFound, ""},
+		{"POST", `{}`, http.StatusBadRequest, ""},
+		{"PUT", "", http.StatusMethodNotAllowed, ""},
+	} {
+		r := httptest.NewRequest(tc.method, "/logs", strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		m.handleLogs(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: status code: expected %d, received %d: %s", tc.method, tc.body, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.code == http.StatusOK && w.Body.String() != tc.patterns {
+			t.Errorf("%s %s: expected %q, received %q", tc.method, tc.body, tc.patterns, w.Body.String())
+		}
+	}
+}
+
+func TestHandleReset(t *testing.T) {
+	store := metrics.NewStore()
+	for _, prog := range []string{"a", "b"} {
+		metric := metrics.NewMetric("requests", prog, metrics.Counter, datum.Int)
+		d, _ := metric.GetDatum()
+		datum.SetInt(d, 5, time.Unix(1, 0))
+		if err := store.Add(metric); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &MtailServer{store: store}
+
+	for _, tc := range []struct {
+		method string
+		body   string
+		code   int
+		reset  string
+	}{
+		{"GET", "", http.StatusMethodNotAllowed, ""},
+		{"POST", `{}`, http.StatusBadRequest, ""},
+		{"POST", `{"name": "missing"}`, http.StatusNotFound, ""},
+		{"POST", `{"name": "requests", "program": "a"}`, http.StatusOK, `["a"]` + "\n"},
+		{"POST", `{"name": "requests"}`, http.StatusOK, `["a","b"]` + "\n"},
+	} {
+		r := httptest.NewRequest(tc.method, "/reset", strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		m.handleReset(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: status code: expected %d, received %d: %s", tc.method, tc.body, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.code == http.StatusOK && w.Body.String() != tc.reset {
+			t.Errorf("%s %s: expected %q, received %q", tc.method, tc.body, tc.reset, w.Body.String())
+		}
+	}
+	for _, metric := range store.Metrics["requests"] {
+		d, _ := metric.GetDatum()
+		if v := datum.GetInt(d); v != 0 {
+			t.Errorf("program %s not reset: %d", metric.Program, v)
+		}
+	}
+}
+
+func TestHandleDryRun(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	l, err := vm.NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), afero.NewMemMapFs(), vm.RecentLines(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines <- logline.NewLogLine("log", "GET /")
+	close(lines)
+	<-l.VMsDone
+	m := &MtailServer{l: l}
+
+	for _, tc := range []struct {
+		method string
+		query  string
+		body   string
+		code   int
+	}{
+		{"GET", "", "", http.StatusMethodNotAllowed},
+		{"POST", "?lines=x", "", http.StatusBadRequest},
+		{"POST", "", "counter gets\n/^GET/ {\n  puts++\n}\n", http.StatusUnprocessableEntity},
+		{"POST", "?name=gets.mtail&lines=1", "counter gets\n/^GET/ {\n  gets++\n}\n", http.StatusOK},
+	} {
+		r := httptest.NewRequest(tc.method, "/dryrun"+tc.query, strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		m.handleDryRun(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: status code: expected %d, received %d: %s", tc.method, tc.query, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.code == http.StatusOK && !strings.Contains(w.Body.String(), `"program":"gets.mtail","lines":1,"matched_lines":1`) {
+			t.Errorf("%s %s: unexpected result %s", tc.method, tc.query, w.Body.String())
+		}
+	}
+}
+
+func TestHandleLinez(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	l, err := vm.NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), afero.NewMemMapFs(), vm.LinesPerSource(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines <- logline.NewLogLine("/var/log/b.log", "GET /")
+	lines <- logline.NewLogLine("/var/log/a.log", "POST /")
+	lines <- logline.NewLogLine("/var/log/a.log", "GET /")
+	close(lines)
+	<-l.VMsDone
+	m := &MtailServer{l: l}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"", http.StatusOK, "==> /var/log/a.log <==\nPOST /\nGET /\n==> /var/log/b.log <==\nGET /\n"},
+		{"?match=^GET&n=1", http.StatusOK, "==> /var/log/a.log <==\nGET /\n==> /var/log/b.log <==\nGET /\n"},
+		{"?source=/var/log/b*", http.StatusOK, "==> /var/log/b.log <==\nGET /\n"},
+		{"?match=(", http.StatusBadRequest, ""},
+		{"?n=-1", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		m.handleLinez(w, httptest.NewRequest("GET", "/linez"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: status code: expected %d, received %d: %s", tc.query, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.code == http.StatusOK && w.Body.String() != tc.expected {
+			t.Errorf("%s: expected %q, received %q", tc.query, tc.expected, w.Body.String())
+		}
+	}
+}
+
+func TestHandlePrograms(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	l, err := vm.NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), afero.NewMemMapFs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(lines)
+	if err := l.CompileAndRun("a.mtail", strings.NewReader("/$/ {}\n")); err != nil {
+		t.Fatal(err)
+	}
+	m := &MtailServer{l: l}
+
+	for _, tc := range []struct {
+		method   string
+		form     bool
+		body     string
+		code     int
+		expected string
+	}{
+		{"PUT", false, "", http.StatusMethodNotAllowed, ""},
+		{"GET", false, "", http.StatusOK, `[{"name":"a.mtail","paused":false}]` + "\n"},
+		{"POST", false, `{}`, http.StatusBadRequest, ""},
+		{"POST", false, `{"name": "b.mtail", "paused": true}`, http.StatusNotFound, ""},
+		{"POST", false, `{"name": "a.mtail", "paused": true}`, http.StatusOK, `[{"name":"a.mtail","paused":true}]` + "\n"},
+		{"POST", true, "name=a.mtail&action=resume", http.StatusSeeOther, ""},
+		{"GET", false, "", http.StatusOK, `[{"name":"a.mtail","paused":false}]` + "\n"},
+	} {
+		r := httptest.NewRequest(tc.method, "/programs", strings.NewReader(tc.body))
+		if tc.form {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		m.handlePrograms(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: status code: expected %d, received %d: %s", tc.method, tc.body, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.code == http.StatusOK && w.Body.String() != tc.expected {
+			t.Errorf("%s %s: expected %q, received %q", tc.method, tc.body, tc.expected, w.Body.String())
+		}
+	}
+}
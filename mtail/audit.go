@@ -0,0 +1,86 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/audit"
+)
+
+// AuditLog sets the file to which program loads and unloads, metric
+// definitions, and changes to the export configuration are appended.
+func AuditLog(path string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.auditLog = path
+		return nil
+	}
+}
+
+// initAudit opens the audit log for this MtailServer, if one is configured.
+// It is opened before the programs are loaded and any change of root
+// directory, and kept open.
+func (m *MtailServer) initAudit() (err error) {
+	if m.auditLog == "" || m.compileOnly {
+		return nil
+	}
+	m.audit, err = audit.Open(m.auditLog)
+	return
+}
+
+// auditExportConfig records the export configuration in the audit log, if it
+// changed since it was last recorded.
+func (m *MtailServer) auditExportConfig() error {
+	if m.audit == nil {
+		return nil
+	}
+	var config []string
+	var hash string
+	if m.exportRules != "" {
+		config = append(config, "export_rules="+m.exportRules)
+		f, err := os.Open(m.exportRules)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		hash = hex.EncodeToString(h.Sum(nil))
+	}
+	if m.omitProgLabel {
+		config = append(config, "omit_prog_label")
+	}
+	if m.numShards > 1 {
+		config = append(config, fmt.Sprintf("shard=%d/%d", m.shard, m.numShards))
+	}
+	return m.audit.SetExportConfig(strings.Join(config, " "), hash)
+}
+
+// handleAuditz serves the events in the audit log, as JSON lines.
+func (m *MtailServer) handleAuditz(w http.ResponseWriter, r *http.Request) {
+	if m.audit == nil {
+		http.Error(w, "no audit log; see the audit_log flag", http.StatusNotFound)
+		return
+	}
+	m.audit.ServeHTTP(w, r)
+}
+
+// closeAudit closes the audit log, if it is open.
+func (m *MtailServer) closeAudit() {
+	if m.audit == nil {
+		return
+	}
+	if err := m.audit.Close(); err != nil {
+		glog.Warning(err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+)
+
+func TestAuditz(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+
+	m := startMtailServer(t, AuditLog(path.Join(workdir, "audit.log")), OmitProgLabel)
+	defer m.Close()
+
+	w := httptest.NewRecorder()
+	m.handleAuditz(w, httptest.NewRequest("GET", "/auditz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("auditz status: expected %d, received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var e struct{ Kind, Program, Metric, Detail string }
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		got = append(got, strings.Join([]string{e.Kind, e.Program, e.Metric, e.Detail}, " "))
+	}
+	expected := []string{
+		"export_config   omit_prog_label",
+		"program_load test  ",
+	}
+	if diff := go_cmp.Diff(expected, got); diff != "" {
+		t.Errorf("audit events differ:\n%s", diff)
+	}
+
+	// Without an audit log, there is nothing to serve.
+	m2 := startMtailServer(t)
+	defer m2.Close()
+	w = httptest.NewRecorder()
+	m2.handleAuditz(w, httptest.NewRequest("GET", "/auditz", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("auditz status without an audit log: expected %d, received %d", http.StatusNotFound, w.Code)
+	}
+}
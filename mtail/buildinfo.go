@@ -0,0 +1,59 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// redacted replaces the values of secret flags on /buildinfo.
+const redacted = "REDACTED"
+
+// secretFlagWords are the words which, if part of a flag name, mark the
+// flag's value as a secret.
+var secretFlagWords = []string{"token", "password", "secret", "community"}
+
+// handleBuildInfo reports the version of mtail running, when it started, and
+// the value of each flag, in the same "name value" form as /varz.  The
+// values of flags that hold secrets, and passwords in URLs, are redacted.
+func (m *MtailServer) handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "text/plain")
+	fmt.Fprintf(w, "version %s\n", m.version)
+	fmt.Fprintf(w, "revision %s\n", m.revision)
+	fmt.Fprintf(w, "go_version %s\n", runtime.Version())
+	fmt.Fprintf(w, "start_time %s\n", m.startTime.Format(time.RFC3339))
+	fmt.Fprintf(w, "uptime_seconds %d\n", int64(time.Since(m.startTime).Seconds()))
+	if m.flags == nil {
+		return
+	}
+	m.flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "flag.%s %q\n", f.Name, redactFlag(f.Name, f.Value.String()))
+	})
+}
+
+// redactFlag returns the value of the named flag fit to be shown: the value
+// of a secret flag is replaced, and so is the password of a URL.
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, word := range secretFlagWords {
+		if strings.Contains(name, word) {
+			return redacted
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return u.String()
+		}
+	}
+	return value
+}
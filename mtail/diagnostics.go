@@ -0,0 +1,169 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// diagnosticsTimeout is how long a diagnostic dump waits for the locks of the
+// tailer, loader and store before giving up on the rest of the dump.
+var diagnosticsTimeout = 10 * time.Second
+
+// WriteDiagnostics writes a snapshot of the state of mtail as plain text to
+// the io.Writer w: the stack of every goroutine, the tailer's log files, the
+// programs, and the sizes of the metrics in the store.  It is written when
+// mtail receives a diagnostic signal, so it needs no HTTP server to debug a
+// wedged mtail.  The stacks are written first, as the rest waits for locks
+// that a wedged mtail may never release.
+func (m *MtailServer) WriteDiagnostics(w io.Writer) error {
+	fmt.Fprintf(w, "mtail diagnostics at %s\n", time.Now().UTC().Format(time.RFC3339))
+	// Duration.Round is new in Go 1.9.
+	fmt.Fprintf(w, "version %s revision %s, up %s, %d goroutines\n", m.version, m.revision, time.Since(m.startTime)/time.Second*time.Second, runtime.NumGoroutine())
+	fmt.Fprintf(w, "lines channel: %d of %d queued\n", len(m.lines), cap(m.lines))
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "goroutines:")
+	if err := pprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	if m.t != nil {
+		if err := m.t.WriteDiagnostics(w); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintln(w, "tailer: not running")
+	}
+
+	fmt.Fprintln(w)
+	if err := m.l.WriteDiagnostics(w); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	m.store.RLock()
+	names := make([]string, 0, len(m.store.Metrics))
+	sizes := make(map[string][]int)
+	var n, lvs int
+	for name, ms := range m.store.Metrics {
+		names = append(names, name)
+		for _, ml := range ms {
+			ml.RLock()
+			size := len(ml.LabelValues)
+			ml.RUnlock()
+			sizes[name] = append(sizes[name], size)
+			n++
+			lvs += size
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "store: %d metrics, %d label value sets\n", n, lvs)
+	for _, name := range names {
+		for i, ml := range m.store.Metrics[name] {
+			fmt.Fprintf(w, "metric %s program %s label value sets %d\n", name, ml.Program, sizes[name][i])
+		}
+	}
+	m.store.RUnlock()
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer that may be read while it is written.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// dumpDiagnostics writes the diagnostics to a new file in the diagnostics
+// directory, or to the log if there isn't one.  If the dump waits for a lock
+// for longer than diagnosticsTimeout, what has been written is left
+// incomplete, so that the stacks of a wedged mtail are still dumped.
+func (m *MtailServer) dumpDiagnostics() {
+	var b syncBuffer
+	var w io.Writer = &b
+	var f *os.File
+	name := "the log"
+	if m.diagnosticsDir != "" {
+		name = filepath.Join(m.diagnosticsDir, fmt.Sprintf("mtail-diagnostics-%s.txt", time.Now().UTC().Format("20060102T150405.000000000")))
+		var err error
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			glog.Warningf("Failed to create diagnostics file: %s", err)
+			return
+		}
+		w = f
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := m.WriteDiagnostics(w)
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(diagnosticsTimeout):
+		err = errors.Errorf("timed out after %s waiting for a lock, so the dump is incomplete", diagnosticsTimeout)
+	}
+	if f == nil {
+		glog.Infof("Diagnostics:\n%s", b.String())
+	}
+	switch {
+	case err != nil:
+		glog.Warningf("Failed to write diagnostics to %s: %s", name, err)
+	case f != nil:
+		glog.Infof("Wrote diagnostics to %s", name)
+	}
+}
+
+// startDiagnosticDumps dumps the diagnostics each time mtail receives a
+// diagnostic signal, until done is closed.
+func (m *MtailServer) startDiagnosticDumps(done <-chan struct{}) {
+	if len(diagnosticSignals) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, diagnosticSignals...)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				m.dumpDiagnostics()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteDiagnostics(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	f, err := os.Create(logFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m := startMtailServer(t, LogPathPatterns(logFilepath), DiagnosticsDir(workdir))
+	defer m.Close()
+	if err := m.l.CompileAndRun("counter.mtail", strings.NewReader("counter lines\n/$/ {\n  lines++\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := m.WriteDiagnostics(&b); err != nil {
+		t.Fatal(err)
+	}
+	if i, j := strings.Index(b.String(), "goroutines:\n"), strings.Index(b.String(), "tailer: "); i < 0 || j < i {
+		t.Errorf("goroutines not written before the tailer:\n%s", b.String())
+	}
+	for _, want := range []string{
+		"tailer: 1 patterns, 1 log files",
+		"file " + logFilepath + " offset 0",
+		"loader: 2 programs running, 0 failed to load",
+		"program counter.mtail running lines ",
+		"store: 1 metrics, 1 label value sets\n",
+		"metric lines program counter.mtail label value sets 1\n",
+		"goroutines:\n",
+		"github.com/google/mtail/mtail.(*MtailServer).WriteDiagnostics",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("diagnostics don't contain %q:\n%s", want, b.String())
+		}
+	}
+
+	m.dumpDiagnostics()
+	files, err := filepath.Glob(filepath.Join(workdir, "mtail-diagnostics-*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("diagnostics files %v, want one", files)
+	}
+	dump, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(dump), "mtail diagnostics at ") {
+		t.Errorf("unexpected diagnostics file:\n%s", dump)
+	}
+
+	// A dump waiting for a lock gives up, having written the stacks.
+	defer func(d time.Duration) { diagnosticsTimeout = d }(diagnosticsTimeout)
+	diagnosticsTimeout = 10 * time.Millisecond
+	m.store.Lock()
+	m.dumpDiagnostics()
+	files, err = filepath.Glob(filepath.Join(workdir, "mtail-diagnostics-*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("diagnostics files %v, want two", files)
+	}
+	// The names sort by time.
+	dump, err = ioutil.ReadFile(files[1])
+	m.store.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dump), "goroutines:\n") || strings.Contains(string(dump), "store: ") {
+		t.Errorf("unexpected incomplete diagnostics file:\n%s", dump)
+	}
+}
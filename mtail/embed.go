@@ -0,0 +1,60 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package mtail runs mtail programs over log lines, and exports the metrics
+// they record.  It is the engine of the mtail command, and can be embedded in
+// another program instead of running the command beside it:
+//
+//	store := metrics.NewStore()
+//	w, err := watcher.NewLogWatcher()
+//	...
+//	m, err := mtail.New(store, w, &afero.OsFs{}, mtail.OmitProgLabel)
+//	...
+//	err = m.LoadProgram("requests.mtail", strings.NewReader(program))
+//	...
+//	m.ProcessLine("access.log", line)
+//	...
+//	m.Close()
+//
+// The metrics recorded are in the store, which the exporter package can
+// serve or push.  A program that also wants mtail to tail log files passes
+// the LogPathPatterns option and calls StartTailing.
+//
+// The exporter package defines some of its settings as command line flags on
+// flag.CommandLine; an embedding program that doesn't parse them gets their
+// defaults.
+package mtail
+
+import (
+	"io"
+
+	"github.com/google/mtail/logline"
+)
+
+// LoadProgram compiles the program read from r and starts running it on the
+// lines processed from now on, replacing any program already loaded with the
+// same name.
+func (m *MtailServer) LoadProgram(name string, r io.Reader) error {
+	return m.l.CompileAndRun(name, r)
+}
+
+// PushMetrics pushes the metrics to the push backends now, rather than
+// waiting for the next push interval.
+func (m *MtailServer) PushMetrics() {
+	m.e.PushMetrics()
+}
+
+// ProcessLine sends a log line to the programs, as though it were read from
+// the log file filename.  It returns once a program has accepted the line,
+// and must not be called after Close.  Lines processed this way skip the
+// filters and length limits applied to lines read from log files.
+func (m *MtailServer) ProcessLine(filename, line string) {
+	m.lines <- logline.NewLogLine(filename, line)
+}
+
+// LinesProcessed returns the number of lines this MtailServer has read, from
+// its log files or ProcessLine, and whether its programs have finished
+// processing all of them.
+func (m *MtailServer) LinesProcessed() (n int64, done bool) {
+	return m.l.LinesProcessed()
+}
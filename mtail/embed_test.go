@@ -0,0 +1,51 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/google/mtail/mtail"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+const requestsProgram = `counter requests by method
+/^(?P<method>[A-Z]+) / {
+  requests[$method]++
+}
+`
+
+// This example runs a program over log lines passed to it directly, rather
+// than read from a log file, and prints the metrics it records.
+func ExampleMtailServer_ProcessLine() {
+	store := metrics.NewStore()
+	w, err := watcher.NewLogWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := mtail.New(store, w, &afero.OsFs{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := m.LoadProgram("requests.mtail", strings.NewReader(requestsProgram)); err != nil {
+		log.Fatal(err)
+	}
+	for _, line := range []string{"GET /", "POST /form", "GET /about"} {
+		m.ProcessLine("access.log", line)
+	}
+	// Close waits for the programs to finish the lines sent.
+	m.Close()
+
+	for _, lv := range store.Metrics["requests"][0].LabelValues {
+		fmt.Println(lv.Labels[0], datum.GetInt(lv.Value))
+	}
+	// Output:
+	// GET 2
+	// POST 1
+}
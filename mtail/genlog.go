@@ -0,0 +1,228 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// genlogFilename is the filename of the lines generated for the programs.
+const genlogFilename = "genlog"
+
+// maxLogGenerationRate is the most lines per second a logGenerator can be
+// asked for.
+const maxLogGenerationRate = 1e9
+
+// logGenerator generates synthetic log lines from templates at a steady
+// rate, to test how many lines a host's programs can keep up with.
+type logGenerator struct {
+	templates []*template.Template // one is chosen at random for each line
+	rate      float64              // lines per second
+	duration  time.Duration        // how long to generate lines for
+
+	rand *rand.Rand
+	seq  int64     // number of the line being generated, from 1
+	when time.Time // time the line being generated is due
+
+	now   func() time.Time    // Replaceable for testing.
+	sleep func(time.Duration) // Replaceable for testing.
+}
+
+// newLogGenerator returns a logGenerator for the templates read from r.
+// Each line of r that isn't blank or a comment starting with # is a template
+// in the syntax of the text/template package, which may call these functions:
+//
+//	now LAYOUT          the time the line is generated, formatted with LAYOUT
+//	seq                 the number of the line, from 1
+//	int MIN MAX         a random integer from MIN to MAX
+//	float MIN MAX       a random number from MIN up to MAX
+//	choice VALUE...     one of the values, at random
+//	ip                  a random IPv4 address
+//	hex N               N random hexadecimal digits
+//
+// A template is chosen at random for each line, so a template given twice is
+// used twice as often.  The random values are the same each run.
+func newLogGenerator(name string, r io.Reader, rate float64, duration time.Duration) (*logGenerator, error) {
+	if rate <= 0 {
+		return nil, errors.Errorf("log generation rate must be positive, got %g", rate)
+	}
+	// Above a line a nanosecond, the interval between lines would be zero.
+	if rate > maxLogGenerationRate {
+		return nil, errors.Errorf("log generation rate must be at most %g lines per second, got %g", maxLogGenerationRate, rate)
+	}
+	if duration <= 0 {
+		return nil, errors.Errorf("log generation duration must be positive, got %s", duration)
+	}
+	g := &logGenerator{rate: rate, duration: duration, rand: rand.New(rand.NewSource(1)), now: time.Now, sleep: time.Sleep}
+	funcs := template.FuncMap{
+		"now": func(layout string) string { return g.when.Format(layout) },
+		"seq": func() int64 { return g.seq },
+		"int": func(min, max int) int {
+			if max < min {
+				return min
+			}
+			return min + g.rand.Intn(max-min+1)
+		},
+		"float": func(min, max float64) float64 { return min + g.rand.Float64()*(max-min) },
+		"choice": func(values ...string) string {
+			if len(values) == 0 {
+				return ""
+			}
+			return values[g.rand.Intn(len(values))]
+		},
+		"ip": func() string {
+			return fmt.Sprintf("%d.%d.%d.%d", 1+g.rand.Intn(223), g.rand.Intn(256), g.rand.Intn(256), 1+g.rand.Intn(254))
+		},
+		"hex": func(n int) string {
+			const digits = "0123456789abcdef"
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = digits[g.rand.Intn(len(digits))]
+			}
+			return string(b)
+		},
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(strings.TrimSpace(text), "#") {
+			continue
+		}
+		t, err := template.New(fmt.Sprintf("%s:%d", name, n)).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		g.templates = append(g.templates, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(g.templates) == 0 {
+		return nil, errors.Errorf("%s: no templates", name)
+	}
+	return g, nil
+}
+
+// line returns the next generated line.
+func (g *logGenerator) line() (string, error) {
+	g.seq++
+	var b bytes.Buffer
+	if err := g.templates[g.rand.Intn(len(g.templates))].Execute(&b, nil); err != nil {
+		return "", err
+	}
+	return strings.Replace(b.String(), "\n", " ", -1), nil
+}
+
+// run generates lines for the duration, calling emit with each as it is due.
+// If emit takes longer than the time between lines, the lines fall behind
+// schedule, and are generated as fast as emit allows.  Before waiting for the
+// next line to be due, idle is called.  run returns the number of lines
+// generated and the time taken.
+func (g *logGenerator) run(emit func(string) error, idle func() error) (int64, time.Duration, error) {
+	start := g.now()
+	interval := time.Duration(float64(time.Second) / g.rate)
+	total := int64(float64(g.duration) / float64(interval))
+	for i := int64(0); i < total; i++ {
+		due := start.Add(time.Duration(i) * interval)
+		if d := due.Sub(g.now()); d > 0 {
+			if err := idle(); err != nil {
+				return i, g.now().Sub(start), err
+			}
+			g.sleep(d)
+		}
+		g.when = g.now()
+		line, err := g.line()
+		if err != nil {
+			return i, g.now().Sub(start), err
+		}
+		if err := emit(line); err != nil {
+			return i, g.now().Sub(start), err
+		}
+	}
+	return total, g.now().Sub(start), nil
+}
+
+// GenerateLog sets the MtailServer to generate log lines from the templates
+// in the file at path, described in newLogGenerator, at rate lines per
+// second for the duration, instead of reading logs.  If output is set, the
+// lines are appended to that file, otherwise they are sent to the programs,
+// and how many the programs accepted per second is reported.
+func GenerateLog(path string, rate float64, duration time.Duration, output string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "log generation templates")
+		}
+		if m.genlog, err = newLogGenerator(path, bytes.NewReader(b), rate, duration); err != nil {
+			return err
+		}
+		m.genlogOutput = output
+		return nil
+	}
+}
+
+// runGenerateLog generates log lines into the output file, or to the
+// programs, then writes a report of the rate achieved to w.
+func (m *MtailServer) runGenerateLog(w io.Writer) error {
+	if m.genlogOutput != "" {
+		f, err := os.OpenFile(m.genlogOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bw := bufio.NewWriter(f)
+		n, elapsed, err := m.genlog.run(func(line string) error {
+			_, err := fmt.Fprintln(bw, line)
+			return err
+		}, bw.Flush)
+		if ferr := bw.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			return err
+		}
+		m.writeGenerateLogReport(w, n, elapsed, "written to "+m.genlogOutput)
+		return nil
+	}
+	glog.Infof("Generating %g log lines per second for %s", m.genlog.rate, m.genlog.duration)
+	n, elapsed, err := m.genlog.run(func(line string) error {
+		m.ProcessLine(genlogFilename, line)
+		return nil
+	}, func() error { return nil })
+	// Close stops the tailer, which closes the lines channel, and waits for
+	// the programs to finish the lines sent.
+	if cerr := m.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	m.writeGenerateLogReport(w, n, elapsed, "accepted by the programs")
+	return nil
+}
+
+// writeGenerateLogReport writes how many lines were generated in the elapsed
+// time to w, and whether they kept up with the rate asked for.
+func (m *MtailServer) writeGenerateLogReport(w io.Writer, n int64, elapsed time.Duration, dest string) {
+	achieved := m.genlog.rate
+	if elapsed > 0 {
+		achieved = float64(n) / elapsed.Seconds()
+	}
+	fmt.Fprintf(w, "%d lines %s in %s: %.0f lines per second, of %.0f asked for\n", n, dest, elapsed/time.Millisecond*time.Millisecond, achieved, m.genlog.rate)
+	if achieved < 0.95*m.genlog.rate {
+		fmt.Fprintf(w, "The lines fell behind: at most about %.0f lines per second can be handled.\n", achieved)
+	}
+}
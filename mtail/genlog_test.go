@@ -0,0 +1,162 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bytes"
+	"expvar"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogGeneratorTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		pattern  string
+	}{
+		{"literal", "hello world", `^hello world$`},
+		{"seq", "line {{seq}}", `^line 1$`},
+		{"now", `{{now "2006-01-02T15:04:05Z07:00"}} up`, `^2018-06-01T12:00:00Z up$`},
+		{"int", "{{int 200 204}}", `^20[0-4]$`},
+		{"float", `{{float 0.5 1.5 | printf "%.3f"}}`, `^[01]\.\d{3}$`},
+		{"choice", `{{choice "GET" "POST"}}`, `^(GET|POST)$`},
+		{"ip", "{{ip}}", `^\d+\.\d+\.\d+\.\d+$`},
+		{"hex", "{{hex 8}}", `^[0-9a-f]{8}$`},
+		{"comments and blanks", "# a comment\n\nx {{seq}}\n", `^x 1$`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := newLogGenerator("test", strings.NewReader(tc.template), 1, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.when = time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+			line, err := g.line()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !regexp.MustCompile(tc.pattern).MatchString(line) {
+				t.Errorf("line %q doesn't match %q", line, tc.pattern)
+			}
+		})
+	}
+}
+
+func TestLogGeneratorErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates string
+		rate      float64
+		duration  time.Duration
+	}{
+		{"no templates", "# only a comment\n", 1, time.Second},
+		{"bad template", "{{seq", 1, time.Second},
+		{"unknown function", "{{nope}}", 1, time.Second},
+		{"zero rate", "x", 0, time.Second},
+		{"rate too high", "x", 2e9, time.Second},
+		{"negative duration", "x", 1, -time.Second},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newLogGenerator("test", strings.NewReader(tc.templates), tc.rate, tc.duration); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLogGeneratorRun(t *testing.T) {
+	g, err := newLogGenerator("test", strings.NewReader("{{seq}}"), 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Unix(0, 0)
+	g.now = func() time.Time { return clock }
+	g.sleep = func(d time.Duration) { clock = clock.Add(d) }
+
+	var lines []string
+	idles := 0
+	n, elapsed, err := g.run(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}, func() error {
+		idles++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 || len(lines) != 10 {
+		t.Errorf("generated %d lines, emitted %d, want 10", n, len(lines))
+	}
+	if lines[9] != "10" {
+		t.Errorf("last line %q, want 10", lines[9])
+	}
+	// The first line is due at once, and each later one a tenth of a second
+	// after the one before.
+	if idles != 9 {
+		t.Errorf("idle %d times, want 9", idles)
+	}
+	if elapsed != 900*time.Millisecond {
+		t.Errorf("elapsed %s, want 900ms", elapsed)
+	}
+}
+
+func TestGenerateLogToFile(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+
+	templates := path.Join(workdir, "templates")
+	if err := ioutil.WriteFile(templates, []byte("line {{seq}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := path.Join(workdir, "out.log")
+	m := &MtailServer{}
+	if err := GenerateLog(templates, 1000, 5*time.Millisecond, output)(m); err != nil {
+		t.Fatal(err)
+	}
+	var report bytes.Buffer
+	if err := m.runGenerateLog(&report); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "line 1\nline 2\nline 3\nline 4\nline 5\n"; string(b) != expected {
+		t.Errorf("output: expected %q, received %q", expected, b)
+	}
+	if !strings.HasPrefix(report.String(), "5 lines written to "+output) {
+		t.Errorf("unexpected report %q", report.String())
+	}
+}
+
+func TestGenerateLogToPrograms(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+
+	templates := path.Join(workdir, "templates")
+	if err := ioutil.WriteFile(templates, []byte(`{{choice "a" "b"}} {{seq}}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := startMtailServer(t, GenerateLog(templates, 1000, 20*time.Millisecond, ""))
+	var report bytes.Buffer
+	if err := m.runGenerateLog(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(report.String(), "20 lines accepted by the programs") {
+		t.Errorf("unexpected report %q", report.String())
+	}
+	if lines := expvar.Get("line_count").String(); lines != "20" {
+		t.Errorf("line_count: expected 20, received %s", lines)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// defaultStallThreshold is how long the programs may take to accept a log
+// line before mtail reports itself as unhealthy.
+const defaultStallThreshold = 30 * time.Second
+
+// handleHealthz reports whether mtail is live.  It fails if the programs
+// have stopped accepting log lines for longer than the stall threshold,
+// which means either a program is stuck or the log volume is more than the
+// programs can keep up with.
+func (m *MtailServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "text/plain")
+	if d := m.l.DispatchTime(); d > m.stallThreshold {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "programs have not accepted a log line for %s\n", d)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether mtail is ready to have its metrics collected:
+// all programs have compiled, and the log files matching the initial
+// patterns have been opened.
+func (m *MtailServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "text/plain")
+	if atomic.LoadInt32(&m.ready) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "log files not yet opened")
+		return
+	}
+	if errs := m.l.ProgramErrors(); len(errs) > 0 {
+		names := make([]string, 0, len(errs))
+		for name := range errs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "programs failed to compile: %q\n", names)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	m := startMtailServer(t)
+	defer m.Close()
+
+	w := httptest.NewRecorder()
+	m.handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("healthz status: expected %d, received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	if err := ioutil.WriteFile(path.Join(workdir, "bad.mtail"), []byte("counter foo\nfoo = \"a\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		options  []func(*MtailServer) error
+		tail     bool
+		expected int
+	}{
+		{"ready", nil, true, http.StatusOK},
+		{"not tailing", nil, false, http.StatusServiceUnavailable},
+		{"compile errors", []func(*MtailServer) error{ProgramPath(workdir)}, true, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := startMtailServer(t, tc.options...)
+			defer m.Close()
+			if !tc.tail {
+				m.ready = 0
+			}
+			w := httptest.NewRecorder()
+			m.handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tc.expected {
+				t.Errorf("readyz status: expected %d, received %d: %s", tc.expected, w.Code, w.Body)
+			}
+		})
+	}
+}
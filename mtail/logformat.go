@@ -0,0 +1,182 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// SetLogFormat sets the format of the messages mtail logs to standard error,
+// and routes the messages of the standard log package, used by some
+// libraries, through glog at the INFO level.  The format is glog, for glog's
+// usual lines, or json, for one JSON object per message with its time,
+// level, source and text, for log collectors that parse structured logs.
+// The log files written by glog are not affected.  It must be called after
+// flag.Parse, before anything is logged.
+//
+// In the json format, messages are converted as they are written, so they
+// may be lost if mtail exits straight after writing them.  Call FlushLogs
+// before exiting, and use Exit and Exitf instead of glog's.
+func SetLogFormat(format string) error {
+	glog.CopyStandardLogTo("INFO")
+	switch format {
+	case "glog", "":
+		return nil
+	case "json":
+	default:
+		return errors.Errorf("unknown log format %q: want glog or json", format)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "failed to create log pipe")
+	}
+	jsonLogs.Lock()
+	defer jsonLogs.Unlock()
+	jsonLogs.w, jsonLogs.stderr, jsonLogs.done = w, os.Stderr, make(chan struct{})
+	// glog writes to os.Stderr as it was when each message is logged.
+	os.Stderr = w
+	go func() {
+		defer close(jsonLogs.done)
+		writeJSONLogs(r, jsonLogs.stderr, time.Now)
+	}()
+	return nil
+}
+
+// jsonLogs is the pipe through which glog's messages are converted to the
+// json format.
+var jsonLogs struct {
+	sync.Mutex
+	w      *os.File      // written by glog, or nil if not converting
+	stderr *os.File      // the real standard error
+	done   chan struct{} // closed once every message has been converted
+}
+
+// FlushLogs writes out every message logged so far in the json format, and
+// writes later messages to standard error unconverted.  It does nothing in
+// the glog format.
+func FlushLogs() {
+	jsonLogs.Lock()
+	defer jsonLogs.Unlock()
+	if jsonLogs.w == nil {
+		return
+	}
+	os.Stderr = jsonLogs.stderr
+	jsonLogs.w.Close()
+	jsonLogs.w = nil
+	select {
+	case <-jsonLogs.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// Exit logs its arguments at the FATAL level and exits with status 1, like
+// glog.Exit, without losing the message in the json format.
+func Exit(args ...interface{}) {
+	exitDepth(1, fmt.Sprint(args...))
+}
+
+// Exitf logs at the FATAL level and exits with status 1, like glog.Exitf,
+// without losing the message in the json format.
+func Exitf(format string, args ...interface{}) {
+	exitDepth(1, fmt.Sprintf(format, args...))
+}
+
+func exitDepth(depth int, msg string) {
+	jsonLogs.Lock()
+	converting := jsonLogs.w != nil
+	jsonLogs.Unlock()
+	if converting {
+		FlushLogs()
+		rec := jsonLogRecord{Time: time.Now().Truncate(time.Microsecond), Level: "FATAL", Msg: msg}
+		if _, file, line, ok := runtime.Caller(depth + 1); ok {
+			rec.Source = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+		json.NewEncoder(os.Stderr).Encode(rec)
+		// glog still writes the message to its log files, if any, but it
+		// has been written to standard error already.
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stderr = devNull
+		}
+	}
+	glog.ExitDepth(depth+1, msg)
+}
+
+// glogHeaderRe matches the header glog writes before each message:
+// Lmmdd hh:mm:ss.uuuuuu threadid file:line]
+var glogHeaderRe = regexp.MustCompile(`^([IWEF])(\d\d)(\d\d) (\d\d):(\d\d):(\d\d)\.(\d{6}) +\d+ ([^:\]]+):(\d+)\] ?`)
+
+// glogLevels names the levels of glog's header letters.
+var glogLevels = map[byte]string{'I': "INFO", 'W': "WARNING", 'E': "ERROR", 'F': "FATAL"}
+
+// jsonLogRecord is a message logged in the json format.
+type jsonLogRecord struct {
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`
+	Source string    `json:"source,omitempty"`
+	Msg    string    `json:"msg"`
+}
+
+// writeJSONLogs copies the glog lines read from r to w as JSON records, until
+// r is closed.  Lines without a glog header, such as the later lines of a
+// message that spans several, or a panic, become records of their own, with
+// the time and level of the message before them.
+func writeJSONLogs(r io.Reader, w io.Writer, now func() time.Time) {
+	enc := json.NewEncoder(w)
+	last := jsonLogRecord{Level: "INFO"}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		rec := parseGlogLine(scanner.Text(), now())
+		if rec.Level == "" {
+			rec.Time, rec.Level = last.Time, last.Level
+			if rec.Time.IsZero() {
+				rec.Time = now()
+			}
+		}
+		last = rec
+		if err := enc.Encode(rec); err != nil {
+			return
+		}
+	}
+}
+
+// parseGlogLine returns the record of a line written by glog, or a record
+// with no level if the line has no glog header.  glog's header has no year,
+// so that of now is used.
+func parseGlogLine(line string, now time.Time) jsonLogRecord {
+	m := glogHeaderRe.FindStringSubmatch(line)
+	if m == nil {
+		return jsonLogRecord{Msg: line}
+	}
+	n := make([]int, 6)
+	for i := range n {
+		n[i], _ = strconv.Atoi(m[i+2])
+	}
+	us, _ := strconv.Atoi(m[7])
+	t := time.Date(now.Year(), time.Month(n[0]), n[1], n[2], n[3], n[4], us*1000, now.Location())
+	// A message logged on the 31st of December and read on the 1st of
+	// January was logged last year.
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return jsonLogRecord{
+		Time:   t,
+		Level:  glogLevels[m[1][0]],
+		Source: m[8] + ":" + m[9],
+		Msg:    line[len(m[0]):],
+	}
+}
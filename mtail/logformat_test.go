@@ -0,0 +1,41 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteJSONLogs(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	input := `I0601 11:59:58.123456   42 mtail.go:202] mtail version 3.0.0
+E0601 11:59:59.000001   42 file.go:301] Failed to read "/var/log/x": EOF
+W1231 23:59:59.000000   42 tail.go:10] from last year
+panic: boom
+goroutine 1 [running]:
+`
+	var b bytes.Buffer
+	writeJSONLogs(strings.NewReader(input), &b, func() time.Time { return now })
+	expected := `{"time":"2018-06-01T11:59:58.123456Z","level":"INFO","source":"mtail.go:202","msg":"mtail version 3.0.0"}
+{"time":"2018-06-01T11:59:59.000001Z","level":"ERROR","source":"file.go:301","msg":"Failed to read \"/var/log/x\": EOF"}
+{"time":"2017-12-31T23:59:59Z","level":"WARNING","source":"tail.go:10","msg":"from last year"}
+{"time":"2017-12-31T23:59:59Z","level":"WARNING","msg":"panic: boom"}
+{"time":"2017-12-31T23:59:59Z","level":"WARNING","msg":"goroutine 1 [running]:"}
+`
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\nreceived:\n%s", expected, b.String())
+	}
+}
+
+func TestSetLogFormat(t *testing.T) {
+	if err := SetLogFormat("glog"); err != nil {
+		t.Error(err)
+	}
+	if err := SetLogFormat("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
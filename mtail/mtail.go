@@ -5,6 +5,7 @@ package mtail
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
@@ -12,11 +13,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/alert"
+	"github.com/google/mtail/audit"
+	"github.com/google/mtail/enrich"
 	"github.com/google/mtail/exporter"
 	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
@@ -37,6 +43,9 @@ type MtailServer struct {
 	t *tailer.Tailer     // t tails the watched files and feeds lines to the VMs.
 	l *vm.MasterControl  // l loads programs and manages the VM lifecycle.
 	e *exporter.Exporter // e manages the export of metrics from the store.
+	a *alert.Evaluator   // a evaluates alert rules over the metrics, if any are configured.
+
+	audit *audit.Log // audit records changes to the definitions of the metrics, if configured.
 
 	webquit   chan struct{} // Channel to signal shutdown from web UI.
 	closeOnce sync.Once     // Ensure shutdown happens only once.
@@ -45,14 +54,92 @@ type MtailServer struct {
 	pollInterval     time.Duration  // Interval between polls of the filesystem
 	bindAddress      string         // address to bind HTTP server
 	buildInfo        string         // go build information
+	version          string         // mtail release version
+	revision         string         // git revision mtail was built from
+	startTime        time.Time      // when the MtailServer was created
+	flags            *flag.FlagSet  // flags reported on /buildinfo
 	programPath      string         // path to programs to load
 	logPathPatterns  []string       // list of patterns to watch for log files to tail
+	listenAddresses  []string       // list of socket URLs on which to receive log lines
+	adminToken       string         // bearer token required by the admin API; if empty the admin API is disabled
+	oneShotFormat    string         // format of the metrics printed at the end of one-shot mode
+	goldenPath       string         // path to expected one-shot metrics to compare against
+	replay           *replayer      // if set, paces one-shot delivery of lines by their timestamps
+	shard            int            // index of the shard of log files this process reads
+	numShards        int            // number of processes the log files are divided between
+	stallThreshold   time.Duration  // how long programs may block the tailer before mtail is unhealthy
+	containerLogs    bool           // if set, log lines are unwrapped from the container runtime log format
+	dockerJSONLogs   bool           // if set, log lines are unwrapped from the Docker json-file log format
+	maxLineLength    int            // if positive, the longest line in bytes sent to the programs
+	longLinePolicy   string         // whether lines longer than maxLineLength are truncated or dropped
+	collisionPolicy  string         // what to do when programs export metrics with the same name
+	loadPolicy       string         // what to do when programs fail to load at startup
+	maxLabelValues   int            // limit on the label value sets of each metric, or 0 for no limit
+	lineBudget       time.Duration  // time a program may spend on one log line, or 0 for no limit
+	maxInstructions  int            // instructions a program may execute on one log line, or 0 for no limit
+	maxMetrics       int            // limit on the metrics of each program, or 0 for no limit
+	pauseOverBudget  int64          // lines a program may abandon for exceeding its budgets before it is paused, or 0 for no limit
+	timerQuantiles   []float64      // quantiles of timer values to estimate, if any
+	snmpAddress      string         // address on which to answer SNMP requests; if empty SNMP is disabled
+	snmpCommunity    string         // community string SNMP requests must present
+	snmpBaseOID      string         // OID under which metrics are exported over SNMP
+	snmpOIDMap       string         // path to a file mapping metric names to OIDs
+
+	anomalyInterval  time.Duration // if nonzero, how often the match rate of each program is compared with its baseline
+	anomalyThreshold float64       // multiple of its baseline beyond which a match rate is anomalous
+
+	ready int32 // set once the initial log files have been opened; accessed atomically
+
+	lineFilters []func(*tailer.Tailer) error // filters, samplers, record separators and start positions for the lines of some log files
+
+	programDirs []vm.ProgramDir // further directories of programs to load, with their settings
+
+	bytecodeCacheDir string // if set, compiled programs are cached in this directory
+
+	eventSink string // if set, the file or socket to which events emitted by programs are written
+
+	geoIPDatabase string // if set, the MaxMind database in which geoip_country looks up IP addresses
+
+	exportRules string // if set, the file of rules applied to the metrics before they are exported
+
+	diagnosticsDir string // if set, the directory diagnostic dumps are written to, instead of the log
+
+	auditLog string // if set, the file changes to the definitions of the metrics are appended to
+
+	clock        func() time.Time                 // if set, replaces time.Now for stamping lines and expiring datums
+	pushBackends []func(*exporter.Exporter) error // push backends added by the embedding program
+
+	genlog       *logGenerator // if set, log lines are generated instead of read from logs
+	genlogOutput string        // if set, the file generated log lines are appended to, instead of sent to the programs
+
+	runAs            *account // if set, the user and group mtail changes to once it is listening
+	chroot           string   // if set, the directory mtail changes its root to before opening the log files
+	restrictSyscalls bool     // if set, mtail denies itself system calls it doesn't need once it is listening
+
+	dryRunLines int // number of recent log lines kept to dry run programs against
+	linezLines  int // number of recent log lines kept from each source for /linez
+
+	alertRules    string        // if set, the file of alert rules to evaluate
+	alertInterval time.Duration // how often alert rules are evaluated
+
+	amqpURI      string // if set, log lines are consumed from an AMQP broker
+	amqpQueue    string // queue from which to consume log lines
+	amqpPrefetch int    // messages the broker may send before they are acknowledged
+
+	natsURI string                  // if set, log lines are received from a NATS server
+	natsSub tailer.NATSSubscription // subject or JetStream consumer from which to receive log lines
+
+	mqttBroker string   // if set, log lines are received from an MQTT broker
+	mqttTopics []string // topics on which to receive log lines
 
 	oneShot      bool // if set, mtail reads log files from the beginning, once, then exits
 	compileOnly  bool // if set, mtail compiles programs then exits
 	dumpAst      bool // if set, mtail prints the program syntax tree after parse
 	dumpAstTypes bool // if set, mtail prints the program syntax tree after type checking
 	dumpBytecode bool // if set, mtail prints the program bytecode after code generation
+	coverage     bool // if set, mtail prints which patterns matched at the end of one-shot mode
+
+	oneShotParallelism int // number of log files read and processed at once in one-shot mode
 
 	syslogUseCurrentYear bool // if set, use the current year for timestamps that have no year information
 	omitMetricSource     bool // if set, do not link the source program to a metric
@@ -64,11 +151,38 @@ type MtailServer struct {
 func (m *MtailServer) StartTailing() error {
 	var err error
 	for _, pattern := range m.logPathPatterns {
+		if tailer.IsObjectURL(pattern) {
+			if err = m.t.TailObjects(pattern); err != nil {
+				return err
+			}
+			continue
+		}
 		glog.V(1).Infof("Tail pattern %q", pattern)
 		if err = m.t.TailPattern(pattern); err != nil {
 			glog.Error(err)
 		}
 	}
+	for _, address := range m.listenAddresses {
+		if err = m.t.TailSocket(address); err != nil {
+			return err
+		}
+	}
+	if m.amqpURI != "" {
+		if err = m.t.TailAMQP(m.amqpURI, m.amqpQueue, m.amqpPrefetch); err != nil {
+			return err
+		}
+	}
+	if m.natsURI != "" {
+		if err = m.t.TailNATS(m.natsURI, m.natsSub); err != nil {
+			return err
+		}
+	}
+	if m.mqttBroker != "" {
+		if err = m.t.TailMQTT(m.mqttBroker, m.mqttTopics); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&m.ready, 1)
 	return nil
 }
 
@@ -90,6 +204,12 @@ func (m *MtailServer) initLoader() error {
 	if m.dumpBytecode {
 		opts = append(opts, vm.DumpBytecode)
 	}
+	if m.coverage {
+		opts = append(opts, vm.Coverage)
+	}
+	if m.oneShot && m.oneShotParallelism > 1 {
+		opts = append(opts, vm.OneShotParallelism(m.oneShotParallelism))
+	}
 	if m.syslogUseCurrentYear {
 		opts = append(opts, vm.SyslogUseCurrentYear)
 	}
@@ -99,12 +219,70 @@ func (m *MtailServer) initLoader() error {
 	if m.overrideLocation != nil {
 		opts = append(opts, vm.OverrideLocation(m.overrideLocation))
 	}
+	if m.collisionPolicy != "" {
+		opts = append(opts, vm.MetricCollisions(m.collisionPolicy))
+	}
+	if m.loadPolicy != "" {
+		opts = append(opts, vm.LoadPolicy(m.loadPolicy))
+	}
+	if m.maxLabelValues > 0 {
+		opts = append(opts, vm.MaxLabelValues(m.maxLabelValues))
+	}
+	if m.lineBudget > 0 {
+		opts = append(opts, vm.LineBudget(m.lineBudget))
+	}
+	if m.maxInstructions > 0 {
+		opts = append(opts, vm.InstructionBudget(m.maxInstructions))
+	}
+	if m.maxMetrics > 0 {
+		opts = append(opts, vm.MaxMetrics(m.maxMetrics))
+	}
+	if m.pauseOverBudget > 0 {
+		opts = append(opts, vm.PauseOverBudget(m.pauseOverBudget))
+	}
+	if m.anomalyInterval > 0 {
+		opts = append(opts, vm.AnomalyDetection(m.anomalyInterval, m.anomalyThreshold))
+	}
+	if len(m.timerQuantiles) > 0 {
+		opts = append(opts, vm.TimerQuantiles(m.timerQuantiles))
+	}
+	if m.bytecodeCacheDir != "" {
+		opts = append(opts, vm.BytecodeCache(m.bytecodeCacheDir))
+	}
+	if m.eventSink != "" {
+		opts = append(opts, vm.EventSink(m.eventSink))
+	}
+	if m.geoIPDatabase != "" {
+		g, err := enrich.NewGeoIPCountry(m.geoIPDatabase)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, vm.Enrichment(vm.GeoIPCountry, g))
+	}
+	if m.version != "" {
+		opts = append(opts, vm.MtailVersion(m.version))
+	}
+	if m.revision != "" {
+		opts = append(opts, vm.MtailRevision(m.revision))
+	}
+	if m.audit != nil {
+		opts = append(opts, vm.AuditLog(m.audit))
+	}
+	if m.dryRunLines > 0 && m.adminToken != "" {
+		opts = append(opts, vm.RecentLines(m.dryRunLines))
+	}
+	if m.linezLines > 0 && m.adminToken != "" {
+		opts = append(opts, vm.LinesPerSource(m.linezLines))
+	}
+	if len(m.programDirs) > 0 {
+		opts = append(opts, vm.ProgramDirs(m.programDirs...))
+	}
 	var err error
 	m.l, err = vm.NewLoader(m.programPath, m.store, m.lines, m.w, m.fs, opts...)
 	if err != nil {
 		return err
 	}
-	if m.programPath == "" {
+	if m.programPath == "" && len(m.programDirs) == 0 {
 		return nil
 	}
 	if errs := m.l.LoadAllPrograms(); errs != nil {
@@ -119,8 +297,39 @@ func (m *MtailServer) initExporter() (err error) {
 	if m.omitProgLabel {
 		opts = append(opts, exporter.OmitProgLabel)
 	}
+	if m.numShards > 1 {
+		opts = append(opts, exporter.Shard(m.shard))
+	}
+	if m.snmpAddress != "" {
+		opts = append(opts, exporter.SNMPCommunity(m.snmpCommunity), exporter.SNMPOIDs(m.snmpBaseOID, m.snmpOIDMap))
+	}
+	if m.exportRules != "" {
+		opts = append(opts, exporter.ExportRules(m.exportRules))
+	}
+	opts = append(opts, m.pushBackends...)
 	m.e, err = exporter.New(m.store, opts...)
-	return
+	if err != nil {
+		return err
+	}
+	return m.auditExportConfig()
+}
+
+// initAlerts sets up an alert Evaluator for this MtailServer, if alert rules
+// are configured.
+func (m *MtailServer) initAlerts() error {
+	if m.alertRules == "" {
+		return nil
+	}
+	rules, err := alert.ReadRules(m.alertRules)
+	if err != nil {
+		return errors.Wrap(err, "alert rules")
+	}
+	var opts []func(*alert.Evaluator) error
+	if m.alertInterval > 0 {
+		opts = append(opts, alert.Interval(m.alertInterval))
+	}
+	m.a, err = alert.New(m.store, rules, opts...)
+	return err
 }
 
 // initTailer sets up a Tailer for this MtailServer.
@@ -130,11 +339,43 @@ func (m *MtailServer) initTailer() (err error) {
 	}
 	if m.oneShot {
 		opts = append(opts, tailer.OneShot)
+		if m.oneShotParallelism > 1 {
+			opts = append(opts, tailer.OneShotParallelism(m.oneShotParallelism))
+		}
+	}
+	if m.numShards > 1 {
+		opts = append(opts, tailer.Shard(m.shard, m.numShards))
+	}
+	if m.dockerJSONLogs {
+		opts = append(opts, tailer.DockerJSONLogs)
+	}
+	if m.containerLogs {
+		opts = append(opts, tailer.ContainerLogs)
+	}
+	if m.maxLineLength > 0 {
+		opts = append(opts, tailer.MaxLineLength(m.maxLineLength, m.longLinePolicy))
 	}
-	m.t, err = tailer.New(m.lines, m.fs, m.w, opts...)
+	opts = append(opts, m.lineFilters...)
+	if m.clock != nil {
+		opts = append(opts, tailer.Clock(m.clock))
+	}
+	lines := m.lines
+	if m.replay != nil {
+		// Interpose the replayer between the tailer and the loader.
+		lines = make(chan *logline.LogLine)
+		go m.replay.run(lines, m.lines)
+	}
+	m.t, err = tailer.New(lines, m.fs, m.w, opts...)
 	return
 }
 
+// gcInterval is how often datums set to expire by programs are removed.
+const gcInterval = time.Minute
+
+// refreshInterval is how often the datums of metrics declared with a refresh
+// interval are checked for staleness.
+const refreshInterval = time.Second
+
 const statusTemplate = `
 <html>
 <head>
@@ -142,9 +383,10 @@ const statusTemplate = `
 </head>
 <body>
 <h1>mtail on {{.BindAddress}}</h1>
-<p>Build: {{.BuildInfo}}</p>
-<p>Metrics: <a href="/json">json</a>, <a href="/metrics">prometheus</a>, <a href="/varz">varz</a></p>
-<p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a></p>
+<p>Build: {{.BuildInfo}} (<a href="/buildinfo">details</a>)</p>
+<p>Metrics: <a href="/json">json</a>, <a href="/metrics">prometheus</a>, <a href="/varz">varz</a>, <a href="/csv">csv</a>, <a href="/metricsproto">protobuf</a>, <a href="/stream">stream</a></p>
+<p>Health: <a href="/healthz">healthz</a>, <a href="/readyz">readyz</a></p>
+<p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a>, <a href="/debug/progz/profile">debug/progz/profile</a></p>
 `
 
 func (m *MtailServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -174,6 +416,16 @@ func (m *MtailServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		glog.Warningf("Error while writing tailer status: %s", err)
 	}
+	err = m.e.WriteStatusHTML(w)
+	if err != nil {
+		glog.Warningf("Error while writing exporter status: %s", err)
+	}
+	if m.a != nil {
+		err = m.a.WriteStatusHTML(w)
+		if err != nil {
+			glog.Warningf("Error while writing alert status: %s", err)
+		}
+	}
 }
 
 // ProgramPath sets the path to find mtail programs in the MtailServer.
@@ -184,6 +436,21 @@ func ProgramPath(path string) func(*MtailServer) error {
 	}
 }
 
+// ProgramDirs adds directories of programs to the MtailServer, each given as
+// a spec of the form DIR[,KEY=VALUE...] as described by vm.ParseProgramDir.
+func ProgramDirs(specs ...string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		for _, spec := range specs {
+			d, err := vm.ParseProgramDir(spec)
+			if err != nil {
+				return err
+			}
+			m.programDirs = append(m.programDirs, d)
+		}
+		return nil
+	}
+}
+
 // LogPathPatterns sets the patterns to find log paths in the MtailServer.
 func LogPathPatterns(patterns ...string) func(*MtailServer) error {
 	return func(m *MtailServer) error {
@@ -192,6 +459,147 @@ func LogPathPatterns(patterns ...string) func(*MtailServer) error {
 	}
 }
 
+// ListenAddresses sets the socket URLs, such as tcp://:5140, on which the
+// MtailServer receives log lines.
+func ListenAddresses(addresses ...string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.listenAddresses = addresses
+		return nil
+	}
+}
+
+// AMQP sets the MtailServer to consume log lines from queue on the AMQP
+// broker at uri, which may send up to prefetch messages before they are
+// acknowledged.
+func AMQP(uri, queue string, prefetch int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.amqpURI, m.amqpQueue, m.amqpPrefetch = uri, queue, prefetch
+		return nil
+	}
+}
+
+// NATS sets the MtailServer to receive log lines from the NATS server at uri,
+// on the subject or JetStream consumer described by sub.
+func NATS(uri string, sub tailer.NATSSubscription) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.natsURI, m.natsSub = uri, sub
+		return nil
+	}
+}
+
+// MQTT sets the MtailServer to receive log lines published on topics to the
+// MQTT broker at uri.
+func MQTT(uri string, topics []string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.mqttBroker, m.mqttTopics = uri, topics
+		return nil
+	}
+}
+
+// KubernetesLogs sets the MtailServer to tail all container logs in dir,
+// where the kubelet links the log files of the containers running on a node,
+// and to unwrap the log messages from the container runtime's format.  It
+// must be applied after LogPathPatterns.
+func KubernetesLogs(dir string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.logPathPatterns = append(m.logPathPatterns, filepath.Join(dir, "*.log"))
+		m.containerLogs = true
+		return nil
+	}
+}
+
+// UnwrapDockerJSON sets the MtailServer to read log files written by the
+// Docker json-file log driver, delivering the log messages they contain to
+// programs with the time Docker recorded as their timestamp.
+func UnwrapDockerJSON(m *MtailServer) error {
+	m.dockerJSONLogs = true
+	return nil
+}
+
+// MaxLineLength limits the log lines sent to the programs to n bytes; longer
+// lines are truncated or dropped, according to policy: "truncate" or "drop".
+func MaxLineLength(n int, policy string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.maxLineLength, m.longLinePolicy = n, policy
+		return nil
+	}
+}
+
+// BytecodeCacheDir caches compiled programs in dir, so that programs that
+// haven't changed aren't compiled again when mtail restarts.
+func BytecodeCacheDir(dir string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.bytecodeCacheDir = dir
+		return nil
+	}
+}
+
+// LogFilter drops the lines of the log files matching glob that don't match
+// the regular expression pattern, before they reach the programs.
+func LogFilter(glob, pattern string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.lineFilters = append(m.lineFilters, tailer.Filter(glob, pattern))
+		return nil
+	}
+}
+
+// LogSample sends only one in every n lines of the log files matching glob
+// to the programs.
+func LogSample(glob string, n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.lineFilters = append(m.lineFilters, tailer.Sample(glob, n))
+		return nil
+	}
+}
+
+// LogDedup drops the lines of the log files matching glob that repeat one of
+// the previous n lines of the same file.
+func LogDedup(glob string, n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.lineFilters = append(m.lineFilters, tailer.Dedup(glob, n))
+		return nil
+	}
+}
+
+// LogRecordSeparator splits what is read from the sources matching glob into
+// lines at sep instead of at newlines.
+func LogRecordSeparator(glob string, sep byte) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.lineFilters = append(m.lineFilters, tailer.RecordSeparator(glob, sep))
+		return nil
+	}
+}
+
+// LogReadFrom starts reading the log files matching glob that exist at
+// startup n bytes before their end, or from their start if n is
+// tailer.ReadFromStart, instead of at their end.
+func LogReadFrom(glob string, n int64) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.lineFilters = append(m.lineFilters, tailer.ReadFrom(glob, n))
+		return nil
+	}
+}
+
+// Clock sets the MtailServer to get the current time from now instead of
+// time.Now when it stamps the lines read and expires and refreshes datums, so
+// that tests can control it.
+func Clock(now func() time.Time) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.clock = now
+		m.store.SetClock(now)
+		return nil
+	}
+}
+
+// PushBackend adds the push backend b, under the given name, to those the
+// metrics are pushed to.
+func PushBackend(name string, b exporter.Backend) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.pushBackends = append(m.pushBackends, exporter.PushBackend(name, b))
+		return nil
+	}
+}
+
 // BindAddress sets the HTTP server address in MtailServer.
 func BindAddress(address, port string) func(*MtailServer) error {
 	return func(m *MtailServer) error {
@@ -208,6 +616,16 @@ func BuildInfo(info string) func(*MtailServer) error {
 	}
 }
 
+// Version sets the mtail release version and git revision reported on
+// /buildinfo.
+func Version(version, revision string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.version = version
+		m.revision = revision
+		return nil
+	}
+}
+
 // OverrideLocation sets the timezone location for log timestamps without any such information.
 func OverrideLocation(loc *time.Location) func(*MtailServer) error {
 	return func(m *MtailServer) error {
@@ -227,12 +645,258 @@ func PollInterval(interval time.Duration) func(*MtailServer) error {
 	}
 }
 
+// AdminToken sets the bearer token that clients must present to use the admin API.
+func AdminToken(token string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.adminToken = token
+		return nil
+	}
+}
+
+// StallThreshold sets how long the programs may take to accept a log line
+// before the health check fails.
+func StallThreshold(d time.Duration) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		if d <= 0 {
+			return errors.New("stall threshold must be positive")
+		}
+		m.stallThreshold = d
+		return nil
+	}
+}
+
 // OneShot sets one-shot mode in the MtailServer.
 func OneShot(m *MtailServer) error {
 	m.oneShot = true
 	return nil
 }
 
+// OneShotFormat sets the format of the metrics printed at the end of one-shot
+// mode; one of "json", "text", or "prometheus".
+func OneShotFormat(format string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		switch format {
+		case "json", "text", "prometheus":
+			m.oneShotFormat = format
+			return nil
+		}
+		return errors.Errorf("unknown one-shot format %q", format)
+	}
+}
+
+// OneShotParallelism sets the MtailServer to read and process up to n log
+// files at once in one-shot mode.  The lines of each log file are processed
+// in order, but the lines of different log files are not.
+func OneShotParallelism(n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		if n < 1 {
+			return errors.Errorf("invalid one-shot parallelism %d", n)
+		}
+		m.oneShotParallelism = n
+		return nil
+	}
+}
+
+// CompareGolden sets the MtailServer to compare the metrics at the end of
+// one-shot mode with the contents of the file at path, instead of printing
+// them.
+func CompareGolden(path string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.goldenPath = path
+		return nil
+	}
+}
+
+// Coverage sets the MtailServer to print, at the end of one-shot mode, which
+// patterns of each program matched no lines and which lines matched no
+// patterns, instead of the metrics.
+func Coverage(m *MtailServer) error {
+	m.coverage = true
+	return nil
+}
+
+// Replay sets the MtailServer to deliver lines in one-shot mode at the rate
+// they were logged, multiplied by speed.  The timestamp of each line is found
+// in the first capture group of pattern, and parsed with layout.
+func Replay(pattern, layout string, speed float64) func(*MtailServer) error {
+	return func(m *MtailServer) (err error) {
+		m.replay, err = newReplayer(pattern, layout, speed, m.overrideLocation)
+		return
+	}
+}
+
+// Shard sets the MtailServer to only read the log files in shard index, of
+// count shards, and to label its metrics with the shard.
+func Shard(index, count int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		if count < 1 || index < 0 || index >= count {
+			return errors.Errorf("invalid shard %d of %d", index, count)
+		}
+		m.shard, m.numShards = index, count
+		return nil
+	}
+}
+
+// MetricCollisions sets the policy for metric names exported by more than one
+// program: "warn", "reject", or "namespace".
+func MetricCollisions(policy string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.collisionPolicy = policy
+		return nil
+	}
+}
+
+// ProgramLoadPolicy sets the policy for programs that fail to load at startup:
+// "permissive" skips them, and "strict" fails startup.
+func ProgramLoadPolicy(policy string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.loadPolicy = policy
+		return nil
+	}
+}
+
+// MaxLabelValues sets the maximum number of sets of label values each metric
+// may have before further values are folded into an overflow set.  Zero
+// means no limit.
+func MaxLabelValues(n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.maxLabelValues = n
+		return nil
+	}
+}
+
+// LineBudget sets the time each program may spend processing one log line
+// before it abandons the line.  Zero means no limit.
+func LineBudget(d time.Duration) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.lineBudget = d
+		return nil
+	}
+}
+
+// InstructionBudget sets the number of instructions each program may execute
+// on one log line before it abandons the line.  Zero means no limit.
+func InstructionBudget(n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.maxInstructions = n
+		return nil
+	}
+}
+
+// MaxMetrics sets the number of metrics each program may export.  Zero means
+// no limit.
+func MaxMetrics(n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.maxMetrics = n
+		return nil
+	}
+}
+
+// PauseOverBudget pauses a program once it has abandoned n log lines for
+// exceeding its budgets.  Zero means programs are never paused for this.
+func PauseOverBudget(n int64) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.pauseOverBudget = n
+		return nil
+	}
+}
+
+// EventSink sets the file or socket to which the events emitted by programs
+// with the emit builtin are written.
+func EventSink(address string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.eventSink = address
+		return nil
+	}
+}
+
+// GeoIPDatabase sets the MaxMind GeoIP2 or GeoLite2 database in which the
+// geoip_country builtin looks up the country of IP addresses.
+func GeoIPDatabase(path string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.geoIPDatabase = path
+		return nil
+	}
+}
+
+// ExportRules sets the file of rules that filter, rename and relabel the
+// metrics before they are exported.
+func ExportRules(path string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.exportRules = path
+		return nil
+	}
+}
+
+// DiagnosticsDir sets the directory to which a diagnostic dump is written on
+// SIGUSR1.  If it isn't set, the dump is written to the log.
+func DiagnosticsDir(dir string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.diagnosticsDir = dir
+		return nil
+	}
+}
+
+// DryRunLines sets the number of recent log lines kept for programs submitted
+// to the /dryrun admin endpoint to be run against.
+func DryRunLines(n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.dryRunLines = n
+		return nil
+	}
+}
+
+// LinezLines sets the number of recent log lines kept from each source, to be
+// shown by the /linez admin endpoint.
+func LinezLines(n int) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.linezLines = n
+		return nil
+	}
+}
+
+// MatchRateAnomalies sets the MtailServer to compare the match rate of each
+// program every interval with its recent baseline, and flag rates more than
+// threshold times, or less than one threshold-th of, the baseline.  A zero
+// interval disables this.
+func MatchRateAnomalies(interval time.Duration, threshold float64) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.anomalyInterval, m.anomalyThreshold = interval, threshold
+		return nil
+	}
+}
+
+// AlertRules sets the file of alert rules to evaluate over the metrics, and
+// how often to evaluate them.  If interval is zero, the default is used.
+func AlertRules(path string, interval time.Duration) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.alertRules, m.alertInterval = path, interval
+		return nil
+	}
+}
+
+// TimerQuantiles sets the quantiles of the values of each timer metric to
+// estimate and export as a summary.
+func TimerQuantiles(qs []float64) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.timerQuantiles = qs
+		return nil
+	}
+}
+
+// SNMP answers SNMP requests for the metrics on the UDP address given.
+// Requests must present the community string.  Metrics are exported under
+// baseOID, unless oidMap names a file that gives the OID of a metric.
+func SNMP(address, community, baseOID, oidMap string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.snmpAddress = address
+		m.snmpCommunity = community
+		m.snmpBaseOID = baseOID
+		m.snmpOIDMap = oidMap
+		return nil
+	}
+}
+
 // CompileOnly sets compile-only mode in the MtailServer.
 func CompileOnly(m *MtailServer) error {
 	m.compileOnly = true
@@ -278,18 +942,28 @@ func OmitMetricSource(m *MtailServer) error {
 // New creates a MtailServer from the supplied Options.
 func New(store *metrics.Store, w watcher.Watcher, fs afero.Fs, options ...func(*MtailServer) error) (*MtailServer, error) {
 	m := &MtailServer{
-		store:   store,
-		lines:   make(chan *logline.LogLine),
-		w:       w,
-		fs:      fs,
-		webquit: make(chan struct{}),
+		store:          store,
+		lines:          make(chan *logline.LogLine),
+		w:              w,
+		fs:             fs,
+		webquit:        make(chan struct{}),
+		oneShotFormat:  "json",
+		stallThreshold: defaultStallThreshold,
+		startTime:      time.Now(),
+		flags:          flag.CommandLine,
 	}
 	if err := m.SetOption(options...); err != nil {
 		return nil, err
 	}
+	if err := m.initAudit(); err != nil {
+		return nil, err
+	}
 	if err := m.initExporter(); err != nil {
 		return nil, err
 	}
+	if err := m.initAlerts(); err != nil {
+		return nil, err
+	}
 	if err := m.initLoader(); err != nil {
 		return nil, err
 	}
@@ -331,14 +1005,57 @@ func (m *MtailServer) Serve() error {
 	http.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
 	http.HandleFunc("/metrics", http.HandlerFunc(m.e.HandlePrometheusMetrics))
 	http.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
+	http.HandleFunc("/csv", http.HandlerFunc(m.e.HandleCSV))
+	http.HandleFunc("/metricsproto", http.HandlerFunc(m.e.HandleProto))
+	http.HandleFunc("/rpc", http.HandlerFunc(m.e.HandleRPC))
+	http.HandleFunc("/stream", http.HandlerFunc(m.e.HandleStream))
 	http.HandleFunc("/quitquitquit", http.HandlerFunc(m.handleQuit))
+	http.HandleFunc("/logs", m.requireAdmin(m.handleLogs))
+	http.HandleFunc("/reset", m.requireAdmin(m.handleReset))
+	http.HandleFunc("/dryrun", m.requireAdmin(m.handleDryRun))
+	http.HandleFunc("/linez", m.requireAdmin(m.handleLinez))
+	http.HandleFunc("/programs", m.requireAdmin(m.handlePrograms))
+	http.HandleFunc("/debug/progz/profile", m.handleProfile)
+	http.HandleFunc("/healthz", m.handleHealthz)
+	http.HandleFunc("/readyz", m.handleReadyz)
+	http.HandleFunc("/buildinfo", m.handleBuildInfo)
+	http.HandleFunc("/auditz", m.handleAuditz)
 	m.e.StartMetricPush()
+	if m.a != nil {
+		m.a.Start()
+	}
+	gcDone := make(chan struct{})
+	defer close(gcDone)
+	m.store.StartGcLoop(gcInterval, gcDone)
+	m.store.StartRefreshLoop(refreshInterval, gcDone)
+
+	if m.snmpAddress != "" {
+		conn, err := net.ListenPacket("udp", m.snmpAddress)
+		if err != nil {
+			return errors.Wrap(err, "SNMP listener")
+		}
+		defer conn.Close()
+		go func() {
+			glog.Infof("Answering SNMP requests on %s", conn.LocalAddr())
+			if err := m.e.ServeSNMP(conn); err != nil {
+				glog.V(1).Infof("SNMP listener stopped: %s", err)
+			}
+		}()
+	}
 
+	ln, err := net.Listen("tcp", m.bindAddress)
+	if err != nil {
+		return errors.Wrap(err, "HTTP listener")
+	}
+	// Every log file and socket is open, so root is no longer needed.
+	if err := m.dropPrivileges(); err != nil {
+		return err
+	}
 	go func() {
 		glog.Infof("Listening on port %s", m.bindAddress)
-		err := http.ListenAndServe(m.bindAddress, nil)
+		err := http.Serve(ln, nil)
 		if err != nil {
-			glog.Exit(err)
+			Exit(err)
 		}
 	}()
 	m.WaitForShutdown()
@@ -368,6 +1085,15 @@ func (m *MtailServer) WaitForShutdown() {
 	if err := m.Close(); err != nil {
 		glog.Warning(err)
 	}
+	if err := m.e.Close(); err != nil {
+		glog.Warning(err)
+	}
+	if m.a != nil {
+		if err := m.a.Close(); err != nil {
+			glog.Warning(err)
+		}
+	}
+	m.closeAudit()
 }
 
 // Close handles the graceful shutdown of this mtail instance, ensuring that it only occurs once.
@@ -406,16 +1132,50 @@ func (m *MtailServer) Run() error {
 		glog.Info("compile-only is set, exiting")
 		return nil
 	}
+	diagnosticsDone := make(chan struct{})
+	defer close(diagnosticsDone)
+	m.startDiagnosticDumps(diagnosticsDone)
+	if m.replay != nil {
+		// Push metrics while replaying, so push collectors receive a time
+		// series rather than a single final value.
+		m.e.StartMetricPush()
+	}
+	if m.genlog != nil {
+		err := m.runGenerateLog(os.Stdout)
+		if eerr := m.e.Close(); eerr != nil {
+			glog.Warning(eerr)
+		}
+		m.closeAudit()
+		return err
+	}
+	if err := m.enterChroot(); err != nil {
+		return err
+	}
 	if err := m.StartTailing(); err != nil {
-		glog.Exitf("tailing failed: %s", err)
+		Exitf("tailing failed: %s", err)
 	}
 	if m.oneShot {
 		err := m.Close()
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Metrics store:")
-		if err := m.WriteMetrics(os.Stdout); err != nil {
+		if m.replay != nil {
+			m.e.PushMetrics()
+		}
+		if err := m.e.Close(); err != nil {
+			glog.Warning(err)
+		}
+		m.closeAudit()
+		if m.goldenPath != "" {
+			return m.compareGolden(os.Stdout)
+		}
+		if m.coverage {
+			return m.l.WriteCoverageReport(os.Stdout)
+		}
+		if m.oneShotFormat == "json" {
+			fmt.Print(jsonPrefix)
+		}
+		if err := m.writeOneShotMetrics(os.Stdout); err != nil {
 			return err
 		}
 	} else {
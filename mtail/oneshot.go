@@ -0,0 +1,98 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// jsonPrefix is printed before the metrics in the json format at the end of
+// one-shot mode.
+const jsonPrefix = "Metrics store:"
+
+// writeOneShotMetrics writes the contents of the metric store to w in the
+// format selected for one-shot mode.
+func (m *MtailServer) writeOneShotMetrics(w io.Writer) error {
+	switch m.oneShotFormat {
+	case "text":
+		return m.e.WriteTextMetrics(w)
+	case "prometheus":
+		m.e.WritePrometheusMetrics(w)
+		return nil
+	default:
+		return m.WriteMetrics(w)
+	}
+}
+
+// compareGolden compares the metrics dumped in the one-shot format against
+// the contents of the golden file, writing any differences to w.  It returns
+// an error if the two differ.
+func (m *MtailServer) compareGolden(w io.Writer) error {
+	golden, err := afero.ReadFile(m.fs, m.goldenPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to read golden file")
+	}
+	var b bytes.Buffer
+	if err := m.writeOneShotMetrics(&b); err != nil {
+		return err
+	}
+	missing, extra := diffLines(m.goldenText(string(golden)), m.goldenText(b.String()))
+	if len(missing) == 0 && len(extra) == 0 {
+		return nil
+	}
+	for _, l := range missing {
+		fmt.Fprintf(w, "-%s\n", l)
+	}
+	for _, l := range extra {
+		fmt.Fprintf(w, "+%s\n", l)
+	}
+	return errors.Errorf("metrics differ from golden file %q: %d missing, %d unexpected", m.goldenPath, len(missing), len(extra))
+}
+
+// jsonTimeRe matches the timestamps of datums in the json format.
+var jsonTimeRe = regexp.MustCompile(`"Time": -?[0-9]+`)
+
+// goldenText returns metrics printed in the one-shot format without what
+// makes two runs over the same logs differ: the prefix printed before the
+// json format, and the timestamps of datums, which are the time a line was
+// processed unless the program sets them from the log.
+func (m *MtailServer) goldenText(s string) string {
+	if m.oneShotFormat != "json" && m.oneShotFormat != "" {
+		return s
+	}
+	s = strings.TrimPrefix(s, jsonPrefix)
+	return jsonTimeRe.ReplaceAllString(s, `"Time": 0`)
+}
+
+// diffLines returns the lines of want not in got, and the lines of got not
+// in want.  The order of lines is not significant, as some formats don't
+// emit metrics in a stable order.
+func diffLines(want, got string) (missing, extra []string) {
+	count := make(map[string]int)
+	for _, l := range strings.Split(want, "\n") {
+		count[l]++
+	}
+	for _, l := range strings.Split(got, "\n") {
+		count[l]--
+	}
+	for l, n := range count {
+		for ; n > 0; n-- {
+			missing = append(missing, l)
+		}
+		for ; n < 0; n++ {
+			extra = append(extra, l)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return
+}
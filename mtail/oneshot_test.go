@@ -0,0 +1,106 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/exporter"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/spf13/afero"
+)
+
+var compareGoldenTests = []struct {
+	name   string
+	format string
+	golden string
+	diff   string
+	ok     bool
+}{
+	{"same", "text",
+		"foo{prog=test} 1\n",
+		"",
+		true},
+	{"different value", "text",
+		"foo{prog=test} 2\n",
+		"-foo{prog=test} 2\n+foo{prog=test} 1\n",
+		false},
+	{"missing", "text",
+		"bar{prog=test} 1\nfoo{prog=test} 1\n",
+		"-bar{prog=test} 1\n",
+		false},
+	// Golden files are saved from the printed json, with its prefix, and
+	// the times lines were processed.
+	{"json", "json",
+		jsonPrefix + `{
+  "foo": [
+    {
+      "Name": "foo",
+      "Program": "test",
+      "Kind": 1,
+      "Type": 0,
+      "LabelValues": [
+        {
+          "Value": {
+            "Value": 1,
+            "Time": 1539600000000000000
+          }
+        }
+      ]
+    }
+  ]
+}`,
+		"",
+		true},
+	{"json different value", "json",
+		jsonPrefix + `{"foo": [{"Value": 2, "Time": 1}]}`,
+		"",
+		false},
+}
+
+func TestCompareGolden(t *testing.T) {
+	for _, tc := range compareGoldenTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store := metrics.NewStore()
+			m := &metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(1397586900, 0))}},
+			}
+			if err := store.Add(m); err != nil {
+				t.Fatal(err)
+			}
+			e, err := exporter.New(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs := afero.NewMemMapFs()
+			if err := afero.WriteFile(fs, "/golden", []byte(tc.golden), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s := &MtailServer{store: store, fs: fs, e: e, oneShotFormat: tc.format, goldenPath: "/golden"}
+			var b bytes.Buffer
+			err = s.compareGolden(&b)
+			if tc.ok != (err == nil) {
+				t.Errorf("unexpected error state: %v", err)
+			}
+			// A json diff is too long to spell out, so only check there is one.
+			if tc.format == "json" && !tc.ok {
+				if b.Len() == 0 {
+					t.Error("no differences written")
+				}
+				return
+			}
+			if diff := cmp.Diff(tc.diff, b.String()); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
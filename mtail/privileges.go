@@ -0,0 +1,161 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/tailer"
+	"github.com/pkg/errors"
+)
+
+// account is a user and group that mtail runs as.
+type account struct {
+	uid, gid int
+}
+
+// RunAs sets mtail to change to the user and group, given by name or number,
+// once it has opened its log files and listening sockets.  If the group is
+// empty, it is the user's primary group.
+func RunAs(userName, groupName string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		if userName == "" && groupName == "" {
+			return nil
+		}
+		a := &account{uid: os.Getuid(), gid: os.Getgid()}
+		if userName != "" {
+			u, err := lookupUser(userName)
+			if err != nil {
+				return err
+			}
+			if a.uid, err = strconv.Atoi(u.Uid); err != nil {
+				return errors.Wrapf(err, "bad uid of user %q", userName)
+			}
+			if a.gid, err = strconv.Atoi(u.Gid); err != nil {
+				return errors.Wrapf(err, "bad gid of user %q", userName)
+			}
+		}
+		if groupName != "" {
+			gid, err := lookupGroup(groupName)
+			if err != nil {
+				return err
+			}
+			a.gid = gid
+		}
+		m.runAs = a
+		return nil
+	}
+}
+
+// lookupUser finds a user by name, or by number.
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		// A user that isn't in the user database runs in a group of the same number.
+		return &user.User{Uid: name, Gid: name}, nil
+	}
+	u, err := user.Lookup(name)
+	return u, errors.Wrapf(err, "unknown user %q", name)
+}
+
+// lookupGroup finds the id of a group by name, or by number.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unknown group %q", name)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Chroot sets mtail to change its root directory to dir before it opens the
+// log files, which must be in dir.
+func Chroot(dir string) func(*MtailServer) error {
+	return func(m *MtailServer) error {
+		m.chroot = dir
+		return nil
+	}
+}
+
+// RestrictSyscalls sets mtail to stop itself from making system calls that a
+// log reader has no need of, such as running programs, once it has changed
+// user.
+func RestrictSyscalls(m *MtailServer) error {
+	m.restrictSyscalls = true
+	return nil
+}
+
+// chrootPatterns returns the log path patterns as seen from inside the root
+// directory dir.  Patterns for object storage are unchanged.
+func chrootPatterns(dir string, patterns []string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	for _, pattern := range patterns {
+		if tailer.IsObjectURL(pattern) {
+			r = append(r, pattern)
+			continue
+		}
+		abs, err := filepath.Abs(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, errors.Errorf("log path pattern %q is not in the chroot directory %q", pattern, dir)
+		}
+		r = append(r, filepath.Join(string(filepath.Separator), rel))
+	}
+	return r, nil
+}
+
+// enterChroot changes the root directory, if mtail is set to, and the log
+// path patterns with it.
+func (m *MtailServer) enterChroot() error {
+	if m.chroot == "" {
+		return nil
+	}
+	patterns, err := chrootPatterns(m.chroot, m.logPathPatterns)
+	if err != nil {
+		return err
+	}
+	if err := chroot(m.chroot); err != nil {
+		return errors.Wrapf(err, "failed to change root to %q", m.chroot)
+	}
+	m.logPathPatterns = patterns
+	glog.Infof("Changed root to %s", m.chroot)
+	return nil
+}
+
+// dropPrivileges changes the user and group, and restricts the system calls,
+// if mtail is set to.
+func (m *MtailServer) dropPrivileges() error {
+	if m.runAs != nil {
+		if err := setCredentials(m.runAs.uid, m.runAs.gid); err != nil {
+			return errors.Wrapf(err, "failed to change to user %d and group %d", m.runAs.uid, m.runAs.gid)
+		}
+		if os.Getuid() != m.runAs.uid || os.Geteuid() != m.runAs.uid || os.Getgid() != m.runAs.gid {
+			return errors.Errorf("still running as user %d and group %d after changing to user %d and group %d", os.Geteuid(), os.Getegid(), m.runAs.uid, m.runAs.gid)
+		}
+		glog.Infof("Running as user %d and group %d", m.runAs.uid, m.runAs.gid)
+	}
+	if m.restrictSyscalls {
+		if err := restrictSyscalls(); err != nil {
+			return errors.Wrap(err, "failed to restrict system calls")
+		}
+		glog.Info("Restricted system calls")
+	}
+	return nil
+}
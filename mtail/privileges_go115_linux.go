@@ -0,0 +1,13 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Before go1.16 the user of only one thread could be changed.
+// +build !go1.16
+
+package mtail
+
+import "github.com/pkg/errors"
+
+func setCredentials(uid, gid int) error {
+	return errors.New("changing user on Linux needs mtail built with Go 1.16 or later")
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Only build with go1.16 or above, as before then the set*id system calls
+// changed the credentials of the calling thread alone, leaving the others
+// running as root.
+// +build go1.16
+
+package mtail
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// setCredentials changes the real, effective and saved user and group of
+// every thread of mtail, and drops its supplementary groups, so that it
+// can't change back.
+func setCredentials(uid, gid int) error {
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	// The credentials are checked on the thread that changed them.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Setgroups([]int{gid}); err != nil {
+		return errors.Wrap(err, "setgroups")
+	}
+	if err := unix.Setresgid(gid, gid, gid); err != nil {
+		return errors.Wrap(err, "setresgid")
+	}
+	if err := unix.Setresuid(uid, uid, uid); err != nil {
+		return errors.Wrap(err, "setresuid")
+	}
+	if unix.Getuid() != uid || unix.Geteuid() != uid || unix.Getgid() != gid || unix.Getegid() != gid {
+		return errors.Errorf("thread still running as user %d and group %d", unix.Geteuid(), unix.Getegid())
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// +build !linux,!windows
+
+package mtail
+
+import (
+	"os"
+	"syscall"
+)
+
+// setCredentials changes the user and group of mtail, and drops its
+// supplementary groups.  Outside Linux, credentials belong to the process
+// rather than to each thread.
+func setCredentials(uid, gid int) error {
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
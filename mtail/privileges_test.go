@@ -0,0 +1,52 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChrootPatterns(t *testing.T) {
+	got, err := chrootPatterns("/var/log", []string{"/var/log/syslog", "/var/log/nginx/*.log", "/var/log", "s3://logs/app/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"/syslog", "/nginx/*.log", "/", "s3://logs/app/"}, got); diff != "" {
+		t.Errorf("patterns differ:\n%s", diff)
+	}
+	for _, pattern := range []string{"/var/logs/syslog", "/etc/passwd", "/var/log/../lib/x"} {
+		if _, err := chrootPatterns("/var/log", []string{pattern}); err == nil {
+			t.Errorf("expected error for %q outside the chroot", pattern)
+		}
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	for _, tc := range []struct {
+		user, group string
+		expected    *account
+	}{
+		{"", "", nil},
+		{"root", "", &account{0, 0}},
+		{"0", "", &account{0, 0}},
+		{"0", "12345", &account{0, 12345}},
+		{"54321", "", &account{54321, 54321}},
+	} {
+		m := &MtailServer{}
+		if err := RunAs(tc.user, tc.group)(m); err != nil {
+			t.Errorf("RunAs(%q, %q) error: %s", tc.user, tc.group, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.expected, m.runAs, cmp.AllowUnexported(account{})); diff != "" {
+			t.Errorf("RunAs(%q, %q) differs:\n%s", tc.user, tc.group, diff)
+		}
+	}
+	for _, tc := range [][2]string{{"no-such-user-here", ""}, {"root", "no-such-group-here"}} {
+		if err := RunAs(tc[0], tc[1])(&MtailServer{}); err == nil {
+			t.Errorf("expected error for RunAs(%q, %q)", tc[0], tc[1])
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// +build !windows
+
+package mtail
+
+import (
+	"os"
+	"syscall"
+)
+
+// chroot changes the root directory to dir, and the working directory to the
+// new root.
+func chroot(dir string) error {
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+	return os.Chdir("/")
+}
@@ -0,0 +1,14 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import "github.com/pkg/errors"
+
+func chroot(dir string) error {
+	return errors.New("chroot is not supported on Windows")
+}
+
+func setCredentials(uid, gid int) error {
+	return errors.New("changing user is not supported on Windows")
+}
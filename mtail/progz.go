@@ -0,0 +1,52 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultProfileSeconds = 10
+	maxProfileSeconds     = 300
+)
+
+// handleProfile collects a profile of the time spent by each program, and
+// each regular expression, over the number of seconds given by the `seconds`
+// query parameter, and writes it as a table sorted by time.
+func (m *MtailServer) handleProfile(w http.ResponseWriter, r *http.Request) {
+	seconds := defaultProfileSeconds
+	if s := r.FormValue("seconds"); s != "" {
+		var err error
+		seconds, err = strconv.Atoi(s)
+		if err != nil || seconds <= 0 || seconds > maxProfileSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", maxProfileSeconds), http.StatusBadRequest)
+			return
+		}
+	}
+	window := time.Duration(seconds) * time.Second
+	entries := m.l.Profile(r.Context(), window)
+
+	w.Header().Set("Content-type", "text/plain")
+	fmt.Fprintf(w, "Profile of programs over %s.  Regexp time is included in its program's time.\n\n", window)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "time\t% of window\tcount\ttime/op\tprogram\tregexp")
+	for _, e := range entries {
+		var perOp time.Duration
+		if e.Count > 0 {
+			perOp = e.Time / time.Duration(e.Count)
+		}
+		fmt.Fprintf(tw, "%s\t%.2f%%\t%d\t%s\t%s\t%s\n",
+			e.Time, 100*float64(e.Time)/float64(window), e.Count, perOp, e.Program, e.Regexp)
+	}
+	if err := tw.Flush(); err != nil {
+		glog.Info(err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/logline"
+	"github.com/pkg/errors"
+)
+
+// replayer paces the delivery of log lines to the programs according to the
+// timestamps in the lines, so that historical logs are processed at the rate
+// they were written, or a multiple of it.
+type replayer struct {
+	re     *regexp.Regexp // Extracts the timestamp from a line in its first capture group.
+	layout string         // Layout of the timestamp, for time.Parse.
+	speed  float64        // Multiple of the original rate to replay at.
+	loc    *time.Location // Location of timestamps without a zone.
+
+	first time.Time // Timestamp of the first line.
+	start time.Time // Wall time the first line was delivered.
+
+	now   func() time.Time    // Replaceable for testing.
+	sleep func(time.Duration) // Replaceable for testing.
+}
+
+func newReplayer(pattern, layout string, speed float64, loc *time.Location) (*replayer, error) {
+	if speed <= 0 {
+		return nil, errors.Errorf("replay speed must be positive, got %g", speed)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid replay timestamp pattern")
+	}
+	if re.NumSubexp() < 1 {
+		return nil, errors.Errorf("replay timestamp pattern %q has no capture group", pattern)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &replayer{re: re, layout: layout, speed: speed, loc: loc, now: time.Now, sleep: time.Sleep}, nil
+}
+
+// run copies lines from in to out, delaying each until the time since the
+// first line is the same, after scaling by the speed, as the difference in
+// their timestamps.  Lines without a timestamp are passed through
+// immediately.  out is closed when in is closed.
+func (r *replayer) run(in <-chan *logline.LogLine, out chan<- *logline.LogLine) {
+	defer close(out)
+	for line := range in {
+		r.wait(line.Line)
+		out <- line
+	}
+}
+
+func (r *replayer) wait(line string) {
+	m := r.re.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	ts, err := time.ParseInLocation(r.layout, m[1], r.loc)
+	if err != nil {
+		glog.V(1).Infof("replay: can't parse timestamp: %s", err)
+		return
+	}
+	if r.first.IsZero() {
+		r.first, r.start = ts, r.now()
+		return
+	}
+	offset := time.Duration(float64(ts.Sub(r.first)) / r.speed)
+	if d := r.start.Add(offset).Sub(r.now()); d > 0 {
+		r.sleep(d)
+	}
+}
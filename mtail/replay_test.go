@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+)
+
+var replayTests = []struct {
+	name   string
+	speed  float64
+	lines  []string
+	sleeps []time.Duration
+}{
+	{"realtime",
+		1,
+		[]string{
+			"2018-06-16T03:37:54Z first",
+			"2018-06-16T03:37:55Z second",
+			"no timestamp",
+			"2018-06-16T03:37:58Z third",
+		},
+		[]time.Duration{time.Second, 3 * time.Second}},
+	{"double speed",
+		2,
+		[]string{
+			"2018-06-16T03:37:54Z first",
+			"2018-06-16T03:37:58Z second",
+		},
+		[]time.Duration{2 * time.Second}},
+	{"out of order",
+		1,
+		[]string{
+			"2018-06-16T03:37:54Z first",
+			"2018-06-16T03:37:52Z second",
+		},
+		nil},
+}
+
+func TestReplay(t *testing.T) {
+	for _, tc := range replayTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newReplayer(`^(\S+)`, time.RFC3339, tc.speed, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock := time.Unix(0, 0)
+			r.now = func() time.Time { return clock }
+			var sleeps []time.Duration
+			r.sleep = func(d time.Duration) {
+				sleeps = append(sleeps, d)
+				clock = clock.Add(d)
+			}
+			in := make(chan *logline.LogLine)
+			out := make(chan *logline.LogLine)
+			go r.run(in, out)
+			for _, l := range tc.lines {
+				in <- logline.NewLogLine("test", l)
+				if got := <-out; got.Line != l {
+					t.Errorf("unexpected line %q, want %q", got.Line, l)
+				}
+			}
+			close(in)
+			if _, ok := <-out; ok {
+				t.Error("output not closed")
+			}
+			if diff := cmp.Diff(tc.sleeps, sleeps); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestNewReplayerErrors(t *testing.T) {
+	if _, err := newReplayer(`^(\S+)`, time.RFC3339, 0, nil); err == nil {
+		t.Error("expected error for zero speed")
+	}
+	if _, err := newReplayer(`^\S+`, time.RFC3339, 1, nil); err == nil {
+		t.Error("expected error for pattern without capture group")
+	}
+}
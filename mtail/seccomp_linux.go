@@ -0,0 +1,122 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/seccomp.h that aren't in the unix package.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+
+	// x32SyscallBit is set in the numbers of the system calls of the x32
+	// ABI on amd64.
+	x32SyscallBit = 0x40000000
+)
+
+// auditArches are the seccomp architectures of the GOARCHes on which system
+// calls can be restricted.
+var auditArches = map[string]uint32{
+	"amd64": unix.AUDIT_ARCH_X86_64,
+	"arm64": unix.AUDIT_ARCH_AARCH64,
+}
+
+// deniedSyscalls are the system calls that fail with EPERM once system calls
+// are restricted: running programs, debugging other processes, changing
+// users, namespaces, mounts or the kernel, and the like.
+var deniedSyscalls = []uint32{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_SETUID,
+	unix.SYS_SETGID,
+	unix.SYS_SETREUID,
+	unix.SYS_SETREGID,
+	unix.SYS_SETRESUID,
+	unix.SYS_SETRESGID,
+	unix.SYS_SETGROUPS,
+	unix.SYS_SETFSUID,
+	unix.SYS_SETFSGID,
+	unix.SYS_CHROOT,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+}
+
+// seccompFilter returns a BPF program that denies the system calls, and any
+// system call of another architecture than arch.
+func seccompFilter(arch uint32, denied []uint32) []unix.SockFilter {
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)}
+	filter := []unix.SockFilter{
+		// Load the architecture from struct seccomp_data.
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: arch, Jt: 1},
+		deny,
+		// Load the system call number.
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, K: x32SyscallBit, Jf: 1},
+		deny,
+	}
+	for _, nr := range denied {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: nr, Jf: 1},
+			deny)
+	}
+	return append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+}
+
+// restrictSyscalls installs a seccomp filter on every thread of mtail that
+// denies the system calls it doesn't need.  The filter can't be removed, and
+// is inherited by any child process.
+func restrictSyscalls() error {
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return errors.Errorf("not supported on %s", runtime.GOARCH)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "prctl(PR_SET_NO_NEW_PRIVS)")
+	}
+	filter := seccompFilter(arch, deniedSyscalls)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	r, _, errno := unix.RawSyscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errors.Wrap(errno, "seccomp")
+	}
+	if r != 0 {
+		return errors.Errorf("seccomp: thread %d could not be synchronised", r)
+	}
+	return nil
+}
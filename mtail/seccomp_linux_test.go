@@ -0,0 +1,46 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRestrictSyscalls(t *testing.T) {
+	if os.Getenv("MTAIL_TEST_RESTRICT_SYSCALLS") == "1" {
+		// In the child process, whose system calls can be restricted
+		// without affecting the other tests.
+		if err := restrictSyscalls(); err != nil {
+			fmt.Printf("restrict failed: %s\n", err)
+			os.Exit(2)
+		}
+		if _, err := os.Stat("/"); err != nil {
+			fmt.Printf("stat failed: %s\n", err)
+			os.Exit(1)
+		}
+		err := exec.Command("/bin/true").Run()
+		fmt.Printf("exec: %v\n", err)
+		os.Exit(0)
+	}
+	if _, ok := auditArches[runtime.GOARCH]; !ok {
+		t.Skipf("system calls can't be restricted on %s", runtime.GOARCH)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestrictSyscalls$")
+	cmd.Env = append(os.Environ(), "MTAIL_TEST_RESTRICT_SYSCALLS=1")
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "restrict failed") {
+		t.Skipf("seccomp unavailable: %s", out)
+	}
+	if err != nil {
+		t.Fatalf("child failed: %s\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "exec: fork/exec /bin/true: operation not permitted") {
+		t.Errorf("exec wasn't denied:\n%s", out)
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// +build !linux
+
+package mtail
+
+import "github.com/pkg/errors"
+
+func restrictSyscalls() error {
+	return errors.New("only supported on Linux")
+}
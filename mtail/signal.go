@@ -0,0 +1,14 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// +build !windows
+
+package mtail
+
+import (
+	"os"
+	"syscall"
+)
+
+// diagnosticSignals are the signals on which mtail dumps its diagnostics.
+var diagnosticSignals = []os.Signal{syscall.SIGUSR1}
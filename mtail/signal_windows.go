@@ -0,0 +1,10 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import "os"
+
+// diagnosticSignals are the signals on which mtail dumps its diagnostics.
+// Windows has no user defined signals.
+var diagnosticSignals []os.Signal
@@ -0,0 +1,426 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+
+	// amqpFrameMax is the largest frame the fake broker accepts.
+	amqpFrameMax = 131072
+)
+
+// AMQP classes and methods used by the fake broker, as class<<16 | method.
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpBasicQos          = 60<<16 | 10
+	amqpBasicQosOk        = 60<<16 | 11
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicAck          = 60<<16 | 80
+)
+
+// amqpSession is one end of a connection speaking AMQP 0-9-1, enough of it
+// for a fake broker.
+type amqpSession struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	frameMax uint32
+}
+
+type amqpFrame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+}
+
+func (s *amqpSession) writeFrame(typ byte, channel uint16, payload []byte) error {
+	b := make([]byte, 7, 8+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint16(b[1:], channel)
+	binary.BigEndian.PutUint32(b[3:], uint32(len(payload)))
+	b = append(append(b, payload...), amqpFrameEnd)
+	_, err := s.conn.Write(b)
+	return err
+}
+
+// send writes a method frame.
+func (s *amqpSession) send(channel uint16, method uint32, args amqpArgs) error {
+	payload := make([]byte, 4, 4+len(args.b))
+	binary.BigEndian.PutUint32(payload, method)
+	return s.writeFrame(amqpFrameMethod, channel, append(payload, args.b...))
+}
+
+// next reads the next frame other than a heartbeat.  A request to close the
+// channel or connection is answered, and returned as an error.
+func (s *amqpSession) next() (amqpFrame, error) {
+	for {
+		var h [7]byte
+		if _, err := io.ReadFull(s.r, h[:]); err != nil {
+			return amqpFrame{}, err
+		}
+		f := amqpFrame{typ: h[0], channel: binary.BigEndian.Uint16(h[1:])}
+		size := binary.BigEndian.Uint32(h[3:])
+		if size > s.frameMax {
+			return f, errors.Errorf("frame of %d bytes is larger than the maximum %d", size, s.frameMax)
+		}
+		f.payload = make([]byte, size+1)
+		if _, err := io.ReadFull(s.r, f.payload); err != nil {
+			return f, err
+		}
+		if f.payload[size] != amqpFrameEnd {
+			return f, errors.New("bad frame end")
+		}
+		f.payload = f.payload[:size]
+		switch {
+		case f.typ == amqpFrameHeartbeat:
+			continue
+		case f.typ == amqpFrameMethod && len(f.payload) < 4:
+			return f, errors.New("short method frame")
+		case f.typ == amqpFrameMethod:
+			method := binary.BigEndian.Uint32(f.payload)
+			if method != amqpConnectionClose && method != amqpChannelClose {
+				return f, nil
+			}
+			args := amqpArgs{b: f.payload[4:]}
+			code := args.short()
+			text := args.shortstr()
+			reply := uint32(amqpConnectionCloseOk)
+			if method == amqpChannelClose {
+				reply = amqpChannelCloseOk
+			}
+			s.send(f.channel, reply, amqpArgs{})
+			return f, errors.Errorf("closed by the consumer: %d %s", code, text)
+		}
+		return f, nil
+	}
+}
+
+// expect reads the next frame, which must be the method on channel.
+func (s *amqpSession) expect(channel uint16, method uint32) (*amqpArgs, error) {
+	f, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	if f.typ != amqpFrameMethod || f.channel != channel || binary.BigEndian.Uint32(f.payload) != method {
+		return nil, errors.Errorf("expected AMQP method %d.%d on channel %d", method>>16, method&0xffff, channel)
+	}
+	return &amqpArgs{b: f.payload[4:]}, nil
+}
+
+// amqpArgs encodes and decodes the arguments of AMQP methods.  Decoding errors
+// are sticky, and the zero value is returned once one has occurred.
+type amqpArgs struct {
+	b   []byte
+	err error
+}
+
+func (a *amqpArgs) take(n int) []byte {
+	if a.err != nil {
+		return nil
+	}
+	if len(a.b) < n {
+		a.err = errors.New("short AMQP method arguments")
+		return nil
+	}
+	b := a.b[:n]
+	a.b = a.b[n:]
+	return b
+}
+
+func (a *amqpArgs) octet() byte {
+	if b := a.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (a *amqpArgs) short() uint16 {
+	if b := a.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (a *amqpArgs) long() uint32 {
+	if b := a.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (a *amqpArgs) longlong() uint64 {
+	if b := a.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (a *amqpArgs) shortstr() string {
+	return string(a.take(int(a.octet())))
+}
+
+func (a *amqpArgs) longstr() string {
+	return string(a.take(int(a.long())))
+}
+
+// table skips a field table, whose contents the fake broker doesn't need.
+func (a *amqpArgs) table() {
+	a.longstr()
+}
+
+// The encoding methods are named for the types they append.
+
+func (a *amqpArgs) putOctet(v byte) { a.b = append(a.b, v) }
+
+func (a *amqpArgs) putShort(v uint16) {
+	a.b = append(a.b, byte(v>>8), byte(v))
+}
+
+func (a *amqpArgs) putLong(v uint32) {
+	a.b = append(a.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (a *amqpArgs) putLonglong(v uint64) {
+	a.putLong(uint32(v >> 32))
+	a.putLong(uint32(v))
+}
+
+func (a *amqpArgs) putShortstr(s string) {
+	a.putOctet(byte(len(s)))
+	a.b = append(a.b, s[:len(s)&0xff]...)
+}
+
+func (a *amqpArgs) putLongstr(s string) {
+	a.putLong(uint32(len(s)))
+	a.b = append(a.b, s...)
+}
+
+// putTable appends a field table of string values.
+func (a *amqpArgs) putTable(fields map[string]string) {
+	var t amqpArgs
+	for k, v := range fields {
+		t.putShortstr(k)
+		t.putOctet('S')
+		t.putLongstr(v)
+	}
+	a.putLongstr(string(t.b))
+}
+
+// fakeBroker answers the AMQP handshake on each connection accepted by l,
+// and delivers one message from bodies to each, closing the connection after
+// the message is acknowledged if more remain.
+func fakeBroker(t *testing.T, l net.Listener, bodies []string) {
+	for i, body := range bodies {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s := &amqpSession{conn: conn, r: bufio.NewReader(conn), frameMax: amqpFrameMax}
+		if err := fakeBrokerSession(s, uint64(i+1), body); err != nil {
+			t.Error(err)
+		}
+		if i < len(bodies)-1 {
+			conn.Close()
+		} else {
+			// Wait for the consumer to close the connection.
+			io.Copy(ioutil.Discard, conn)
+		}
+	}
+}
+
+func fakeBrokerSession(s *amqpSession, tag uint64, body string) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		return err
+	}
+	var m amqpArgs
+	m.putOctet(0)
+	m.putOctet(9)
+	m.putTable(nil)
+	m.putLongstr("AMQPLAIN PLAIN")
+	m.putLongstr("en_US")
+	if err := s.send(0, amqpConnectionStart, m); err != nil {
+		return err
+	}
+	args, err := s.expect(0, amqpConnectionStartOk)
+	if err != nil {
+		return err
+	}
+	args.table()
+	args.shortstr()
+	if response := args.longstr(); response != "\x00user\x00secret" {
+		return errors.Errorf("fake broker received unexpected PLAIN response %q", response)
+	}
+	m = amqpArgs{}
+	m.putShort(0)
+	m.putLong(amqpFrameMax)
+	m.putShort(0)
+	if err := s.send(0, amqpConnectionTune, m); err != nil {
+		return err
+	}
+	if _, err := s.expect(0, amqpConnectionTuneOk); err != nil {
+		return err
+	}
+	if args, err = s.expect(0, amqpConnectionOpen); err != nil {
+		return err
+	}
+	if vhost := args.shortstr(); vhost != "logs" {
+		return errors.Errorf("fake broker received unexpected vhost %q", vhost)
+	}
+	m = amqpArgs{}
+	m.putShortstr("")
+	if err := s.send(0, amqpConnectionOpenOk, m); err != nil {
+		return err
+	}
+	if _, err := s.expect(1, amqpChannelOpen); err != nil {
+		return err
+	}
+	m = amqpArgs{}
+	m.putLongstr("")
+	if err := s.send(1, amqpChannelOpenOk, m); err != nil {
+		return err
+	}
+	if args, err = s.expect(1, amqpBasicQos); err != nil {
+		return err
+	}
+	args.long()
+	if prefetch := args.short(); prefetch != 10 {
+		return errors.Errorf("fake broker received unexpected prefetch %d", prefetch)
+	}
+	if err := s.send(1, amqpBasicQosOk, amqpArgs{}); err != nil {
+		return err
+	}
+	if args, err = s.expect(1, amqpBasicConsume); err != nil {
+		return err
+	}
+	args.short()
+	if queue := args.shortstr(); queue != "app" {
+		return errors.Errorf("fake broker received unexpected queue %q", queue)
+	}
+	ctag := args.shortstr()
+	m = amqpArgs{}
+	m.putShortstr(ctag)
+	if err := s.send(1, amqpBasicConsumeOk, m); err != nil {
+		return err
+	}
+	m = amqpArgs{}
+	m.putShortstr(ctag)
+	m.putLonglong(tag)
+	m.putOctet(0)
+	m.putShortstr("")
+	m.putShortstr("app")
+	if err := s.send(1, amqpBasicDeliver, m); err != nil {
+		return err
+	}
+	h := make([]byte, 14)
+	binary.BigEndian.PutUint16(h, 60)
+	binary.BigEndian.PutUint64(h[4:], uint64(len(body)))
+	if err := s.writeFrame(amqpFrameHeader, 1, h); err != nil {
+		return err
+	}
+	// Split the body over two frames.
+	if err := s.writeFrame(amqpFrameBody, 1, []byte(body[:1])); err != nil {
+		return err
+	}
+	if err := s.writeFrame(amqpFrameBody, 1, []byte(body[1:])); err != nil {
+		return err
+	}
+	if args, err = s.expect(1, amqpBasicAck); err != nil {
+		return err
+	}
+	if got := args.longlong(); got != tag {
+		return errors.Errorf("fake broker received acknowledgement of tag %d, want %d", got, tag)
+	}
+	return nil
+}
+
+func TestTailAMQP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		fakeBroker(t, l, []string{"a\r\nb\n", "cd"})
+		close(done)
+	}()
+
+	lines := make(chan *logline.LogLine, 10)
+	ta, err := New(lines, afero.NewMemMapFs(), watcher.NewFakeWatcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.TailAMQP("amqp://user:secret@"+l.Addr().String()+"/logs", "app", 10); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 0; i < 3; i++ {
+		line := <-lines
+		if want := "amqp://user@" + l.Addr().String() + "/logs#app"; line.Filename != want {
+			t.Errorf("filename %q, want %q", line.Filename, want)
+		}
+		got = append(got, line.Line)
+	}
+	if err := ta.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if diff := cmp.Diff([]string{"a", "b", "cd"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+}
+
+func TestTailAMQPErrors(t *testing.T) {
+	ta, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ta.Close()
+	for _, tc := range []struct {
+		uri, queue string
+		prefetch   int
+	}{
+		{"http://localhost/", "q", 1},
+		{"amqp://localhost/", "", 1},
+		{"amqp://localhost/", "q", -1},
+		{":%zz", "q", 1},
+	} {
+		if err := ta.TailAMQP(tc.uri, tc.queue, tc.prefetch); err == nil {
+			t.Errorf("TailAMQP(%q, %q, %d) succeeded", tc.uri, tc.queue, tc.prefetch)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// unwrapFunc extracts the log message from a line written by a log driver,
+// and the time it was logged if known.  Drivers split long messages over
+// several lines; partial is true if the message continues on the next line.
+// ok is false if the line isn't in the driver's format.
+type unwrapFunc func(line string) (message string, ts time.Time, partial, ok bool)
+
+// dockerJSONLine is a line written by the Docker json-file log driver.
+type dockerJSONLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// unwrapDockerJSONLine unwraps a line written by the Docker json-file log
+// driver:
+//
+//	{"log":"message\n","stream":"stdout","time":"2018-05-25T05:23:45.123456789Z"}
+func unwrapDockerJSONLine(line string) (message string, ts time.Time, partial, ok bool) {
+	if !strings.HasPrefix(line, "{") {
+		return "", time.Time{}, false, false
+	}
+	var d dockerJSONLine
+	if err := json.Unmarshal([]byte(line), &d); err != nil {
+		return "", time.Time{}, false, false
+	}
+	if !strings.HasSuffix(d.Log, "\n") {
+		return d.Log, d.Time, true, true
+	}
+	return strings.TrimSuffix(d.Log, "\n"), d.Time, false, true
+}
+
+// unwrapCRILine unwraps a line in the CRI log format written by containerd
+// and CRI-O:
+//
+//	2018-05-25T05:23:45.123456789Z stdout F message
+func unwrapCRILine(line string) (message string, ts time.Time, partial, ok bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || (fields[1] != "stdout" && fields[1] != "stderr") {
+		return "", time.Time{}, false, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return "", time.Time{}, false, false
+	}
+	if len(fields) == 3 {
+		fields = append(fields, "")
+	}
+	switch fields[2] {
+	case "P":
+		return fields[3], ts, true, true
+	case "F":
+		return fields[3], ts, false, true
+	}
+	return "", time.Time{}, false, false
+}
+
+// unwrapContainerLine unwraps a line written by a container runtime, in
+// either the CRI or Docker json-file format.
+func unwrapContainerLine(line string) (message string, ts time.Time, partial, ok bool) {
+	if strings.HasPrefix(line, "{") {
+		return unwrapDockerJSONLine(line)
+	}
+	return unwrapCRILine(line)
+}
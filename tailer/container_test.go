@@ -0,0 +1,81 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/spf13/afero"
+)
+
+var unwrapContainerLineTests = []struct {
+	line    string
+	message string
+	ts      time.Time
+	partial bool
+	ok      bool
+}{
+	{"2018-05-25T05:23:45.123456789Z stdout F GET /index.html 200", "GET /index.html 200", time.Date(2018, 5, 25, 5, 23, 45, 123456789, time.UTC), false, true},
+	{"2018-05-25T05:23:45Z stderr P start of a ", "start of a ", time.Date(2018, 5, 25, 5, 23, 45, 0, time.UTC), true, true},
+	{"2018-05-25T05:23:45Z stdout F", "", time.Date(2018, 5, 25, 5, 23, 45, 0, time.UTC), false, true},
+	{`{"log":"GET /index.html 200\n","stream":"stdout","time":"2018-05-25T05:23:45.123456789Z"}`, "GET /index.html 200", time.Date(2018, 5, 25, 5, 23, 45, 123456789, time.UTC), false, true},
+	{`{"log":"start of a ","stream":"stdout","time":"2018-05-25T05:23:45Z"}`, "start of a ", time.Date(2018, 5, 25, 5, 23, 45, 0, time.UTC), true, true},
+	{"GET /index.html 200", "", time.Time{}, false, false},
+	{"{not json", "", time.Time{}, false, false},
+	{"yesterday stdout F what", "", time.Time{}, false, false},
+	{"2018-05-25T05:23:45Z stdout X what", "", time.Time{}, false, false},
+}
+
+func TestUnwrapContainerLine(t *testing.T) {
+	for _, tc := range unwrapContainerLineTests {
+		message, ts, partial, ok := unwrapContainerLine(tc.line)
+		if message != tc.message || !ts.Equal(tc.ts) || partial != tc.partial || ok != tc.ok {
+			t.Errorf("unwrapContainerLine(%q) = %q, %v, %v, %v; want %q, %v, %v, %v", tc.line,
+				message, ts, partial, ok, tc.message, tc.ts, tc.partial, tc.ok)
+		}
+	}
+}
+
+func TestUnwrapDockerJSONLine(t *testing.T) {
+	if _, _, _, ok := unwrapDockerJSONLine("2018-05-25T05:23:45Z stdout F GET"); ok {
+		t.Error("CRI line unwrapped as Docker json-file")
+	}
+	message, ts, _, ok := unwrapDockerJSONLine(`{"log":"GET\n","stream":"stdout","time":"2018-05-25T05:23:45Z"}`)
+	if !ok || message != "GET" || !ts.Equal(time.Date(2018, 5, 25, 5, 23, 45, 0, time.UTC)) {
+		t.Errorf("unwrapDockerJSONLine = %q, %v, %v", message, ts, ok)
+	}
+}
+
+func TestReadContainerLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	logfile := "/var/log/containers/web-1_prod_nginx-0123abcd.log"
+	if err := afero.WriteFile(fs, logfile, []byte(
+		"2018-05-25T05:23:45Z stdout P a long \n"+
+			"2018-05-25T05:23:45Z stdout F line\n"+
+			"not wrapped\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan *logline.LogLine, 10)
+	f, err := NewFile(fs, logfile, lines, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.unwrap = unwrapContainerLine
+	f.Read()
+	close(lines)
+	var result []*logline.LogLine
+	for l := range lines {
+		result = append(result, l)
+	}
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "a long line", Time: time.Date(2018, 5, 25, 5, 23, 45, 0, time.UTC)},
+		{Filename: logfile, Line: "not wrapped"},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
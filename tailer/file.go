@@ -9,6 +9,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -16,6 +19,7 @@ import (
 	"github.com/google/mtail/logline"
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
 )
 
 var (
@@ -27,17 +31,79 @@ var (
 	logTruncs = expvar.NewMap("log_truncates_total")
 	// lineCount counts the numbre of lines read per log file
 	lineCount = expvar.NewMap("log_lines_total")
+	// byteCount counts the number of bytes read per log file
+	byteCount = expvar.NewMap("log_bytes_total")
+	// longLinesTruncated counts the lines truncated to the maximum line length per log file
+	longLinesTruncated = expvar.NewMap("log_long_lines_truncated_total")
+	// longLinesDropped counts the lines dropped for exceeding the maximum line length per log file
+	longLinesDropped = expvar.NewMap("log_long_lines_dropped_total")
 )
 
+// lastLineTimes holds the time each log file last had a line read from it, or
+// was opened if no lines have been read, so that a log that goes silent can
+// be alerted on.
+var lastLineTimes = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+func init() {
+	expvar.Publish("log_seconds_since_last_line", expvar.Func(secondsSinceLastLine))
+}
+
+// secondsSinceLastLine returns the age of the last line read from each log file.
+func secondsSinceLastLine() interface{} {
+	lastLineTimes.Lock()
+	defer lastLineTimes.Unlock()
+	now := time.Now()
+	ages := make(map[string]float64, len(lastLineTimes.m))
+	for name, t := range lastLineTimes.m {
+		ages[name] = now.Sub(t).Seconds()
+	}
+	return ages
+}
+
+func setLastLineTime(name string, t time.Time) {
+	lastLineTimes.Lock()
+	defer lastLineTimes.Unlock()
+	lastLineTimes.m[name] = t
+}
+
+func forgetLastLineTime(name string) {
+	lastLineTimes.Lock()
+	defer lastLineTimes.Unlock()
+	delete(lastLineTimes.m, name)
+}
+
 // File provides an abstraction over files and named pipes being tailed
 // by `mtail`.
 type File struct {
 	Name     string // Given name for the file (possibly relative, used for displau)
 	Pathname string // Full absolute path of the file used internally
+	target   string // If Pathname is a symlink, the file it points to
 	fs       afero.Fs
 	file     afero.File
 	partial  *bytes.Buffer
 	lines    chan<- *logline.LogLine // output channel for lines read
+	offset   int64                   // bytes read from the current file, for status; accessed atomically
+
+	unwrap    unwrapFunc  // if set, extracts the log message from each line
+	filter    *lineFilter // if set, decides which lines are sent
+	continued string      // start of a log message split over several lines
+
+	maxLineLength int  // if positive, the longest line sent
+	dropLongLines bool // if set, lines longer than maxLineLength are dropped instead of truncated
+	longLine      bool // the partial line has exceeded maxLineLength
+
+	separator byte // the byte that ends each line, usually a newline
+	skipping  bool // the rest of the partial line is being skipped, as its start wasn't read
+
+	now func() time.Time // if set, stamps the lines that have no time of their own
+
+	relinked func(*File) // if set, called after the symlink Pathname is pointed at another file
+
+	mu     sync.Mutex // serialises reads with Close
+	closed bool       // set by Close; nothing more is read
 }
 
 // NewFile returns a new File named by the given pathname.  `seenBefore` indicates
@@ -61,13 +127,14 @@ func NewFile(fs afero.Fs, pathname string, lines chan<- *logline.LogLine, seekTo
 		logErrors.Add(absPath, 1)
 		return nil, errors.Wrapf(err, "Failed to stat %q", absPath)
 	}
+	var offset int64
 	switch m := fi.Mode(); {
 	case m.IsRegular():
 		seekWhence := io.SeekEnd
 		if seekToStart {
 			seekWhence = io.SeekCurrent
 		}
-		if _, err := f.Seek(0, seekWhence); err != nil {
+		if offset, err = f.Seek(0, seekWhence); err != nil {
 			return nil, errors.Wrapf(err, "Seek failed on %q", absPath)
 		}
 		// Named pipes are the same as far as we're concerned, but we can't seek them.
@@ -76,7 +143,37 @@ func NewFile(fs afero.Fs, pathname string, lines chan<- *logline.LogLine, seekTo
 	default:
 		return nil, errors.Errorf("Can't open files with mode %v: %s", m&os.ModeType, absPath)
 	}
-	return &File{pathname, absPath, fs, f, bytes.NewBufferString(""), lines}, nil
+	setLastLineTime(pathname, time.Now())
+	return &File{
+		Name:     pathname,
+		Pathname: absPath,
+		target:   linkTarget(fs, absPath),
+		fs:       fs,
+		file:     f,
+		partial:  bytes.NewBufferString(""),
+		lines:    lines,
+		offset:   offset,
+
+		separator: '\n',
+	}, nil
+}
+
+// linkTarget returns the file that pathname points to if it is a symlink, or
+// the empty string if it isn't or it can't be resolved.
+func linkTarget(fs afero.Fs, pathname string) string {
+	l, ok := fs.(afero.Lstater)
+	if !ok {
+		return ""
+	}
+	fi, lstatCalled, err := l.LstatIfPossible(pathname)
+	if err != nil || !lstatCalled || fi.Mode()&os.ModeSymlink == 0 {
+		return ""
+	}
+	target, err := filepath.EvalSymlinks(pathname)
+	if err != nil {
+		return ""
+	}
+	return target
 }
 
 func open(fs afero.Fs, pathname string, seenBefore bool) (afero.File, error) {
@@ -102,18 +199,42 @@ Retry:
 		}
 	}
 	if err != nil {
-		glog.Infof("open failed all retries")
+		errLog.Infof("open of %q failed all retries: %s", pathname, err)
 		return nil, err
 	}
 	glog.V(2).Infof("open succeeded %s", pathname)
 	return f, nil
 }
 
-// Follow reads from the file until EOF.  It tracks log rotations (i.e new inode or device).
+// Follow reads from the file until EOF.  It tracks log rotations (i.e new inode
+// or device), including a symlink being pointed at a new file, as is done with
+// the `current` log of svlogd and similar.  It reads nothing once the File is
+// closed.
 func (f *File) Follow() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	return f.follow()
+}
+
+func (f *File) follow() error {
+	if f.target != "" {
+		if target := linkTarget(f.fs, f.Pathname); target != "" && target != f.target {
+			glog.V(1).Infof("Symlink %s now points to %s, treating as rotation", f.Pathname, target)
+			f.target = target
+			if err := f.doRotation(); err != nil {
+				return err
+			}
+			if f.relinked != nil {
+				f.relinked(f)
+			}
+		}
+	}
 	s1, err := f.file.Stat()
 	if err != nil {
-		glog.Infof("Stat failed on %q: %s", f.Name, err)
+		errLog.Infof("Stat failed on %q: %s", f.Name, err)
 		// We have a fd but it's invalid, handle as a rotation (delete/create)
 		err := f.doRotation()
 		if err != nil {
@@ -122,10 +243,10 @@ func (f *File) Follow() error {
 	}
 	s2, err := f.fs.Stat(f.Pathname)
 	if err != nil {
-		glog.Infof("Stat failed on %q: %s", f.Pathname, err)
+		errLog.Infof("Stat failed on %q: %s", f.Pathname, err)
 		return nil
 	}
-	if !os.SameFile(s1, s2) {
+	if !sameFile(s1, s2) {
 		glog.V(1).Infof("New inode detected for %s, treating as rotation", f.Pathname)
 		err = f.doRotation()
 		if err != nil {
@@ -137,33 +258,63 @@ func (f *File) Follow() error {
 	}
 
 	glog.V(2).Info("doing the normal read")
-	return f.Read()
+	return f.read()
+}
+
+// sameFile reports whether s1 and s2 describe the same file, like
+// os.SameFile, but also for files in an afero.MemMapFs, which has no inodes.
+func sameFile(s1, s2 os.FileInfo) bool {
+	if m1, ok := s1.(*mem.FileInfo); ok {
+		m2, ok := s2.(*mem.FileInfo)
+		return ok && m1.FileData == m2.FileData
+	}
+	return os.SameFile(s1, s2)
 }
 
 // doRotation reads the remaining content of the currently opened file, then reopens the new one.
 func (f *File) doRotation() error {
 	glog.V(2).Info("doing the rotation flush read")
-	f.Read()
+	f.read()
+	// Nothing more will be read from the old file, so its last line is
+	// complete even without a newline, and mustn't be joined to the first
+	// line of the new one.
+	f.flush()
 	logRotations.Add(f.Name, 1)
 	newFile, err := open(f.fs, f.Pathname, true /*seenBefore*/)
 	if err != nil {
 		return err
 	}
 	f.file = newFile
+	atomic.StoreInt64(&f.offset, 0)
 	return nil
 }
 
 // Read blocks of 4096 bytes from the File, sending LogLines to the given
-// channel as newlines are encountered.  If EOF is read, the partial line is
+// channel as separators, usually newlines, are encountered.  If EOF is read, the partial line is
 // stored to be concatenated to on the next call.  At EOF, checks for
-// truncation and resets the file offset if so.
+// truncation and resets the file offset if so.  It reads nothing once the File
+// is closed.
 func (f *File) Read() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	return f.read()
+}
+
+func (f *File) read() error {
 	b := make([]byte, 0, 4096)
 	totalBytes := 0
+	sep := rune(f.separator)
 	for {
 		n, err := f.file.Read(b[:cap(b)])
 		glog.V(2).Infof("Read count %v err %v", n, err)
 		totalBytes += n
+		atomic.AddInt64(&f.offset, int64(n))
+		if n > 0 {
+			byteCount.Add(f.Name, int64(n))
+		}
 		b = b[:n]
 
 		if err == io.EOF && totalBytes == 0 {
@@ -171,7 +322,7 @@ func (f *File) Read() error {
 			// If there was nothing to be read, perhaps the file just got truncated.
 			truncated, terr := f.checkForTruncate()
 			if terr != nil {
-				glog.Infof("checkForTruncate returned with error '%v'", terr)
+				errLog.Infof("checkForTruncate on %q returned with error '%v'", f.Pathname, terr)
 			}
 			if truncated {
 				// Try again: offset was greater than filesize and now we've seeked to start.
@@ -186,7 +337,18 @@ func (f *File) Read() error {
 		for i := 0; i < len(b) && i < n; i += width {
 			rune, width = utf8.DecodeRune(b[i:])
 			switch {
-			case rune != '\n':
+			case f.skipping:
+				f.skipping = rune != sep
+			case rune != sep:
+				if f.longLine {
+					continue
+				}
+				if f.maxLineLength > 0 && f.partial.Len()+width > f.maxLineLength {
+					// Discard the rest of the line, even runes narrow
+					// enough to still fit.
+					f.longLine = true
+					continue
+				}
 				f.partial.WriteRune(rune)
 			default:
 				f.sendLine()
@@ -200,12 +362,74 @@ func (f *File) Read() error {
 	}
 }
 
+// rewind moves the File back to n bytes before its end, or to its start if n
+// is ReadFromStart or the file is shorter, so that the lines already in it
+// are read.  Unless the File is moved to its start, it is moved back one more
+// byte and the rest of the line it lands in is skipped, so that no partial
+// line is sent.  Named pipes can't be rewound.
+func (f *File) rewind(n int64) error {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	offset := fi.Size() - n - 1
+	if n == ReadFromStart || offset <= 0 {
+		offset = 0
+	}
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "Seek failed on %q", f.Pathname)
+	}
+	atomic.StoreInt64(&f.offset, offset)
+	f.skipping = offset > 0
+	glog.V(1).Infof("Reading %q from offset %d", f.Pathname, offset)
+	return nil
+}
+
+// flush sends the partial line, if any, as a complete line.  Until then a
+// partial line is held until the rest of it is read, because writers may
+// flush in the middle of a line.
+func (f *File) flush() {
+	if f.partial.Len() > 0 || f.longLine {
+		f.sendLine()
+	}
+}
+
 // sendLine sends the contents of the partial buffer off for processing.
 func (f *File) sendLine() {
-	f.lines <- logline.NewLogLine(f.Name, f.partial.String())
-	lineCount.Add(f.Name, 1)
+	setLastLineTime(f.Name, time.Now())
+	// Lines ending in CRLF are sent without the CR.
+	l := logline.NewLogLine(f.Name, strings.TrimSuffix(f.partial.String(), "\r"))
 	// reset partial accumulator
 	f.partial.Reset()
+	if f.longLine {
+		f.longLine = false
+		if f.dropLongLines {
+			longLinesDropped.Add(f.Name, 1)
+			lineCount.Add(f.Name, 1)
+			return
+		}
+		longLinesTruncated.Add(f.Name, 1)
+	}
+	if f.unwrap != nil {
+		if message, ts, partial, ok := f.unwrap(l.Line); ok {
+			if partial {
+				f.continued += message
+				return
+			}
+			l.Line, l.Time, f.continued = f.continued+message, ts, ""
+		}
+	}
+	lineCount.Add(f.Name, 1)
+	if f.filter != nil && !f.filter.keep(f.Name, l.Line) {
+		return
+	}
+	if f.now != nil && l.Time.IsZero() {
+		l.Time = f.now()
+	}
+	sendLine(f.lines, l)
 }
 
 // checkForTruncate checks to see if the current offset into the file
@@ -237,14 +461,25 @@ func (f *File) checkForTruncate() (bool, error) {
 
 	p, serr := f.file.Seek(0, io.SeekStart)
 	glog.V(2).Infof("Truncated?  Seeked to %d: %v", p, serr)
+	atomic.StoreInt64(&f.offset, p)
 	logTruncs.Add(f.Name, 1)
 	return true, serr
 }
 
+// Offset returns the number of bytes read so far from the file currently open
+// at this pathname.
+func (f *File) Offset() int64 {
+	return atomic.LoadInt64(&f.offset)
+}
+
 func (f *File) Stat() (os.FileInfo, error) {
 	return f.file.Stat()
 }
 
+// Close closes the file, waiting for any read in progress to finish.
 func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
 	return f.file.Close()
 }
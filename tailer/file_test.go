@@ -4,6 +4,7 @@
 package tailer
 
 import (
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/mtail/logline"
@@ -77,7 +79,7 @@ func TestReadPartial(t *testing.T) {
 		t.Errorf("partial line not empty: %q", f.partial)
 	}
 	expected := []*logline.LogLine{
-		{logfile, "ohi"},
+		{Filename: logfile, Line: "ohi"},
 	}
 	diff := cmp.Diff(expected, result)
 	if diff != "" {
@@ -118,3 +120,234 @@ func TestOpenRetries(t *testing.T) {
 		t.Fatalf("Expected a permission denied error here: %s", err)
 	}
 }
+
+func TestReadOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_test_offset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Log(err)
+		}
+	}()
+	fs := afero.NewOsFs()
+	logfile := filepath.Join(dir, "log")
+	if err := afero.WriteFile(fs, logfile, []byte("a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan *logline.LogLine, 10)
+	f, err := NewFile(fs, logfile, lines, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Offset() != 2 {
+		t.Errorf("offset after open at end: got %d, want 2", f.Offset())
+	}
+	fd, err := fs.OpenFile(logfile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if _, err := fd.WriteString("bcd\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	if f.Offset() != 6 {
+		t.Errorf("offset after read: got %d, want 6", f.Offset())
+	}
+}
+
+func TestReadFreshness(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	logfile := "/freshness"
+	fd, err := fs.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan *logline.LogLine, 10)
+	f, err := NewFile(fs, logfile, lines, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opening counts as the last line, so a file that is silent from the start goes stale.
+	setLastLineTime(logfile, time.Now().Add(-time.Hour))
+	if age := secondsSinceLastLine().(map[string]float64)[logfile]; age < 3600 {
+		t.Errorf("seconds since last line before reading: got %f, want at least 3600", age)
+	}
+	fd.WriteString("abc\ndef\n")
+	fd.Seek(0, 0)
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	if age, ok := secondsSinceLastLine().(map[string]float64)[logfile]; !ok || age > 60 {
+		t.Errorf("seconds since last line after reading: got %f, %v", age, ok)
+	}
+	if got := byteCount.Get(logfile).String(); got != "8" {
+		t.Errorf("bytes read: got %s, want 8", got)
+	}
+	if got := lineCount.Get(logfile).String(); got != "2" {
+		t.Errorf("lines read: got %s, want 2", got)
+	}
+}
+
+func TestReadLongLines(t *testing.T) {
+	for _, tc := range []struct {
+		drop      bool
+		expected  []string
+		truncated string
+		dropped   string
+	}{
+		{false, []string{"abcd", "ef", "ghij", "xyz"}, "3", ""},
+		{true, []string{"ef"}, "", "3"},
+	} {
+		t.Run(fmt.Sprintf("drop=%v", tc.drop), func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			logfile := fmt.Sprintf("/long-%v", tc.drop)
+			fd, err := fs.Create(logfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := make(chan *logline.LogLine, 10)
+			f, err := NewFile(fs, logfile, lines, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.maxLineLength, f.dropLongLines = 4, tc.drop
+			// A rune narrow enough to fit after one that didn't is still discarded.
+			fd.WriteString("abcdefgh\nef\nghij\u00e9\nxyz\u00e9w\n")
+			fd.Seek(0, 0)
+			if err := f.Read(); err != io.EOF {
+				t.Errorf("error returned not EOF: %v", err)
+			}
+			close(lines)
+			var got []string
+			for l := range lines {
+				got = append(got, l.Line)
+			}
+			if diff := cmp.Diff(tc.expected, got); diff != "" {
+				t.Errorf("lines differ:\n%s", diff)
+			}
+			for _, c := range []struct {
+				m        *expvar.Map
+				expected string
+			}{
+				{longLinesTruncated, tc.truncated},
+				{longLinesDropped, tc.dropped},
+			} {
+				var got string
+				if v := c.m.Get(logfile); v != nil {
+					got = v.String()
+				}
+				if got != c.expected {
+					t.Errorf("count: got %q, want %q", got, c.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestReadCRLF(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	logfile := "/crlf"
+	fd, err := fs.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan *logline.LogLine, 10)
+	f, err := NewFile(fs, logfile, lines, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString("a\r\nb\rc\r\nd\r")
+	fd.Seek(0, 0)
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	// The partial line is held until the rest of it arrives.
+	if f.partial.String() != "d\r" {
+		t.Errorf("partial line: got %q, want %q", f.partial, "d\r")
+	}
+	f.flush()
+	close(lines)
+	var got []string
+	for l := range lines {
+		got = append(got, l.Line)
+	}
+	if diff := cmp.Diff([]string{"a", "b\rc", "d"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+}
+
+func TestRotationFlushesPartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_test_rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Log(err)
+		}
+	}()
+	fs := afero.NewOsFs()
+	logfile := filepath.Join(dir, "log")
+	if err := afero.WriteFile(fs, logfile, []byte("1\n2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan *logline.LogLine, 10)
+	f, err := NewFile(fs, logfile, lines, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, logfile, []byte("3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Follow(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	close(lines)
+	var got []string
+	for l := range lines {
+		got = append(got, l.Line)
+	}
+	if diff := cmp.Diff([]string{"1", "2", "3"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+}
+
+func TestSameFileMemMapFs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	fd, err := fs.Create("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := fd.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := fs.Stat("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameFile(s1, s2) {
+		t.Error("open file and its path aren't the same file")
+	}
+	if err := fs.Rename("/log", "/log.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Create("/log"); err != nil {
+		t.Fatal(err)
+	}
+	s3, err := fs.Stat("/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sameFile(s1, s3) {
+		t.Error("rotated file is the same file as its replacement")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"expvar"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// linesFiltered counts the lines dropped because they didn't match the filter of their log file.
+	linesFiltered = expvar.NewMap("log_lines_filtered_total")
+	// linesSampledOut counts the lines dropped by sampling, per log file.
+	linesSampledOut = expvar.NewMap("log_lines_sampled_out_total")
+	// linesDeduplicated counts the lines dropped as repeats of a recent line, per log file.
+	linesDeduplicated = expvar.NewMap("log_lines_deduplicated_total")
+)
+
+// lineFilter decides which lines read from the log files matching a glob
+// pattern are sent to the programs, trading accuracy for less work on noisy
+// logs.
+type lineFilter struct {
+	glob   string
+	match  *regexp.Regexp // if set, lines not matching are dropped
+	sample int64          // if greater than 1, only one line in sample is kept
+	n      int64          // lines seen by the sampler; accessed atomically
+	dedup  int            // if positive, lines repeating one of the last dedup lines of their log file are dropped
+
+	mu     sync.Mutex
+	recent map[string]*dedupWindow // the last lines of each log file, for dedup
+}
+
+// Filter sets the tailer to drop the lines of the log files matching glob
+// that don't match the regular expression pattern, before they are sent to
+// the programs.  An anchored pattern, like `^ERROR`, is cheapest.
+func Filter(glob, pattern string) func(*Tailer) error {
+	return func(t *Tailer) error {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "filter for %q", glob)
+		}
+		f, err := t.lineFilter(glob)
+		if err != nil {
+			return err
+		}
+		f.match = re
+		return nil
+	}
+}
+
+// Sample sets the tailer to send only one in every n lines of the log files
+// matching glob to the programs.
+func Sample(glob string, n int) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("sample rate for %q must be positive", glob)
+		}
+		f, err := t.lineFilter(glob)
+		if err != nil {
+			return err
+		}
+		f.sample = int64(n)
+		return nil
+	}
+}
+
+// Dedup sets the tailer to drop the lines of the log files matching glob
+// that are the same as one of the previous n lines of the same file, so that
+// a message repeated thousands of times during an incident is counted once.
+// With n of 1, only consecutive repeats are dropped.
+func Dedup(glob string, n int) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("dedup window for %q must be positive", glob)
+		}
+		f, err := t.lineFilter(glob)
+		if err != nil {
+			return err
+		}
+		f.dedup = n
+		f.recent = make(map[string]*dedupWindow)
+		return nil
+	}
+}
+
+// lineFilter returns the filter for glob, creating it if needed.
+func (t *Tailer) lineFilter(glob string) (*lineFilter, error) {
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return nil, errors.Wrapf(err, "bad glob %q", glob)
+	}
+	for _, f := range t.filters {
+		if f.glob == glob {
+			return f, nil
+		}
+	}
+	f := &lineFilter{glob: glob}
+	t.filters = append(t.filters, f)
+	return f, nil
+}
+
+// filterFor returns the first filter whose glob matches pathname, or nil.
+func (t *Tailer) filterFor(pathname string) *lineFilter {
+	abs, err := filepath.Abs(pathname)
+	if err != nil {
+		abs = pathname
+	}
+	for _, f := range t.filters {
+		if ok, _ := filepath.Match(f.glob, pathname); ok {
+			return f
+		}
+		if ok, _ := filepath.Match(f.glob, abs); ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// keep reports whether line, read from the named log file, should be sent to
+// the programs, and counts it if not.
+func (f *lineFilter) keep(name, line string) bool {
+	if f.match != nil && !f.match.MatchString(line) {
+		linesFiltered.Add(name, 1)
+		return false
+	}
+	if f.dedup > 0 && f.repeated(name, line) {
+		linesDeduplicated.Add(name, 1)
+		return false
+	}
+	if f.sample > 1 && atomic.AddInt64(&f.n, 1)%f.sample != 1 {
+		linesSampledOut.Add(name, 1)
+		return false
+	}
+	return true
+}
+
+// repeated reports whether line is the same as one of the last lines read
+// from the named log file, and remembers it.
+func (f *lineFilter) repeated(name, line string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w, ok := f.recent[name]
+	if !ok {
+		w = &dedupWindow{lines: make([]string, 0, f.dedup), counts: make(map[string]int)}
+		f.recent[name] = w
+	}
+	return w.add(line)
+}
+
+// dedupWindow holds the last lines read from a log file, oldest first from
+// next, and the number of times each appears among them.
+type dedupWindow struct {
+	lines  []string
+	next   int
+	counts map[string]int
+}
+
+// add adds line to the window, evicting the oldest line if it is full, and
+// reports whether line was already in the window.
+func (w *dedupWindow) add(line string) bool {
+	seen := w.counts[line] > 0
+	if len(w.lines) < cap(w.lines) {
+		w.lines = append(w.lines, line)
+	} else {
+		old := w.lines[w.next]
+		if w.counts[old]--; w.counts[old] == 0 {
+			delete(w.counts, old)
+		}
+		w.lines[w.next] = line
+		w.next = (w.next + 1) % len(w.lines)
+	}
+	w.counts[line]++
+	return seen
+}
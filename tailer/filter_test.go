@@ -0,0 +1,113 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestLineFilterKeep(t *testing.T) {
+	ta, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher(),
+		Filter("/var/log/debug*", "^(WARN|ERROR)"),
+		Sample("/var/log/debug*", 2),
+		Sample("/var/log/noisy.log", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		pathname string
+		lines    []string
+		want     []string
+	}{
+		{"/var/log/debug.log",
+			[]string{"DEBUG a", "ERROR b", "WARN c", "ERROR d", "INFO e", "ERROR f"},
+			[]string{"ERROR b", "ERROR d"}},
+		{"/var/log/noisy.log",
+			[]string{"1", "2", "3", "4", "5"},
+			[]string{"1", "4"}},
+		{"/var/log/other.log",
+			[]string{"x"},
+			[]string{"x"}},
+	} {
+		f := ta.filterFor(tc.pathname)
+		var got []string
+		for _, line := range tc.lines {
+			if f == nil || f.keep(tc.pathname, line) {
+				got = append(got, line)
+			}
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: kept %q, want %q", tc.pathname, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: kept %q, want %q", tc.pathname, got, tc.want)
+				break
+			}
+		}
+	}
+	if n := linesFiltered.Get("/var/log/debug.log").String(); n != "2" {
+		t.Errorf("filtered count %s", n)
+	}
+}
+
+func TestLineFilterDedup(t *testing.T) {
+	ta, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher(),
+		Dedup("/var/log/syslog*", 1),
+		Dedup("/var/log/app.log", 2),
+		Sample("/var/log/app.log", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		pathname string
+		lines    []string
+		want     []string
+	}{
+		{"/var/log/syslog",
+			[]string{"a", "a", "a", "b", "a", "a"},
+			[]string{"a", "b", "a"}},
+		// Each log file has its own window.
+		{"/var/log/syslog.1",
+			[]string{"a", "b"},
+			[]string{"a", "b"}},
+		// Repeats are dropped before sampling.
+		{"/var/log/app.log",
+			[]string{"a", "b", "a", "b", "c", "a", "d", "e"},
+			[]string{"a", "c", "d"}},
+	} {
+		f := ta.filterFor(tc.pathname)
+		var got []string
+		for _, line := range tc.lines {
+			if f.keep(tc.pathname, line) {
+				got = append(got, line)
+			}
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: kept lines differ:\n%s", tc.pathname, diff)
+		}
+	}
+	if n := linesDeduplicated.Get("/var/log/syslog").String(); n != "3" {
+		t.Errorf("deduplicated count %s", n)
+	}
+}
+
+func TestLineFilterOptionErrors(t *testing.T) {
+	for _, o := range []func(*Tailer) error{
+		Filter("*.log", "("),
+		Filter("[", "x"),
+		Sample("*.log", 0),
+		Dedup("*.log", 0),
+	} {
+		if _, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher(), o); err == nil {
+			t.Error("bad filter option accepted")
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// fakeNATSServer answers the NATS handshake on one connection accepted by l,
+// expects a subscription to subject, or to a durable consumer if durable is
+// set, and publishes the messages on it, waiting for the acknowledgement of
+// each if durable is set.  It closes sent once the messages are published and
+// acknowledged.
+func fakeNATSServer(l net.Listener, subject, durable string, msgs []string, sent chan<- struct{}) (err error) {
+	defer func() {
+		if err != nil {
+			close(sent)
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+	line, err := readLine()
+	if err != nil {
+		return err
+	}
+	var opts map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &opts); err != nil {
+		return err
+	}
+	if opts["user"] != "user" || opts["pass"] != "secret" {
+		fmt.Fprintf(conn, "-ERR 'Authorization Violation'\r\n")
+		return errors.Errorf("fake server received unexpected credentials in %q", line)
+	}
+	if line, err = readLine(); err != nil || line != "PING" {
+		return errors.Errorf("fake server expected PING, got %q, %v", line, err)
+	}
+	fmt.Fprintf(conn, "PONG\r\n")
+	reply := ""
+	if durable != "" {
+		// Requests are made on a subscription to a wildcard inbox.
+		if line, err = readLine(); err != nil {
+			return err
+		}
+		var inbox, inboxSid string
+		if _, err := fmt.Sscanf(line, "SUB %s %s", &inbox, &inboxSid); err != nil || !strings.HasSuffix(inbox, ".*") {
+			return errors.Errorf("fake server expected inbox subscription, got %q, %v", line, err)
+		}
+		if line, err = readLine(); err != nil {
+			return err
+		}
+		var api, replyTo string
+		var size int
+		if _, err := fmt.Sscanf(line, "PUB %s %s %d", &api, &replyTo, &size); err != nil {
+			return errors.Wrapf(err, "fake server expected consumer request, got %q", line)
+		}
+		if want := "$JS.API.CONSUMER.DURABLE.CREATE.logs." + durable; api != want || !strings.HasPrefix(replyTo, strings.TrimSuffix(inbox, "*")) {
+			return errors.Errorf("fake server received request on %q replying to %q, want %q and %q", api, replyTo, want, inbox)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		var req struct {
+			Config struct {
+				FilterSubject string `json:"filter_subject"`
+				AckPolicy     string `json:"ack_policy"`
+			} `json:"config"`
+		}
+		if err := json.Unmarshal(b[:size], &req); err != nil {
+			return err
+		}
+		if req.Config.FilterSubject != "app.>" || req.Config.AckPolicy != "explicit" {
+			return errors.Errorf("fake server received unexpected consumer config %q", b[:size])
+		}
+		resp := `{"type":"io.nats.jetstream.api.v1.consumer_create_response","config":{"deliver_subject":"deliver.here"}}`
+		fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", replyTo, inboxSid, len(resp), resp)
+		subject = "deliver.here"
+		reply = "$JS.ACK.logs." + durable + ".1"
+	}
+	if line, err = readLine(); err != nil {
+		return err
+	}
+	var subscribed, sid string
+	if _, err := fmt.Sscanf(line, "SUB %s %s", &subscribed, &sid); err != nil || subscribed != subject {
+		return errors.Errorf("fake server expected subscription to %q, got %q, %v", subject, line, err)
+	}
+	// Check that the subscriber answers pings.
+	fmt.Fprintf(conn, "PING\r\n")
+	if line, err = readLine(); err != nil || line != "PONG" {
+		return errors.Errorf("fake server expected PONG, got %q, %v", line, err)
+	}
+	for i, msg := range msgs {
+		if reply == "" {
+			fmt.Fprintf(conn, "MSG app.web %s %d\r\n%s\r\n", sid, len(msg), msg)
+			continue
+		}
+		fmt.Fprintf(conn, "MSG app.web %s %s%d %d\r\n%s\r\n", sid, reply, i, len(msg), msg)
+		if line, err = readLine(); err != nil || line != fmt.Sprintf("PUB %s%d 0", reply, i) {
+			return errors.Errorf("fake server expected acknowledgement, got %q, %v", line, err)
+		}
+		if line, err = readLine(); err != nil || line != "" {
+			return errors.Errorf("fake server expected empty acknowledgement, got %q, %v", line, err)
+		}
+	}
+	close(sent)
+	// Wait for the subscriber to close the connection.
+	io.Copy(ioutil.Discard, conn)
+	return nil
+}
+
+func TestTailNATS(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sub  NATSSubscription
+	}{
+		{"core", NATSSubscription{Subject: "app.>"}},
+		{"jetstream", NATSSubscription{Subject: "app.>", Stream: "logs", Durable: "mtail"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			done := make(chan error)
+			sent := make(chan struct{})
+			go func() {
+				done <- fakeNATSServer(l, tc.sub.Subject, tc.sub.Durable, []string{"a\r\nb\n", "cd"}, sent)
+			}()
+
+			lines := make(chan *logline.LogLine, 10)
+			ta, err := New(lines, afero.NewMemMapFs(), watcher.NewFakeWatcher())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ta.TailNATS("nats://user:secret@"+l.Addr().String(), tc.sub); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i := 0; i < 3; i++ {
+				line := <-lines
+				if want := "nats://user@" + l.Addr().String() + "/app.web"; line.Filename != want {
+					t.Errorf("filename %q, want %q", line.Filename, want)
+				}
+				got = append(got, line.Line)
+			}
+			<-sent
+			if err := ta.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+			if diff := cmp.Diff([]string{"a", "b", "cd"}, got); diff != "" {
+				t.Errorf("lines differ:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTailNATSErrors(t *testing.T) {
+	ta, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ta.Close()
+	for _, tc := range []struct {
+		uri string
+		sub NATSSubscription
+	}{
+		{"http://localhost/", NATSSubscription{Subject: "a"}},
+		{":%zz", NATSSubscription{Subject: "a"}},
+		{"nats://localhost/", NATSSubscription{}},
+		{"nats://localhost/", NATSSubscription{Subject: "a b"}},
+		{"nats://localhost/", NATSSubscription{Stream: "logs"}},
+	} {
+		if err := ta.TailNATS(tc.uri, tc.sub); err == nil {
+			t.Errorf("TailNATS(%q, %+v) succeeded", tc.uri, tc.sub)
+		}
+	}
+}
@@ -0,0 +1,637 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// objectsRead counts the objects read from cloud storage, per bucket
+	objectsRead = expvar.NewMap("log_objects_read_total")
+)
+
+// IsObjectURL reports whether pattern names objects in cloud storage, like
+// s3://bucket/logs/*.gz or gs://bucket/logs/, which are read by TailObjects
+// rather than TailPattern.
+func IsObjectURL(pattern string) bool {
+	return strings.HasPrefix(pattern, "s3://") || strings.HasPrefix(pattern, "gs://")
+}
+
+const (
+	// objectRetries is how many times a request to a storage service is
+	// retried if the service fails or throttles it.
+	objectRetries = 4
+	// credentialsMargin is how long before they expire that credentials from
+	// a metadata service are fetched again.
+	credentialsMargin = 5 * time.Minute
+	// credentialsRetry is how long after failing to fetch credentials from a
+	// metadata service that they are fetched again.
+	credentialsRetry = time.Minute
+)
+
+var (
+	// objectBackoff is how long the first retry of a request to a storage
+	// service waits; later retries double it.
+	objectBackoff = time.Second
+
+	// objectClient sends requests to storage services.  It has no overall
+	// timeout, as the body of an object is read for as long as it takes to
+	// send its lines to the programs.
+	objectClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+
+	// metadataClient sends requests to the metadata services of the cloud
+	// mtail runs in, which answer promptly when they are there at all.
+	metadataClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// objectStore reads objects from a cloud storage service.
+type objectStore interface {
+	// list returns the names of the objects in bucket whose names start with prefix.
+	list(bucket, prefix string) ([]string, error)
+	// open returns the contents of the named object in bucket.
+	open(bucket, name string) (io.ReadCloser, error)
+}
+
+// TailObjects reads, in one-shot mode, the objects in Amazon S3 or Google
+// Cloud Storage named by uri, and sends their lines to the programs.  The uri
+// is of the form s3://bucket/name or gs://bucket/name, where name may be a
+// glob, or a prefix ending in a slash to read every object under it.  Objects
+// whose names end in .gz are decompressed as they are read.  The filename of
+// each line is the URL of its object.
+//
+// S3 requests are signed with the credentials in the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables, or
+// without them, with the temporary credentials of the ECS task or EC2
+// instance, in the region in AWS_REGION, and are sent to AWS_ENDPOINT_URL if
+// set, for S3 compatible services.  Cloud Storage requests carry the access
+// token in GOOGLE_OAUTH_ACCESS_TOKEN, or without it, that of the Compute
+// Engine service account, and are sent to STORAGE_EMULATOR_HOST if set.
+// Temporary credentials are fetched again before they expire.  Without
+// credentials, only public objects can be read.  Requests that fail, or are
+// throttled, are retried with a backoff.
+func (t *Tailer) TailObjects(uri string) error {
+	if !t.oneShot {
+		return errors.Errorf("objects in %q can only be read in one-shot mode", uri)
+	}
+	var store objectStore
+	switch {
+	case strings.HasPrefix(uri, "s3://"):
+		store = newS3Store()
+	case strings.HasPrefix(uri, "gs://"):
+		store = newGCSStore()
+	default:
+		return errors.Errorf("unsupported object URL %q", uri)
+	}
+	// The name isn't parsed as part of a URL, as a glob may contain `?'.
+	scheme := uri[:strings.Index(uri, "://")]
+	bucket := uri[len(scheme)+3:]
+	var name string
+	if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		bucket, name = bucket[:i], bucket[i+1:]
+	}
+	if bucket == "" {
+		return errors.Errorf("no bucket in object URL %q", uri)
+	}
+	names, err := objectNames(store, bucket, name)
+	if err != nil {
+		return errors.Wrapf(err, "listing objects for %q", uri)
+	}
+	if len(names) == 0 {
+		return errors.Errorf("No objects match %q", uri)
+	}
+	for _, name := range names {
+		name := name
+		if t.oneShotReaders != nil {
+			// Read the object alongside the others, as with log files.
+			t.oneShotReaders <- struct{}{}
+			t.oneShotReads.Add(1)
+			go func() {
+				defer t.oneShotReads.Done()
+				if err := t.readObject(store, scheme, bucket, name); err != nil {
+					errLog.Infof("Failed to read %s://%s/%s: %s", scheme, bucket, name, err)
+				}
+				<-t.oneShotReaders
+			}()
+		} else if err := t.readObject(store, scheme, bucket, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectNames returns the names of the objects in bucket matched by name,
+// which may be a glob, or a prefix ending in a slash.
+func objectNames(store objectStore, bucket, name string) ([]string, error) {
+	i := strings.IndexAny(name, "*?[")
+	if i < 0 && name != "" && !strings.HasSuffix(name, "/") {
+		return []string{name}, nil
+	}
+	if i < 0 {
+		i = len(name)
+	} else if _, err := path.Match(name, ""); err != nil {
+		return nil, errors.Wrapf(err, "bad glob %q", name)
+	}
+	all, err := store.list(bucket, name[:i])
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, n := range all {
+		if strings.HasSuffix(n, "/") {
+			// Placeholders for directories hold no lines.
+			continue
+		}
+		if i < len(name) {
+			if ok, _ := path.Match(name, n); !ok {
+				continue
+			}
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readObject streams the lines of the named object in bucket to the programs.
+func (t *Tailer) readObject(store objectStore, scheme, bucket, name string) error {
+	source := scheme + "://" + bucket + "/" + name
+	rc, err := store.open(bucket, name)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", source)
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			return errors.Wrapf(err, "decompressing %s", source)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	glog.Infof("Reading %s", source)
+	objectsRead.Add(scheme+"://"+bucket, 1)
+	br := bufio.NewReader(r)
+	sep := t.separatorFor(source)
+	for {
+		line, long, err := t.readLine(br, sep)
+		if len(line) > 0 || long || err == nil {
+			t.sendSocketLine(source, source, line, long)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", source)
+		}
+	}
+}
+
+// getObject sends the request made by newRequest, and returns the response
+// if it succeeded.  The request is made again, with a backoff, if the service
+// couldn't be reached, failed, or throttled it.
+func getObject(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	backoff := objectBackoff
+	for i := 0; ; i++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := objectClient.Do(req)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				return resp, nil
+			}
+			b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			err = errors.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(b)))
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return nil, err
+			}
+		}
+		if i == objectRetries {
+			return nil, err
+		}
+		glog.V(1).Infof("%s; retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// credentials caches the credentials fetched from a metadata service, and
+// fetches them again shortly before they expire.
+type credentials struct {
+	fetch func() (interface{}, time.Time, error) // returns the credentials and when they expire
+	now   func() time.Time                       // mockable clock
+
+	mu      sync.Mutex
+	value   interface{}
+	refresh time.Time // when the credentials are next fetched
+}
+
+// get returns the credentials.  If they can't be fetched, it returns nil, so
+// that requests are sent without them, until they are fetched again after
+// credentialsRetry.
+func (c *credentials) get() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Before(c.refresh) {
+		return c.value
+	}
+	v, expires, err := c.fetch()
+	if err != nil {
+		glog.Warningf("Failed to fetch credentials, sending requests without them: %s", err)
+		c.value, c.refresh = nil, now.Add(credentialsRetry)
+		return nil
+	}
+	c.value, c.refresh = v, expires.Add(-credentialsMargin)
+	return v
+}
+
+// getMetadata sends a request to a metadata service with the given headers,
+// and returns the body of the response.
+func getMetadata(method, rawurl string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s %s: %s", method, rawurl, resp.Status)
+	}
+	return b, nil
+}
+
+// s3Store reads objects from Amazon S3, or an S3 compatible service.
+type s3Store struct {
+	endpoint string // if set, the URL of an S3 compatible service, to which requests are made with the bucket in the path
+	region   string
+	creds    func() *awsCredentials // returns the credentials requests are signed with, or nil to send them unsigned
+
+	now func() time.Time // mockable clock
+}
+
+// awsCredentials are the credentials S3 requests are signed with.
+type awsCredentials struct {
+	accessKey, secretKey, sessionToken string
+}
+
+// emptySHA256 is the hash of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func newS3Store() *s3Store {
+	s := &s3Store{
+		endpoint: strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/"),
+		region:   os.Getenv("AWS_REGION"),
+		now:      time.Now,
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	switch {
+	case os.Getenv("AWS_ACCESS_KEY_ID") != "":
+		c := &awsCredentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		s.creds = func() *awsCredentials { return c }
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") == "" && os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") == "" && os.Getenv("AWS_EC2_METADATA_DISABLED") == "true":
+		s.creds = func() *awsCredentials { return nil }
+	default:
+		cache := &credentials{fetch: fetchAWSCredentials, now: time.Now}
+		s.creds = func() *awsCredentials {
+			c, _ := cache.get().(*awsCredentials)
+			return c
+		}
+	}
+	return s
+}
+
+// fetchAWSCredentials fetches the temporary credentials of the ECS task mtail
+// runs in, or otherwise of the EC2 instance, from its metadata service.
+func fetchAWSCredentials() (interface{}, time.Time, error) {
+	var body []byte
+	var err error
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		body, err = getMetadata("GET", "http://169.254.170.2"+uri, nil)
+	} else if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); uri != "" {
+		body, err = getMetadata("GET", uri, map[string]string{"Authorization": os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")})
+	} else {
+		endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+		if endpoint == "" {
+			endpoint = "http://169.254.169.254"
+		}
+		// The instance metadata service requires a session token.
+		var token, role []byte
+		token, err = getMetadata("PUT", endpoint+"/latest/api/token", map[string]string{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": "21600"})
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		headers := map[string]string{"X-Aws-Ec2-Metadata-Token": string(token)}
+		role, err = getMetadata("GET", endpoint+"/latest/meta-data/iam/security-credentials/", headers)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+		if name == "" {
+			return nil, time.Time{}, errors.New("no IAM role for the EC2 instance")
+		}
+		body, err = getMetadata("GET", endpoint+"/latest/meta-data/iam/security-credentials/"+name, headers)
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var result struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "bad AWS credentials")
+	}
+	return &awsCredentials{accessKey: result.AccessKeyID, secretKey: result.SecretAccessKey, sessionToken: result.Token}, result.Expiration, nil
+}
+
+// bucketURL returns the URL of bucket, to which the escaped name of an
+// object is appended.
+func (s *s3Store) bucketURL(bucket string) string {
+	if s.endpoint != "" {
+		return s.endpoint + "/" + bucket + "/"
+	}
+	return "https://" + bucket + ".s3." + s.region + ".amazonaws.com/"
+}
+
+func (s *s3Store) get(rawurl string) (*http.Response, error) {
+	return getObject(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", rawurl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if c := s.creds(); c != nil {
+			s.sign(req, c)
+		}
+		return req, nil
+	})
+}
+
+func (s *s3Store) open(bucket, name string) (io.ReadCloser, error) {
+	resp, err := s.get(s.bucketURL(bucket) + s3Escape(name, false))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) list(bucket, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		// The query is sorted by key, as the signature requires.
+		query := "list-type=2&prefix=" + s3Escape(prefix, true)
+		if token != "" {
+			query = "continuation-token=" + s3Escape(token, true) + "&" + query
+		}
+		resp, err := s.get(s.bucketURL(bucket) + "?" + query)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "bad S3 object listing")
+		}
+		for _, c := range result.Contents {
+			names = append(names, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// sign adds an AWS Signature Version 4 with the credentials c to req,
+// signing its host, its range if any, and its x-amz- headers.
+func (s *s3Store) sign(req *http.Request, c *awsCredentials) {
+	now := s.now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k := range req.Header {
+		if k := strings.ToLower(k); k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	query := strings.Split(req.URL.RawQuery, "&")
+	sort.Strings(query)
+	canonical := strings.Join([]string{req.Method, uri, strings.Join(query, "&"), canonicalHeaders.String(), signedHeaders, emptySHA256}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, v := range []string{date, s.region, "s3", "aws4_request", toSign} {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(v))
+		key = h.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x", c.accessKey, scope, signedHeaders, key))
+}
+
+// s3Escape escapes s as the S3 signature requires: every byte but letters,
+// digits, and `-._~', and slashes unless slash is set, is percent-encoded.
+func s3Escape(s string, slash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 || (c == '/' && !slash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// gcsStore reads objects from Google Cloud Storage, with its JSON API.
+type gcsStore struct {
+	endpoint string
+	token    func() string // returns the OAuth 2.0 access token sent with requests, or the empty string to send none
+}
+
+func newGCSStore() *gcsStore {
+	s := &gcsStore{endpoint: "https://storage.googleapis.com"}
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		s.endpoint = strings.TrimSuffix(host, "/")
+	}
+	switch token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); {
+	case token != "":
+		s.token = func() string { return token }
+	case host != "":
+		// The emulator needs no token.
+		s.token = func() string { return "" }
+	default:
+		cache := &credentials{fetch: fetchGCPToken, now: time.Now}
+		s.token = func() string {
+			token, _ := cache.get().(string)
+			return token
+		}
+	}
+	return s
+}
+
+// fetchGCPToken fetches an access token for the service account of the
+// Compute Engine instance mtail runs on from its metadata server.
+func fetchGCPToken() (interface{}, time.Time, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	body, err := getMetadata("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "bad Compute Engine access token")
+	}
+	return result.AccessToken, time.Now().Add(time.Duration(result.ExpiresIn) * time.Second), nil
+}
+
+func (s *gcsStore) get(rawurl string) (*http.Response, error) {
+	return getObject(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", rawurl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token := s.token(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req, nil
+	})
+}
+
+func (s *gcsStore) open(bucket, name string) (io.ReadCloser, error) {
+	resp, err := s.get(s.endpoint + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name) + "?alt=media")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *gcsStore) list(bucket, prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"prefix": {prefix}, "fields": {"items(name),nextPageToken"}}
+	for {
+		resp, err := s.get(s.endpoint + "/storage/v1/b/" + url.PathEscape(bucket) + "/o?" + query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "bad Cloud Storage object listing")
+		}
+		for _, item := range result.Items {
+			names = append(names, item.Name)
+		}
+		if result.NextPageToken == "" {
+			return names, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// logMessagesSuppressed counts the log messages not written because an
+	// identical message was written recently.
+	logMessagesSuppressed = expvar.NewInt("log_messages_suppressed_total")
+)
+
+// defaultErrorLogInterval is the minimum time between repeats of the same
+// error message from the tailer.
+const defaultErrorLogInterval = time.Minute
+
+// errorLog writes error messages to the info log, but drops repeats of a
+// message that was logged less than interval ago.  A file that has gone away
+// will otherwise cause an error on every poll and every event in its
+// directory, flooding the log.  The number of suppressed repeats is reported
+// when the message is next logged.
+type errorLog struct {
+	interval time.Duration
+	now      func() time.Time // mockable clock
+
+	mu   sync.Mutex
+	seen map[string]*errorLogEntry // keyed by message text
+}
+
+type errorLogEntry struct {
+	last       time.Time
+	suppressed int
+}
+
+func newErrorLog(interval time.Duration) *errorLog {
+	return &errorLog{interval: interval, now: time.Now, seen: make(map[string]*errorLogEntry)}
+}
+
+// errLog is shared by all files being tailed.
+var errLog = newErrorLog(defaultErrorLogInterval)
+
+// format returns the message to log, or false if the message is a repeat
+// that should be suppressed.
+func (l *errorLog) format(format string, args ...interface{}) (string, bool) {
+	msg := fmt.Sprintf(format, args...)
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.seen[msg]
+	if !ok {
+		e = &errorLogEntry{}
+		l.seen[msg] = e
+	} else if now.Sub(e.last) < l.interval {
+		e.suppressed++
+		logMessagesSuppressed.Add(1)
+		return "", false
+	}
+	// Forget messages that haven't repeated recently, so that the table
+	// doesn't grow without bound as files come and go.
+	for k, v := range l.seen {
+		if k != msg && now.Sub(v.last) >= l.interval {
+			delete(l.seen, k)
+		}
+	}
+	if e.suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d repeats suppressed)", msg, e.suppressed)
+	}
+	e.last = now
+	e.suppressed = 0
+	return msg, true
+}
+
+// Infof logs the message at info level unless it is a recent repeat.  If
+// verbose logging is enabled at level 2 or higher, nothing is suppressed.
+func (l *errorLog) Infof(format string, args ...interface{}) {
+	if glog.V(2) {
+		glog.Infof(format, args...)
+		return
+	}
+	if msg, ok := l.format(format, args...); ok {
+		glog.InfoDepth(1, msg)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErrorLogSuppressesRepeats(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newErrorLog(time.Minute)
+	l.now = func() time.Time { return now }
+
+	steps := []struct {
+		advance time.Duration
+		msg     string
+		want    string
+		logged  bool
+	}{
+		{0, "a", "a", true},
+		{time.Second, "a", "", false},
+		{time.Second, "b", "b", true},
+		{time.Second, "a", "", false},
+		{time.Minute, "a", "a (2 repeats suppressed)", true},
+		{time.Second, "a", "", false},
+		{2 * time.Minute, "a", "a (1 repeats suppressed)", true},
+		{2 * time.Minute, "a", "a", true},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		got, logged := l.format("%s", s.msg)
+		if logged != s.logged || got != s.want {
+			t.Errorf("step %d: format(%q) = %q, %v; want %q, %v", i, s.msg, got, logged, s.want, s.logged)
+		}
+	}
+	if _, ok := l.seen["b"]; ok {
+		t.Errorf("stale message not expired: %v", l.seen)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ReadFromStart is the argument to ReadFrom that reads the whole of a log
+// file.
+const ReadFromStart = -1
+
+// readFrom is how much of the existing content of the log files matching a
+// glob pattern is read when they are first tailed.
+type readFrom struct {
+	glob string
+	n    int64 // bytes before the end to start at, or ReadFromStart
+}
+
+// ParseReadFrom parses where to start reading a log file: start, end, or a
+// number of bytes before the end.
+func ParseReadFrom(s string) (int64, error) {
+	switch s {
+	case "start":
+		return ReadFromStart, nil
+	case "end":
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("bad read position %q: want start, end, or a number of bytes", s)
+	}
+	return n, nil
+}
+
+// ReadFrom sets the tailer to start reading the log files matching glob that
+// exist when they are first tailed n bytes before their end, or from their
+// start if n is ReadFromStart, instead of at their end.  This backfills the
+// metrics with what was logged before mtail started.  A read that starts in
+// the middle of a line skips the rest of it.  Log files created or rotated
+// later are always read from the start, and one-shot mode always reads the
+// whole file.
+func ReadFrom(glob string, n int64) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return errors.Wrapf(err, "bad glob %q", glob)
+		}
+		if n < ReadFromStart {
+			return errors.Errorf("bad read position %d for %q", n, glob)
+		}
+		t.readFroms = append(t.readFroms, readFrom{glob, n})
+		return nil
+	}
+}
+
+// readFromFor returns how many bytes before the end of the log file pathname
+// to start reading it when first tailed, according to the first ReadFrom
+// whose glob matches it, or zero to start at the end.
+func (t *Tailer) readFromFor(pathname string) int64 {
+	for _, r := range t.readFroms {
+		if globMatches(r.glob, pathname) {
+			return r.n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestParseReadFrom(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"start", ReadFromStart, true},
+		{"end", 0, true},
+		{"65536", 65536, true},
+		{"-1", 0, false},
+		{"1MB", 0, false},
+		{"", 0, false},
+	} {
+		got, err := ParseReadFrom(tc.s)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: error %v, want ok %v", tc.s, err, tc.ok)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %d, want %d", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	const content = "one\ntwo\nthree\n"
+	for _, tc := range []struct {
+		n    int64
+		want []string
+	}{
+		{ReadFromStart, []string{"one", "two", "three"}},
+		{0, nil},
+		// Starts in the middle of "two", which is skipped.
+		{8, []string{"three"}},
+		// Starts at the start of "two".
+		{10, []string{"two", "three"}},
+		{1000, []string{"one", "two", "three"}},
+	} {
+		t.Run(fmt.Sprintf("%d", tc.n), func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			if err := afero.WriteFile(fs, "/log", []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := afero.WriteFile(fs, "/other", []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			lines := make(chan *logline.LogLine, 10)
+			ta, err := New(lines, fs, watcher.NewFakeWatcher(), ReadFrom("/log", tc.n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pathname := range []string{"/log", "/other"} {
+				if err := ta.TailPath(pathname); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(lines)
+			var got []string
+			for l := range lines {
+				if l.Filename != "/log" {
+					t.Errorf("line %q read from %s, which doesn't match", l.Line, l.Filename)
+				}
+				got = append(got, l.Line)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("lines differ:\n%s", diff)
+			}
+		})
+	}
+	if _, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher(), ReadFrom("/log", -2)); err == nil {
+		t.Error("expected an error for a bad read position")
+	}
+}
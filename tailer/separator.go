@@ -0,0 +1,82 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// recordSeparator is the byte that ends each record of the sources matching
+// a glob pattern, for writers that don't end their records with a newline.
+type recordSeparator struct {
+	glob string
+	sep  byte
+}
+
+// recordSeparatorNames are the names of the separators that
+// ParseRecordSeparator accepts besides a single character.
+var recordSeparatorNames = map[string]byte{
+	"newline": '\n',
+	"nul":     0,
+	"rs":      0x1e, // ASCII record separator
+}
+
+// ParseRecordSeparator parses the name of a record separator: newline, nul,
+// rs for the ASCII record separator, a single character, or a quoted Go
+// character escape like \x1e.
+func ParseRecordSeparator(s string) (byte, error) {
+	if sep, ok := recordSeparatorNames[s]; ok {
+		return sep, nil
+	}
+	if len(s) == 1 {
+		return s[0], nil
+	}
+	if v, mb, tail, err := strconv.UnquoteChar(s, 0); err == nil && !mb && tail == "" {
+		return byte(v), nil
+	}
+	return 0, errors.Errorf("bad record separator %q: want newline, nul, rs, a single character, or an escape like \\x1e", s)
+}
+
+// RecordSeparator sets the tailer to split what is read from the sources
+// matching glob into records at sep, instead of at newlines, so that each
+// record is sent to the programs as a line of its own.  A source is a log
+// file, matched by its pathname, or a socket, broker or object store, matched
+// by the address or URL it was given as.
+func RecordSeparator(glob string, sep byte) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return errors.Wrapf(err, "bad glob %q", glob)
+		}
+		t.separators = append(t.separators, recordSeparator{glob, sep})
+		return nil
+	}
+}
+
+// separatorFor returns the separator of the first RecordSeparator whose glob
+// matches the source name, or a newline.
+func (t *Tailer) separatorFor(name string) byte {
+	for _, s := range t.separators {
+		if globMatches(s.glob, name) {
+			return s.sep
+		}
+	}
+	return '\n'
+}
+
+// globMatches reports whether glob matches the source name, or its absolute
+// path.
+func globMatches(glob, name string) bool {
+	if ok, _ := filepath.Match(glob, name); ok {
+		return true
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	ok, _ := filepath.Match(glob, abs)
+	return ok
+}
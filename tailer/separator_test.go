@@ -0,0 +1,144 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestParseRecordSeparator(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want byte
+		ok   bool
+	}{
+		{"newline", '\n', true},
+		{"nul", 0, true},
+		{"rs", 0x1e, true},
+		{";", ';', true},
+		{`\x1e`, 0x1e, true},
+		{`\t`, '\t', true},
+		{"", 0, false},
+		{"tab", 0, false},
+		{` `, 0, false},
+	} {
+		got, err := ParseRecordSeparator(tc.s)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: error %v, want ok %v", tc.s, err, tc.ok)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestSeparatorFor(t *testing.T) {
+	ta, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher(),
+		RecordSeparator("/var/log/journal/*", 0),
+		RecordSeparator("udp://:5140", 0x1e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]byte{
+		"/var/log/journal/export": 0,
+		"udp://:5140":             0x1e,
+		"/var/log/syslog":         '\n',
+		"tcp://:5140":             '\n',
+	} {
+		if got := ta.separatorFor(name); got != want {
+			t.Errorf("%s: separator %q, want %q", name, got, want)
+		}
+	}
+	if _, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher(), RecordSeparator("[", 0)); err == nil {
+		t.Error("expected an error for a bad glob")
+	}
+}
+
+func TestReadRecordSeparator(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+	fs := afero.NewMemMapFs()
+	fd, err := fs.Create("/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(fs, "/t", lines, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.separator = 0
+	// Records may hold newlines, and several may arrive in one write.
+	fd.WriteString("a\x00b\nc\x00d")
+	fd.Seek(0, io.SeekStart)
+	if err := f.Read(); err != io.EOF {
+		t.Fatalf("error returned not EOF: %v", err)
+	}
+	close(lines)
+	var got []string
+	for l := range lines {
+		got = append(got, l.Line)
+	}
+	if diff := cmp.Diff([]string{"a", "b\nc"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+	if f.partial.String() != "d" {
+		t.Errorf("partial record %q, want %q", f.partial, "d")
+	}
+}
+
+func TestTailSocketRecordSeparator(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			address := network + "://127.0.0.1:0"
+			lines := make(chan *logline.LogLine, 10)
+			ta, err := New(lines, afero.NewMemMapFs(), watcher.NewFakeWatcher(), RecordSeparator(address, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ta.TailSocket(address); err != nil {
+				t.Fatal(err)
+			}
+			var addr net.Addr
+			ta.sockets.mu.Lock()
+			for c := range ta.sockets.closers {
+				switch c := c.(type) {
+				case net.Listener:
+					addr = c.Addr()
+				case net.PacketConn:
+					addr = c.LocalAddr()
+				}
+			}
+			ta.sockets.mu.Unlock()
+			c, err := net.Dial(network, addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Write([]byte("a\x00b\nc\x00")); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			want := []string{"a", "b\nc"}
+			var got []string
+			for range want {
+				got = append(got, (<-lines).Line)
+			}
+			if err := ta.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for l := range lines {
+				got = append(got, l.Line)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("lines differ:\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/logline"
+	"github.com/pkg/errors"
+)
+
+var (
+	// socketConnections counts the connections accepted per stream socket
+	socketConnections = expvar.NewMap("log_socket_connections_total")
+)
+
+// maxDatagramSize is the largest datagram read from a packet socket.
+const maxDatagramSize = 65535
+
+// sockets holds the sockets the tailer receives log lines on, so they can be
+// closed before the lines channel is.
+type sockets struct {
+	mu      sync.Mutex
+	closers map[io.Closer]struct{} // listeners and open connections
+	wg      sync.WaitGroup         // running socket goroutines
+	closed  bool
+	done    chan struct{} // closed by closeAll
+}
+
+// stopped returns a channel that is closed when the sockets are closed.
+func (s *sockets) stopped() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// add records c to be closed by closeAll, unless that has happened already.
+func (s *sockets) add(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.closers == nil {
+		s.closers = make(map[io.Closer]struct{})
+	}
+	s.closers[c] = struct{}{}
+	return true
+}
+
+func (s *sockets) remove(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.closers, c)
+}
+
+// closeAll closes the sockets and waits for their goroutines to finish.
+func (s *sockets) closeAll() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		if s.done == nil {
+			s.done = make(chan struct{})
+		}
+		close(s.done)
+	}
+	for c := range s.closers {
+		if err := c.Close(); err != nil {
+			glog.V(1).Info(err)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// TailSocket receives log lines sent to address, a URL such as
+// tcp://:5140 or udp://127.0.0.1:5140.  Stream sockets accept newline
+// delimited text on each connection; each datagram received on a packet
+// socket holds one or more lines.  The filename of each line is the URL of
+// the sender, so programs can tell the sources apart.
+func (t *Tailer) TailSocket(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return errors.Wrapf(err, "bad socket address %q", address)
+	}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6", "unix":
+		host := u.Host
+		if u.Scheme == "unix" {
+			host = u.Path
+		}
+		l, err := net.Listen(u.Scheme, host)
+		if err != nil {
+			return err
+		}
+		if !t.sockets.add(l) {
+			return l.Close()
+		}
+		glog.Infof("Receiving log lines on %s", address)
+		t.sockets.wg.Add(1)
+		go t.acceptConns(address, l)
+	case "udp", "udp4", "udp6", "unixgram":
+		host := u.Host
+		if u.Scheme == "unixgram" {
+			host = u.Path
+		}
+		c, err := net.ListenPacket(u.Scheme, host)
+		if err != nil {
+			return err
+		}
+		if !t.sockets.add(c) {
+			return c.Close()
+		}
+		glog.Infof("Receiving log lines on %s", address)
+		t.sockets.wg.Add(1)
+		go t.readPackets(address, u.Scheme, c)
+	default:
+		return errors.Errorf("unsupported socket type %q in %q", u.Scheme, address)
+	}
+	t.socketAddrsMu.Lock()
+	t.socketAddrs = append(t.socketAddrs, address)
+	t.socketAddrsMu.Unlock()
+	return nil
+}
+
+// acceptConns reads lines from each connection accepted by l until l is closed.
+func (t *Tailer) acceptConns(address string, l net.Listener) {
+	defer t.sockets.wg.Done()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			glog.V(1).Infof("Stopped receiving log lines on %s: %s", address, err)
+			return
+		}
+		if !t.sockets.add(c) {
+			c.Close()
+			return
+		}
+		socketConnections.Add(address, 1)
+		t.sockets.wg.Add(1)
+		go t.readConn(address, c)
+	}
+}
+
+// readConn sends the lines read from c, until it is closed by either end.
+func (t *Tailer) readConn(address string, c net.Conn) {
+	defer t.sockets.wg.Done()
+	defer t.sockets.remove(c)
+	defer c.Close()
+	source := sourceURL(c.LocalAddr().Network(), c.RemoteAddr())
+	glog.V(1).Infof("New connection from %s on %s", source, address)
+	r := bufio.NewReader(c)
+	sep := t.separatorFor(address)
+	for {
+		line, long, err := t.readLine(r, sep)
+		if len(line) > 0 || long || err == nil {
+			t.sendSocketLine(address, source, line, long)
+		}
+		if err != nil {
+			if err != io.EOF {
+				glog.V(1).Infof("Reading from %s: %s", source, err)
+			}
+			return
+		}
+	}
+}
+
+// readPackets sends the lines in each datagram read from c, until c is closed.
+func (t *Tailer) readPackets(address, network string, c net.PacketConn) {
+	defer t.sockets.wg.Done()
+	b := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			glog.V(1).Infof("Stopped receiving log lines on %s: %s", address, err)
+			return
+		}
+		t.sendMessageLines(address, sourceURL(network, addr), b[:n])
+	}
+}
+
+// sendMessageLines sends the lines in a message, such as a datagram, received
+// on the socket at address from source.  Writers that batch several records
+// in a message separate them with newlines, or the RecordSeparator of
+// address.
+func (t *Tailer) sendMessageLines(address, source string, message []byte) {
+	sep := []byte{t.separatorFor(address)}
+	for _, line := range bytes.Split(bytes.TrimSuffix(message, sep), sep) {
+		long := false
+		if t.maxLineLength > 0 && len(line) > t.maxLineLength {
+			line, long = line[:t.maxLineLength], true
+		}
+		t.sendSocketLine(address, source, string(line), long)
+	}
+}
+
+// maxRedialBackoff is the longest wait between attempts to connect to a
+// message broker.
+const maxRedialBackoff = time.Minute
+
+// redial calls connect, which connects to the message broker called name and
+// receives log lines until the connection fails, until the tailer is closed.
+// The wait between attempts doubles after each failure, up to
+// maxRedialBackoff.
+func (t *Tailer) redial(name string, connect func() error) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := connect()
+		select {
+		case <-t.sockets.stopped():
+			glog.V(1).Infof("Stopped receiving log lines from %s: %s", name, err)
+			return
+		default:
+		}
+		if time.Since(start) > maxRedialBackoff {
+			// The connection was good for a while; retry promptly.
+			backoff = time.Second
+		}
+		glog.Infof("Receiving log lines from %s failed, retrying in %s: %s", name, backoff, err)
+		select {
+		case <-t.sockets.stopped():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRedialBackoff {
+			backoff = maxRedialBackoff
+		}
+	}
+}
+
+// readLine reads a line ending in sep from r, up to the maximum line length;
+// the rest of a longer line is discarded, and long is set.
+func (t *Tailer) readLine(r *bufio.Reader, sep byte) (line string, long bool, err error) {
+	var b []byte
+	for {
+		var frag []byte
+		frag, err = r.ReadSlice(sep)
+		if err == nil {
+			frag = frag[:len(frag)-1]
+		}
+		if t.maxLineLength > 0 && len(b)+len(frag) > t.maxLineLength {
+			frag, long = frag[:t.maxLineLength-len(b)], true
+		}
+		b = append(b, frag...)
+		if err != bufio.ErrBufferFull {
+			return string(b), long, err
+		}
+	}
+}
+
+// sendSocketLine sends a line received on the socket at address from source.
+func (t *Tailer) sendSocketLine(address, source, line string, long bool) {
+	line = strings.TrimSuffix(line, "\r")
+	if long {
+		if t.longLines == LongLinesDrop {
+			longLinesDropped.Add(address, 1)
+			lineCount.Add(address, 1)
+			return
+		}
+		longLinesTruncated.Add(address, 1)
+	}
+	lineCount.Add(address, 1)
+	byteCount.Add(address, int64(len(line)))
+	l := logline.NewLogLine(source, line)
+	if t.now != nil {
+		l.Time = t.now()
+	}
+	sendLine(t.lines, l)
+}
+
+// sourceURL names the sender of lines received on a socket.
+func sourceURL(network string, addr net.Addr) string {
+	if addr == nil || addr.String() == "" {
+		return network + "://"
+	}
+	return network + "://" + addr.String()
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestTailSocket(t *testing.T) {
+	for _, tc := range []struct {
+		network string
+		send    []string
+		max     int
+		policy  string
+		want    []string
+	}{
+		{"tcp", []string{"a\nb\r\n", "c", "d\ne"}, 0, LongLinesTruncate, []string{"a", "b", "cd", "e"}},
+		{"tcp", []string{"abcdef\nab\n"}, 4, LongLinesTruncate, []string{"abcd", "ab"}},
+		{"tcp", []string{"abcdef\nab\n"}, 4, LongLinesDrop, []string{"ab"}},
+		{"udp", []string{"a\nb\r\n"}, 0, LongLinesTruncate, []string{"a", "b"}},
+	} {
+		t.Run(fmt.Sprintf("%s %d %s", tc.network, tc.max, tc.policy), func(t *testing.T) {
+			lines := make(chan *logline.LogLine, 10)
+			ta, err := New(lines, afero.NewMemMapFs(), watcher.NewFakeWatcher(), MaxLineLength(tc.max, tc.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ta.TailSocket(tc.network + "://127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+			// Find the port the socket was bound to.
+			var addr net.Addr
+			ta.sockets.mu.Lock()
+			for c := range ta.sockets.closers {
+				switch c := c.(type) {
+				case net.Listener:
+					addr = c.Addr()
+				case net.PacketConn:
+					addr = c.LocalAddr()
+				}
+			}
+			ta.sockets.mu.Unlock()
+			c, err := net.Dial(tc.network, addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.send {
+				if _, err := c.Write([]byte(s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The last line is complete when the connection is closed.
+			c.Close()
+			var got []string
+			for range tc.want {
+				l := <-lines
+				if !strings.HasPrefix(l.Filename, tc.network+"://127.0.0.1:") {
+					t.Errorf("line %q from unexpected source %q", l.Line, l.Filename)
+				}
+				got = append(got, l.Line)
+			}
+			if err := ta.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for l := range lines {
+				got = append(got, l.Line)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("lines differ:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTailSocketErrors(t *testing.T) {
+	ta, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ta.Close()
+	for _, address := range []string{"ftp://:21", "tcp://nonexistent.invalid:99999", ":%zz"} {
+		if err := ta.TailSocket(address); err == nil {
+			t.Errorf("TailSocket(%q) succeeded", address)
+		}
+	}
+}
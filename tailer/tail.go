@@ -12,11 +12,15 @@ package tailer
 
 import (
 	"expvar"
+	"fmt"
+	"hash/fnv"
 	"html/template"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -31,8 +35,20 @@ import (
 var (
 	// logCount records the number of logs that are being tailed
 	logCount = expvar.NewInt("log_count")
+	// tailerEvents counts the log file events handled by the tailer, by kind
+	tailerEvents = expvar.NewMap("log_tailer_events_total")
+	// linesPending is the number of lines read but not yet accepted by the programs
+	linesPending = expvar.NewInt("log_lines_pending")
 )
 
+// sendLine sends a line read from a log to the programs, counting it as
+// pending until they accept it, so that a backlog can be seen.
+func sendLine(lines chan<- *logline.LogLine, l *logline.LogLine) {
+	linesPending.Add(1)
+	lines <- l
+	linesPending.Add(-1)
+}
+
 // Tailer receives notification of changes from a Watcher and extracts new log
 // lines from files. It also handles new log file creation events and log
 // rotations.
@@ -54,6 +70,26 @@ type Tailer struct {
 	pollTicker *time.Ticker
 
 	oneShot bool
+
+	oneShotReaders chan struct{}  // if set, limits the log files read at once in one-shot mode
+	oneShotReads   sync.WaitGroup // log files being read in one-shot mode
+
+	shard, numShards int // this tailer only reads the files in shard, of numShards
+
+	unwrap unwrapFunc // if set, extracts the log message from each line read
+
+	filters    []*lineFilter     // drop or sample lines of some log files
+	separators []recordSeparator // split the records of some sources at other than newlines
+	readFroms  []readFrom        // read the existing content of some log files when first tailed
+
+	now func() time.Time // if set, stamps the lines read that have no time of their own
+
+	maxLineLength int    // if positive, the longest line in bytes sent to the programs
+	longLines     string // what to do with lines longer than maxLineLength
+
+	sockets       sockets    // sockets receiving log lines
+	socketAddrsMu sync.Mutex // protects socketAddrs
+	socketAddrs   []string   // addresses of the sockets, for status
 }
 
 // OneShot puts the tailer in one-shot mode.
@@ -62,6 +98,46 @@ func OneShot(t *Tailer) error {
 	return nil
 }
 
+// OneShotParallelism sets the tailer to read up to n log files at once in
+// one-shot mode, instead of one after another.
+func OneShotParallelism(n int) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("invalid one-shot parallelism %d", n)
+		}
+		if n > 1 {
+			t.oneShotReaders = make(chan struct{}, n)
+		}
+		return nil
+	}
+}
+
+// ContainerLogs sets the tailer to read logs written by a container runtime,
+// such as the files in /var/log/containers on a Kubernetes node, and send the
+// log messages they contain instead of the lines as written.
+func ContainerLogs(t *Tailer) error {
+	t.unwrap = unwrapContainerLine
+	return nil
+}
+
+// DockerJSONLogs sets the tailer to read logs written by the Docker json-file
+// log driver, and send the log messages they contain, timestamped with the
+// time Docker recorded, instead of the lines as written.
+func DockerJSONLogs(t *Tailer) error {
+	t.unwrap = unwrapDockerJSONLine
+	return nil
+}
+
+// Clock sets the tailer to stamp the lines it reads whose format doesn't
+// record when they were logged with the time given by now, instead of leaving
+// the programs to use the current time, so that tests can control it.
+func Clock(now func() time.Time) func(*Tailer) error {
+	return func(t *Tailer) error {
+		t.now = now
+		return nil
+	}
+}
+
 // PollInterval sets the time interval between polls of the watched log files.
 func PollInterval(interval time.Duration) func(*Tailer) error {
 	return func(t *Tailer) error {
@@ -72,6 +148,46 @@ func PollInterval(interval time.Duration) func(*Tailer) error {
 	}
 }
 
+// Shard limits the tailer to reading the subset of log files whose pathnames
+// hash to index, out of count, so that several processes can divide a set of
+// logs between them.
+func Shard(index, count int) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if count < 1 || index < 0 || index >= count {
+			return errors.Errorf("invalid shard %d of %d", index, count)
+		}
+		t.shard, t.numShards = index, count
+		return nil
+	}
+}
+
+// Policies for lines longer than the maximum line length.
+const (
+	// LongLinesTruncate sends the first part of the line, up to the maximum length.
+	LongLinesTruncate = "truncate"
+	// LongLinesDrop drops the line.
+	LongLinesDrop = "drop"
+)
+
+// MaxLineLength limits the lines sent to the programs to n bytes.  Longer
+// lines are truncated or dropped, according to policy, which is one of
+// LongLinesTruncate or LongLinesDrop.  The rest of a long line is discarded
+// as it is read, so a pathological line doesn't have to fit in memory.
+func MaxLineLength(n int, policy string) func(*Tailer) error {
+	return func(t *Tailer) error {
+		if n < 0 {
+			return errors.New("max line length must not be negative")
+		}
+		switch policy {
+		case LongLinesTruncate, LongLinesDrop:
+		default:
+			return errors.Errorf("unknown long line policy %q", policy)
+		}
+		t.maxLineLength, t.longLines = n, policy
+		return nil
+	}
+}
+
 // New creates a new Tailer.
 func New(lines chan<- *logline.LogLine, fs afero.Fs, w watcher.Watcher, options ...func(*Tailer) error) (*Tailer, error) {
 	if lines == nil {
@@ -90,6 +206,7 @@ func New(lines chan<- *logline.LogLine, fs afero.Fs, w watcher.Watcher, options
 		handles:      make(map[string]*File),
 		globPatterns: make(map[string]struct{}),
 		runDone:      make(chan struct{}),
+		numShards:    1,
 	}
 	if err := t.SetOption(options...); err != nil {
 		return nil, err
@@ -166,7 +283,7 @@ func (t *Tailer) TailPattern(pattern string) error {
 	glog.V(1).Infof("glob matches: %v", matches)
 	// Error if there are no matches, but if they show up later, they'll get picked up by the directory watch set above.
 	if len(matches) == 0 {
-		return errors.Errorf("No matches for pattern %q", pattern)
+		return noMatchesError(pattern)
 	}
 	for _, pathname := range matches {
 		err := t.TailPath(pathname)
@@ -177,8 +294,41 @@ func (t *Tailer) TailPattern(pattern string) error {
 	return nil
 }
 
+// inShard returns true if pathname belongs to this tailer's shard.
+func (t *Tailer) inShard(pathname string) bool {
+	if t.numShards <= 1 {
+		return true
+	}
+	if abs, err := filepath.Abs(pathname); err == nil {
+		pathname = abs
+	}
+	h := fnv.New32a()
+	h.Write([]byte(pathname))
+	return int(h.Sum32()%uint32(t.numShards)) == t.shard
+}
+
+// noMatchesError is returned by TailPattern when no files match the pattern
+// yet.  The pattern is still tailed.
+type noMatchesError string
+
+func (e noMatchesError) Error() string {
+	return fmt.Sprintf("No matches for pattern %q", string(e))
+}
+
+// IsNoMatches reports whether err is the error TailPattern returns when no
+// files match the pattern yet, which leaves the pattern tailed so that files
+// are picked up once they are created.
+func IsNoMatches(err error) bool {
+	_, ok := errors.Cause(err).(noMatchesError)
+	return ok
+}
+
 // TailPath registers a filesystem pathname to be tailed.
 func (t *Tailer) TailPath(pathname string) error {
+	if !t.inShard(pathname) {
+		glog.V(1).Infof("%q is not in shard %d, not tailing", pathname, t.shard)
+		return nil
+	}
 	if t.hasHandle(pathname) {
 		glog.V(2).Infof("already watching %q", pathname)
 		return nil
@@ -190,6 +340,84 @@ func (t *Tailer) TailPath(pathname string) error {
 	return t.openLogPath(pathname, false)
 }
 
+// HasPattern reports whether the pattern is being tailed.
+func (t *Tailer) HasPattern(pattern string) bool {
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	_, ok := t.globPatterns[pattern]
+	return ok
+}
+
+// Patterns returns a sorted list of the glob patterns currently being tailed.
+func (t *Tailer) Patterns() []string {
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	patterns := make([]string, 0, len(t.globPatterns))
+	for pattern := range t.globPatterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// UntailPattern stops tailing a pattern previously registered with
+// TailPattern.  Any open files whose pathname matches the pattern, and no
+// other pattern still being tailed, are closed and their watches removed.
+// Directory watches are left in place as they may be shared with other
+// patterns.
+func (t *Tailer) UntailPattern(pattern string) error {
+	t.globPatternsMu.Lock()
+	if _, ok := t.globPatterns[pattern]; !ok {
+		t.globPatternsMu.Unlock()
+		return errors.Errorf("pattern %q is not being tailed", pattern)
+	}
+	delete(t.globPatterns, pattern)
+	var others []string
+	for p := range t.globPatterns {
+		if abs, err := filepath.Abs(p); err == nil {
+			others = append(others, abs)
+		}
+	}
+	t.globPatternsMu.Unlock()
+
+	absPattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lookup abspath of %q", pattern)
+	}
+	t.handlesMu.Lock()
+	defer t.handlesMu.Unlock()
+	for pathname, fd := range t.handles {
+		matched, err := filepath.Match(absPattern, pathname)
+		if err != nil {
+			return err
+		}
+		if !matched || matchesAny(others, pathname) {
+			continue
+		}
+		glog.V(1).Infof("Stop tailing %q", pathname)
+		if err := t.w.Remove(pathname); err != nil {
+			glog.Infof("Remove watch on %q failed: %s", pathname, err)
+		}
+		if err := fd.Close(); err != nil {
+			glog.Infof("Close of %q failed: %s", pathname, err)
+		}
+		delete(t.handles, pathname)
+		forgetLastLineTime(fd.Name)
+		logCount.Add(-1)
+	}
+	return nil
+}
+
+// matchesAny reports whether any of the patterns matches pathname.
+func matchesAny(patterns []string, pathname string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, pathname); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // handleLogEvent is dispatched when an Event is received, causing the tailer
 // to read all available bytes from an already-opened file and send each log
 // line onto lines channel.  Because we handle rotations and truncates when
@@ -200,6 +428,7 @@ func (t *Tailer) handleLogEvent(pathname string) {
 	fd, ok := t.handleForPath(pathname)
 	if !ok {
 		glog.V(1).Infof("No file handle found for %q, but is being watched", pathname)
+		tailerEvents.Add("unopened", 1)
 		// We want to open files we have watches on in case the file was
 		// unreadable before now; but we have to copmare against the glob to be
 		// sure we don't just add all the files in a watched directory as they
@@ -207,6 +436,7 @@ func (t *Tailer) handleLogEvent(pathname string) {
 		t.handleCreateGlob(pathname)
 		return
 	}
+	tailerEvents.Add("update", 1)
 	doFollow(fd)
 }
 
@@ -214,7 +444,7 @@ func (t *Tailer) handleLogEvent(pathname string) {
 func doFollow(fd *File) {
 	err := fd.Follow()
 	if err != nil && err != io.EOF {
-		glog.Info(err)
+		errLog.Infof("Failed to read %q: %s", fd.Pathname, err)
 	}
 }
 
@@ -222,6 +452,7 @@ func doFollow(fd *File) {
 func (t *Tailer) pollHandles() {
 	t.handlesMu.RLock()
 	defer t.handlesMu.RUnlock()
+	tailerEvents.Add("poll", 1)
 	for _, fd := range t.handles {
 		doFollow(fd)
 	}
@@ -240,6 +471,10 @@ func (t *Tailer) watchDirname(pathname string) error {
 // openLogPath opens a log file named by pathname.
 func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 	glog.V(2).Infof("openlogPath %s %v", pathname, seekToStart)
+	if !t.inShard(pathname) {
+		glog.V(1).Infof("%q is not in shard %d, not tailing", pathname, t.shard)
+		return nil
+	}
 	if err := t.watchDirname(pathname); err != nil {
 		return err
 	}
@@ -253,6 +488,19 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 		}
 		return err
 	}
+	f.unwrap = t.unwrap
+	f.filter = t.filterFor(pathname)
+	f.separator = t.separatorFor(pathname)
+	f.now = t.now
+	if !seekToStart && !t.oneShot {
+		if n := t.readFromFor(pathname); n != 0 {
+			if err := f.rewind(n); err != nil {
+				return err
+			}
+		}
+	}
+	f.maxLineLength, f.dropLongLines = t.maxLineLength, t.longLines == LongLinesDrop
+	f.relinked = t.rewatch
 	glog.V(2).Infof("Adding a file watch on %q", f.Pathname)
 	if err := t.w.Add(f.Pathname, t.eventsHandle); err != nil {
 		return err
@@ -260,7 +508,19 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 	if err := t.setHandle(pathname, f); err != nil {
 		return err
 	}
-	if err := f.Read(); err != nil && err != io.EOF {
+	if t.oneShot && t.oneShotReaders != nil {
+		// Read the file alongside the others, once fewer than the limit are
+		// being read.
+		t.oneShotReaders <- struct{}{}
+		t.oneShotReads.Add(1)
+		go func() {
+			defer t.oneShotReads.Done()
+			if err := t.readFile(f); err != nil {
+				errLog.Infof("Failed to read %q: %s", f.Pathname, err)
+			}
+			<-t.oneShotReaders
+		}()
+	} else if err := t.readFile(f); err != nil {
 		return err
 	}
 	glog.Infof("Tailing %s", f.Pathname)
@@ -268,6 +528,34 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 	return nil
 }
 
+// readFile reads the lines of a newly opened log file.
+func (t *Tailer) readFile(f *File) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	if err := f.read(); err != nil && err != io.EOF {
+		return err
+	}
+	if t.oneShot {
+		// The file has been read to the end, so the last line is complete.
+		f.flush()
+	}
+	return nil
+}
+
+// rewatch replaces the watch on a symlinked log file, which stays on the file
+// the symlink pointed to when it was added, with one on its new target.
+func (t *Tailer) rewatch(f *File) {
+	if err := t.w.Remove(f.Pathname); err != nil {
+		glog.V(1).Infof("Failed to remove the watch on %q: %s", f.Pathname, err)
+	}
+	if err := t.w.Add(f.Pathname, t.eventsHandle); err != nil {
+		errLog.Infof("Failed to watch the new target of %q: %s", f.Pathname, err)
+	}
+}
+
 // handleCreateGlob matches the pathname against the glob patterns and starts tailing the file.
 func (t *Tailer) handleCreateGlob(pathname string) {
 	t.globPatternsMu.RLock()
@@ -286,7 +574,7 @@ func (t *Tailer) handleCreateGlob(pathname string) {
 		glog.V(1).Infof("New file %q matched existing glob %q", pathname, pattern)
 		// If this file was just created, read from the start of the file.
 		if err := t.openLogPath(pathname, true); err != nil {
-			glog.Infof("Failed to tail new file %q: %s", pathname, err)
+			errLog.Infof("Failed to tail new file %q: %s", pathname, err)
 		}
 		glog.V(2).Infof("started tailing %q", pathname)
 		return
@@ -324,8 +612,11 @@ func (t *Tailer) run(events <-chan watcher.Event) {
 	}
 }
 
-// Close signals termination to the watcher.
+// Close stops receiving lines on sockets, and signals termination to the watcher.
 func (t *Tailer) Close() error {
+	// Finish reading the log files in one-shot mode.
+	t.oneShotReads.Wait()
+	t.sockets.closeAll()
 	if err := t.w.Close(); err != nil {
 		return err
 	}
@@ -341,22 +632,36 @@ const tailerTemplate = `
 <li><pre>{{$name}}</pre></li>
 {{end}}
 </ul>
+{{if $.Sockets}}
+<h3>Sockets</h3>
+<ul>
+{{range $addr := $.Sockets}}
+<li><pre>{{$addr}}</pre> lines: {{index $.Lines $addr}} connections: {{index $.Connections $addr}}</li>
+{{end}}
+</ul>
+{{end}}
 <h3>Log files watched</h3>
 <table border=1>
 <tr>
 <th>pathname</th>
+<th>offset</th>
 <th>errors</th>
 <th>rotations</th>
 <th>truncations</th>
 <th>lines read</th>
+<th>bytes read</th>
+<th>seconds since last line</th>
 </tr>
 {{range $name, $val := $.Handles}}
 <tr>
 <td><pre>{{$name}}</pre></td>
+<td>{{$val.Offset}}</td>
 <td>{{index $.Errors $name}}</td>
 <td>{{index $.Rotations $name}}</td>
 <td>{{index $.Truncs $name}}</td>
 <td>{{index $.Lines $name}}</td>
+<td>{{index $.Bytes $name}}</td>
+<td>{{index $.LastLine $name}}</td>
 </tr>
 {{end}}
 </table>
@@ -380,6 +685,11 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 		Lines     map[string]string
 		Errors    map[string]string
 		Truncs    map[string]string
+		Bytes     map[string]string
+		LastLine  map[string]string
+
+		Sockets     []string
+		Connections map[string]string
 	}{
 		t.handles,
 		t.globPatterns,
@@ -387,7 +697,14 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
+		make(map[string]string),
+		make(map[string]string),
+		nil,
+		make(map[string]string),
 	}
+	t.socketAddrsMu.Lock()
+	data.Sockets = append(data.Sockets, t.socketAddrs...)
+	t.socketAddrsMu.Unlock()
 	for _, pair := range []struct {
 		v *expvar.Map
 		m map[string]string
@@ -396,10 +713,64 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 		{logRotations, data.Rotations},
 		{logTruncs, data.Truncs},
 		{lineCount, data.Lines},
+		{byteCount, data.Bytes},
+		{socketConnections, data.Connections},
 	} {
 		pair.v.Do(func(kv expvar.KeyValue) {
 			pair.m[kv.Key] = kv.Value.String()
 		})
 	}
+	for name, age := range secondsSinceLastLine().(map[string]float64) {
+		data.LastLine[name] = fmt.Sprintf("%.0f", age)
+	}
 	return tpl.Execute(w, data)
 }
+
+// WriteDiagnostics writes the Tailer's state as plain text to the io.Writer
+// w, for a diagnostic dump.
+func (t *Tailer) WriteDiagnostics(w io.Writer) error {
+	t.globPatternsMu.RLock()
+	patterns := make([]string, 0, len(t.globPatterns))
+	for pattern := range t.globPatterns {
+		patterns = append(patterns, pattern)
+	}
+	t.globPatternsMu.RUnlock()
+	sort.Strings(patterns)
+	t.handlesMu.RLock()
+	files := make([]*File, 0, len(t.handles))
+	for _, f := range t.handles {
+		files = append(files, f)
+	}
+	t.handlesMu.RUnlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	t.socketAddrsMu.Lock()
+	sockets := append([]string(nil), t.socketAddrs...)
+	t.socketAddrsMu.Unlock()
+
+	fmt.Fprintf(w, "tailer: %d patterns, %d log files, %d sockets, %d lines pending\n", len(patterns), len(files), len(sockets), linesPending.Value())
+	for _, pattern := range patterns {
+		fmt.Fprintf(w, "pattern %s\n", pattern)
+	}
+	ages := secondsSinceLastLine().(map[string]float64)
+	for _, f := range files {
+		fmt.Fprintf(w, "file %s offset %d lines %s bytes %s errors %s rotations %s truncations %s", f.Name, atomic.LoadInt64(&f.offset),
+			expvarValue(lineCount, f.Name), expvarValue(byteCount, f.Name), expvarValue(logErrors, f.Pathname),
+			expvarValue(logRotations, f.Name), expvarValue(logTruncs, f.Name))
+		if age, ok := ages[f.Name]; ok {
+			fmt.Fprintf(w, " last line %.0fs ago", age)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, address := range sockets {
+		fmt.Fprintf(w, "socket %s connections %s\n", address, expvarValue(socketConnections, address))
+	}
+	return nil
+}
+
+// expvarValue returns the value of key in the map m, or 0 if it is not set.
+func expvarValue(m *expvar.Map, key string) string {
+	if v := m.Get(key); v != nil {
+		return v.String()
+	}
+	return "0"
+}
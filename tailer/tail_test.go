@@ -4,6 +4,7 @@
 package tailer
 
 import (
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -122,10 +123,10 @@ func TestHandleLogUpdate(t *testing.T) {
 	<-done
 
 	expected := []*logline.LogLine{
-		{logfile, "a"},
-		{logfile, "b"},
-		{logfile, "c"},
-		{logfile, "d"},
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "b"},
+		{Filename: logfile, Line: "c"},
+		{Filename: logfile, Line: "d"},
 	}
 	if diff := cmp.Diff(expected, result); diff != "" {
 		t.Errorf("result didn't match:\n%s", diff)
@@ -190,11 +191,11 @@ func TestHandleLogTruncate(t *testing.T) {
 	<-done
 
 	expected := []*logline.LogLine{
-		{logfile, "a"},
-		{logfile, "b"},
-		{logfile, "c"},
-		{logfile, "d"},
-		{logfile, "e"},
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "b"},
+		{Filename: logfile, Line: "c"},
+		{Filename: logfile, Line: "d"},
+		{Filename: logfile, Line: "e"},
 	}
 	if diff := cmp.Diff(expected, result); diff != "" {
 		t.Errorf("result didn't match:\n%s", diff)
@@ -256,7 +257,7 @@ func TestHandleLogUpdatePartialLine(t *testing.T) {
 	<-done
 
 	expected := []*logline.LogLine{
-		{logfile, "ab"},
+		{Filename: logfile, Line: "ab"},
 	}
 	diff := cmp.Diff(expected, result)
 	if diff != "" {
@@ -414,8 +415,8 @@ func TestHandleLogRotate(t *testing.T) {
 	<-done
 
 	expected := []*logline.LogLine{
-		{logfile, "1"},
-		{logfile, "2"},
+		{Filename: logfile, Line: "1"},
+		{Filename: logfile, Line: "2"},
 	}
 	diff := cmp.Diff(expected, result)
 	if diff != "" {
@@ -423,6 +424,80 @@ func TestHandleLogRotate(t *testing.T) {
 	}
 }
 
+func TestHandleLogRelink(t *testing.T) {
+	ta, lines, w, fs, dir, cleanup := makeTestTailReal(t, "relink")
+	defer cleanup()
+
+	current := filepath.Join(dir, "current")
+	first := filepath.Join(dir, "app-1.log")
+	second := filepath.Join(dir, "app-2.log")
+	f1, err := fs.Create(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := fs.Create(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if err := os.Symlink(first, current); err != nil {
+		t.Fatal(err)
+	}
+
+	result := []*logline.LogLine{}
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	go func() {
+		for line := range lines {
+			result = append(result, line)
+			wg.Done()
+		}
+		close(done)
+	}()
+
+	if err := ta.TailPath(current); err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(3)
+	if _, err := f1.WriteString("1\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.InjectUpdate(current)
+
+	// Point the symlink at the second file, the way svlogd does.
+	if err := os.Symlink(second, current+".new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(current+".new", current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f2.WriteString("2\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.InjectCreate(current)
+	if _, err := f2.WriteString("3\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.InjectUpdate(current)
+
+	wg.Wait()
+	w.Close()
+	<-done
+
+	expected := []*logline.LogLine{
+		{Filename: current, Line: "1"},
+		{Filename: current, Line: "2"},
+		{Filename: current, Line: "3"},
+	}
+	if diff := cmp.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match expected:\n%s", diff)
+	}
+	if r := logRotations.Get(current); r == nil || r.String() != "1" {
+		t.Errorf("log_rotations_total for %s: got %v, want 1", current, r)
+	}
+}
+
 func TestHandleLogRotateSignalsWrong(t *testing.T) {
 	ta, lines, w, fs, dir, cleanup := makeTestTailReal(t, "rotate wrong")
 	defer cleanup()
@@ -483,11 +558,297 @@ func TestHandleLogRotateSignalsWrong(t *testing.T) {
 	<-done
 
 	expected := []*logline.LogLine{
-		{logfile, "1"},
-		{logfile, "2"},
+		{Filename: logfile, Line: "1"},
+		{Filename: logfile, Line: "2"},
 	}
 	diff := cmp.Diff(expected, result)
 	if diff != "" {
 		t.Errorf("result didn't match expected:\n%s", diff)
 	}
 }
+
+func TestUntailPattern(t *testing.T) {
+	ta, _, w, fs, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f, err := fs.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := ta.TailPattern(logfile); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{logfile}, ta.Patterns()); diff != "" {
+		t.Errorf("patterns didn't match:\n%s", diff)
+	}
+	if !ta.hasHandle(logfile) {
+		t.Errorf("path not found in files map: %+#v", ta.handles)
+	}
+
+	if err := ta.UntailPattern(logfile); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{}, ta.Patterns()); diff != "" {
+		t.Errorf("patterns didn't match:\n%s", diff)
+	}
+	if ta.hasHandle(logfile) {
+		t.Errorf("path still in files map: %+#v", ta.handles)
+	}
+
+	if err := ta.UntailPattern(logfile); err == nil {
+		t.Error("expected error untailing unknown pattern")
+	}
+}
+
+func TestUntailPatternSharedFile(t *testing.T) {
+	ta, _, w, fs, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f, err := fs.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	glob := filepath.Join(dir, "*")
+	for _, pattern := range []string{logfile, glob} {
+		if err := ta.TailPattern(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ta.UntailPattern(logfile); err != nil {
+		t.Fatal(err)
+	}
+	if !ta.hasHandle(logfile) {
+		t.Error("file still covered by another pattern was closed")
+	}
+	if err := ta.UntailPattern(glob); err != nil {
+		t.Fatal(err)
+	}
+	if ta.hasHandle(logfile) {
+		t.Error("file covered by no pattern is still open")
+	}
+
+	err = ta.TailPattern(filepath.Join(dir, "nonexistent"))
+	if !IsNoMatches(err) {
+		t.Errorf("error %v, want no matches", err)
+	}
+	if !ta.HasPattern(filepath.Join(dir, "nonexistent")) {
+		t.Error("pattern without matches isn't tailed")
+	}
+}
+
+func TestUntailPatternWhileReading(t *testing.T) {
+	ta, lines, w, fs, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f, err := fs.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := ta.TailPattern(logfile); err != nil {
+		t.Fatal(err)
+	}
+	fd, ok := ta.handleForPath(logfile)
+	if !ok {
+		t.Fatal("no handle for the log file")
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-lines:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := f.WriteString("line\n"); err != nil {
+				t.Error(err)
+				return
+			}
+			ta.handleLogEvent(logfile)
+		}
+	}()
+	if err := ta.UntailPattern(logfile); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// Reads of the closed file read nothing, rather than failing.
+	if _, err := f.WriteString("line\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Follow(); err != nil {
+		t.Errorf("Follow after untail: %s", err)
+	}
+}
+
+func TestTailPathShard(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := fs.Mkdir("/tail_test", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i := 0; i < 10; i++ {
+		p := filepath.Join("/tail_test", fmt.Sprintf("log%d", i))
+		f, err := fs.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		paths = append(paths, p)
+	}
+	tailed := make(map[string]int)
+	for shard := 0; shard < 3; shard++ {
+		w := watcher.NewFakeWatcher()
+		lines := make(chan *logline.LogLine, 1)
+		ta, err := New(lines, fs, w, Shard(shard, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range paths {
+			if err := ta.TailPath(p); err != nil {
+				t.Fatal(err)
+			}
+			if ta.hasHandle(p) {
+				tailed[p]++
+			}
+		}
+		w.Close()
+	}
+	for _, p := range paths {
+		if tailed[p] != 1 {
+			t.Errorf("%q tailed by %d shards, want 1", p, tailed[p])
+		}
+	}
+}
+
+func TestShardOption(t *testing.T) {
+	for _, s := range [][2]int{{0, 0}, {-1, 2}, {2, 2}} {
+		if err := Shard(s[0], s[1])(&Tailer{}); err == nil {
+			t.Errorf("expected error for shard %d of %d", s[0], s[1])
+		}
+	}
+}
+
+func TestOneShotSendsLastPartialLine(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 10)
+	ta, err := New(lines, fs, w, OneShot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logfile := "/log"
+	if err := afero.WriteFile(fs, logfile, []byte("a\nb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.TailPath(logfile); err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for l := range lines {
+		got = append(got, l.Line)
+	}
+	if diff := cmp.Diff([]string{"a", "b"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+}
+
+func TestOneShotParallelism(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 100)
+	ta, err := New(lines, fs, w, OneShot, OneShotParallelism(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string][]string)
+	for _, name := range []string{"/a", "/b", "/c", "/d", "/e"} {
+		var contents string
+		for i := 0; i < 10; i++ {
+			line := fmt.Sprintf("%s %d", name, i)
+			contents += line + "\n"
+			want[name] = append(want[name], line)
+		}
+		if err := afero.WriteFile(fs, name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ta.TailPath(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ta.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for l := range lines {
+		got[l.Filename] = append(got[l.Filename], l.Line)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+}
+
+func TestOneShotParallelismInvalid(t *testing.T) {
+	if _, err := New(make(chan *logline.LogLine), afero.NewMemMapFs(), watcher.NewFakeWatcher(), OneShotParallelism(0)); err == nil {
+		t.Error("expected error for zero parallelism")
+	}
+}
+
+func TestTailerEngineVars(t *testing.T) {
+	// The lines channel has room for one line, and the second is left pending.
+	ta, lines, w, fs, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	logfile := filepath.Join(dir, "log")
+	f, err := fs.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.TailPath(logfile); err != nil {
+		t.Fatal(err)
+	}
+	count := func() int64 {
+		if v, ok := tailerEvents.Get("update").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	updates, pending := count(), linesPending.Value()
+	if _, err := f.WriteString("a\nb\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.InjectUpdate(logfile)
+	for i := 0; linesPending.Value() != pending+1; i++ {
+		if i > 100 {
+			t.Fatalf("lines pending %d, want %d", linesPending.Value(), pending+1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := count(); got != updates+1 {
+		t.Errorf("update events %d, want %d", got, updates+1)
+	}
+	<-lines
+	<-lines
+}
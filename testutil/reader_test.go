@@ -123,7 +123,7 @@ func TestReadTestData(t *testing.T) {
 	defer f.Close()
 	store := metrics.NewStore()
 	ReadTestData(f, "reader_test", store)
-	diff := cmp.Diff(expectedMetrics, store.Metrics, cmpopts.IgnoreUnexported(sync.RWMutex{}, datum.StringDatum{}))
+	diff := cmp.Diff(expectedMetrics, store.Metrics, cmpopts.IgnoreUnexported(sync.RWMutex{}, datum.BaseDatum{}, datum.StringDatum{}, metrics.Metric{}))
 	if diff != "" {
 		t.Error(diff)
 		t.Logf("store contains %s", store.Metrics)
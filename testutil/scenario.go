@@ -0,0 +1,428 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package testutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/mtail"
+	"github.com/google/mtail/watcher"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// ScenarioLogDir is the directory of the in-memory filesystem that a Scenario
+// tails the *.log files of.
+const ScenarioLogDir = "/var/log"
+
+// ScenarioStart is the time the clock of a new Scenario reads.
+var ScenarioStart = time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// settleTimeout is how long a Scenario waits for the lines written to be
+// processed before failing the test.
+var settleTimeout = 5 * time.Second
+
+// Scenario runs an mtail program end to end against log files in an
+// in-memory filesystem, with a fake clock and a recording push backend, so
+// that rotation, expiry and push behaviours can be tested without sleeping
+// or touching the real filesystem.  Steps are taken either by calling its
+// methods, or by running a script with Run.
+type Scenario struct {
+	t testing.TB
+
+	Clock   *FakeClock
+	Store   *metrics.Store
+	FS      afero.Fs
+	Watcher *watcher.FakeWatcher
+	Server  *mtail.MtailServer
+
+	pushed *recordingBackend
+
+	written int64 // lines written to the log files so far
+}
+
+// NewScenario starts mtail with the program, tailing the *.log files in
+// ScenarioLogDir.  Further options are passed to mtail.New.  The Scenario
+// must be closed with Close.
+func NewScenario(t testing.TB, program string, options ...func(*mtail.MtailServer) error) *Scenario {
+	s := &Scenario{
+		t:       t,
+		Clock:   NewFakeClock(ScenarioStart),
+		Store:   metrics.NewStore(),
+		FS:      afero.NewMemMapFs(),
+		Watcher: watcher.NewFakeWatcher(),
+		pushed:  &recordingBackend{},
+	}
+	if err := s.FS.MkdirAll(ScenarioLogDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := []func(*mtail.MtailServer) error{
+		mtail.Clock(s.Clock.Now),
+		mtail.PushBackend("scenario", s.pushed),
+		mtail.LogPathPatterns(filepath.Join(ScenarioLogDir, "*.log")),
+	}
+	m, err := mtail.New(s.Store, s.Watcher, s.FS, append(opts, options...)...)
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	s.Server = m
+	if err := m.LoadProgram("scenario", strings.NewReader(program)); err != nil {
+		t.Fatalf("couldn't load program: %s", err)
+	}
+	if err := m.StartTailing(); err != nil {
+		t.Fatalf("couldn't start tailing: %s", err)
+	}
+	return s
+}
+
+// Close shuts down mtail.
+func (s *Scenario) Close() {
+	if err := s.Server.Close(); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// Write appends the lines to the log file, creating it if it doesn't exist,
+// and waits for them to be processed.  A relative filename is taken to be in
+// ScenarioLogDir.
+func (s *Scenario) Write(filename string, lines ...string) {
+	if err := s.write(filename, lines...); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// Rotate renames the log file to filename.1, as logrotate does, and creates
+// a new empty one in its place.
+func (s *Scenario) Rotate(filename string) {
+	if err := s.rotate(filename); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// Advance moves the clock forward by d, then expires the datums that have
+// gone without an update for longer than their expiry, and refreshes those
+// that need it, as mtail does periodically.
+func (s *Scenario) Advance(d time.Duration) {
+	s.Clock.Advance(d)
+	s.Store.Gc()
+	s.Store.Refresh()
+}
+
+// Push pushes the metrics to the push backends.
+func (s *Scenario) Push() {
+	s.Server.PushMetrics()
+}
+
+// Expect checks that the series has the value.  A series is a metric name
+// followed by its labels in braces, like requests_total{code=200,method=GET}.
+func (s *Scenario) Expect(series, value string) {
+	if err := s.expect(series, value); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// ExpectAbsent checks that the series has no value.
+func (s *Scenario) ExpectAbsent(series string) {
+	if err := s.expectAbsent(series); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// ExpectPushed checks that the series had the value in the last push.
+func (s *Scenario) ExpectPushed(series, value string) {
+	if err := s.expectPushed(series, value); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// Run runs the scenario script read from r, failing the test at the first
+// step that fails.  Each line of a script is one of:
+//
+//	write FILE TEXT          append the line TEXT to FILE
+//	rotate FILE              rotate FILE
+//	advance DURATION         move the clock forward, e.g. advance 1h30m
+//	push                     push the metrics
+//	expect SERIES VALUE      SERIES has VALUE
+//	expect_absent SERIES     SERIES has no value
+//	expect_pushed SERIES VALUE
+//	                         SERIES had VALUE in the last push
+//
+// Blank lines and lines starting with # are ignored.  The name is used in
+// error messages.
+func (s *Scenario) Run(name string, r io.Reader) {
+	if err := s.run(name, r); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *Scenario) run(name string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := s.step(line); err != nil {
+			return errors.Errorf("%s:%d: %s", name, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// step takes the step described by one line of a script.
+func (s *Scenario) step(line string) error {
+	fields := strings.Fields(line)
+	args := fields[1:]
+	switch fields[0] {
+	case "write":
+		if len(args) < 1 {
+			return errors.New("write: want a file and the text of a line")
+		}
+		// The text is the rest of the line after the file name, spaces and all.
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[len("write"):]), args[0]))
+		return s.write(args[0], text)
+	case "rotate":
+		if len(args) != 1 {
+			return errors.New("rotate: want a file")
+		}
+		return s.rotate(args[0])
+	case "advance":
+		if len(args) != 1 {
+			return errors.New("advance: want a duration")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return errors.Wrap(err, "advance")
+		}
+		s.Advance(d)
+		return nil
+	case "push":
+		if len(args) != 0 {
+			return errors.New("push: takes no arguments")
+		}
+		s.Push()
+		return nil
+	case "expect":
+		if len(args) != 2 {
+			return errors.New("expect: want a series and a value")
+		}
+		return s.expect(args[0], args[1])
+	case "expect_absent":
+		if len(args) != 1 {
+			return errors.New("expect_absent: want a series")
+		}
+		return s.expectAbsent(args[0])
+	case "expect_pushed":
+		if len(args) != 2 {
+			return errors.New("expect_pushed: want a series and a value")
+		}
+		return s.expectPushed(args[0], args[1])
+	}
+	return errors.Errorf("unknown step %q", fields[0])
+}
+
+// logPath returns the path of a log file named in a step.
+func logPath(filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(ScenarioLogDir, filename)
+}
+
+func (s *Scenario) write(filename string, lines ...string) error {
+	pathname := logPath(filename)
+	if _, err := s.FS.Stat(pathname); os.IsNotExist(err) {
+		if err := s.create(pathname); err != nil {
+			return err
+		}
+	}
+	f, err := s.FS.OpenFile(pathname, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if _, err := io.WriteString(f, l+"\n"); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.Watcher.InjectUpdate(pathname)
+	s.written += int64(len(lines))
+	return s.settle()
+}
+
+// create creates an empty log file and tells the tailer about it.
+func (s *Scenario) create(pathname string) error {
+	f, err := s.FS.Create(pathname)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.Watcher.InjectCreate(pathname)
+	return nil
+}
+
+func (s *Scenario) rotate(filename string) error {
+	pathname := logPath(filename)
+	if err := s.FS.Rename(pathname, pathname+".1"); err != nil {
+		return err
+	}
+	s.Watcher.InjectDelete(pathname)
+	s.Watcher.InjectCreate(pathname + ".1")
+	return s.create(pathname)
+}
+
+// settle waits until the programs of this scenario's server have processed
+// every line written, so that the metrics reflect them, and returns an error
+// if they haven't after settleTimeout.
+func (s *Scenario) settle() error {
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		n, done := s.Server.LinesProcessed()
+		if n > s.written {
+			return errors.Errorf("%d lines processed, but only %d written", n, s.written)
+		}
+		if n == s.written && done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("%d lines processed after %s, want %d", n, settleTimeout, s.written)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expect checks the series has the value, once expired datums are removed.
+func (s *Scenario) expect(series, value string) error {
+	s.Store.Gc()
+	got, ok := s.value(series)
+	if !ok {
+		return errors.Errorf("%s: no value, want %s", series, value)
+	}
+	if got != value {
+		return errors.Errorf("%s: value %s, want %s", series, got, value)
+	}
+	return nil
+}
+
+func (s *Scenario) expectAbsent(series string) error {
+	s.Store.Gc()
+	if got, ok := s.value(series); ok {
+		return errors.Errorf("%s: value %s, want none", series, got)
+	}
+	return nil
+}
+
+func (s *Scenario) expectPushed(series, value string) error {
+	want := normalizeSeries(series) + " " + value
+	pushed := s.pushed.lastPush()
+	for _, p := range pushed {
+		if p == want {
+			return nil
+		}
+	}
+	return errors.Errorf("%q not pushed; last push was %q", want, pushed)
+}
+
+// value returns the value of the series in the store.
+func (s *Scenario) value(series string) (string, bool) {
+	series = normalizeSeries(series)
+	name := series
+	if i := strings.Index(series, "{"); i >= 0 {
+		name = series[:i]
+	}
+	s.Store.RLock()
+	defer s.Store.RUnlock()
+	for _, m := range s.Store.Metrics[name] {
+		m.RLock()
+		lc := make(chan *metrics.LabelSet)
+		go m.EmitLabelSets(lc)
+		var v string
+		found := false
+		for l := range lc {
+			if seriesName(name, l.Labels) == series {
+				v, found = l.Datum.ValueString(), true
+			}
+		}
+		m.RUnlock()
+		if found {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// seriesName returns the name of a series, like name{a=1,b=2}, with its
+// labels in sorted order.
+func seriesName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var kvs []string
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return fmt.Sprintf("%s{%s}", name, strings.Join(kvs, ","))
+}
+
+// normalizeSeries sorts the labels of a series named in a step, so that they
+// can be given in any order.
+func normalizeSeries(series string) string {
+	i := strings.Index(series, "{")
+	if i < 0 || !strings.HasSuffix(series, "}") {
+		return series
+	}
+	kvs := strings.Split(series[i+1:len(series)-1], ",")
+	sort.Strings(kvs)
+	return fmt.Sprintf("%s{%s}", series[:i], strings.Join(kvs, ","))
+}
+
+// recordingBackend is a push backend that remembers what was in the last
+// push, as "series value" strings.
+type recordingBackend struct {
+	mu      sync.Mutex
+	pending []string
+	last    []string
+}
+
+func (b *recordingBackend) Init() error { return nil }
+
+func (b *recordingBackend) Export(hostname string, m *metrics.Metric, l *metrics.LabelSet) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, seriesName(m.Name, l.Labels)+" "+l.Datum.ValueString())
+	return nil
+}
+
+func (b *recordingBackend) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sort.Strings(b.pending)
+	b.last, b.pending = b.pending, nil
+	return nil
+}
+
+func (b *recordingBackend) Close() error { return nil }
+
+func (b *recordingBackend) lastPush() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package testutil
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/mtail"
+)
+
+const scenarioProgram = `
+counter requests_total by code
+gauge session_open by session
+
+/^(?P<code>\d+) (?P<session>\w+)$/ {
+  requests_total[$code]++
+  session_open[$session] = 1
+  del session_open[$session] after 1h
+}
+`
+
+func TestScenario(t *testing.T) {
+	s := NewScenario(t, scenarioProgram)
+	defer s.Close()
+
+	s.Write("app.log", "200 a", "500 b")
+	s.Expect("requests_total{code=200}", "1")
+	s.Expect("requests_total{code=500}", "1")
+
+	// Lines written after a rotation are read from the new file, and none
+	// are counted twice.
+	s.Rotate("app.log")
+	s.Write("app.log", "200 c")
+	s.Expect("requests_total{code=200}", "2")
+	s.Expect("requests_total{code=500}", "1")
+
+	// Sessions not seen for an hour expire.
+	s.Advance(30 * time.Minute)
+	s.Write("app.log", "200 a")
+	s.Advance(45 * time.Minute)
+	s.Expect("session_open{session=a}", "1")
+	s.ExpectAbsent("session_open{session=b}")
+	s.ExpectAbsent("session_open{session=c}")
+
+	s.Push()
+	s.ExpectPushed("requests_total{code=200}", "3")
+	s.ExpectPushed("session_open{session=a}", "1")
+}
+
+func TestScenarioScript(t *testing.T) {
+	s := NewScenario(t, scenarioProgram)
+	defer s.Close()
+
+	s.Run("script", strings.NewReader(`
+# A session is open until an hour passes without a request from it.
+write app.log 200 a
+expect session_open{session=a} 1
+rotate app.log
+write app.log 404 a
+expect requests_total{code=404} 1
+advance 59m
+expect session_open{session=a} 1
+advance 2m
+expect_absent session_open{session=a}
+push
+expect_pushed requests_total{code=200} 1
+`))
+}
+
+func TestNormalizeSeries(t *testing.T) {
+	for series, want := range map[string]string{
+		"requests_total":                      "requests_total",
+		"requests_total{code=200}":            "requests_total{code=200}",
+		"requests_total{method=GET,code=200}": "requests_total{code=200,method=GET}",
+	} {
+		if got := normalizeSeries(series); got != want {
+			t.Errorf("%s: got %s, want %s", series, got, want)
+		}
+	}
+}
+
+func TestScenarioScriptErrors(t *testing.T) {
+	s := NewScenario(t, scenarioProgram)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		script string
+		want   string
+	}{
+		{"frobnicate", `script:1: unknown step "frobnicate"`},
+		{"# comment\n\nadvance soon", "script:3: advance: "},
+		{"push\nexpect_pushed requests_total{code=200} 1", `script:2: "requests_total{code=200} 1" not pushed`},
+		{"rotate", "script:1: rotate: want a file"},
+		{"rotate missing.log", "script:1: rename"},
+	} {
+		err := s.run("script", strings.NewReader(tc.script))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("%q: error %v, want one starting %q", tc.script, err, tc.want)
+		}
+	}
+}
+
+func TestScenarioSettleTimeout(t *testing.T) {
+	defer func(d time.Duration) { settleTimeout = d }(settleTimeout)
+	settleTimeout = 100 * time.Millisecond
+
+	// The filter drops the line, so the programs never process it.
+	s := NewScenario(t, scenarioProgram, mtail.LogFilter(filepath.Join(ScenarioLogDir, "*.log"), "^200 "))
+	defer s.Close()
+
+	if err := s.write("app.log", "500 a"); err == nil || !strings.HasPrefix(err.Error(), "0 lines processed") {
+		t.Errorf("write: error %v, want lines not processed", err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// progMatchRate is the rate of pattern matches per second of each program over the last interval.
+	progMatchRate = expvar.NewMap("prog_match_rate")
+	// progMatchRateScore is the match rate of each program over the last interval, as a multiple of its baseline.
+	progMatchRateScore = expvar.NewMap("prog_match_rate_anomaly_score")
+	// progMatchRateAnomalies counts the intervals in which the match rate of each program was anomalous.
+	progMatchRateAnomalies = expvar.NewMap("prog_match_rate_anomalies_total")
+)
+
+const (
+	// anomalyBaselineIntervals is the number of intervals over which the
+	// baseline match rate of a program is averaged.
+	anomalyBaselineIntervals = 30
+	// anomalyWarmupIntervals is the number of intervals a program must have
+	// run for before its match rate is compared with its baseline.
+	anomalyWarmupIntervals = 5
+)
+
+// matchRate tracks the rate at which the patterns of a program match, and
+// how it compares with the recent past.
+type matchRate struct {
+	vm        *VM     // The program whose matches are counted; a reloaded program starts again.
+	last      int64   // Matches counted at the end of the last interval.
+	intervals int     // Intervals measured since the program was loaded.
+	rate      float64 // Matches per second in the last interval.
+	baseline  float64 // Moving average of the rate, excluding the last interval.
+	score     float64 // The last interval's matches, over the matches expected from the baseline.
+	anomalous bool    // Whether the score is beyond the threshold.
+}
+
+// AnomalyDetection sets the loader to measure the match rate of each
+// program every interval, and compare it with a moving average of its recent
+// rates.  A program whose rate is more than threshold times, or less than
+// one threshold-th of, its baseline is flagged as anomalous on the status
+// page.
+func AnomalyDetection(interval time.Duration, threshold float64) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if interval <= 0 {
+			return errors.New("anomaly detection interval must be positive")
+		}
+		if threshold <= 1 {
+			return errors.New("anomaly threshold must be greater than 1")
+		}
+		l.anomalyInterval, l.anomalyThreshold = interval, threshold
+		l.matchRates = make(map[string]*matchRate)
+		return nil
+	}
+}
+
+// watchMatchRates updates the match rates of the programs every interval,
+// until the loader shuts down.
+func (l *MasterControl) watchMatchRates() {
+	ticker := time.NewTicker(l.anomalyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.VMsDone:
+			return
+		case <-ticker.C:
+			l.updateMatchRates(l.anomalyInterval)
+		}
+	}
+}
+
+// updateMatchRates measures the match rate of each program over the elapsed
+// interval, scores it against its baseline, then folds it into the baseline.
+func (l *MasterControl) updateMatchRates(elapsed time.Duration) {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	l.matchRateMu.Lock()
+	defer l.matchRateMu.Unlock()
+	for name := range l.matchRates {
+		if h, ok := l.handles[name]; !ok || h.vm == nil {
+			delete(l.matchRates, name)
+		}
+	}
+	for name, h := range l.handles {
+		if h.vm == nil {
+			continue
+		}
+		r, ok := l.matchRates[name]
+		if !ok || r.vm != h.vm {
+			r = &matchRate{vm: h.vm}
+			l.matchRates[name] = r
+		}
+		n := h.vm.matchCount()
+		matches := float64(n - r.last)
+		r.last = n
+		r.intervals++
+		r.rate = matches / elapsed.Seconds()
+		// One match is added to each side, so that a program that starts
+		// matching after matching nothing has a finite score.
+		expected := r.baseline * elapsed.Seconds()
+		r.score = (matches + 1) / (expected + 1)
+		wasAnomalous := r.anomalous
+		r.anomalous = r.intervals > anomalyWarmupIntervals && (r.score >= l.anomalyThreshold || r.score <= 1/l.anomalyThreshold)
+		if r.intervals == 1 {
+			r.baseline = r.rate
+		} else {
+			const alpha = 2.0 / (anomalyBaselineIntervals + 1)
+			r.baseline += alpha * (r.rate - r.baseline)
+		}
+
+		rate := new(expvar.Float)
+		rate.Set(r.rate)
+		progMatchRate.Set(name, rate)
+		score := new(expvar.Float)
+		score.Set(r.score)
+		progMatchRateScore.Set(name, score)
+		if r.anomalous {
+			progMatchRateAnomalies.Add(name, 1)
+			if !wasAnomalous {
+				glog.Warningf("Match rate of %s is %.3g/s, %.3gx its baseline of %.3g/s", name, r.rate, r.score, r.baseline)
+			}
+		}
+	}
+}
+
+// matchRateStatus describes the match rate of the named program for the
+// status page, and whether it is anomalous.
+func (l *MasterControl) matchRateStatus(name string) (string, bool) {
+	l.matchRateMu.Lock()
+	defer l.matchRateMu.Unlock()
+	r, ok := l.matchRates[name]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%.3g/s (%.3gx baseline)", r.rate, r.score), r.anomalous
+}
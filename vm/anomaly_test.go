@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestMatchRateAnomaly(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/errors.mtail", []byte("counter errors\n/ERROR/ {\n  errors++\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The interval is long enough that the rates are only measured by the test.
+	l, err := NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), fs, AnomalyDetection(time.Hour, 10))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	defer func() {
+		close(lines)
+		<-l.VMsDone
+	}()
+	if err := l.LoadProgram("/errors.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	// send sends n matching lines, then a line that doesn't match, which is
+	// received once the program has finished with the last matching line.
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			lines <- logline.NewLogLine("log", "ERROR")
+		}
+		lines <- logline.NewLogLine("log", "INFO")
+		lines <- logline.NewLogLine("log", "INFO")
+	}
+	for i, tc := range []struct {
+		matches       int
+		wantAnomalous bool
+	}{
+		// A spike while the baseline is being learned isn't flagged.
+		{9, false}, {200, false}, {9, false}, {9, false}, {9, false},
+		{9, false}, {9, false},
+		{300, true},
+		{9, false},
+		{0, true},
+	} {
+		send(tc.matches)
+		l.updateMatchRates(time.Minute)
+		status, anomalous := l.matchRateStatus("errors.mtail")
+		t.Logf("interval %d: %s", i, status)
+		if anomalous != tc.wantAnomalous {
+			t.Errorf("interval %d with %d matches: anomalous %v, want %v (%s)", i, tc.matches, anomalous, tc.wantAnomalous, status)
+		}
+	}
+	var b bytes.Buffer
+	if err := l.WriteStatusHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `<b style="color: red">0/s`) {
+		t.Errorf("status page doesn't flag the anomaly:\n%s", b.String())
+	}
+	if n := progMatchRateAnomalies.Get("errors.mtail").String(); n != "2" {
+		t.Errorf("anomalies counted %s, want 2", n)
+	}
+}
+
+func TestAnomalyDetectionInvalid(t *testing.T) {
+	for _, o := range []func(*MasterControl) error{
+		AnomalyDetection(0, 10),
+		AnomalyDetection(time.Minute, 1),
+	} {
+		if _, err := NewLoader("", metrics.NewStore(), make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), o); err == nil {
+			t.Error("bad anomaly detection option accepted")
+		}
+	}
+}
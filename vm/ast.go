@@ -5,6 +5,7 @@ package vm
 
 import (
 	"sync"
+	"time"
 
 	"github.com/google/mtail/metrics"
 )
@@ -206,6 +207,12 @@ type declNode struct {
 	keys         []string
 	kind         metrics.Kind
 	exportedName string
+	inits        [][]string    // label values to initialize to zero at load
+	window       time.Duration // if nonzero, values are kept per time window of this length
+	keep         time.Duration // how long before the latest window older windows are kept, or zero for the default
+	refresh      time.Duration // if nonzero, how often values not updated are stamped with the current time
+	description  string        // what the variable measures, for people reading the exported metrics
+	unit         string        // the unit of the values, such as "seconds" or "requests"
 	sym          *Symbol
 }
 
@@ -256,6 +263,18 @@ func (n *floatConstNode) Type() Type {
 	return Float
 }
 
+type durationConstNode struct {
+	pos position
+	d   time.Duration
+}
+
+func (n *durationConstNode) Pos() *position {
+	return &n.pos
+}
+func (n *durationConstNode) Type() Type {
+	return Duration
+}
+
 // patternExprNode is the top of a pattern expression
 type patternExprNode struct {
 	expr    astNode
@@ -348,6 +367,18 @@ func (n *nextNode) Type() Type {
 	return None
 }
 
+type stopNode struct {
+	pos position
+}
+
+func (n *stopNode) Pos() *position {
+	return &n.pos
+}
+
+func (n *stopNode) Type() Type {
+	return None
+}
+
 type otherwiseNode struct {
 	pos position
 }
@@ -361,8 +392,9 @@ func (n *otherwiseNode) Type() Type {
 }
 
 type delNode struct {
-	pos position
-	n   astNode
+	pos    position
+	n      astNode
+	expiry time.Duration // if not zero, delete the datum only once it has not been updated for this long
 }
 
 func (d *delNode) Pos() *position {
@@ -0,0 +1,113 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/audit"
+	"github.com/google/mtail/metrics"
+)
+
+// AuditLog sets the Loader to record the programs it loads and unloads, and
+// the definitions of their metrics, in the audit log a.
+func AuditLog(a *audit.Log) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		l.audit = a
+		return nil
+	}
+}
+
+// metricDefinition describes the definition of m, like the declaration of it
+// in a program, followed by the metric prefix of its program directory, if
+// any, which is already part of its name.
+func metricDefinition(m *metrics.Metric, prefix string) string {
+	def := fmt.Sprintf("%s %s", strings.ToLower(m.Kind.String()), m.Name)
+	if m.Description != "" {
+		def += " " + strconv.Quote(m.Description)
+	}
+	if m.Unit != "" {
+		def += " unit " + strconv.Quote(m.Unit)
+	}
+	keys := m.Keys
+	if m.Window > 0 {
+		// The window key is added by the window, not declared.
+		keys = keys[:len(keys)-1]
+	}
+	if len(keys) > 0 {
+		def += " by " + strings.Join(keys, ", ")
+	}
+	if m.Window > 0 {
+		def += " window " + m.Window.String()
+		if m.WindowKeep > 0 {
+			def += " keep " + m.WindowKeep.String()
+		}
+	}
+	if m.Refresh > 0 {
+		def += " refresh " + m.Refresh.String()
+	}
+	def += " of type " + m.Type.String()
+	if prefix != "" {
+		def += " with prefix " + strconv.Quote(prefix)
+	}
+	return def
+}
+
+// auditLoad records in the audit log that the program name was loaded from
+// source with the given hash, and the definitions of the metrics it exports
+// with the metric prefix of its program directory.
+// Failures to write the log are logged and otherwise ignored, so that they
+// don't stop programs from loading.
+func (l *MasterControl) auditLoad(name, hash, prefix string, ms []*metrics.Metric) {
+	if l.audit == nil {
+		return
+	}
+	if err := l.audit.Record(audit.Event{Kind: audit.ProgramLoad, Program: name, SHA256: hash}); err != nil {
+		glog.Info(err)
+		return
+	}
+	for _, m := range ms {
+		if m.Hidden {
+			continue
+		}
+		if err := l.audit.DefineMetric(name, m.Name, metricDefinition(m, prefix)); err != nil {
+			glog.Info(err)
+			return
+		}
+	}
+}
+
+// auditUnload records in the audit log that the program name was unloaded.
+func (l *MasterControl) auditUnload(name string) {
+	if l.audit == nil {
+		return
+	}
+	if err := l.audit.Record(audit.Event{Kind: audit.ProgramUnload, Program: name}); err != nil {
+		glog.Info(err)
+	}
+}
+
+// fileHash returns the SHA-256 hash of the file at path as a hex string, or
+// the empty string if it can't be read.
+func fileHash(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		glog.Info(err)
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		glog.Info(err)
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
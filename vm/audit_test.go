@@ -0,0 +1,102 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/mtail/audit"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := audit.Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	fs := afero.NewMemMapFs()
+	v1 := "counter requests\n/GET/ {\n  requests++\n}\n"
+	v2 := "counter requests by code\nhidden counter seen\n/GET (\\d+)/ {\n  requests[$1]++\n  seen++\n}\n"
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), fs, AuditLog(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{v1, v1, v2} {
+		if err := afero.WriteFile(fs, "/progs/web.mtail", []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.LoadProgram("/progs/web.mtail"); err != nil {
+			t.Fatal(err)
+		}
+		if errs := l.ProgramErrors(); len(errs) > 0 {
+			t.Fatalf("program failed to load: %v", errs)
+		}
+	}
+	l.UnloadProgram("/progs/web.mtail")
+	close(lines)
+	<-l.VMsDone
+
+	hash := func(text string) string {
+		h := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(h[:])
+	}
+	events, err := a.Events(audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []audit.Event{
+		{Kind: audit.ProgramLoad, Program: "web.mtail", SHA256: hash(v1)},
+		{Kind: audit.MetricCreate, Program: "web.mtail", Metric: "requests", Detail: "counter requests of type Int"},
+		{Kind: audit.ProgramLoad, Program: "web.mtail", SHA256: hash(v1)},
+		{Kind: audit.ProgramLoad, Program: "web.mtail", SHA256: hash(v2)},
+		{Kind: audit.MetricChange, Program: "web.mtail", Metric: "requests", Detail: "counter requests by code of type Int"},
+		{Kind: audit.ProgramUnload, Program: "web.mtail"},
+	}
+	if diff := go_cmp.Diff(expected, events, cmpopts.IgnoreFields(audit.Event{}, "Time")); diff != "" {
+		t.Errorf("audit events differ:\n%s", diff)
+	}
+}
+
+func TestMetricDefinition(t *testing.T) {
+	v, err := Compile("defs.mtail", strings.NewReader(`counter requests "Requests served" unit "requests" by code window 1m keep 1h
+gauge queue_length refresh 30s
+timer latency
+/(\d+) (\d+) (\d+)/ {
+  requests[$1]++
+  queue_length = $2
+  latency = $3
+}
+`), false, false, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{
+		`counter requests "Requests served" unit "requests" by code window 1m0s keep 1h0m0s of type Int with prefix "web_"`,
+		`gauge queue_length refresh 30s of type Int with prefix "web_"`,
+		`timer latency of type Int with prefix "web_"`,
+	} {
+		if got := metricDefinition(v.m[i], "web_"); got != want {
+			t.Errorf("metricDefinition(%s) = %q, want %q", v.m[i].Name, got, want)
+		}
+	}
+}
@@ -50,7 +50,12 @@ const (
 	cat                      // string concatenation
 	setmatched               // Set "matched" flag
 	otherwise                // Only match if "matched" flag is false.
+	stop                     // Stop execution of the program on this line of input.
 	del                      //  Pop `operand` keys and metric off stack, and remove the datum at metric[key,...] from memory
+	expire                   // Pop `operand` keys and metric off stack, and an expiry duration, and set the datum at metric[key,...] to be removed once it is that old.
+	emit                     // Pop a string off the stack and write it to the event sink.
+	rate                     // Pop a window and a datum off the stack, and push the rate of change per second of the datum's value over the window.  Operand is true if the datum is a counter's, so decreases are resets.
+	ewma                     // Pop a window and a datum off the stack, and push the average of the datum's values, exponentially weighted by age with the window as time constant.
 
 	// Floating point ops
 	fadd
@@ -61,7 +66,15 @@ const (
 	fpow
 	fset // Floating point assignment
 
-	getfilename // Push input.Filename onto the stack.
+	getfilename  // Push input.Filename onto the stack.
+	getpod       // Push the pod name from a container log filename onto the stack.
+	getnamespace // Push the namespace from a container log filename onto the stack.
+	getcontainer // Push the container name from a container log filename onto the stack.
+	getenv       // Pop a string off the stack, and push the value of the environment variable it names.
+	hostname     // Push the hostname of the machine onto the stack.
+	parseip      // Pop a string off the stack, and push the canonical form of the IP address in it, or the empty string.
+	cidrmatch    // Pop a network in CIDR notation and a string off the stack, and push whether the string is an IP address in the network.
+	enrich       // Pop a string off the stack, and push the value the enrichment builtin named by the operand looks up for it.
 
 	// Conversions
 	i2f // int to float
@@ -69,6 +82,9 @@ const (
 	s2f // string to float
 	i2s // int to string
 	f2s // float to string
+	f2i // float to int, truncating
+	s2d // string duration to float seconds
+	s2b // string byte size to int bytes
 
 	// Typed comparisons, behave the same as cmp but do no conversion.
 	icmp // integer compare
@@ -77,71 +93,99 @@ const (
 )
 
 var opNames = map[opcode]string{
-	match:       "match",
-	smatch:      "smatch",
-	cmp:         "cmp",
-	jnm:         "jnm",
-	jm:          "jm",
-	jmp:         "jmp",
-	inc:         "inc",
-	strptime:    "strptime",
-	timestamp:   "timestamp",
-	settime:     "settime",
-	push:        "push",
-	capref:      "capref",
-	str:         "str",
-	sset:        "sset",
-	iset:        "iset",
-	iadd:        "iadd",
-	isub:        "isub",
-	imul:        "imul",
-	idiv:        "idiv",
-	imod:        "imod",
-	ipow:        "ipow",
-	shl:         "shl",
-	shr:         "shr",
-	and:         "and",
-	or:          "or",
-	xor:         "xor",
-	not:         "not",
-	neg:         "neg",
-	mload:       "mload",
-	dload:       "dload",
-	iget:        "iget",
-	fget:        "fget",
-	sget:        "sget",
-	tolower:     "tolower",
-	length:      "length",
-	cat:         "cat",
-	setmatched:  "setmatched",
-	otherwise:   "otherwise",
-	del:         "del",
-	fadd:        "fadd",
-	fsub:        "fsub",
-	fmul:        "fmul",
-	fdiv:        "fdiv",
-	fmod:        "fmod",
-	fpow:        "fpow",
-	fset:        "fset",
-	getfilename: "getfilename",
-	i2f:         "i2f",
-	s2i:         "s2i",
-	s2f:         "s2f",
-	i2s:         "i2s",
-	f2s:         "f2s",
-	icmp:        "icmp",
-	fcmp:        "fcmp",
-	scmp:        "scmp",
+	match:        "match",
+	smatch:       "smatch",
+	cmp:          "cmp",
+	jnm:          "jnm",
+	jm:           "jm",
+	jmp:          "jmp",
+	inc:          "inc",
+	strptime:     "strptime",
+	timestamp:    "timestamp",
+	settime:      "settime",
+	push:         "push",
+	capref:       "capref",
+	str:          "str",
+	sset:         "sset",
+	iset:         "iset",
+	iadd:         "iadd",
+	isub:         "isub",
+	imul:         "imul",
+	idiv:         "idiv",
+	imod:         "imod",
+	ipow:         "ipow",
+	shl:          "shl",
+	shr:          "shr",
+	and:          "and",
+	or:           "or",
+	xor:          "xor",
+	not:          "not",
+	neg:          "neg",
+	mload:        "mload",
+	dload:        "dload",
+	iget:         "iget",
+	fget:         "fget",
+	sget:         "sget",
+	tolower:      "tolower",
+	length:       "length",
+	cat:          "cat",
+	setmatched:   "setmatched",
+	otherwise:    "otherwise",
+	stop:         "stop",
+	del:          "del",
+	expire:       "expire",
+	emit:         "emit",
+	rate:         "rate",
+	ewma:         "ewma",
+	fadd:         "fadd",
+	fsub:         "fsub",
+	fmul:         "fmul",
+	fdiv:         "fdiv",
+	fmod:         "fmod",
+	fpow:         "fpow",
+	fset:         "fset",
+	getfilename:  "getfilename",
+	getpod:       "getpod",
+	getnamespace: "getnamespace",
+	getcontainer: "getcontainer",
+	getenv:       "getenv",
+	hostname:     "hostname",
+	parseip:      "parseip",
+	cidrmatch:    "cidrmatch",
+	enrich:       "enrich",
+	i2f:          "i2f",
+	s2i:          "s2i",
+	s2f:          "s2f",
+	i2s:          "i2s",
+	f2s:          "f2s",
+	f2i:          "f2i",
+	s2d:          "s2d",
+	s2b:          "s2b",
+	icmp:         "icmp",
+	fcmp:         "fcmp",
+	scmp:         "scmp",
 }
 
 var builtin = map[string]opcode{
-	"getfilename": getfilename,
-	"len":         length,
-	"settime":     settime,
-	"strptime":    strptime,
-	"strtol":      s2i,
-	"timestamp":   timestamp,
-	"tolower":     tolower,
+	"bytesize":     s2b,
+	"duration":     s2d,
+	"emit":         emit,
+	"ewma":         ewma,
+	"cidrmatch":    cidrmatch,
+	"getcontainer": getcontainer,
+	"getenv":       getenv,
+	"getfilename":  getfilename,
+	"getnamespace": getnamespace,
+	"getpod":       getpod,
+	"hostname":     hostname,
+	"len":          length,
+	"parseip":      parseip,
+	"rate":         rate,
+	"settime":      settime,
+	"strptime":     strptime,
+	"strtol":       s2i,
+	"timestamp":    timestamp,
+	"tolower":      tolower,
 }
 
 type instr struct {
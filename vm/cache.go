@@ -0,0 +1,240 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+var (
+	// progCacheHits counts the programs loaded from the bytecode cache.
+	progCacheHits = expvar.NewInt("prog_cache_hits_total")
+	// progCacheMisses counts the programs compiled because they weren't in the bytecode cache.
+	progCacheMisses = expvar.NewInt("prog_cache_misses_total")
+)
+
+// cacheFormat names the encoding of cached programs.  Change it when the
+// encoding changes; changes to the instruction set are detected by hashing
+// the opcode names.
+const cacheFormat = "mtail bytecode 6"
+
+// cacheFileExt is the extension of the files in the bytecode cache.
+const cacheFileExt = ".mtc"
+
+func init() {
+	// Register the operand types that aren't registered by encoding/gob.
+	gob.Register(time.Duration(0))
+}
+
+// cachedProgram is the encoding of a compiled program object in the cache.
+type cachedProgram struct {
+	Prog    []cachedInstr
+	Str     []string
+	Re      []string
+	Metrics []cachedMetric
+	RePos   []string
+}
+
+type cachedInstr struct {
+	Op   opcode
+	Opnd interface{}
+}
+
+// cachedMetric is a metric declared by a program, and the label values
+// initialized to zero.
+type cachedMetric struct {
+	Name    string
+	Program string
+	Kind    metrics.Kind
+	Type    datum.Type
+	Hidden  bool
+	Keys    []string
+	Source  string
+	Inits   [][]string
+
+	Window     time.Duration
+	WindowKeep time.Duration
+	Refresh    time.Duration
+
+	Description string
+	Unit        string
+}
+
+// bytecodeCache stores compiled programs on disk, keyed by a hash of their
+// name and source, so that unchanged programs needn't be compiled again when
+// mtail restarts.
+type bytecodeCache struct {
+	dir   string
+	build string // version and revision of mtail, so other builds' entries aren't used
+}
+
+// key returns the cache key for a program.  The key includes the version and
+// revision of mtail and the opcode names, so that a cache written by another
+// build, or one with a different instruction set, is not used.
+func (c *bytecodeCache) key(name string, source []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", cacheFormat, c.build)
+	ops := make([]string, 0, len(opNames))
+	for op, name := range opNames {
+		ops = append(ops, fmt.Sprintf("%d=%s", op, name))
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Fprintf(h, "%s\x00", op)
+	}
+	fmt.Fprintf(h, "%s\x00", name)
+	h.Write(source)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *bytecodeCache) path(name string, source []byte) string {
+	return filepath.Join(c.dir, c.key(name, source)+cacheFileExt)
+}
+
+// load returns the compiled object for the program, or nil if it is not in
+// the cache.
+func (c *bytecodeCache) load(name string, source []byte) *object {
+	f, err := os.Open(c.path(name, source))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Infof("Reading bytecode cache for %s: %s", name, err)
+		}
+		progCacheMisses.Add(1)
+		return nil
+	}
+	defer f.Close()
+	obj, err := decodeObject(f)
+	if err != nil {
+		glog.Infof("Bad bytecode cache entry for %s, recompiling: %s", name, err)
+		progCacheMisses.Add(1)
+		return nil
+	}
+	progCacheHits.Add(1)
+	return obj
+}
+
+// store writes the compiled object for the program to the cache.  Failures
+// are logged; the program is simply compiled again next time.
+func (c *bytecodeCache) store(name string, source []byte, obj *object) {
+	var b bytes.Buffer
+	if err := encodeObject(&b, obj); err != nil {
+		glog.Infof("Can't cache bytecode for %s: %s", name, err)
+		return
+	}
+	// Write to a temporary file and rename it into place, so that a
+	// concurrent load never sees a partial entry.
+	tmp, err := ioutil.TempFile(c.dir, "tmp")
+	if err != nil {
+		glog.Infof("Can't cache bytecode for %s: %s", name, err)
+		return
+	}
+	_, err = tmp.Write(b.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(name, source))
+	}
+	if err != nil {
+		glog.Infof("Can't cache bytecode for %s: %s", name, err)
+		os.Remove(tmp.Name())
+	}
+}
+
+// encodeObject writes the compiled object to w.
+func encodeObject(w io.Writer, obj *object) error {
+	p := cachedProgram{Str: obj.str, RePos: obj.rePos}
+	for _, i := range obj.prog {
+		p.Prog = append(p.Prog, cachedInstr{i.op, i.opnd})
+	}
+	for _, re := range obj.re {
+		p.Re = append(p.Re, re.String())
+	}
+	for _, m := range obj.m {
+		cm := cachedMetric{
+			Name:    m.Name,
+			Program: m.Program,
+			Kind:    m.Kind,
+			Type:    m.Type,
+			Hidden:  m.Hidden,
+			Keys:    m.Keys,
+			Source:  m.Source,
+
+			Window:     m.Window,
+			WindowKeep: m.WindowKeep,
+			Refresh:    m.Refresh,
+
+			Description: m.Description,
+			Unit:        m.Unit,
+		}
+		for _, lv := range m.LabelValues {
+			cm.Inits = append(cm.Inits, lv.Labels)
+		}
+		p.Metrics = append(p.Metrics, cm)
+	}
+	return gob.NewEncoder(w).Encode(&p)
+}
+
+// decodeObject reads a compiled object written by encodeObject from r.
+func decodeObject(r io.Reader) (*object, error) {
+	var p cachedProgram
+	if err := gob.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	obj := &object{str: p.Str, rePos: p.RePos}
+	for _, i := range p.Prog {
+		obj.prog = append(obj.prog, instr{i.Op, i.Opnd})
+	}
+	for _, pattern := range p.Re {
+		re, err := sharedRegexps.compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		obj.re = append(obj.re, re)
+	}
+	for _, cm := range p.Metrics {
+		m := metrics.NewMetric(cm.Name, cm.Program, cm.Kind, cm.Type, cm.Keys...)
+		m.Hidden = cm.Hidden
+		m.Source = cm.Source
+		m.Window, m.WindowKeep = cm.Window, cm.WindowKeep
+		m.Refresh = cm.Refresh
+		m.Description, m.Unit = cm.Description, cm.Unit
+		for _, labels := range cm.Inits {
+			if len(labels) == 0 {
+				labels = nil
+			}
+			d, err := m.GetDatum(labels...)
+			if err != nil {
+				return nil, err
+			}
+			// Initialized to zero at the zero time, as in codegen.
+			switch cm.Type {
+			case metrics.Int:
+				datum.SetInt(d, 0, time.Unix(0, 0))
+			case metrics.Float:
+				datum.SetFloat(d, 0, time.Unix(0, 0))
+			default:
+				return nil, errors.Errorf("can't initialize metric %s of type %v", cm.Name, cm.Type)
+			}
+		}
+		obj.m = append(obj.m, m)
+	}
+	return obj, nil
+}
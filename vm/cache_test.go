@@ -0,0 +1,120 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+const cacheTestProgram = `counter c by a init ["x"]
+counter total
+gauge g "Last value seen" unit "widgets" refresh 1m
+hidden gauge start by id
+counter per_minute by a window 1m keep 10m
+/(?P<id>\w+) (\d+\.\d+)/ {
+  c[$id]++
+  total++
+  per_minute[$id]++
+  g = $2
+  start[$id] = 1
+  del start[$id] after 1h
+}
+`
+
+func TestBytecodeCacheRoundTrip(t *testing.T) {
+	obj, err := compileObject("cache.mtail", strings.NewReader(cacheTestProgram), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := encodeObject(&b, obj); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeObject(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(obj.prog, got.prog) {
+		t.Errorf("prog:\n%v\nwant\n%v", got.prog, obj.prog)
+	}
+	if !reflect.DeepEqual(obj.str, got.str) {
+		t.Errorf("str %q, want %q", got.str, obj.str)
+	}
+	if len(got.re) != len(obj.re) || got.re[0].String() != obj.re[0].String() {
+		t.Errorf("re %v, want %v", got.re, obj.re)
+	}
+	// Compare the metrics as printed, which covers their label values.
+	if len(got.m) != len(obj.m) {
+		t.Fatalf("metrics %v, want %v", got.m, obj.m)
+	}
+	for i := range obj.m {
+		if got.m[i].String() != obj.m[i].String() {
+			t.Errorf("metric %d: %s, want %s", i, got.m[i], obj.m[i])
+		}
+		if got.m[i].Window != obj.m[i].Window || got.m[i].WindowKeep != obj.m[i].WindowKeep {
+			t.Errorf("metric %d window %s keep %s, want %s keep %s", i, got.m[i].Window, got.m[i].WindowKeep, obj.m[i].Window, obj.m[i].WindowKeep)
+		}
+		if got.m[i].Refresh != obj.m[i].Refresh {
+			t.Errorf("metric %d refresh %s, want %s", i, got.m[i].Refresh, obj.m[i].Refresh)
+		}
+		if got.m[i].Description != obj.m[i].Description || got.m[i].Unit != obj.m[i].Unit {
+			t.Errorf("metric %d description %q unit %q, want %q unit %q", i, got.m[i].Description, got.m[i].Unit, obj.m[i].Description, obj.m[i].Unit)
+		}
+	}
+}
+
+func TestBytecodeCacheLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bytecode_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hits, misses := progCacheHits.Value(), progCacheMisses.Value()
+	for i, source := range []string{cacheTestProgram, cacheTestProgram, cacheTestProgram + "counter other\n/x/ {\n  other++\n}\n"} {
+		store := metrics.NewStore()
+		l, err := NewLoader("", store, make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), CompileOnly, BytecodeCache(dir))
+		if err != nil {
+			t.Fatalf("couldn't create loader: %s", err)
+		}
+		if err := l.CompileAndRun("cache.mtail", strings.NewReader(source)); err != nil {
+			t.Fatalf("load %d: %s", i, err)
+		}
+		if _, ok := store.Metrics["c"]; !ok {
+			t.Errorf("load %d: metrics not loaded: %v", i, store.Metrics)
+		}
+	}
+	if h, m := progCacheHits.Value()-hits, progCacheMisses.Value()-misses; h != 1 || m != 2 {
+		t.Errorf("cache hits %d misses %d, want 1 and 2", h, m)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("cache has %d entries, want 2", len(entries))
+	}
+}
+
+func TestBytecodeCacheKeyBuild(t *testing.T) {
+	source := []byte(cacheTestProgram)
+	a := &bytecodeCache{build: "v3.0.0\x00abc"}
+	b := &bytecodeCache{build: "v3.0.0\x00def"}
+	if a.key("cache.mtail", source) == b.key("cache.mtail", source) {
+		t.Error("builds from different revisions share a cache key")
+	}
+	if a.key("cache.mtail", source) != a.key("cache.mtail", source) {
+		t.Error("cache key is not stable")
+	}
+}
@@ -5,6 +5,7 @@ package vm
 
 import (
 	"fmt"
+	"net"
 	"regexp/syntax"
 	"strings"
 	"time"
@@ -17,7 +18,7 @@ import (
 type checker struct {
 	scope *Scope // the current scope
 
-	decoScopes []*Scope // A stack of scopes used for resolving symbols in decorated nodes
+	decoScopes []*Scope // A stack of scopes used for resolving symbols in decorated nodes, one per enclosing decorator definition
 
 	errors ErrorList
 }
@@ -46,6 +47,19 @@ func (c *checker) VisitBefore(node astNode) Visitor {
 	case *condNode:
 		n.s = NewScope(c.scope)
 		c.scope = n.s
+		if n.cond != nil {
+			Walk(c, n.cond)
+		}
+		Walk(c, n.truthNode)
+		if n.elseNode != nil {
+			// The else block runs when the condition didn't match, so the
+			// capture groups of the condition have no values there.
+			c.scope = n.s.Parent
+			Walk(c, n.elseNode)
+			c.scope = n.s
+		}
+		c.VisitAfter(n)
+		return nil
 
 	case *caprefNode:
 		if n.sym == nil {
@@ -70,6 +84,9 @@ func (c *checker) VisitBefore(node astNode) Visitor {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of metric `%s' previously declared at %s", n.name, alt.Pos))
 			return nil
 		}
+		// Bind the declaration so the kind of metric can be checked on
+		// assignment; codegen replaces this with the metric itself.
+		n.sym.Binding = n
 		var rType Type
 		switch n.kind {
 		case metrics.Counter, metrics.Gauge, metrics.Timer:
@@ -94,6 +111,28 @@ func (c *checker) VisitBefore(node astNode) Visitor {
 		} else {
 			n.sym.Type = rType
 		}
+		for _, labels := range n.inits {
+			if n.kind == metrics.Text {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't initialize text metric `%s' to zero.", n.name))
+				break
+			}
+			if len(labels) != len(n.keys) {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Metric `%s' has %d keys, but is initialized with %d label values %q.", n.name, len(n.keys), len(labels), labels))
+			}
+		}
+		if n.window > 0 {
+			for _, key := range n.keys {
+				if key == metrics.WindowKey {
+					c.errors.Add(n.Pos(), fmt.Sprintf("Metric `%s' has a time window, so can't also have a key named `%s'.", n.name, key))
+				}
+			}
+			if len(n.inits) > 0 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Metric `%s' has a time window, so can't be initialized to zero.", n.name))
+			}
+			if n.keep > 0 && n.keep < n.window {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Metric `%s' keeps its windows for %s, less than its window of %s.", n.name, n.keep, n.window))
+			}
+		}
 
 	case *idNode:
 		if n.sym == nil {
@@ -125,6 +164,8 @@ func (c *checker) VisitBefore(node astNode) Visitor {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of decorator `%s' previously declared at %s", n.name, alt.Pos))
 			return nil
 		}
+		// Push a placeholder for the scope of the enclosed nextNode.
+		c.decoScopes = append(c.decoScopes, nil)
 
 	case *decoNode:
 		if sym := c.scope.Lookup(n.name, DecoSymbol); sym != nil {
@@ -134,6 +175,11 @@ func (c *checker) VisitBefore(node astNode) Visitor {
 			}
 			sym.Used = true
 			n.def = sym.Binding.(*decoDefNode)
+			if n.def.scope == nil {
+				// The definition is still being checked.
+				c.errors.Add(n.Pos(), fmt.Sprintf("Can't use decorator `%s' inside its own definition.", n.name))
+				return nil
+			}
 		} else {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Decorator `%s' not defined.\n\tTry adding a definition `def %s {}' earlier in the program.", n.name, n.name))
 			return nil
@@ -204,14 +250,27 @@ func (c *checker) VisitAfter(node astNode) {
 		c.scope = n.scope.Parent
 
 	case *nextNode:
-		// Put the current scope on a decorator-specific scoe stack for unwinding
-		c.decoScopes = append(c.decoScopes, c.scope)
+		// Put the current scope on a decorator-specific scope stack for unwinding
+		last := len(c.decoScopes) - 1
+		switch {
+		case last < 0:
+			c.errors.Add(n.Pos(), "Can't use `next' outside of a decorator definition.")
+		case c.decoScopes[last] != nil:
+			c.errors.Add(n.Pos(), "Can't use `next' more than once in a decorator definition.")
+		default:
+			c.decoScopes[last] = c.scope
+		}
 
 	case *decoDefNode:
 		// Pop a decorator scope off the stack from the enclosed nextNode.
 		last := len(c.decoScopes) - 1
 		n.scope = c.decoScopes[last]
 		c.decoScopes = c.decoScopes[:last]
+		if n.scope == nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("No `next' statement found in decorator `%s'.\n\tTry adding `next' where the decorated block should run.", n.name))
+			// Use the enclosing scope so that uses of the decorator can still be checked.
+			n.scope = c.scope
+		}
 
 	case *binaryExprNode:
 		var rType Type
@@ -239,6 +298,16 @@ func (c *checker) VisitAfter(node astNode) {
 				n.SetType(rType)
 				return
 			}
+			// Strings can only be added together; a string with a number
+			// or in any other arithmetic is a mistake.
+			if Equals(rType, String) && (n.op != PLUS || isNumericType(lT) || isNumericType(rT)) {
+				lOk := c.checkNumeric(n.lhs, "a numeric expression")
+				rOk := c.checkNumeric(n.rhs, "a numeric expression")
+				if !lOk || !rOk {
+					n.SetType(Error)
+					return
+				}
+			}
 			// astType is the type signature of the ast expression
 			astType := Function(lT, rT, rType)
 
@@ -314,6 +383,12 @@ func (c *checker) VisitAfter(node astNode) {
 			// Tr <= Tl
 			// ⇒ O ⊢ e : Tl
 			glog.V(2).Infof("lt %q, rt %q", lT, rT)
+			if d := assignedMetric(n.lhs); d != nil && d.kind != metrics.Text {
+				if !c.checkNumeric(n.rhs, fmt.Sprintf("assignment to %s `%s'", strings.ToLower(d.kind.String()), d.name)) {
+					n.SetType(Error)
+					return
+				}
+			}
 			rType = lT
 			// TODO(jaq): the rT <= lT relationship is not correctly encoded here.
 			t := LeastUpperBound(lT, rT)
@@ -496,6 +571,17 @@ func (c *checker) VisitAfter(node astNode) {
 			n.SetType(Error)
 			return
 		}
+		// Unification permits a string where a number is expected, as it
+		// would for a conversion, but builtins don't convert their arguments.
+		if args, ok := n.args.(*exprlistNode); ok {
+			params := fresh.(*TypeOperator).Args
+			for i, arg := range args.children {
+				if isNumericType(params[i]) && !c.checkNumeric(arg, fmt.Sprintf("call to `%s'", n.name)) {
+					n.SetType(Error)
+					return
+				}
+			}
+		}
 		n.SetType(rType)
 
 		switch n.name {
@@ -518,6 +604,59 @@ func (c *checker) VisitAfter(node astNode) {
 					return
 				}
 			}
+
+		case "cidrmatch":
+			// The network is usually a constant, which can be checked now
+			// rather than on every line.
+			if f, ok := n.args.(*exprlistNode).children[1].(*stringConstNode); ok {
+				if _, _, err := net.ParseCIDR(f.text); err != nil {
+					c.errors.Add(f.Pos(), fmt.Sprintf("invalid network %q in CIDR notation, like \"10.0.0.0/8\"", f.text))
+					n.SetType(Error)
+					return
+				}
+			}
+
+		case "getenv":
+			// Programs may only read the environment variables that the
+			// operator has set for them, so that an untrusted program
+			// can't export the credentials of the mtail process.
+			arg := n.args.(*exprlistNode).children[0]
+			s, ok := arg.(*stringConstNode)
+			if !ok {
+				c.errors.Add(arg.Pos(), "The argument to `getenv' must be a string constant.")
+				n.SetType(Error)
+				return
+			}
+			if !strings.HasPrefix(s.text, getenvPrefix) {
+				c.errors.Add(arg.Pos(), fmt.Sprintf("The environment variable %q can't be read; only those starting with %q can.", s.text, getenvPrefix))
+				n.SetType(Error)
+				return
+			}
+
+		case "rate", "ewma":
+			// The VM keeps the history of the values of a datum, so the
+			// first argument must name one, rather than compute a value.
+			arg := n.args.(*exprlistNode).children[0]
+			var id *idNode
+			if ie, ok := arg.(*indexedExprNode); ok {
+				id, _ = ie.lhs.(*idNode)
+			}
+			if id == nil || id.sym == nil || id.sym.Kind != VarSymbol {
+				c.errors.Add(arg.Pos(), fmt.Sprintf("The first argument to `%s' must be a counter or gauge.", n.name))
+				n.SetType(Error)
+				return
+			}
+			if Equals(arg.Type(), Error) {
+				// Already reported, for example too few keys.
+				n.SetType(Error)
+				return
+			}
+			if !isNumericType(arg.Type()) {
+				c.errors.Add(arg.Pos(), fmt.Sprintf("The first argument to `%s' must be a counter or gauge with a numeric value, not `%s'.", n.name, id.name))
+				n.SetType(Error)
+				return
+			}
+			id.lvalue = true
 		}
 
 	case *patternExprNode:
@@ -544,6 +683,43 @@ func (c *checker) VisitAfter(node astNode) {
 	}
 }
 
+// checkNumeric reports an error if the expression n, used in the given
+// numeric context, has a string type.  It returns false if an error was
+// reported.
+func (c *checker) checkNumeric(n astNode, context string) bool {
+	if !Equals(n.Type(), String) {
+		return true
+	}
+	if v, ok := n.(*caprefNode); ok {
+		c.errors.Add(n.Pos(), fmt.Sprintf("Capture group `$%s' used in %s may not be numeric.\n\tTry using a numeric pattern like `(\\d+)' for the capture group, or convert it with `int()' or `float()'.", v.name, context))
+		return false
+	}
+	c.errors.Add(n.Pos(), fmt.Sprintf("Expression of type String can't be used in %s.", context))
+	return false
+}
+
+// isNumericType returns true if t is a numeric type.
+func isNumericType(t Type) bool {
+	return Equals(t, Int) || Equals(t, Float)
+}
+
+// assignedMetric returns the declaration of the metric that is the target of
+// an assignment to n, or nil if n is not a metric.
+func assignedMetric(n astNode) *declNode {
+	var id *idNode
+	switch v := n.(type) {
+	case *idNode:
+		id = v
+	case *indexedExprNode:
+		id, _ = v.lhs.(*idNode)
+	}
+	if id == nil || id.sym == nil {
+		return nil
+	}
+	d, _ := id.sym.Binding.(*declNode)
+	return d
+}
+
 // checkRegex is a helper method to compile and check a regular expression, and
 // to generate its capture groups as symbols.
 func (c *checker) checkRegex(pattern string, n astNode) {
@@ -569,12 +745,32 @@ func (c *checker) checkRegex(pattern string, n astNode) {
 				}
 			}
 		}
+		if size := regexSize(reAst); size > maxRegexSize {
+			glog.Warningf("%s: regular expression compiles to %d instructions, which may be slow to match against every log line.  Consider anchoring it, or splitting it into nested conditions.", n.Pos(), size)
+		}
 	} else {
 		c.errors.Add(n.Pos(), err.Error())
 		return
 	}
 }
 
+// maxRegexSize is the number of regular expression program instructions
+// above which the checker warns that a pattern may be slow.  The time taken
+// to match is proportional to the product of the size of the program and the
+// length of the line.
+const maxRegexSize = 2000
+
+// regexSize returns the number of instructions in the compiled program of
+// the regular expression re.  Counted repetitions are expanded by the
+// compiler, so a pattern like `\w{1,1000}` is large.
+func regexSize(re *syntax.Regexp) int {
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0
+	}
+	return len(prog.Inst)
+}
+
 // patternEvaluator is a helper that performs concatenation of pattern
 // fragments so that they can be compiled as whole regular expression patterns.
 type patternEvaluator struct {
@@ -610,3 +806,7 @@ func (p *patternEvaluator) VisitBefore(n astNode) Visitor {
 
 func (p *patternEvaluator) VisitAfter(n astNode) {
 }
+
+// getenvPrefix is the prefix of the names of the environment variables that
+// programs may read with getenv.
+const getenvPrefix = "MTAIL_"
@@ -4,6 +4,7 @@
 package vm
 
 import (
+	"regexp/syntax"
 	"strings"
 	"testing"
 
@@ -16,6 +17,14 @@ var checkerInvalidPrograms = []struct {
 	program string
 	errors  []string
 }{
+	{"init with wrong number of label values",
+		"counter foo by a, b init [\"x\"]\n/x/ {\n  foo[1, 2]++\n}\n",
+		[]string{"init with wrong number of label values:1:9-11: Metric `foo' has 2 keys, but is initialized with 1 label values [\"x\"]."}},
+
+	{"init text",
+		"text foo init\n/x/ {\n  foo = \"y\"\n}\n",
+		[]string{"init text:1:6-8: Can't initialize text metric `foo' to zero."}},
+
 	{"undefined named capture group",
 		"/blurgh/ { $undef++\n }\n",
 		[]string{"undefined named capture group:1:12-17: Capture group `$undef' was not defined by a regular expression visible to this scope.", "\tTry using `(?P<undef>...)' to name the capture group."}},
@@ -26,10 +35,32 @@ var checkerInvalidPrograms = []struct {
 			"visible to this scope.", "\tCheck that there are at least 2 pairs of parentheses."},
 	},
 
+	{"capref in else block",
+		"counter foo by a\n/(x)/ {\n} else {\n  foo[$1]++\n}\n",
+		[]string{"capref in else block:4:7-8: Capture group `$1' was not defined by a regular expression " +
+			"visible to this scope.", "\tCheck that there are at least 1 pairs of parentheses."},
+	},
+
 	{"undefined decorator",
 		"@foo {}\n",
 		[]string{"undefined decorator:1:1-4: Decorator `foo' not defined.", "\tTry adding a definition `def foo {}' earlier in the program."}},
 
+	{"decorator without next",
+		"def foo {}\n@foo {}\n",
+		[]string{"decorator without next:1:1-3: No `next' statement found in decorator `foo'.", "\tTry adding `next' where the decorated block should run."}},
+
+	{"next outside decorator",
+		"// {\n  next\n}\n",
+		[]string{"next outside decorator:2:3-6: Can't use `next' outside of a decorator definition."}},
+
+	{"next twice in decorator",
+		"def foo {\n  next\n  next\n}\n@foo {}\n",
+		[]string{"next twice in decorator:3:3-6: Can't use `next' more than once in a decorator definition."}},
+
+	{"decorator used in its own definition",
+		"def foo {\n  @foo {\n  }\n  next\n}\n@foo {}\n",
+		[]string{"decorator used in its own definition:2:3-6: Can't use decorator `foo' inside its own definition."}},
+
 	{"undefined identifier",
 		"// { x++ \n}\n",
 		[]string{"undefined identifier:1:6: Identifier `x' not declared.", "\tTry adding `counter x' to the top of the program."},
@@ -106,6 +137,24 @@ counter bar by a, b
 		[]string{
 			"bad strptime format:1:33-53: invalid time format string \"2017-10-16 06:50:25\"", "\tRefer to the documentation at https://golang.org/pkg/time/#pkg-constants for advice."}},
 
+	{"bad cidrmatch network",
+		`cidrmatch("10.1.2.3", "10.0.0.0/33") {
+}
+`,
+		[]string{"bad cidrmatch network:1:23-35: invalid network \"10.0.0.0/33\" in CIDR notation, like \"10.0.0.0/8\""}},
+
+	{"getenv without prefix",
+		`getenv("AWS_SECRET_ACCESS_KEY")
+`,
+		[]string{"getenv without prefix:1:8-30: The environment variable \"AWS_SECRET_ACCESS_KEY\" can't be read; only those starting with \"MTAIL_\" can."}},
+
+	{"getenv not constant",
+		`/(\S+)/ {
+  getenv($1)
+}
+`,
+		[]string{"getenv not constant:2:10-11: The argument to `getenv' must be a string constant."}},
+
 	{"undefined const regex",
 		"/foo / + X + / bar/ {}\n",
 		[]string{"undefined const regex:1:10: Identifier `X' not declared.", "\tTry adding `const X /.../' earlier in the program."}},
@@ -126,15 +175,73 @@ const ID /bar/
 }
 `,
 		[]string{"invalid del index count:3:7-11: Not enough keys for indexed expression: expecting 2, received 1"}},
-	// TODO(jaq): is it an error to make a counter of type string?
-	// 	{"counter as string",
-	// 		`counter foo
+	{"counter as string",
+		`counter foo
+
+/(?P<v>.*)/ {
+  foo = $v
+}
+`,
+		[]string{"counter as string:4:9-10: Capture group `$v' used in assignment to counter `foo' may not be numeric.",
+			"\tTry using a numeric pattern like `(\\d+)' for the capture group, or convert it with `int()' or `float()'."}},
+
+	{"string in arithmetic",
+		`gauge foo
+/(\S+) (\d+)/ {
+  foo = $2 * $1
+}
+`,
+		[]string{"string in arithmetic:3:14-15: Capture group `$1' used in a numeric expression may not be numeric.",
+			"\tTry using a numeric pattern like `(\\d+)' for the capture group, or convert it with `int()' or `float()'."}},
+
+	{"string builtin argument",
+		`/(\S+)/ {
+  settime("now")
+}
+`,
+		[]string{"string builtin argument:2:11-15: Expression of type String can't be used in call to `settime'."}},
+
+	{"rate of an expression",
+		`gauge r
+/(\d+)/ {
+  r = rate($1, 1m)
+}
+`,
+		[]string{"rate of an expression:3:12-13: The first argument to `rate' must be a counter or gauge."}},
+
+	{"ewma of a text metric",
+		`text t
+gauge r
+/(\w+)/ {
+  t = $1
+  r = ewma(t, 1m)
+}
+`,
+		[]string{"ewma of a text metric:5:12: The first argument to `ewma' must be a counter or gauge with a numeric value, not `t'."}},
 
-	// /(?P<v>.*)/ {
-	//   foo = $v
-	// }
-	// `,
-	// 	[]string{"counter as string:4:4-11: Can't assign rhs of type String to lhs of type Int"}},
+	{"windowed metric with window key",
+		`counter c by "window" window 1m
+/(\d+)/ {
+  c[$1]++
+}
+`,
+		[]string{"windowed metric with window key:1:9: Metric `c' has a time window, so can't also have a key named `window'."}},
+
+	{"initialized windowed metric",
+		`counter c by code init ["200"] window 1m
+/(\d+)/ {
+  c[$1]++
+}
+`,
+		[]string{"initialized windowed metric:1:9: Metric `c' has a time window, so can't be initialized to zero."}},
+
+	{"windowed metric kept less than window",
+		`counter c window 1h keep 1m
+/x/ {
+  c++
+}
+`,
+		[]string{"windowed metric kept less than window:1:9: Metric `c' keeps its windows for 1m0s, less than its window of 1h0m0s."}},
 }
 
 func TestCheckInvalidPrograms(t *testing.T) {
@@ -173,16 +280,38 @@ var checkerValidPrograms = []struct {
 	name    string
 	program string
 }{
+	{"rate and ewma",
+		`counter c by a
+gauge r by a
+gauge e by a
+/(\d+)/ {
+  c[$1]++
+  r[$1] = rate(c[$1], 5m)
+  e[$1] = ewma(c[$1], 1h30m)
+}
+`,
+	},
 	{"capture group",
 		`counter foo
-/(.*)/ {
+/(\d+)/ {
   foo += $1
 }
+`,
+	},
+	{"outer capture group in else block",
+		`counter foo by a
+/(\w+)/ {
+  /x(\d+)/ {
+    foo[$1]++
+  } else {
+    foo[$1]++
+  }
+}
 `,
 	},
 	{"shadowed positionals",
 		`counter foo
-/(.*)/ {
+/(\d+)/ {
   foo += $1
   /bar(\d+)/ {
    foo += $1
@@ -191,7 +320,7 @@ var checkerValidPrograms = []struct {
 `},
 	{"sibling positionals",
 		`counter foo
-/(.*)/ {
+/(\d+)/ {
   foo += $1
 }
 /bar(\d+)/ {
@@ -242,6 +371,20 @@ var checkerValidPrograms = []struct {
 
 	{"strptime format", `
 strptime("2006-01-02 15:04:05", "2006-01-02 15:04:05")
+`},
+
+	{"cidrmatch", `
+counter internal
+/from (\S+)/ {
+  cidrmatch($1, "10.0.0.0/8") || cidrmatch(parseip($1), "fd00::/8") {
+    internal++
+  }
+}
+`},
+
+	{"getenv", `
+text cluster
+cluster = getenv("MTAIL_CLUSTER")
 `},
 
 	{"string concat", `
@@ -387,3 +530,21 @@ func TestCheckTypeExpressions(t *testing.T) {
 		})
 	}
 }
+
+func TestRegexSize(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		large   bool
+	}{
+		{`^(\S+) (\d+) "(GET|POST) ([^"]*)"$`, false},
+		{`\w{1,1000}:\d{1,1000}`, true},
+	} {
+		re, err := syntax.Parse(tc.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := regexSize(re); (size > maxRegexSize) != tc.large {
+			t.Errorf("regexSize(%q) = %d, want large %v", tc.pattern, size, tc.large)
+		}
+	}
+}
@@ -5,7 +5,6 @@ package vm
 
 import (
 	"fmt"
-	"regexp"
 	"time"
 
 	"github.com/golang/glog"
@@ -14,6 +13,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// defaultWindows is the number of time windows before the latest that a
+// windowed metric keeps, if its declaration doesn't say how long to keep them.
+const defaultWindows = 60
+
 // codegen represents a code generator.
 type codegen struct {
 	name string // Name of the program.
@@ -91,13 +94,31 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 			}
 			dtyp = metrics.Int
 		}
-		m := metrics.NewMetric(name, c.name, n.kind, dtyp, n.keys...)
+		keys := n.keys
+		if n.window > 0 {
+			// The window is the last key, and is added by the VM.
+			keys = append(keys[:len(keys):len(keys)], metrics.WindowKey)
+		}
+		m := metrics.NewMetric(name, c.name, n.kind, dtyp, keys...)
 		m.SetSource(n.Pos().String())
+		m.Refresh = n.refresh
+		m.Description, m.Unit = n.description, n.unit
+		if n.window > 0 {
+			m.Window, m.WindowKeep = n.window, n.keep
+			if m.WindowKeep == 0 {
+				m.WindowKeep = defaultWindows * n.window
+			}
+		}
 		// Scalar counters can be initialized to zero.  Dimensioned counters we
 		// don't know the values of the labels yet.  Gauges and Timers we can't
-		// assume start at zero.
-		if len(n.keys) == 0 && n.kind == metrics.Counter {
-			d, err := m.GetDatum()
+		// assume start at zero.  The program can list the labels values, or
+		// ask for a gauge, to be initialized.
+		inits := n.inits
+		if len(n.keys) == 0 && n.kind == metrics.Counter && len(inits) == 0 {
+			inits = [][]string{nil}
+		}
+		for _, labels := range inits {
+			d, err := m.GetDatum(labels...)
 			if err != nil {
 				c.errorf(n.Pos(), "%s", err)
 				return nil
@@ -142,12 +163,13 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 		return nil
 
 	case *patternExprNode:
-		re, err := regexp.Compile(n.pattern)
+		re, err := sharedRegexps.compile(n.pattern)
 		if err != nil {
 			c.errorf(n.Pos(), "%s", err)
 			return nil
 		}
 		c.obj.re = append(c.obj.re, re)
+		c.obj.rePos = append(c.obj.rePos, n.Pos().String())
 		// Store the location of this regular expression in the patterNode
 		n.index = len(c.obj.re) - 1
 		c.emit(instr{match, n.index})
@@ -162,6 +184,9 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 	case *floatConstNode:
 		c.emit(instr{push, n.f})
 
+	case *durationConstNode:
+		c.emit(instr{push, n.d})
+
 	case *idNode:
 		if n.sym.Kind != VarSymbol {
 			break
@@ -172,7 +197,11 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 		}
 		c.emit(instr{mload, n.sym.Addr})
 		m := n.sym.Binding.(*metrics.Metric)
-		c.emit(instr{dload, len(m.Keys)})
+		keys := len(m.Keys)
+		if m.Window > 0 {
+			keys--
+		}
+		c.emit(instr{dload, keys})
 
 		if !n.lvalue {
 			t := n.Type()
@@ -221,19 +250,33 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 		return nil
 
 	case *nextNode:
-		// Visit the 'next' block on the decorated block stack
-		deco := c.decos[len(c.decos)-1]
+		// Visit the 'next' block on the decorated block stack.  The block is
+		// outside of the decorator, so pop it off while it is visited, in case
+		// it is itself decorated.
+		last := len(c.decos) - 1
+		deco := c.decos[last]
+		c.decos = c.decos[:last]
 		Walk(c, deco.block)
+		c.decos = append(c.decos, deco)
 		return nil
 
+	case *stopNode:
+		c.emit(instr{op: stop})
+
 	case *otherwiseNode:
 		c.emit(instr{op: otherwise})
 
 	case *delNode:
+		if n.expiry > 0 {
+			c.emit(instr{push, n.expiry})
+		}
 		Walk(c, n.n)
 		// overwrite the dload instruction
 		pc := c.pc()
 		c.obj.prog[pc].op = del
+		if n.expiry > 0 {
+			c.obj.prog[pc].op = expire
+		}
 
 	case *binaryExprNode:
 		switch n.op {
@@ -330,13 +373,29 @@ func (c *codegen) VisitAfter(node astNode) {
 				c.errorf(n.Pos(), "too many arguments to builtin %q: %#v", n.name, n)
 				return
 			}
-			if err := c.emitConversion(n.args.(*exprlistNode).children[0].Type(), n.Type()); err != nil {
+			arg := n.args.(*exprlistNode).children[0]
+			inType := arg.Type()
+			if _, ok := arg.(*caprefNode); ok && Equals(inType, n.Type()) {
+				// Capture groups are strings until converted, whatever type
+				// was inferred from their pattern, so int($1) still parses.
+				inType = String
+			}
+			if err := c.emitConversion(inType, n.Type()); err != nil {
 				c.errorf(n.Pos(), "%s on node %v", err.Error(), n)
 				return
 			}
 
 		default:
-			c.emit(instr{builtin[n.name], arglen})
+			if enrichmentBuiltins[n.name] {
+				// The operand names the database to look up.
+				c.emit(instr{enrich, n.name})
+			} else if n.name == "rate" {
+				// The operand is true if the metric is a counter, whose
+				// decreases are resets.
+				c.emit(instr{rate, isCounterArg(n.args.(*exprlistNode).children[0])})
+			} else {
+				c.emit(instr{builtin[n.name], arglen})
+			}
 		}
 	case *unaryExprNode:
 		switch n.op {
@@ -462,7 +521,9 @@ func (c *codegen) VisitAfter(node astNode) {
 
 func (c *codegen) emitConversion(inType, outType Type) error {
 	glog.V(2).Infof("Conversion: %q to %q", inType, outType)
-	if Equals(Int, inType) && Equals(Float, outType) {
+	if Equals(inType, outType) {
+		// nothing, already the right type
+	} else if Equals(Int, inType) && Equals(Float, outType) {
 		c.emit(instr{op: i2f})
 	} else if Equals(String, inType) && Equals(Float, outType) {
 		c.emit(instr{op: s2f})
@@ -472,6 +533,8 @@ func (c *codegen) emitConversion(inType, outType Type) error {
 		c.emit(instr{op: f2s})
 	} else if Equals(Int, inType) && Equals(String, outType) {
 		c.emit(instr{op: i2s})
+	} else if Equals(Float, inType) && Equals(Int, outType) {
+		c.emit(instr{op: f2i})
 	} else if Equals(Pattern, inType) && Equals(Bool, outType) {
 		// nothing, pattern is implicit bool
 	} else {
@@ -498,3 +561,18 @@ func (c *codegen) writeJumps() {
 		}
 	}
 }
+
+// isCounterArg returns true if n, the first argument of rate, names a datum
+// of a counter.
+func isCounterArg(n astNode) bool {
+	ie, ok := n.(*indexedExprNode)
+	if !ok {
+		return false
+	}
+	id, ok := ie.lhs.(*idNode)
+	if !ok || id.sym == nil {
+		return false
+	}
+	m, ok := id.sym.Binding.(*metrics.Metric)
+	return ok && m.Kind == metrics.Counter
+}
@@ -6,6 +6,7 @@ package vm
 import (
 	"strings"
 	"testing"
+	"time"
 
 	go_cmp "github.com/google/go-cmp/cmp"
 )
@@ -336,6 +337,22 @@ otherwise {
 			{dload, 0},
 			{inc, nil},
 			{setmatched, true}}},
+	{"stop", `
+counter a
+/foo/ {
+	stop
+}
+a++
+`,
+		[]instr{
+			{match, 0},
+			{jnm, 5},
+			{setmatched, false},
+			{stop, nil},
+			{setmatched, true},
+			{mload, 0},
+			{dload, 0},
+			{inc, nil}}},
 	{"cond else",
 		`counter foo
 counter bar
@@ -383,6 +400,16 @@ del a["string"]
 			{mload, 0},
 			{del, 1}},
 	},
+	{"del after", `
+counter a by b
+del a["string"] after 1h
+`,
+		[]instr{
+			{push, time.Hour},
+			{str, 0},
+			{mload, 0},
+			{expire, 1}},
+	},
 	{"types", `
 gauge i
 gauge f
@@ -423,6 +450,69 @@ getfilename()
 		},
 	},
 
+	{"getenv hostname", `
+text cluster
+text host
+cluster = getenv("MTAIL_CLUSTER")
+host = hostname()
+`,
+		[]instr{
+			{mload, 0},
+			{dload, 0},
+			{str, 0},
+			{getenv, 1},
+			{sset, nil},
+			{mload, 1},
+			{dload, 0},
+			{hostname, 0},
+			{sset, nil},
+		},
+	},
+
+	{"rate", `
+counter c
+gauge r
+/x/ {
+  c++
+  r = rate(c, 5m)
+}
+`,
+		[]instr{
+			{match, 0},
+			{jnm, 14},
+			{setmatched, false},
+			{mload, 0},
+			{dload, 0},
+			{inc, nil},
+			{mload, 1},
+			{dload, 0},
+			{mload, 0},
+			{dload, 0},
+			{push, 5 * time.Minute},
+			{rate, true},
+			{fset, nil},
+			{setmatched, true},
+		},
+	},
+
+	{"emit", `
+/(\w+) failed/ {
+  emit("failure " + $1)
+}
+`,
+		[]instr{
+			{match, 0},
+			{jnm, 9},
+			{setmatched, false},
+			{str, 0},
+			{push, 0},
+			{capref, 1},
+			{cat, nil},
+			{emit, 1},
+			{setmatched, true},
+		},
+	},
+
 	{"dimensioned counter",
 		`counter c by a,b,c
 /(\d) (\d) (\d)/ {
@@ -528,6 +618,83 @@ getfilename()
 			{dload, 1},
 			{inc, nil},
 			{setmatched, true}}},
+	{"int of int capref",
+		`gauge g
+/(\d+)/ {
+  g = int($1)
+}
+`,
+		[]instr{
+			{match, 0},
+			{jnm, 10},
+			{setmatched, false},
+			{mload, 0},
+			{dload, 0},
+			{push, 0},
+			{capref, 1},
+			{s2i, nil},
+			{iset, nil},
+			{setmatched, true}}},
+	{"bytesize and duration",
+		`gauge size
+gauge latency
+/(\S+) (\S+)/ {
+  size = bytesize($1)
+  latency = duration($2) * 1000.0
+}
+`,
+		[]instr{
+			{match, 0},
+			{jnm, 18},
+			{setmatched, false},
+			{mload, 0},
+			{dload, 0},
+			{push, 0},
+			{capref, 1},
+			{s2b, 1},
+			{iset, nil},
+			{mload, 1},
+			{dload, 0},
+			{push, 0},
+			{capref, 2},
+			{s2d, 1},
+			{push, 1000.0},
+			{fmul, nil},
+			{fset, nil},
+			{setmatched, true}}},
+	{"cidrmatch",
+		`counter internal
+/(\S+)/ {
+  cidrmatch($1, "10.0.0.0/8") {
+    internal++
+  }
+}
+`,
+		[]instr{
+			{match, 0},
+			{jnm, 14},
+			{setmatched, false},
+			{push, 0},
+			{capref, 1},
+			{str, 0},
+			{cidrmatch, 2},
+			{jnm, 13},
+			{setmatched, false},
+			{mload, 0},
+			{dload, 0},
+			{inc, nil},
+			{setmatched, true},
+			{setmatched, true}}},
+	{"geoip_country",
+		`text country
+country = geoip_country("81.2.69.142")
+`,
+		[]instr{
+			{mload, 0},
+			{dload, 0},
+			{str, 0},
+			{enrich, "geoip_country"},
+			{sset, nil}}},
 	{"nested comparisons",
 		`counter foo
 /(.*)/ {
@@ -801,3 +968,46 @@ func TestCodegen(t *testing.T) {
 		})
 	}
 }
+
+func TestCodegenInitializesMetrics(t *testing.T) {
+	source := `counter c
+counter d by code init ["200"], ["500"]
+gauge g init
+gauge h
+/(\d+)/ {
+  c++
+  d[$1]++
+  g = 1
+  h = 1
+}
+`
+	ast, err := Parse("init", strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(ast); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := CodeGen("init", ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][][]string{
+		"c": {nil},
+		"d": {{"200"}, {"500"}},
+		"g": {nil},
+		"h": nil,
+	}
+	for _, m := range obj.m {
+		var labels [][]string
+		for _, lv := range m.LabelValues {
+			if v := lv.Value.ValueString(); v != "0" {
+				t.Errorf("%s%v initialized to %s", m.Name, lv.Labels, v)
+			}
+			labels = append(labels, lv.Labels)
+		}
+		if diff := go_cmp.Diff(expected[m.Name], labels); diff != "" {
+			t.Errorf("%s initialized labels: %s", m.Name, diff)
+		}
+	}
+}
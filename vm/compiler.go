@@ -7,8 +7,10 @@
 package vm
 
 import (
+	"fmt"
 	"io"
 	"path/filepath"
+	"runtime/debug"
 	"time"
 
 	"github.com/golang/glog"
@@ -19,6 +21,25 @@ import (
 // additional arguments to build the virtual machine.
 func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location) (*VM, error) {
 	name = filepath.Base(name)
+	obj, err := compileObject(name, input, emitAst, emitAstTypes)
+	if err != nil {
+		return nil, err
+	}
+	vm := New(name, obj, syslogUseCurrentYear, loc)
+	return vm, nil
+}
+
+// compileObject compiles a program from the input into an optimised object.
+// The name is the program's name, not its path.  A bug in the compiler
+// returns an error instead of crashing mtail, as the program being compiled
+// may be arbitrary text.
+func compileObject(name string, input io.Reader, emitAst bool, emitAstTypes bool) (obj *object, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("panic compiling %s: %s\n%s", name, r, debug.Stack())
+			obj, err = nil, &internalError{name, r}
+		}
+	}()
 
 	ast, err := Parse(name, input)
 	if err != nil {
@@ -38,11 +59,20 @@ func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, sysl
 		glog.Infof("%s AST with Type Annotation:\n%s", name, s.Dump(ast))
 	}
 
-	obj, err := CodeGen(name, ast)
+	obj, err = CodeGen(name, ast)
 	if err != nil {
 		return nil, err
 	}
+	Optimise(obj)
+	return obj, nil
+}
 
-	vm := New(name, obj, syslogUseCurrentYear, loc)
-	return vm, nil
+// internalError is returned when compiling a program panics.
+type internalError struct {
+	name string
+	r    interface{}
+}
+
+func (e *internalError) Error() string {
+	return fmt.Sprintf("%s: internal compiler error: %v", e.name, e.r)
 }
@@ -0,0 +1,150 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/google/mtail/logline"
+)
+
+// maxUnmatchedSamples is the number of lines that matched no pattern kept
+// from each program for the coverage report.
+const maxUnmatchedSamples = 10
+
+// vmCoverage counts the lines a VM processes, and the lines matched by each
+// of its regular expressions, while coverage is enabled.  It is shared by the
+// workers of a VM.
+type vmCoverage struct {
+	sync.Mutex
+	lines     int64
+	unmatched int64
+	samples   []*logline.LogLine // The first lines that matched no pattern.
+	matches   []int64
+}
+
+func newVMCoverage(numRegexps int) *vmCoverage {
+	return &vmCoverage{matches: make([]int64, numRegexps)}
+}
+
+func (c *vmCoverage) addMatch(index int) {
+	c.Lock()
+	defer c.Unlock()
+	if index < len(c.matches) {
+		c.matches[index]++
+	}
+}
+
+// addLine counts a line processed, which matched a pattern if matched.
+func (c *vmCoverage) addLine(line *logline.LogLine, matched bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.lines++
+	if matched {
+		return
+	}
+	c.unmatched++
+	if len(c.samples) < maxUnmatchedSamples {
+		c.samples = append(c.samples, line)
+	}
+}
+
+// PatternCoverage is the number of lines matched by one pattern of a program.
+type PatternCoverage struct {
+	Position string // Where the pattern is in the program.
+	Pattern  string
+	Matches  int64
+}
+
+// ProgramCoverage describes which patterns of a program matched the lines it
+// was sent, and which lines matched none of them.
+type ProgramCoverage struct {
+	Program          string
+	Lines            int64
+	UnmatchedLines   int64
+	UnmatchedSamples []*logline.LogLine // Some of the lines that matched no pattern.
+	Patterns         []PatternCoverage
+}
+
+// Coverage sets the loader to count the lines matched by each pattern of each
+// program, for CoverageReport.
+func Coverage(l *MasterControl) error {
+	l.covered = make(map[string]*VM)
+	return nil
+}
+
+// CoverageReport returns the coverage of each program loaded since the
+// loader was created with the Coverage option, ordered by program name.
+func (l *MasterControl) CoverageReport() []ProgramCoverage {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	var report []ProgramCoverage
+	for _, v := range l.covered {
+		v.coverage.Lock()
+		pc := ProgramCoverage{
+			Program:          v.name,
+			Lines:            v.coverage.lines,
+			UnmatchedLines:   v.coverage.unmatched,
+			UnmatchedSamples: v.coverage.samples,
+		}
+		for i, re := range v.re {
+			p := PatternCoverage{Pattern: re.String(), Matches: v.coverage.matches[i]}
+			if i < len(v.rePos) {
+				p.Position = v.rePos[i]
+			}
+			pc.Patterns = append(pc.Patterns, p)
+		}
+		v.coverage.Unlock()
+		report = append(report, pc)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Program < report[j].Program })
+	return report
+}
+
+// percent returns n as a percentage of total, or zero if total is zero.
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// WriteCoverageReport writes the coverage report to w as text, listing the
+// patterns of each program that matched no lines, and some of the lines that
+// matched no pattern.
+func (l *MasterControl) WriteCoverageReport(w io.Writer) error {
+	var patterns, matched int64
+	for _, pc := range l.CoverageReport() {
+		var hit int64
+		for _, p := range pc.Patterns {
+			if p.Matches > 0 {
+				hit++
+			}
+		}
+		n := int64(len(pc.Patterns))
+		patterns += n
+		matched += hit
+		if _, err := fmt.Fprintf(w, "%s: %d of %d patterns matched (%.1f%%), %d of %d lines matched no pattern (%.1f%%)\n",
+			pc.Program, hit, n, percent(hit, n), pc.UnmatchedLines, pc.Lines, percent(pc.UnmatchedLines, pc.Lines)); err != nil {
+			return err
+		}
+		for _, p := range pc.Patterns {
+			if p.Matches == 0 {
+				if _, err := fmt.Fprintf(w, "  never matched: %s /%s/\n", p.Position, p.Pattern); err != nil {
+					return err
+				}
+			}
+		}
+		for _, line := range pc.UnmatchedSamples {
+			if _, err := fmt.Fprintf(w, "  matched no pattern: %s: %q\n", line.Filename, line.Line); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "total: %d of %d patterns matched (%.1f%%)\n", matched, patterns, percent(matched, patterns))
+	return err
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestCoverageReport(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), afero.NewMemMapFs(), Coverage)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	prog := `counter gets
+counter posts
+/^GET/ {
+  gets++
+}
+/^POST/ {
+  posts++
+}
+`
+	if err := l.CompileAndRun("web.mtail", strings.NewReader(prog)); err != nil {
+		t.Fatal(err)
+	}
+	lines <- logline.NewLogLine("access.log", "GET /")
+	lines <- logline.NewLogLine("access.log", "GET /index.html")
+	lines <- logline.NewLogLine("access.log", "DELETE /")
+	close(lines)
+	<-l.VMsDone
+
+	unmatched := logline.NewLogLine("access.log", "DELETE /")
+	want := []ProgramCoverage{{
+		Program:          "web.mtail",
+		Lines:            3,
+		UnmatchedLines:   1,
+		UnmatchedSamples: []*logline.LogLine{unmatched},
+		Patterns: []PatternCoverage{
+			{Position: "web.mtail:3:1-6", Pattern: "^GET", Matches: 2},
+			{Position: "web.mtail:6:1-7", Pattern: "^POST"},
+		},
+	}}
+	if diff := go_cmp.Diff(want, l.CoverageReport()); diff != "" {
+		t.Errorf("coverage differs:\n%s", diff)
+	}
+
+	var b bytes.Buffer
+	if err := l.WriteCoverageReport(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"web.mtail: 1 of 2 patterns matched (50.0%), 1 of 3 lines matched no pattern (33.3%)",
+		"never matched: web.mtail:6:1-7 /^POST/",
+		`matched no pattern: access.log: "DELETE /"`,
+		"total: 1 of 2 patterns matched (50.0%)",
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("report doesn't contain %q:\n%s", s, b.String())
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+)
+
+// lineRing holds the most recent lines received by the loader, so that
+// candidate programs can be tried against them.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []*logline.LogLine // a circular buffer
+	next  int                // index of the slot for the next line
+	full  bool               // set once every slot has been filled
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]*logline.LogLine, size)}
+}
+
+// add records a line, displacing the oldest if the ring is full.
+func (r *lineRing) add(line *logline.LogLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = line
+	r.next++
+	if r.next == len(r.lines) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// last returns up to n of the most recent lines, oldest first.  If n is zero
+// or negative, all the lines held are returned.
+func (r *lineRing) last(n int) []*logline.LogLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.lines)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	lines := make([]*logline.LogLine, 0, n)
+	for i := r.next - n; i < r.next; i++ {
+		lines = append(lines, r.lines[(i+len(r.lines))%len(r.lines)])
+	}
+	return lines
+}
+
+// RecentLines keeps the n most recent log lines received by the loader, for
+// dry runs of programs.
+func RecentLines(n int) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if n > 0 {
+			l.recent = newLineRing(n)
+		}
+		return nil
+	}
+}
+
+// DryRunResult describes the outcome of a dry run of a program.
+type DryRunResult struct {
+	Program       string            `json:"program"`
+	CompileErrors string            `json:"compile_errors,omitempty"`
+	Lines         int               `json:"lines"`
+	MatchedLines  int               `json:"matched_lines"`
+	RuntimeErrors int               `json:"runtime_errors"`
+	Metrics       []*metrics.Metric `json:"metrics,omitempty"`
+}
+
+// DryRun compiles the program read from input, and if it compiles, runs it
+// over the last n log lines kept by the loader (all of them if n is zero).
+// The program's metrics are returned in the result rather than added to the
+// store, and the running programs are not affected.  Events emitted by the
+// program are discarded.
+func (l *MasterControl) DryRun(name string, input io.Reader, n int) *DryRunResult {
+	result := &DryRunResult{Program: name}
+	obj, err := compileObject(filepath.Base(name), input, false, false)
+	if err != nil {
+		result.CompileErrors = err.Error()
+		return result
+	}
+	v := New(name, obj, l.syslogUseCurrentYear, l.overrideLocation)
+	v.dryRun = true
+	if l.recent != nil {
+		for _, line := range l.recent.last(n) {
+			atomic.StoreInt64(&v.lastMatch, 0)
+			v.processLine(line)
+			result.Lines++
+			if atomic.LoadInt64(&v.lastMatch) != 0 {
+				result.MatchedLines++
+			}
+		}
+	}
+	result.RuntimeErrors = int(v.RuntimeErrors())
+	for _, m := range v.m {
+		if !m.Hidden {
+			result.Metrics = append(result.Metrics, m)
+		}
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestLineRing(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		added    []string
+		n        int
+		expected []string
+	}{
+		{"empty", nil, 0, []string{}},
+		{"partly full", []string{"a", "b"}, 0, []string{"a", "b"}},
+		{"last n", []string{"a", "b"}, 1, []string{"b"}},
+		{"more than held", []string{"a", "b"}, 5, []string{"a", "b"}},
+		{"wrapped", []string{"a", "b", "c", "d", "e"}, 0, []string{"c", "d", "e"}},
+		{"wrapped last n", []string{"a", "b", "c", "d", "e"}, 2, []string{"d", "e"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newLineRing(3)
+			for _, line := range tc.added {
+				r.add(logline.NewLogLine("log", line))
+			}
+			got := []string{}
+			for _, line := range r.last(tc.n) {
+				got = append(got, line.Line)
+			}
+			if diff := go_cmp.Diff(tc.expected, got); diff != "" {
+				t.Errorf("lines differ:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	store := metrics.NewStore()
+	inLines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, inLines, watcher.NewFakeWatcher(), afero.NewMemMapFs(), RecentLines(3))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	for _, line := range []string{"GET /", "GET /a", "POST /a", "GET /b"} {
+		inLines <- logline.NewLogLine("log", line)
+	}
+	close(inLines)
+	<-l.VMsDone
+
+	result := l.DryRun("requests.mtail", strings.NewReader("counter gets\n/^GET/ {\n  gets++\n}\n"), 0)
+	if result.CompileErrors != "" {
+		t.Fatal(result.CompileErrors)
+	}
+	if result.Lines != 3 || result.MatchedLines != 2 || result.RuntimeErrors != 0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(result.Metrics) != 1 {
+		t.Fatalf("expected one metric: %v", result.Metrics)
+	}
+	d, err := result.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := datum.GetInt(d); v != 2 {
+		t.Errorf("gets = %d, want 2", v)
+	}
+	if len(store.Metrics) != 0 {
+		t.Errorf("dry run added metrics to the store: %v", store.Metrics)
+	}
+
+	result = l.DryRun("bad.mtail", strings.NewReader("counter gets\n/^GET/ {\n  puts++\n}\n"), 0)
+	if result.CompileErrors == "" {
+		t.Errorf("expected compile errors: %+v", result)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/pkg/errors"
+)
+
+var (
+	// enrichmentLookups counts the lookups made by each enrichment builtin.
+	enrichmentLookups = expvar.NewMap("prog_enrichment_lookups_total")
+	// enrichmentCacheMisses counts the lookups by each enrichment builtin that
+	// weren't cached, and so were made in its database.
+	enrichmentCacheMisses = expvar.NewMap("prog_enrichment_cache_misses_total")
+)
+
+// GeoIPCountry is the name of the builtin that looks up the country an IP
+// address is in.
+const GeoIPCountry = "geoip_country"
+
+// enrichmentBuiltins are the builtins that look up a value in an enrichment
+// database.  Each is a function of one string, returning a string.
+var enrichmentBuiltins = map[string]bool{
+	GeoIPCountry: true,
+}
+
+// enrichmentCacheSize is the number of results of each enrichment builtin
+// that are cached.
+const enrichmentCacheSize = 4096
+
+// An Enricher looks up a property of a value from a log line in an external
+// database, such as the country an IP address is in.
+type Enricher interface {
+	// Lookup returns the property of key, or the empty string if the
+	// database doesn't know it.
+	Lookup(key string) (string, error)
+}
+
+// cachedEnricher remembers the most recent results of an Enricher, as log
+// lines often repeat the same values.  It is shared by all the programs.
+type cachedEnricher struct {
+	name string
+	e    Enricher
+
+	mu    sync.Mutex // guards cache
+	cache *lru.Cache
+}
+
+func (c *cachedEnricher) Lookup(key string) (string, error) {
+	enrichmentLookups.Add(c.name, 1)
+	c.mu.Lock()
+	v, ok := c.cache.Get(key)
+	c.mu.Unlock()
+	if ok {
+		return v.(string), nil
+	}
+	enrichmentCacheMisses.Add(c.name, 1)
+	s, err := c.e.Lookup(key)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.cache.Add(key, s)
+	c.mu.Unlock()
+	return s, nil
+}
+
+// Enrichment sets the loader to look up the values passed to the enrichment
+// builtin name, such as GeoIPCountry, with e.  Results are cached.  Programs
+// that call an enrichment builtin that has no Enricher get the empty string.
+func Enrichment(name string, e Enricher) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if !enrichmentBuiltins[name] {
+			return errors.Errorf("no enrichment builtin %q", name)
+		}
+		if l.enrichers == nil {
+			l.enrichers = make(map[string]Enricher)
+		}
+		l.enrichers[name] = &cachedEnricher{name: name, e: e, cache: lru.New(enrichmentCacheSize)}
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/watcher"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// fakeEnricher looks up keys in a map, and counts the lookups.
+type fakeEnricher struct {
+	values  map[string]string
+	lookups int
+}
+
+func (f *fakeEnricher) Lookup(key string) (string, error) {
+	f.lookups++
+	if key == "bad" {
+		return "", errors.New("lookup failed")
+	}
+	return f.values[key], nil
+}
+
+const enrichProg = `counter requests by country
+/^(\S+) / {
+  requests[geoip_country($1)]++
+}
+`
+
+func TestEnrichment(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	e := &fakeEnricher{values: map[string]string{"81.2.69.142": "GB", "216.160.83.56": "US"}}
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewMemMapFs(), Enrichment(GeoIPCountry, e))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("geo.mtail", strings.NewReader(enrichProg)); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"81.2.69.142", "216.160.83.56", "81.2.69.142", "192.0.2.1", "bad"} {
+		lines <- logline.NewLogLine("access.log", ip+" GET /")
+	}
+	close(lines)
+	<-l.VMsDone
+
+	m := store.Metrics["requests"][0]
+	got := map[string]string{}
+	for _, lv := range m.LabelValues {
+		got[lv.Labels[0]] = lv.Value.ValueString()
+	}
+	want := map[string]string{"GB": "2", "US": "1", "": "1"}
+	if len(got) != len(want) {
+		t.Errorf("requests %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("requests[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+	// The repeated address is looked up once.
+	if e.lookups != 4 {
+		t.Errorf("database looked up %d times, want 4", e.lookups)
+	}
+	if got := expvar.Get("prog_enrichment_lookups_total").(*expvar.Map).Get(GeoIPCountry).String(); got != "5" {
+		t.Errorf("lookups %s, want 5", got)
+	}
+}
+
+func TestEnrichmentWithoutDatabase(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("geo.mtail", strings.NewReader(enrichProg)); err != nil {
+		t.Fatal(err)
+	}
+	lines <- logline.NewLogLine("access.log", "81.2.69.142 GET /")
+	close(lines)
+	<-l.VMsDone
+	lv := store.Metrics["requests"][0].LabelValues
+	if len(lv) != 1 || lv[0].Labels[0] != "" {
+		t.Errorf("requests label values %v, want only the empty country", lv)
+	}
+}
+
+func TestEnrichmentUnknownBuiltin(t *testing.T) {
+	if _, err := NewLoader("", metrics.NewStore(), nil, watcher.NewFakeWatcher(), afero.NewMemMapFs(), Enrichment("geoip_planet", &fakeEnricher{})); err == nil {
+		t.Error("expected error for enrichment of an unknown builtin")
+	}
+}
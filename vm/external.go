@@ -0,0 +1,344 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bufio"
+	"expvar"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+// externalFileExt is the extension of external programs: executables that
+// read log lines on standard input and write metric updates to standard
+// output, for parsing that the mtail language can't express.
+const externalFileExt = ".exec"
+
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	// stopTimeout is how long an external program has to exit after its
+	// standard input is closed before it is killed.
+	stopTimeout = 5 * time.Second
+)
+
+var (
+	// externalRestarts counts the times each external program has been restarted.
+	externalRestarts = expvar.NewMap("prog_external_restarts_total")
+	// externalLinesDropped counts the log lines not sent to each external
+	// program because it wasn't running.
+	externalLinesDropped = expvar.NewMap("prog_external_lines_dropped_total")
+	// externalUpdateErrors counts the malformed metric updates written by each external program.
+	externalUpdateErrors = expvar.NewMap("prog_external_update_errors_total")
+)
+
+// externalProgram supervises an external program, sending it every log line
+// and applying the metric updates it writes to the store.  If the program
+// exits it is restarted, with an exponential backoff between restarts.
+type externalProgram struct {
+	name string // Name of the program, the basename of its file.
+	path string // Path to the executable.
+	ms   *metrics.Store
+
+	maxLabelValues         int
+	minRestart, maxRestart time.Duration
+	omitMetricSource       bool
+	metricPrefix           string // prepended to the name of each metric
+	maxMetrics             int    // limit on the number of metrics, or 0 for no limit
+
+	mu      sync.Mutex
+	metrics map[string]*metrics.Metric // Metrics created by updates, by name.
+}
+
+func newExternalProgram(name, path string, ms *metrics.Store) *externalProgram {
+	return &externalProgram{
+		name:       name,
+		path:       path,
+		ms:         ms,
+		minRestart: minRestartDelay,
+		maxRestart: maxRestartDelay,
+		metrics:    make(map[string]*metrics.Metric),
+	}
+}
+
+// Run starts the external program and feeds it lines until the lines channel
+// is closed, at which point the program's standard input is closed and it is
+// waited for.  Closes shutdown when done.
+func (p *externalProgram) Run(lines <-chan *logline.LogLine, shutdown chan<- struct{}) {
+	defer close(shutdown)
+
+	glog.Infof("Starting external program %s", p.name)
+	delay := p.minRestart
+	for {
+		started := time.Now()
+		cmd, stdin, exited, err := p.start()
+		if err != nil {
+			glog.Infof("Failed to start external program %s: %s", p.name, err)
+		} else if !p.feed(cmd, stdin, exited, lines) {
+			glog.Infof("Stopping external program %s", p.name)
+			return
+		}
+		// A program that ran for a while before exiting is restarted
+		// promptly; one that keeps exiting is restarted less and less often.
+		if time.Since(started) > p.maxRestart {
+			delay = p.minRestart
+		}
+		glog.Infof("External program %s exited, restarting in %s", p.name, delay)
+		if !p.drop(lines, delay) {
+			return
+		}
+		externalRestarts.Add(p.name, 1)
+		if delay *= 2; delay > p.maxRestart {
+			delay = p.maxRestart
+		}
+	}
+}
+
+// start starts the external program.  The returned channel is closed once
+// the program has exited and all of its output has been read.
+func (p *externalProgram) start() (*exec.Cmd, io.WriteCloser, <-chan struct{}, error) {
+	cmd := exec.Command(p.path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if err := p.apply(scanner.Text()); err != nil {
+				externalUpdateErrors.Add(p.name, 1)
+				glog.Infof("External program %s: %s", p.name, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			glog.Infof("Failed to read output of external program %s: %s", p.name, err)
+		}
+		if err := cmd.Wait(); err != nil {
+			glog.Infof("External program %s: %s", p.name, err)
+		}
+	}()
+	return cmd, stdin, exited, nil
+}
+
+// feed writes lines to the program's standard input until the program exits,
+// in which case it returns true, or the lines channel is closed, in which
+// case the program is stopped and it returns false.
+func (p *externalProgram) feed(cmd *exec.Cmd, stdin io.WriteCloser, exited <-chan struct{}, lines <-chan *logline.LogLine) bool {
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if err := stdin.Close(); err != nil {
+					glog.Info(err)
+				}
+				select {
+				case <-exited:
+				case <-time.After(stopTimeout):
+					glog.Infof("External program %s didn't exit, killing it", p.name)
+					if err := cmd.Process.Kill(); err != nil {
+						glog.Info(err)
+					}
+					<-exited
+				}
+				return false
+			}
+			if _, err := io.WriteString(stdin, line.Line+"\n"); err != nil {
+				// The program has closed its standard input, and is
+				// expected to exit.
+				externalLinesDropped.Add(p.name, 1)
+				if err := stdin.Close(); err != nil {
+					glog.V(2).Info(err)
+				}
+				<-exited
+				return true
+			}
+		case <-exited:
+			if err := stdin.Close(); err != nil {
+				glog.V(2).Info(err)
+			}
+			return true
+		}
+	}
+}
+
+// drop discards lines while the program is not running, so that other
+// programs aren't held up.  It returns false if the lines channel is closed
+// before the delay has passed.
+func (p *externalProgram) drop(lines <-chan *logline.LogLine, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return false
+			}
+			externalLinesDropped.Add(p.name, 1)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// metricUpdate is a change to a metric written by an external program, one
+// per line, in the form
+//
+//	inc NAME [KEY=VALUE ...] [DELTA]
+//	set NAME [KEY=VALUE ...] VALUE
+//
+// inc adds DELTA, or 1, to a counter, and set sets the value of a gauge.
+type metricUpdate struct {
+	op     string
+	name   string
+	keys   []string
+	labels []string
+	value  string
+}
+
+// parseUpdate parses a metricUpdate from a line of external program output.
+// The labels are sorted by key, so that their order in the line doesn't
+// matter.
+func parseUpdate(line string) (*metricUpdate, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.Errorf("malformed update %q", line)
+	}
+	u := &metricUpdate{op: fields[0], name: fields[1]}
+	labels := map[string]string{}
+	for _, f := range fields[2:] {
+		i := strings.Index(f, "=")
+		if i < 0 {
+			if u.value != "" {
+				return nil, errors.Errorf("malformed update %q: more than one value", line)
+			}
+			u.value = f
+			continue
+		}
+		if u.value != "" {
+			return nil, errors.Errorf("malformed update %q: label after value", line)
+		}
+		if i == 0 {
+			return nil, errors.Errorf("malformed update %q: empty label key", line)
+		}
+		labels[f[:i]] = f[i+1:]
+	}
+	for k := range labels {
+		u.keys = append(u.keys, k)
+	}
+	sort.Strings(u.keys)
+	for _, k := range u.keys {
+		u.labels = append(u.labels, labels[k])
+	}
+	switch u.op {
+	case "inc":
+		if u.value == "" {
+			u.value = "1"
+		}
+	case "set":
+		if u.value == "" {
+			return nil, errors.Errorf("malformed update %q: no value", line)
+		}
+	default:
+		return nil, errors.Errorf("malformed update %q: unknown operation %q", line, u.op)
+	}
+	return u, nil
+}
+
+// apply parses a line of program output and applies the update to the
+// metric it names, creating the metric if this is its first update.
+func (p *externalProgram) apply(line string) error {
+	u, err := parseUpdate(line)
+	if err != nil {
+		return err
+	}
+	kind := metrics.Counter
+	if u.op == "set" {
+		kind = metrics.Gauge
+	}
+	m, err := p.metric(u, kind)
+	if err != nil {
+		return err
+	}
+	d, err := m.GetDatum(u.labels...)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	switch m.Type {
+	case datum.Int:
+		v, err := strconv.ParseInt(u.value, 10, 64)
+		if err != nil {
+			return errors.Errorf("metric %s has integer values, not %q", u.name, u.value)
+		}
+		if u.op == "inc" {
+			datum.IncIntBy(d, v, now)
+		} else {
+			datum.SetInt(d, v, now)
+		}
+	case datum.Float:
+		v, err := strconv.ParseFloat(u.value, 64)
+		if err != nil {
+			return errors.Errorf("metric %s has float values, not %q", u.name, u.value)
+		}
+		if u.op == "inc" {
+			v += datum.GetFloat(d)
+		}
+		datum.SetFloat(d, v, now)
+	}
+	return nil
+}
+
+// metric returns the metric named by an update, creating it and adding it to
+// the store if needed.  The metric's type is chosen by the first value it is
+// given.
+func (p *externalProgram) metric(u *metricUpdate, kind metrics.Kind) (*metrics.Metric, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m, ok := p.metrics[u.name]; ok {
+		if m.Kind != kind {
+			return nil, errors.Errorf("metric %s is a %s, can't %s", u.name, m.Kind, u.op)
+		}
+		if strings.Join(m.Keys, " ") != strings.Join(u.keys, " ") {
+			return nil, errors.Errorf("metric %s has label keys %q, not %q", u.name, m.Keys, u.keys)
+		}
+		return m, nil
+	}
+	if p.maxMetrics > 0 && len(p.metrics) >= p.maxMetrics {
+		return nil, errors.Errorf("metric %s would be more than the limit of %d metrics", u.name, p.maxMetrics)
+	}
+	typ := datum.Float
+	if _, err := strconv.ParseInt(u.value, 10, 64); err == nil {
+		typ = datum.Int
+	}
+	m := metrics.NewMetric(p.metricPrefix+u.name, p.name, kind, typ, u.keys...)
+	m.Limit = p.maxLabelValues
+	if !p.omitMetricSource {
+		m.SetSource(p.path)
+	}
+	if err := p.ms.Add(m); err != nil {
+		return nil, err
+	}
+	p.metrics[u.name] = m
+	return m, nil
+}
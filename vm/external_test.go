@@ -0,0 +1,126 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+var parseUpdateTests = []struct {
+	line string
+	want *metricUpdate
+	err  bool
+}{
+	{"inc requests", &metricUpdate{op: "inc", name: "requests", value: "1"}, false},
+	{"inc requests 3", &metricUpdate{op: "inc", name: "requests", value: "3"}, false},
+	{"set size path=/ code=200 1.5",
+		&metricUpdate{op: "set", name: "size", keys: []string{"code", "path"}, labels: []string{"200", "/"}, value: "1.5"}, false},
+	{"set size", nil, true},
+	{"inc", nil, true},
+	{"add requests 1", nil, true},
+	{"inc requests 1 2", nil, true},
+	{"inc requests 1 a=b", nil, true},
+	{"inc requests =b", nil, true},
+}
+
+func TestParseUpdate(t *testing.T) {
+	for _, tc := range parseUpdateTests {
+		got, err := parseUpdate(tc.line)
+		if (err != nil) != tc.err {
+			t.Errorf("parseUpdate(%q) error = %v, want error %v", tc.line, err, tc.err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("parseUpdate(%q) = %+v, want %+v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestExternalProgramRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtail-external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Counts one line, then exits, so that it needs restarting for each line.
+	path := filepath.Join(dir, "once.exec")
+	script := "#!/bin/sh\nread line\necho \"inc lines_seen\"\necho \"set last_line len=${#line} 1.5\"\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store := metrics.NewStore()
+	p := newExternalProgram("once.exec", path, store)
+	p.minRestart = time.Millisecond
+	p.maxRestart = 10 * time.Millisecond
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go p.Run(lines, done)
+
+	seen := func() int64 {
+		p.mu.Lock()
+		m, ok := p.metrics["lines_seen"]
+		p.mu.Unlock()
+		if !ok {
+			return 0
+		}
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return datum.GetInt(d)
+	}
+	// Lines sent while the program is restarting are dropped, so keep
+	// sending until two instances have counted one each.
+	deadline := time.Now().Add(10 * time.Second)
+	for seen() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("external program not restarted, lines_seen = %d", seen())
+		}
+		lines <- logline.NewLogLine("f", "abc")
+		time.Sleep(time.Millisecond)
+	}
+	close(lines)
+	<-done
+
+	if len(store.Metrics["last_line"]) != 1 {
+		t.Fatalf("last_line not in store: %v", store.Metrics)
+	}
+	m := store.Metrics["last_line"][0]
+	if m.Kind != metrics.Gauge || m.Type != datum.Float || m.Source != path {
+		t.Errorf("unexpected metric %s", m)
+	}
+	d, err := m.GetDatum("3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := datum.GetFloat(d); v != 1.5 {
+		t.Errorf("last_line = %v, want 1.5", v)
+	}
+}
+
+func TestExternalProgramMismatchedUpdate(t *testing.T) {
+	p := newExternalProgram("test.exec", "/bin/true", metrics.NewStore())
+	if err := p.apply("inc requests code=200"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"set requests code=200 3",
+		"inc requests path=/",
+		"inc requests code=200 1.5",
+	} {
+		if err := p.apply(line); err == nil {
+			t.Errorf("apply(%q) succeeded, want error", line)
+		}
+	}
+}
@@ -15,6 +15,10 @@ func Fuzz(data []byte) int {
 	flag.Set("v", "2")
 	flag.Parse()
 	if _, err := Compile("fuzz", bytes.NewReader(data), false, false, false, nil); err != nil {
+		if _, ok := err.(*internalError); ok {
+			// Compile recovered from a panic; crash so go-fuzz records it.
+			panic(err)
+		}
 		return 0
 	}
 	return 1
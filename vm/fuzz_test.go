@@ -0,0 +1,42 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Only build with go1.18 or above because testing.F did not exist before.
+// +build go1.18
+
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzCompile checks that no program text makes the compiler panic.  Run it
+// with `go test -run XXX -fuzz FuzzCompile ./vm`; crashers found are written
+// to testdata/fuzz/FuzzCompile, and should be added to the checker or parser
+// tests once fixed.
+func FuzzCompile(f *testing.F) {
+	files, err := filepath.Glob("../examples/*.mtail")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	// Crashers found previously.
+	f.Add([]byte("def#\nA{} "))
+	f.Add([]byte("next\n"))
+	f.Add([]byte("def a {\n  next\n}\ndef b {\n  @a {\n    next\n  }\n}\n@b {\n}\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := Compile("fuzz", bytes.NewReader(data), false, false, false, nil)
+		if _, ok := err.(*internalError); ok {
+			t.Fatalf("Compile(%q) panicked: %s", data, err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/google/mtail/metrics/datum"
+)
+
+// maxHistories bounds the number of datums whose values are remembered for
+// the rate and ewma builtins; the least recently used are forgotten.
+const maxHistories = 10000
+
+// histories holds the values remembered for the rate and ewma builtins, by
+// historyKey.  It is shared by the workers of a VM, so that a datum updated
+// from log files handled by different workers has one history.
+type histories struct {
+	sync.Mutex
+	c *lru.Cache
+}
+
+func newHistories() *histories {
+	return &histories{c: lru.New(maxHistories)}
+}
+
+// historyKey identifies the values of a datum remembered by one call of rate
+// or ewma in a program.
+type historyKey struct {
+	pc int
+	d  datum.Datum
+}
+
+type sample struct {
+	t time.Time
+	v float64
+}
+
+// rateHistory holds the values of a datum over the window of a rate.
+type rateHistory struct {
+	samples []sample // oldest first
+	counter bool     // the datum is a counter's, so a decrease is a reset
+}
+
+// rate records the value v at time now, and returns the rate of change per
+// second since the newest value recorded at or before the start of the window.
+// For a counter, a decrease is taken to be a reset, and the history is
+// restarted; a gauge's rate is negative while it decreases.
+func (h *rateHistory) rate(now time.Time, v float64, window time.Duration) float64 {
+	if n := len(h.samples); h.counter && n > 0 && v < h.samples[n-1].v {
+		h.samples = h.samples[:0]
+	}
+	h.samples = append(h.samples, sample{now, v})
+	start := now.Add(-window)
+	for len(h.samples) > 1 && !h.samples[1].t.After(start) {
+		h.samples = h.samples[1:]
+	}
+	oldest := h.samples[0]
+	elapsed := now.Sub(oldest.t).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return (v - oldest.v) / elapsed
+}
+
+// ewmaHistory holds the exponentially weighted sum of the values of a datum.
+type ewmaHistory struct {
+	t      time.Time // time of the last value
+	sum    float64   // weighted sum of values
+	weight float64   // sum of weights
+}
+
+// average records the value v at time now, and returns the average of the
+// values recorded, each weighted by exp(-age/window).
+func (h *ewmaHistory) average(now time.Time, v float64, window time.Duration) float64 {
+	if h.weight > 0 {
+		decay := 1.0
+		if age := now.Sub(h.t); age > 0 {
+			decay = math.Exp(-float64(age) / float64(window))
+		}
+		h.sum *= decay
+		h.weight *= decay
+	}
+	h.t = now
+	h.sum += v
+	h.weight++
+	return h.sum / h.weight
+}
+
+// datumValue returns the numeric value of d.
+func datumValue(d datum.Datum) (float64, bool) {
+	switch d := d.(type) {
+	case *datum.IntDatum:
+		return float64(d.Get()), true
+	case *datum.FloatDatum:
+		return d.Get(), true
+	}
+	return 0, false
+}
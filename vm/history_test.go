@@ -0,0 +1,69 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateHistory(t *testing.T) {
+	start := time.Unix(1000, 0)
+	h := &rateHistory{counter: true}
+	for _, tc := range []struct {
+		seconds  int
+		value    float64
+		expected float64
+	}{
+		{0, 10, 0},
+		{10, 20, 1},
+		{30, 40, 1},
+		{70, 80, 1}, // the oldest sample in the minute window is at 10s
+		{80, 5, 0},  // a reset restarts the history
+		{90, 25, 2},
+	} {
+		got := h.rate(start.Add(time.Duration(tc.seconds)*time.Second), tc.value, time.Minute)
+		if got != tc.expected {
+			t.Errorf("at %ds: rate %g, want %g", tc.seconds, got, tc.expected)
+		}
+	}
+}
+
+func TestGaugeRateHistory(t *testing.T) {
+	start := time.Unix(1000, 0)
+	h := &rateHistory{}
+	for _, tc := range []struct {
+		seconds  int
+		value    float64
+		expected float64
+	}{
+		{0, 10, 0},
+		{10, 20, 1},
+		{20, 0, -0.5}, // a gauge's decrease is not a reset
+	} {
+		got := h.rate(start.Add(time.Duration(tc.seconds)*time.Second), tc.value, time.Minute)
+		if got != tc.expected {
+			t.Errorf("at %ds: rate %g, want %g", tc.seconds, got, tc.expected)
+		}
+	}
+}
+
+func TestEWMAHistory(t *testing.T) {
+	start := time.Unix(1000, 0)
+	h := &ewmaHistory{}
+	if got := h.average(start, 10, time.Minute); got != 10 {
+		t.Errorf("first average %g, want 10", got)
+	}
+	// Values at the same time are weighted equally.
+	if got := h.average(start, 20, time.Minute); got != 15 {
+		t.Errorf("second average %g, want 15", got)
+	}
+	// After one time constant the earlier values weigh 1/e each.
+	got := h.average(start.Add(time.Minute), 40, time.Minute)
+	w := math.Exp(-1)
+	if expected := (30*w + 40) / (2*w + 1); math.Abs(got-expected) > 1e-9 {
+		t.Errorf("third average %g, want %g", got, expected)
+	}
+}
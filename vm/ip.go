@@ -0,0 +1,41 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parseIP returns the IP address in s, which may be followed by a port, as in
+// "192.0.2.1:80" or "[2001:db8::1]:443", or nil if s isn't an IP address.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// network returns the network in CIDR notation, like "10.0.0.0/8", parsing
+// it on first use.
+func (v *VM) network(cidr string) (*net.IPNet, error) {
+	if n, ok := v.networks[cidr]; ok {
+		return n, nil
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Wrap(err, "cidrmatch")
+	}
+	if v.networks == nil {
+		v.networks = make(map[string]*net.IPNet)
+	}
+	v.networks[cidr] = n
+	return n, nil
+}
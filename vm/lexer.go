@@ -18,63 +18,71 @@ type lexeme int
 
 // Printable names for lexemes.
 var lexemeName = map[lexeme]string{
-	EOF:          "EOF",
-	INVALID:      "INVALID",
-	LCURLY:       "LCURLY",
-	RCURLY:       "RCURLY",
-	LPAREN:       "LPAREN",
-	RPAREN:       "RPAREN",
-	LSQUARE:      "LSQUARE",
-	RSQUARE:      "RSQUARE",
-	COMMA:        "COMMA",
-	INC:          "INC",
-	DEC:          "DEC",
-	MINUS:        "MINUS",
-	PLUS:         "PLUS",
-	MUL:          "MUL",
-	DIV:          "DIV",
-	MOD:          "MOD",
-	POW:          "POW",
-	SHL:          "SHL",
-	SHR:          "SHR",
-	BITAND:       "BITAND",
-	BITOR:        "BITOR",
-	AND:          "AND",
-	OR:           "OR",
-	ADD_ASSIGN:   "ADD_ASSIGN",
-	ASSIGN:       "ASSIGN",
-	LT:           "LT",
-	GT:           "GT",
-	LE:           "LE",
-	GE:           "GE",
-	EQ:           "EQ",
-	NE:           "NE",
-	REGEX:        "REGEX",
-	ID:           "ID",
-	CAPREF:       "CAPREF",
-	CAPREF_NAMED: "CAPREF_NAMED",
-	STRING:       "STRING",
-	BUILTIN:      "BUILTIN",
-	COUNTER:      "COUNTER",
-	GAUGE:        "GAUGE",
-	TIMER:        "TIMER",
-	AS:           "AS",
-	BY:           "BY",
-	HIDDEN:       "HIDDEN",
-	DEF:          "DEF",
-	DECO:         "DECO",
-	NEXT:         "NEXT",
-	CONST:        "CONST",
-	OTHERWISE:    "OTHERWISE",
-	ELSE:         "ELSE",
-	DEL:          "DEL",
-	INTLITERAL:   "INTLITERAL",
-	FLOATLITERAL: "FLOATLITERAL",
-	NL:           "NL",
-	CONCAT:       "CONCAT",
-	MATCH:        "MATCH",
-	NOT_MATCH:    "NOT_MATCH",
-	TEXT:         "TEXT",
+	EOF:             "EOF",
+	INVALID:         "INVALID",
+	LCURLY:          "LCURLY",
+	RCURLY:          "RCURLY",
+	LPAREN:          "LPAREN",
+	RPAREN:          "RPAREN",
+	LSQUARE:         "LSQUARE",
+	RSQUARE:         "RSQUARE",
+	COMMA:           "COMMA",
+	INC:             "INC",
+	DEC:             "DEC",
+	MINUS:           "MINUS",
+	PLUS:            "PLUS",
+	MUL:             "MUL",
+	DIV:             "DIV",
+	MOD:             "MOD",
+	POW:             "POW",
+	SHL:             "SHL",
+	SHR:             "SHR",
+	BITAND:          "BITAND",
+	BITOR:           "BITOR",
+	AND:             "AND",
+	OR:              "OR",
+	ADD_ASSIGN:      "ADD_ASSIGN",
+	ASSIGN:          "ASSIGN",
+	LT:              "LT",
+	GT:              "GT",
+	LE:              "LE",
+	GE:              "GE",
+	EQ:              "EQ",
+	NE:              "NE",
+	REGEX:           "REGEX",
+	ID:              "ID",
+	CAPREF:          "CAPREF",
+	CAPREF_NAMED:    "CAPREF_NAMED",
+	STRING:          "STRING",
+	BUILTIN:         "BUILTIN",
+	COUNTER:         "COUNTER",
+	GAUGE:           "GAUGE",
+	TIMER:           "TIMER",
+	AFTER:           "AFTER",
+	AS:              "AS",
+	BY:              "BY",
+	HIDDEN:          "HIDDEN",
+	INIT:            "INIT",
+	WINDOW:          "WINDOW",
+	KEEP:            "KEEP",
+	REFRESH:         "REFRESH",
+	UNIT:            "UNIT",
+	DEF:             "DEF",
+	DECO:            "DECO",
+	NEXT:            "NEXT",
+	CONST:           "CONST",
+	OTHERWISE:       "OTHERWISE",
+	ELSE:            "ELSE",
+	DEL:             "DEL",
+	STOP:            "STOP",
+	INTLITERAL:      "INTLITERAL",
+	FLOATLITERAL:    "FLOATLITERAL",
+	DURATIONLITERAL: "DURATIONLITERAL",
+	NL:              "NL",
+	CONCAT:          "CONCAT",
+	MATCH:           "MATCH",
+	NOT_MATCH:       "NOT_MATCH",
+	TEXT:            "TEXT",
 }
 
 func (t lexeme) String() string {
@@ -86,6 +94,7 @@ func (t lexeme) String() string {
 
 // List of keywords.  Keep this list sorted!
 var keywords = map[string]lexeme{
+	"after":     AFTER,
 	"as":        AS,
 	"by":        BY,
 	"const":     CONST,
@@ -95,19 +104,38 @@ var keywords = map[string]lexeme{
 	"else":      ELSE,
 	"gauge":     GAUGE,
 	"hidden":    HIDDEN,
+	"init":      INIT,
+	"keep":      KEEP,
 	"next":      NEXT,
 	"otherwise": OTHERWISE,
+	"refresh":   REFRESH,
+	"stop":      STOP,
 	"text":      TEXT,
 	"timer":     TIMER,
+	"unit":      UNIT,
+	"window":    WINDOW,
 }
 
 // List of builtin functions.  Keep this list sorted!
 var builtins = []string{
 	"bool",
+	"bytesize",
+	"cidrmatch",
+	"duration",
+	"emit",
+	"ewma",
 	"float",
+	"geoip_country",
+	"getcontainer",
+	"getenv",
 	"getfilename",
+	"getnamespace",
+	"getpod",
+	"hostname",
 	"int",
 	"len",
+	"parseip",
+	"rate",
 	"settime",
 	"string",
 	"strptime",
@@ -465,6 +493,10 @@ Loop:
 			}
 			kind = FLOATLITERAL
 			l.accept()
+		case isAlpha(r):
+			// A number followed by units, like 1h30m, is a duration.
+			kind = DURATIONLITERAL
+			l.accept()
 		default:
 			l.backup()
 			break Loop
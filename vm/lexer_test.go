@@ -66,7 +66,7 @@ var lexerTests = []lexerTest{
 		{DEC, "--", position{"operators", 0, 63, 64}},
 		{EOF, "", position{"operators", 0, 65, 65}}}},
 	{"keywords",
-		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\n", []token{
+		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nstop\ninit\nafter\n", []token{
 			{COUNTER, "counter", position{"keywords", 0, 0, 6}},
 			{NL, "\n", position{"keywords", 1, 7, -1}},
 			{GAUGE, "gauge", position{"keywords", 1, 0, 4}},
@@ -93,9 +93,15 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position{"keywords", 12, 3, -1}},
 			{TEXT, "text", position{"keywords", 12, 0, 3}},
 			{NL, "\n", position{"keywords", 13, 4, -1}},
-			{EOF, "", position{"keywords", 13, 0, 0}}}},
+			{STOP, "stop", position{"keywords", 13, 0, 3}},
+			{NL, "\n", position{"keywords", 14, 4, -1}},
+			{INIT, "init", position{"keywords", 14, 0, 3}},
+			{NL, "\n", position{"keywords", 15, 4, -1}},
+			{AFTER, "after", position{"keywords", 15, 0, 4}},
+			{NL, "\n", position{"keywords", 16, 5, -1}},
+			{EOF, "", position{"keywords", 16, 0, 0}}}},
 	{"builtins",
-		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nbool\nfloat\nstring\n", []token{
+		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nbool\nfloat\nstring\ngetpod\ngetnamespace\ngetcontainer\n", []token{
 			{BUILTIN, "strptime", position{"builtins", 0, 0, 7}},
 			{NL, "\n", position{"builtins", 1, 8, -1}},
 			{BUILTIN, "timestamp", position{"builtins", 1, 0, 8}},
@@ -118,7 +124,13 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position{"builtins", 10, 5, -1}},
 			{BUILTIN, "string", position{"builtins", 10, 0, 5}},
 			{NL, "\n", position{"builtins", 11, 6, -1}},
-			{EOF, "", position{"builtins", 11, 0, 0}}}},
+			{BUILTIN, "getpod", position{"builtins", 11, 0, 5}},
+			{NL, "\n", position{"builtins", 12, 6, -1}},
+			{BUILTIN, "getnamespace", position{"builtins", 12, 0, 11}},
+			{NL, "\n", position{"builtins", 13, 12, -1}},
+			{BUILTIN, "getcontainer", position{"builtins", 13, 0, 11}},
+			{NL, "\n", position{"builtins", 14, 12, -1}},
+			{EOF, "", position{"builtins", 14, 0, 0}}}},
 	{"numbers", "1 23 3.14 1.61.1 -1 -1.0", []token{
 		{INTLITERAL, "1", position{"numbers", 0, 0, 0}},
 		{INTLITERAL, "23", position{"numbers", 0, 2, 3}},
@@ -129,6 +141,13 @@ var lexerTests = []lexerTest{
 		{FLOATLITERAL, "-1.0", position{"numbers", 0, 20, 23}},
 		{EOF, "", position{"numbers", 0, 24, 24}},
 	}},
+	{"durations", "1h 30s 1h30m 1.5m", []token{
+		{DURATIONLITERAL, "1h", position{"durations", 0, 0, 1}},
+		{DURATIONLITERAL, "30s", position{"durations", 0, 3, 5}},
+		{DURATIONLITERAL, "1h30m", position{"durations", 0, 7, 11}},
+		{DURATIONLITERAL, "1.5m", position{"durations", 0, 13, 16}},
+		{EOF, "", position{"durations", 0, 17, 17}},
+	}},
 	{"identifier", "a be foo\nquux line_count", []token{
 		{ID, "a", position{"identifier", 0, 0, 0}},
 		{ID, "be", position{"identifier", 0, 2, 3}},
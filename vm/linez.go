@@ -0,0 +1,100 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/google/mtail/logline"
+)
+
+// maxLineSources bounds the number of sources whose recent lines are kept;
+// the sources least recently written to are forgotten.
+const maxLineSources = 1000
+
+// sourceLines holds the most recent lines received from each source, for
+// debugging.
+type sourceLines struct {
+	mu      sync.Mutex
+	size    int                  // lines kept per source
+	rings   map[string]*lineRing // by source name
+	recency *lru.Cache           // source names, to evict the least recently used
+}
+
+func newSourceLines(size int) *sourceLines {
+	s := &sourceLines{size: size, rings: make(map[string]*lineRing), recency: lru.New(maxLineSources)}
+	s.recency.OnEvicted = func(key lru.Key, _ interface{}) {
+		delete(s.rings, key.(string))
+	}
+	return s
+}
+
+// add records a line in the ring of its source.
+func (s *sourceLines) add(line *logline.LogLine) {
+	s.mu.Lock()
+	r, ok := s.rings[line.Filename]
+	if !ok {
+		r = newLineRing(s.size)
+		s.rings[line.Filename] = r
+	}
+	s.recency.Add(line.Filename, nil)
+	s.mu.Unlock()
+	r.add(line)
+}
+
+// LinesPerSource keeps the n most recent log lines received from each
+// source, to be shown by RecentLines.
+func LinesPerSource(n int) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if n > 0 {
+			l.sourceLines = newSourceLines(n)
+		}
+		return nil
+	}
+}
+
+// RecentLines returns up to n of the most recent lines, oldest first, from
+// each source whose name matches the glob pattern source, or from every source
+// if it is empty.  If re is not nil, only lines it matches are returned.  If
+// n is zero or negative, all the lines held are returned.
+func (l *MasterControl) RecentLines(source string, re *regexp.Regexp, n int) (map[string][]string, error) {
+	result := make(map[string][]string)
+	if l.sourceLines == nil {
+		return result, nil
+	}
+	rings := make(map[string]*lineRing)
+	l.sourceLines.mu.Lock()
+	for name, r := range l.sourceLines.rings {
+		if source != "" && name != source {
+			matched, err := filepath.Match(source, name)
+			if err != nil {
+				l.sourceLines.mu.Unlock()
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		}
+		rings[name] = r
+	}
+	l.sourceLines.mu.Unlock()
+	for name, r := range rings {
+		var lines []string
+		for _, line := range r.last(0) {
+			if re == nil || re.MatchString(line.Line) {
+				lines = append(lines, line.Line)
+			}
+		}
+		if n > 0 && len(lines) > n {
+			lines = lines[len(lines)-n:]
+		}
+		if len(lines) > 0 {
+			result[name] = lines
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+)
+
+func TestRecentLines(t *testing.T) {
+	l := &MasterControl{}
+	if err := l.SetOption(LinesPerSource(2)); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []*logline.LogLine{
+		logline.NewLogLine("/var/log/a.log", "GET /1"),
+		logline.NewLogLine("/var/log/b.log", "POST /2"),
+		logline.NewLogLine("/var/log/a.log", "POST /3"),
+		logline.NewLogLine("/var/log/a.log", "GET /4"),
+		logline.NewLogLine("udp://10.0.0.1:5140", "GET /5"),
+	} {
+		l.sourceLines.add(line)
+	}
+	for _, tc := range []struct {
+		name     string
+		source   string
+		re       string
+		n        int
+		expected map[string][]string
+	}{
+		{"all", "", "", 0, map[string][]string{
+			"/var/log/a.log":      {"POST /3", "GET /4"},
+			"/var/log/b.log":      {"POST /2"},
+			"udp://10.0.0.1:5140": {"GET /5"},
+		}},
+		{"exact source", "/var/log/b.log", "", 0, map[string][]string{
+			"/var/log/b.log": {"POST /2"},
+		}},
+		{"glob source", "/var/log/*", "", 1, map[string][]string{
+			"/var/log/a.log": {"GET /4"},
+			"/var/log/b.log": {"POST /2"},
+		}},
+		{"match", "", "^POST", 0, map[string][]string{
+			"/var/log/a.log": {"POST /3"},
+			"/var/log/b.log": {"POST /2"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var re *regexp.Regexp
+			if tc.re != "" {
+				re = regexp.MustCompile(tc.re)
+			}
+			got, err := l.RecentLines(tc.source, re, tc.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := go_cmp.Diff(tc.expected, got); diff != "" {
+				t.Errorf("lines differ:\n%s", diff)
+			}
+		})
+	}
+	if _, err := l.RecentLines("[", nil, 0); err == nil {
+		t.Error("bad source pattern accepted")
+	}
+}
+
+func TestRecentLinesForgetsSources(t *testing.T) {
+	s := newSourceLines(1)
+	for i := 0; i <= maxLineSources; i++ {
+		s.add(logline.NewLogLine(fmt.Sprintf("/var/log/%d.log", i), "line"))
+	}
+	if len(s.rings) != maxLineSources {
+		t.Errorf("kept lines from %d sources, want %d", len(s.rings), maxLineSources)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// LintFinding describes a likely performance or correctness problem found in
+// a program by Lint.
+type LintFinding struct {
+	Program  string `json:"program"`
+	Position string `json:"position,omitempty"`
+	Check    string `json:"check"` // One of the checks below, or compile for a compile error.
+	Message  string `json:"message"`
+
+	pos position
+}
+
+// The checks made by Lint.
+const (
+	lintCompile          = "compile"
+	lintLeadingWildcard  = "leading-wildcard"
+	lintOverlapping      = "overlapping-patterns"
+	lintUnusedCapture    = "unused-capture"
+	lintUnusedMetric     = "unused-metric"
+	lintShadowedBlock    = "shadowed-block"
+	lintUnreachableStmts = "unreachable"
+)
+
+// Lint compiles the program read from input, and returns the problems found
+// in it, in the order they appear in the program.  A program that fails to
+// compile has a finding for each compile error.
+func Lint(name string, input io.Reader) []LintFinding {
+	name = filepath.Base(name)
+	ast, err := Parse(name, input)
+	if err == nil {
+		err = Check(ast)
+	}
+	l := &linter{name: name, reads: make(map[*Symbol]int), writes: make(map[*Symbol]int)}
+	if el, ok := err.(ErrorList); ok {
+		for _, e := range el {
+			l.add(&e.pos, lintCompile, "%s", e.msg)
+		}
+	} else if err != nil {
+		return []LintFinding{{Program: name, Check: lintCompile, Message: err.Error()}}
+	} else {
+		Walk(l, ast)
+		l.checkUnused()
+	}
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		a, b := l.findings[i].pos, l.findings[j].pos
+		return a.line < b.line || (a.line == b.line && a.startcol < b.startcol)
+	})
+	return l.findings
+}
+
+// LintPrograms lints the program or package at path, or each program and
+// package in the directory at path, and writes each finding to w as a line of
+// JSON.  It returns the number of findings.
+func LintPrograms(path string, w io.Writer) (int, error) {
+	s, err := os.Stat(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to stat %q", path)
+	}
+	// A loader is only used to read packages, so needs no store or watcher.
+	l := &MasterControl{fs: afero.NewOsFs()}
+	programs := []string{path}
+	if s.IsDir() && !l.isPackage(path) {
+		fis, err := ioutil.ReadDir(path)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to list programs in %q", path)
+		}
+		programs = programs[:0]
+		for _, fi := range fis {
+			if strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			p := filepath.Join(path, fi.Name())
+			if fi.IsDir() && l.isPackage(p) || !fi.IsDir() && filepath.Ext(fi.Name()) == fileExt {
+				programs = append(programs, p)
+			}
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	count := 0
+	for _, p := range programs {
+		findings, err := l.lint(p)
+		if err != nil {
+			return count, err
+		}
+		for _, finding := range findings {
+			if err := enc.Encode(finding); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// lint lints the program or package at path.  The findings in a package are
+// positioned in the files the manifest names.
+func (l *MasterControl) lint(path string) ([]LintFinding, error) {
+	if !l.isPackage(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %q", path)
+		}
+		defer f.Close()
+		return Lint(path, f), nil
+	}
+	_, src, err := l.readPackage(path)
+	if err != nil {
+		return nil, err
+	}
+	findings := Lint(src.name, src)
+	for i := range findings {
+		if findings[i].Position != "" {
+			src.reposition(&findings[i].pos)
+			findings[i].Position = findings[i].pos.String()
+		}
+	}
+	return findings, nil
+}
+
+// linter is a Visitor that looks for problems in a program that has been
+// checked.
+type linter struct {
+	name     string
+	findings []LintFinding
+
+	decls  []*declNode
+	scopes []*Scope
+	reads  map[*Symbol]int // The number of times each variable is referenced.
+	writes map[*Symbol]int // The number of times each variable is assigned.
+}
+
+func (l *linter) add(pos *position, check, format string, args ...interface{}) {
+	l.findings = append(l.findings, LintFinding{
+		Program:  l.name,
+		Position: pos.String(),
+		Check:    check,
+		Message:  fmt.Sprintf(format, args...),
+		pos:      *pos,
+	})
+}
+
+// VisitBefore implements the Visitor interface.
+func (l *linter) VisitBefore(node astNode) Visitor {
+	switch n := node.(type) {
+	case *stmtlistNode:
+		l.scopes = append(l.scopes, n.s)
+		l.checkSiblings(n.children)
+
+	case *condNode:
+		l.scopes = append(l.scopes, n.s)
+
+	case *declNode:
+		l.decls = append(l.decls, n)
+
+	case *patternExprNode:
+		if leadingWildcard(n.pattern) {
+			l.add(n.Pos(), lintLeadingWildcard, "Pattern `/%s/' starts with `.*', which makes every line slower to match without changing what it matches.  Remove the `.*'.", n.pattern)
+		}
+
+	case *idNode:
+		if n.sym != nil && n.sym.Kind == VarSymbol {
+			l.reads[n.sym]++
+		}
+
+	case *binaryExprNode:
+		if n.op == ASSIGN || n.op == ADD_ASSIGN {
+			l.written(n.lhs)
+		}
+
+	case *unaryExprNode:
+		if n.op == INC || n.op == DEC {
+			l.written(n.expr)
+		}
+	}
+	return l
+}
+
+// VisitAfter implements the Visitor interface.
+func (l *linter) VisitAfter(node astNode) {}
+
+// written records that the variable in the expression n is assigned.
+func (l *linter) written(n astNode) {
+	if ie, ok := n.(*indexedExprNode); ok {
+		n = ie.lhs
+	}
+	if id, ok := n.(*idNode); ok && id.sym != nil {
+		l.writes[id.sym]++
+	}
+}
+
+// checkSiblings looks for statements in a block that can't run, and for
+// conditions that match the same lines as an earlier condition in the block.
+func (l *linter) checkSiblings(stmts []astNode) {
+	earlier := make(map[string]*condNode)
+	for i, stmt := range stmts {
+		switch n := stmt.(type) {
+		case *stopNode:
+			if i < len(stmts)-1 {
+				l.add(stmts[i+1].Pos(), lintUnreachableStmts, "Statements after the `stop' at %s are never run.", n.Pos())
+			}
+		case *condNode:
+			pe, ok := n.cond.(*patternExprNode)
+			if !ok || pe.pattern == "" {
+				continue
+			}
+			prev, ok := earlier[pe.pattern]
+			if !ok {
+				earlier[pe.pattern] = n
+				continue
+			}
+			if endsInStop(prev) {
+				l.add(pe.Pos(), lintShadowedBlock, "This block is never run, because the block at %s matches the same lines and stops.", prev.cond.Pos())
+			} else {
+				l.add(pe.Pos(), lintOverlapping, "Pattern `/%s/' is the same as the pattern at %s, so it is matched against each line twice.  Combine the two blocks.", pe.pattern, prev.cond.Pos())
+			}
+		}
+	}
+}
+
+// endsInStop reports whether the block run when n matches ends with stop.
+func endsInStop(n *condNode) bool {
+	s, ok := n.truthNode.(*stmtlistNode)
+	if !ok || len(s.children) == 0 {
+		return false
+	}
+	_, ok = s.children[len(s.children)-1].(*stopNode)
+	return ok
+}
+
+// checkUnused reports capture groups that are never referenced, and metrics
+// that are never updated, or are hidden and never read.
+func (l *linter) checkUnused() {
+	seen := make(map[*Symbol]bool)
+	for _, s := range l.scopes {
+		if s == nil {
+			continue
+		}
+		var unused []*Symbol
+		for _, sym := range s.Symbols {
+			// The zeroth capture group is the whole match, and isn't declared by the program.
+			if sym.Kind != CaprefSymbol || sym.Used || sym.Addr == 0 || seen[sym] {
+				continue
+			}
+			seen[sym] = true
+			unused = append(unused, sym)
+		}
+		sort.Slice(unused, func(i, j int) bool { return unused[i].Addr < unused[j].Addr })
+		for _, sym := range unused {
+			l.add(sym.Pos, lintUnusedCapture, "Capture group `$%s' is never used.  Use a non-capturing group `(?:...)' instead.", sym.Name)
+		}
+	}
+	for _, d := range l.decls {
+		if d.sym == nil {
+			continue
+		}
+		switch {
+		case l.writes[d.sym] == 0:
+			l.add(d.Pos(), lintUnusedMetric, "Metric `%s' is never updated, so only ever has its initial value, if any.", d.name)
+		case d.hidden && l.reads[d.sym] == l.writes[d.sym]:
+			l.add(d.Pos(), lintUnusedMetric, "Hidden metric `%s' is updated but never read, so has no effect.", d.name)
+		}
+	}
+}
+
+// leadingWildcard reports whether the unanchored pattern starts with a `.*'
+// outside of a capture group, which it doesn't need.  A `.*' followed by a
+// capture group is kept, as it changes what the group captures: `.*(\d+)'
+// captures the last digit of the line, not the first number.
+func leadingWildcard(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpStar {
+		return false
+	}
+	if op := re.Sub[0].Sub[0].Op; op != syntax.OpAnyChar && op != syntax.OpAnyCharNotNL {
+		return false
+	}
+	for _, sub := range re.Sub[1:] {
+		if hasCapture(sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasCapture reports whether re contains a capture group.
+func hasCapture(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpCapture {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasCapture(sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+)
+
+var lintTests = []struct {
+	name    string
+	program string
+	want    []string // check and position of each finding
+}{
+	{"clean",
+		`counter c
+/^foo (?P<n>\d+)/ {
+  c += $n
+}
+`,
+		nil},
+
+	{"compile error",
+		`counter c
+/foo/ {
+  d++
+}
+`,
+		[]string{"compile compile error:1:9", "compile compile error:3:3"}},
+
+	{"leading wildcard",
+		`counter c
+/.*foo/ {
+  c++
+}
+/^.*bar/ {
+  c++
+}
+/(.*)baz/ {
+  c++
+}
+/.*qux (\d+)/ {
+  c += $1
+}
+/.*quux (?:\d+)/ {
+  c++
+}
+`,
+		[]string{"leading-wildcard leading wildcard:2:1-7", "unused-capture leading wildcard:8:1-9", "leading-wildcard leading wildcard:14:1-16"}},
+
+	{"overlapping patterns",
+		`counter c
+counter d
+/foo/ {
+  c++
+}
+/foo/ {
+  d++
+}
+`,
+		[]string{"overlapping-patterns overlapping patterns:6:1-5"}},
+
+	{"shadowed block",
+		`counter c
+counter d
+/foo/ {
+  c++
+  stop
+}
+/foo/ {
+  d++
+}
+`,
+		[]string{"shadowed-block shadowed block:7:1-5"}},
+
+	{"unreachable",
+		`counter c
+counter d
+/foo/ {
+  c++
+  stop
+  d++
+}
+`,
+		[]string{"unreachable unreachable:6:3-5"}},
+
+	{"unused metrics",
+		`counter c
+counter never_updated
+hidden gauge never_read
+/foo/ {
+  c++
+  never_read = 1
+}
+/bar/ && never_updated > 0 {
+  c++
+}
+`,
+		[]string{"unused-metric unused metrics:2:9-21", "unused-metric unused metrics:3:14-23"}},
+}
+
+func TestLint(t *testing.T) {
+	for _, tc := range lintTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var got []string
+			for _, f := range Lint(tc.name, strings.NewReader(tc.program)) {
+				t.Log(f.Message)
+				got = append(got, f.Check+" "+f.Position)
+			}
+			if diff := go_cmp.Diff(tc.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestLintPrograms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, program := range map[string]string{
+		"good.mtail":         "counter c\n/foo/ {\n  c++\n}\n",
+		"bad.mtail":          "counter c\n/.*foo/ {\n  c++\n}\n",
+		".hidden.mtail":      "counter c\n/.*foo/ {\n  c++\n}\n",
+		"README":             "/.*foo/",
+		"web/MANIFEST":       "include patterns.mtail\nprogram requests.mtail\n",
+		"web/patterns.mtail": "const BAR /bar/\n",
+		"web/requests.mtail": "counter c\n/.*/ + BAR {\n  c++\n}\n",
+		"notes/bad.mtail":    "counter c\n/.*foo/ {\n  c++\n}\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(program), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	n, err := LintPrograms(dir, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("LintPrograms() = %d, want 2:\n%s", n, buf.String())
+	}
+	var got []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var f LintFinding
+		if err := dec.Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, f.Program+" "+f.Check+" "+f.Position)
+	}
+	want := []string{
+		"bad.mtail leading-wildcard bad.mtail:2:1-7",
+		"web leading-wildcard web/requests.mtail:2:1-10",
+	}
+	if diff := go_cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
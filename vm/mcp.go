@@ -11,23 +11,33 @@ package vm
 // of mtail programs.
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"expvar"
+	"fmt"
+	"hash"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 
+	"github.com/google/mtail/audit"
 	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
 	"github.com/google/mtail/watcher"
 )
 
@@ -39,35 +49,80 @@ var (
 	// ProgLoadErrors counts the number of program load errors.
 	ProgLoadErrors    = expvar.NewMap("prog_load_errors")
 	progRuntimeErrors = expvar.NewMap("prog_runtime_errors")
+	// ProgsSkipped is the number of programs whose last load failed.
+	ProgsSkipped = expvar.NewInt("prog_load_skipped")
+	// lineBudgetExceeded counts the lines abandoned by each program for taking too long.
+	lineBudgetExceeded = expvar.NewMap("prog_line_budget_exceeded_total")
+	// instructionBudgetExceeded counts the lines abandoned by each program for executing too many instructions.
+	instructionBudgetExceeded = expvar.NewMap("prog_instruction_budget_exceeded_total")
+	// progsPausedOverBudget counts the times each program was paused for exceeding its budgets.
+	progsPausedOverBudget = expvar.NewMap("prog_paused_over_budget_total")
+	// progLines counts the lines sent to each program.
+	progLines = expvar.NewMap("prog_lines_total")
+	// progsLoaded is the number of programs running.
+	progsLoaded = expvar.NewInt("prog_loaded")
+	// dispatchSeconds is the total time spent waiting for the programs to accept the lines sent to them.
+	dispatchSeconds = expvar.NewFloat("line_dispatch_seconds_total")
 )
 
 const (
 	fileExt = ".mtail"
 )
 
-// LoadAllPrograms loads all programs in a directory and starts watching the
-// directory for filesystem changes.  Any compile errors are stored for later retrieival.
-// This function returns an error if an internal error occurs.
+// LoadAllPrograms loads all programs in each program directory and starts
+// watching the directories for filesystem changes.  Any compile errors are
+// stored for later retrieival.  This function returns an error if an internal
+// error occurs, or if the load policy is LoadStrict and any program failed to
+// load.
 func (l *MasterControl) LoadAllPrograms() error {
-	s, err := os.Stat(l.programPath)
+	for _, d := range l.dirs() {
+		if err := l.loadDir(d.Path); err != nil {
+			return err
+		}
+	}
+	if l.loadPolicy == LoadStrict {
+		if errs := l.ProgramErrors(); len(errs) > 0 {
+			msgs := make([]string, 0, len(errs))
+			for name, err := range errs {
+				msgs = append(msgs, fmt.Sprintf("%s: %s", name, err))
+			}
+			sort.Strings(msgs)
+			return errors.Errorf("%d programs failed to load with the strict load policy:\n%s", len(msgs), strings.Join(msgs, "\n"))
+		}
+	}
+	return nil
+}
+
+// loadDir loads all programs in the directory programPath, or the single
+// program at programPath, and starts watching it for filesystem changes.
+func (l *MasterControl) loadDir(programPath string) error {
+	s, err := os.Stat(programPath)
 	if err != nil {
-		return errors.Wrapf(err, "failed to stat %q", l.programPath)
+		return errors.Wrapf(err, "failed to stat %q", programPath)
 	}
-	if err = l.w.Add(l.programPath, l.eventsHandle); err != nil {
-		glog.Infof("Failed to add watch on %q but continuing: %s", l.programPath, err)
+	if err = l.w.Add(programPath, l.eventsHandle); err != nil {
+		glog.Infof("Failed to add watch on %q but continuing: %s", programPath, err)
 	}
 	switch {
+	case s.IsDir() && l.isPackage(programPath):
+		err = l.LoadProgram(programPath)
+		if err != nil {
+			if l.errorsAbort {
+				return err
+			}
+			glog.Warning(err)
+		}
 	case s.IsDir():
-		fis, rerr := ioutil.ReadDir(l.programPath)
+		fis, rerr := ioutil.ReadDir(programPath)
 		if rerr != nil {
-			return errors.Wrapf(rerr, "Failed to list programs in %q", l.programPath)
+			return errors.Wrapf(rerr, "Failed to list programs in %q", programPath)
 		}
 
 		for _, fi := range fis {
-			if fi.IsDir() {
+			if fi.IsDir() && !l.isPackage(path.Join(programPath, fi.Name())) {
 				continue
 			}
-			err = l.LoadProgram(path.Join(l.programPath, fi.Name()))
+			err = l.LoadProgram(path.Join(programPath, fi.Name()))
 			if err != nil {
 				if l.errorsAbort {
 					return err
@@ -76,7 +131,7 @@ func (l *MasterControl) LoadAllPrograms() error {
 			}
 		}
 	default:
-		err = l.LoadProgram(l.programPath)
+		err = l.LoadProgram(programPath)
 		if err != nil {
 			if l.errorsAbort {
 				return err
@@ -88,21 +143,42 @@ func (l *MasterControl) LoadAllPrograms() error {
 }
 
 // LoadProgram loads or reloads a program from the path specified.  The name of
-// the program is the basename of the file.
+// the program is the basename of the file, prefixed by the basename of its
+// program directory if that isn't the loader's program path.  If the path is
+// a program package, or a file in one, the package is loaded.
 func (l *MasterControl) LoadProgram(programPath string) error {
-	name := filepath.Base(programPath)
-	if strings.HasPrefix(name, ".") {
+	if dir := l.packageFor(programPath); dir != "" {
+		return l.loadPackage(dir)
+	}
+	if base := filepath.Base(programPath); strings.HasPrefix(base, ".") {
 		glog.V(2).Infof("Skipping %s because it is a hidden file.", programPath)
 		return nil
 	}
-	if filepath.Ext(name) != fileExt {
+	if ext := filepath.Ext(programPath); ext != fileExt && ext != externalFileExt {
 		glog.V(2).Infof("Skipping %s due to file extension.", programPath)
 		return nil
 	}
+	name := l.programName(programPath)
+	d := l.dirFor(programPath)
+	if filepath.Ext(name) == externalFileExt {
+		l.programErrorMu.Lock()
+		defer l.programErrorMu.Unlock()
+		l.programErrors[name] = l.runExternal(name, programPath, d)
+		l.countSkipped()
+		if l.programErrors[name] != nil && l.errorsAbort {
+			return l.programErrors[name]
+		}
+		return nil
+	}
 	f, err := l.fs.Open(programPath)
 	if err != nil {
 		ProgLoadErrors.Add(name, 1)
-		return errors.Wrapf(err, "Failed to read program %q", programPath)
+		err = errors.Wrapf(err, "Failed to read program %q", programPath)
+		l.programErrorMu.Lock()
+		defer l.programErrorMu.Unlock()
+		l.programErrors[name] = err
+		l.countSkipped()
+		return err
 	}
 	defer func() {
 		if err := f.Close(); err != nil {
@@ -111,7 +187,8 @@ func (l *MasterControl) LoadProgram(programPath string) error {
 	}()
 	l.programErrorMu.Lock()
 	defer l.programErrorMu.Unlock()
-	l.programErrors[name] = l.CompileAndRun(name, f)
+	l.programErrors[name] = l.compileAndRun(name, f, d)
+	l.countSkipped()
 	if l.programErrors[name] != nil {
 		if l.errorsAbort {
 			return l.programErrors[name]
@@ -121,8 +198,24 @@ func (l *MasterControl) LoadProgram(programPath string) error {
 	return nil
 }
 
+// countSkipped updates ProgsSkipped from the program errors.  The caller must
+// hold programErrorMu.
+func (l *MasterControl) countSkipped() {
+	var n int64
+	for _, err := range l.programErrors {
+		if err != nil {
+			n++
+		}
+	}
+	ProgsSkipped.Set(n)
+}
+
 const loaderTemplate = `
 <h2 id="loader">Program Loader</h2>
+{{if $.Skipped}}
+<p style="color: red"><b>{{len $.Skipped}} programs failed to load:</b>
+{{range $i, $name := $.Skipped}}{{if $i}}, {{end}}<a href="#prog-{{$name}}">{{$name}}</a>{{end}}</p>
+{{end}}
 <table border=1>
 <tr>
 <th>program name</th>
@@ -130,9 +223,12 @@ const loaderTemplate = `
 <th>load errors</th>
 <th>load successes</th>
 <th>runtime errors</th>
+<th>last match</th>
+<th>match rate</th>
+<th>state</th>
 </tr>
-<tr>
 {{range $name, $errors := $.Errors}}
+<tr id="prog-{{$name}}">
 <td>{{$name}}</td>
 <td>
 {{if $errors}}
@@ -144,6 +240,22 @@ No compile errors
 <td>{{index $.Loaderrors $name}}</td>
 <td>{{index $.Loadsuccess $name}}</td>
 <td>{{index $.RuntimeErrors $name}}</td>
+<td>{{index $.LastMatch $name}}</td>
+<td>{{if index $.Anomalous $name}}<b style="color: red">{{index $.MatchRate $name}}</b>{{else}}{{index $.MatchRate $name}}{{end}}</td>
+<td>
+{{with index $.State $name}}
+<form method="post" action="/programs">
+{{if eq . "over budget"}}<b style="color: red">paused: over budget</b>{{else}}{{.}}{{end}}
+<input type="hidden" name="name" value="{{$name}}">
+<input type="password" name="token" placeholder="admin token" size="12">
+{{if eq . "running"}}
+<button type="submit" name="action" value="pause">Pause</button>
+{{else}}
+<button type="submit" name="action" value="resume">Resume</button>
+{{end}}
+</form>
+{{end}}
+</td>
 </tr>
 {{end}}
 </table>
@@ -162,13 +274,28 @@ func (l *MasterControl) WriteStatusHTML(w io.Writer) error {
 		Loaderrors    map[string]string
 		Loadsuccess   map[string]string
 		RuntimeErrors map[string]string
+		LastMatch     map[string]string
+		MatchRate     map[string]string
+		Anomalous     map[string]bool
+		State         map[string]string
+		Skipped       []string
 	}{
 		l.programErrors,
 		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
+		make(map[string]string),
+		make(map[string]string),
+		make(map[string]bool),
+		make(map[string]string),
+		nil,
 	}
-	for name := range l.programErrors {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	for name, err := range l.programErrors {
+		if err != nil {
+			data.Skipped = append(data.Skipped, name)
+		}
 		if ProgLoadErrors.Get(name) != nil {
 			data.Loaderrors[name] = ProgLoadErrors.Get(name).String()
 		}
@@ -178,18 +305,75 @@ func (l *MasterControl) WriteStatusHTML(w io.Writer) error {
 		if progRuntimeErrors.Get(name) != nil {
 			data.RuntimeErrors[name] = progRuntimeErrors.Get(name).String()
 		}
+		if _, ok := l.handles[name]; ok {
+			data.State[name] = "running"
+			if l.overBudget[name] {
+				data.State[name] = "over budget"
+			} else if l.paused[name] {
+				data.State[name] = "paused"
+			}
+		}
+		if h, ok := l.handles[name]; ok && h.vm != nil {
+			if t := h.vm.LastMatch(); t.IsZero() {
+				data.LastMatch[name] = "never"
+			} else {
+				data.LastMatch[name] = t.Format(time.RFC3339)
+			}
+			data.MatchRate[name], data.Anomalous[name] = l.matchRateStatus(name)
+		}
 	}
+	sort.Strings(data.Skipped)
 	return t.Execute(w, data)
 }
 
+// compile compiles a program read from the input, or loads it from the
+// bytecode cache if it is unchanged since it was last compiled.
+func (l *MasterControl) compile(name string, input io.Reader) (*VM, error) {
+	if l.cache == nil || l.dumpAst || l.dumpAstTypes {
+		obj, err := compileObject(name, input, l.dumpAst, l.dumpAstTypes)
+		if err != nil {
+			return nil, err
+		}
+		return New(name, obj, l.syslogUseCurrentYear, l.overrideLocation), nil
+	}
+	source, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	obj := l.cache.load(name, source)
+	if obj == nil {
+		obj, err = compileObject(name, bytes.NewReader(source), false, false)
+		if err != nil {
+			return nil, err
+		}
+		l.cache.store(name, source, obj)
+	}
+	return New(name, obj, l.syslogUseCurrentYear, l.overrideLocation), nil
+}
+
 // CompileAndRun compiles a program read from the input, starting execution if
 // it succeeds.  If an existing virtual machine of the same name already
 // exists, the previous virtual machine is terminated and the new loaded over
 // it.  If the new program fails to compile, any existing virtual machine with
 // the same name remains running.
 func (l *MasterControl) CompileAndRun(name string, input io.Reader) error {
+	return l.compileAndRun(name, input, nil)
+}
+
+// compileAndRun is CompileAndRun for a program loaded from the program
+// directory d, or from no directory if d is nil.
+func (l *MasterControl) compileAndRun(name string, input io.Reader, d *ProgramDir) error {
 	glog.V(2).Infof("CompileAndRun %s", name)
-	v, errs := Compile(name, input, l.dumpAst, l.dumpAstTypes, l.syslogUseCurrentYear, l.overrideLocation)
+	src := input
+	var h hash.Hash
+	if l.audit != nil {
+		h = sha256.New()
+		input = io.TeeReader(input, h)
+	}
+	v, errs := l.compile(name, input)
+	if s, ok := src.(*packageSource); ok {
+		errs = s.positionErrors(errs)
+	}
 	if errs != nil {
 		ProgLoadErrors.Add(name, 1)
 		return errors.Errorf("compile failed for %s:\n%s", name, errs)
@@ -203,18 +387,65 @@ func (l *MasterControl) CompileAndRun(name string, input io.Reader) error {
 		glog.Info("Dumping program objects and bytecode\n", v.DumpByteCode(name))
 	}
 
+	maxLabelValues, lineBudget := l.maxLabelValues, l.lineBudget
+	instructionBudget, maxMetrics := l.instructionBudget, l.maxMetrics
+	var prefix string
+	var sources []string
+	if d != nil {
+		prefix, sources = d.MetricPrefix, d.Logs
+		if d.MaxLabelValues > 0 {
+			maxLabelValues = d.MaxLabelValues
+		}
+		if d.LineBudget > 0 {
+			lineBudget = d.LineBudget
+		}
+		if d.InstructionBudget > 0 {
+			instructionBudget = d.InstructionBudget
+		}
+		if d.MaxMetrics > 0 {
+			maxMetrics = d.MaxMetrics
+		}
+	}
+
+	if maxMetrics > 0 && len(v.m) > maxMetrics {
+		ProgLoadErrors.Add(name, 1)
+		return errors.Errorf("%s declares %d metrics, more than the limit of %d", name, len(v.m), maxMetrics)
+	}
+
+	if err := l.checkMetricCollisions(name, prefix, v.m); err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return err
+	}
+
 	// Load the metrics from the compilation into the global metric storage for export.
+	var hidden []*metrics.Metric
 	for _, m := range v.m {
-		if !m.Hidden {
-			if l.omitMetricSource {
-				m.Source = ""
-			}
-			err := l.ms.Add(m)
-			if err != nil {
-				return err
+		m.Limit = maxLabelValues
+		if m.Kind == metrics.Timer && len(l.timerQuantiles) > 0 {
+			m.Quantiles = l.timerQuantiles
+			for _, lv := range m.LabelValues {
+				datum.WithQuantiles(lv.Value, m.Quantiles)
 			}
 		}
+		if m.Hidden {
+			hidden = append(hidden, m)
+			continue
+		}
+		if l.omitMetricSource {
+			m.Source = ""
+		}
+		err := l.ms.Add(m)
+		if err != nil {
+			return err
+		}
 	}
+	l.ms.SetHidden(name, hidden)
+
+	v.SetLineBudget(lineBudget)
+	v.SetInstructionBudget(instructionBudget)
+	v.sink = l.sink
+	v.enrichers = l.enrichers
+	v.updates = l.ms.UpdateLocker()
 
 	ProgLoads.Add(name, 1)
 	glog.Infof("Loaded program %s", name)
@@ -234,7 +465,13 @@ func (l *MasterControl) CompileAndRun(name string, input io.Reader) error {
 		glog.Infof("Stopped %s", name)
 	}
 
-	l.handles[name] = &vmHandle{make(chan *logline.LogLine), make(chan struct{})}
+	if l.covered != nil {
+		v.coverage = newVMCoverage(len(v.re))
+		l.covered[name] = v
+	}
+	v.setParallelism(l.oneShotParallelism)
+	l.handles[name] = &vmHandle{vm: v, sources: sources, lines: make(chan *logline.LogLine), done: make(chan struct{})}
+	progsLoaded.Set(int64(len(l.handles)))
 	nameCode := nameToCode(name)
 	glog.Infof("Program %s has goroutine marker 0x%x", name, nameCode)
 	started := make(chan struct{})
@@ -242,10 +479,78 @@ func (l *MasterControl) CompileAndRun(name string, input io.Reader) error {
 	<-started
 	glog.Infof("Started %s", name)
 
+	if h != nil {
+		// Hash all of the source, even if the compiler didn't read to the end.
+		if _, err := io.Copy(ioutil.Discard, input); err != nil {
+			glog.Info(err)
+		}
+		l.auditLoad(name, hex.EncodeToString(h.Sum(nil)), prefix, v.m)
+	}
+	return nil
+}
+
+// RunExternal starts the external program at programPath, replacing any
+// running program of the same name.  See externalProgram.
+func (l *MasterControl) RunExternal(name, programPath string) error {
+	return l.runExternal(name, programPath, nil)
+}
+
+// runExternal is RunExternal for a program loaded from the program directory
+// d, or from no directory if d is nil.
+func (l *MasterControl) runExternal(name, programPath string, d *ProgramDir) error {
+	fi, err := os.Stat(programPath)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+		return errors.Wrapf(err, "failed to stat external program %q", programPath)
+	}
+	if fi.Mode()&0111 == 0 {
+		ProgLoadErrors.Add(name, 1)
+		return errors.Errorf("external program %q is not executable", programPath)
+	}
+	ProgLoads.Add(name, 1)
+	glog.Infof("Loaded external program %s", name)
+
+	if l.compileOnly {
+		return nil
+	}
+
+	p := newExternalProgram(name, programPath, l.ms)
+	p.maxLabelValues = l.maxLabelValues
+	p.maxMetrics = l.maxMetrics
+	p.omitMetricSource = l.omitMetricSource
+	var sources []string
+	if d != nil {
+		p.metricPrefix, sources = d.MetricPrefix, d.Logs
+		if d.MaxLabelValues > 0 {
+			p.maxLabelValues = d.MaxLabelValues
+		}
+		if d.MaxMetrics > 0 {
+			p.maxMetrics = d.MaxMetrics
+		}
+	}
+
+	l.handleMu.Lock()
+	defer l.handleMu.Unlock()
+
+	if handle, ok := l.handles[name]; ok {
+		close(handle.lines)
+		<-handle.done
+		glog.Infof("Stopped %s", name)
+	}
+
+	l.handles[name] = &vmHandle{sources: sources, lines: make(chan *logline.LogLine), done: make(chan struct{})}
+	progsLoaded.Set(int64(len(l.handles)))
+	go p.Run(l.handles[name].lines, l.handles[name].done)
+	glog.Infof("Started %s", name)
+	if l.audit != nil {
+		l.auditLoad(name, fileHash(programPath), "", nil)
+	}
 	return nil
 }
 
 func nameToCode(name string) uint32 {
+	// Package names may be shorter than four characters.
+	name += "\x00\x00\x00\x00"
 	return uint32(name[0])<<24 | uint32(name[1])<<16 | uint32(name[2])<<8 | uint32(name[3])
 }
 
@@ -259,13 +564,24 @@ type MasterControl struct {
 	fs          afero.Fs        // filesystem interface
 	programPath string          // Path that contains mtail programs.
 
+	programDirs []*ProgramDir // Further directories of programs, with their settings.
+
 	eventsHandle int // record the handle with which to add programs to the watcher
 
-	handleMu sync.RWMutex         // guards accesses to handles
-	handles  map[string]*vmHandle // map of program names to virtual machines
+	handleMu   sync.RWMutex         // guards accesses to handles, paused, overBudget and covered
+	handles    map[string]*vmHandle // map of program names to virtual machines
+	paused     map[string]bool      // names of programs not being sent log lines
+	overBudget map[string]bool      // names of programs paused for exceeding their budgets
+	covered    map[string]*VM       // if not nil, the virtual machines counting the lines matched by their patterns, kept after shutdown
 
-	programErrorMu sync.RWMutex     // guards access to programErrors
+	programErrorMu sync.RWMutex     // guards access to programErrors and packages
 	programErrors  map[string]error // errors from the last compile attempt of the program
+	packages       map[string]bool  // directories of the program packages loaded
+
+	profileMu sync.Mutex // serialises collection of profiles
+
+	dispatchStart int64 // Unix nanoseconds at which the line being sent to the VMs was received, or zero if idle; accessed atomically
+	linesRead     int64 // number of lines read from the input and sent to the VMs; accessed atomically
 
 	watcherDone chan struct{} // Synchronise shutdown of the watcher processEvents goroutine
 	VMsDone     chan struct{} // Notify mtail when all running VMs are shutdown.
@@ -278,6 +594,33 @@ type MasterControl struct {
 	dumpBytecode         bool           // Instructs the loader to dump to stdout the compiled program after compilation.
 	syslogUseCurrentYear bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
 	omitMetricSource     bool
+	collisionPolicy      string         // What to do when programs export metrics with the same name.
+	loadPolicy           string         // What to do when programs fail to load at startup.
+	maxLabelValues       int            // Limit on the label value sets of each metric, or 0 for no limit.
+	lineBudget           time.Duration  // Time a program may spend on one line, or 0 for no limit.
+	instructionBudget    int            // Instructions a program may execute on one line, or 0 for no limit.
+	maxMetrics           int            // Limit on the metrics of each program, or 0 for no limit.
+	pauseOverBudget      int64          // Lines a program may abandon for exceeding its budgets before it is paused, or 0 for no limit.
+	timerQuantiles       []float64      // Quantiles of timer values to estimate, if any.
+	cache                *bytecodeCache // If set, compiled programs are cached here.
+	sink                 *sink          // If set, events emitted by programs are written here.
+
+	oneShotParallelism int // Number of workers each program processes lines with, in one-shot mode.
+
+	enrichers map[string]Enricher // Databases looked up by the enrichment builtins, by builtin name.
+
+	mtailVersion  string // If set, the version of mtail that program packages may require.
+	mtailRevision string // The git revision mtail was built from, if known.
+
+	audit *audit.Log // If set, program loads and metric definitions are recorded here.
+
+	anomalyInterval  time.Duration         // If nonzero, how often the match rates of the programs are measured.
+	anomalyThreshold float64               // Multiple of its baseline beyond which a match rate is anomalous.
+	matchRateMu      sync.Mutex            // guards matchRates
+	matchRates       map[string]*matchRate // match rates of each program, while anomaly detection is enabled
+
+	recent      *lineRing    // If set, the most recent lines received, for dry runs.
+	sourceLines *sourceLines // If set, the most recent lines received from each source.
 }
 
 // OverrideLocation sets the timezone location for the VM.
@@ -324,6 +667,208 @@ func SyslogUseCurrentYear(l *MasterControl) error {
 	return nil
 }
 
+// Policies for programs that fail to load when the Loader starts.
+const (
+	// LoadPermissive skips the programs that fail to load, and runs the rest.
+	LoadPermissive = "permissive"
+	// LoadStrict fails the initial load if any program fails to load.
+	LoadStrict = "strict"
+)
+
+// LoadPolicy sets the Loader's policy for programs that fail to load in
+// LoadAllPrograms; one of LoadPermissive or LoadStrict.  Programs reloaded
+// later are always skipped if they fail to load, leaving the rest running.
+func LoadPolicy(policy string) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		switch policy {
+		case LoadPermissive, LoadStrict:
+			l.loadPolicy = policy
+			return nil
+		}
+		return errors.Errorf("unknown program load policy %q", policy)
+	}
+}
+
+// Policies for metric names exported by more than one program.
+const (
+	// CollisionWarn logs a warning and exports the metrics from all programs.
+	CollisionWarn = "warn"
+	// CollisionReject fails to load a program that exports a metric name
+	// already exported by another program.
+	CollisionReject = "reject"
+	// CollisionNamespace prefixes the name of every metric with the name of
+	// the program that exports it, so no names can collide.
+	CollisionNamespace = "namespace"
+)
+
+// MetricCollisions sets the Loader's policy for metric names exported by
+// more than one program; one of CollisionWarn, CollisionReject, or
+// CollisionNamespace.
+func MetricCollisions(policy string) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		switch policy {
+		case CollisionWarn, CollisionReject, CollisionNamespace:
+			l.collisionPolicy = policy
+			return nil
+		}
+		return errors.Errorf("unknown metric collision policy %q", policy)
+	}
+}
+
+// MaxLabelValues sets the Loader to limit each metric to n sets of label
+// values; any more are folded into a single overflow set.  Zero means no limit.
+func MaxLabelValues(n int) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if n < 0 {
+			return errors.New("max label values must not be negative")
+		}
+		l.maxLabelValues = n
+		return nil
+	}
+}
+
+// TimerQuantiles sets the Loader to estimate the given quantiles of the
+// values of each timer metric, for export as a summary.
+func TimerQuantiles(qs []float64) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		for _, q := range qs {
+			if q <= 0 || q >= 1 {
+				return errors.Errorf("quantile %g is not between 0 and 1", q)
+			}
+		}
+		l.timerQuantiles = qs
+		return nil
+	}
+}
+
+// BytecodeCache sets the Loader to cache compiled programs in dir, so that
+// programs that haven't changed aren't compiled again on restart.
+func BytecodeCache(dir string) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrap(err, "bytecode cache")
+		}
+		l.cache = &bytecodeCache{dir: dir}
+		return nil
+	}
+}
+
+// LineBudget sets the time a program may spend processing one log line
+// before the line is abandoned and counted.  Zero means no limit.
+func LineBudget(d time.Duration) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if d < 0 {
+			return errors.New("line budget must not be negative")
+		}
+		l.lineBudget = d
+		return nil
+	}
+}
+
+// InstructionBudget sets the number of VM instructions a program may execute
+// on one log line before the line is abandoned and counted.  Zero means no
+// limit.
+func InstructionBudget(n int) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if n < 0 {
+			return errors.New("instruction budget must not be negative")
+		}
+		l.instructionBudget = n
+		return nil
+	}
+}
+
+// MaxMetrics sets the number of metrics a program may export.  A program
+// that declares more fails to load.  Zero means no limit.
+func MaxMetrics(n int) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if n < 0 {
+			return errors.New("maximum metrics must not be negative")
+		}
+		l.maxMetrics = n
+		return nil
+	}
+}
+
+// PauseOverBudget pauses a program once it has abandoned n lines for
+// exceeding its line or instruction budget, until it is resumed with
+// ResumeProgram.  Zero means programs are never paused for this.
+func PauseOverBudget(n int64) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if n < 0 {
+			return errors.New("over budget line count must not be negative")
+		}
+		l.pauseOverBudget = n
+		return nil
+	}
+}
+
+// OneShotParallelism sets each program to process lines with n workers, each
+// taking all the lines of some of the log files.  The lines of each log file
+// are still processed in order, but the lines of different log files are
+// not, so this is for one-shot mode only.
+func OneShotParallelism(n int) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		if n < 1 {
+			return errors.Errorf("invalid one-shot parallelism %d", n)
+		}
+		l.oneShotParallelism = n
+		return nil
+	}
+}
+
+// EventSink sets the destination of the events emitted by programs with the
+// emit builtin: the path of a file to append them to, or the URL of a socket
+// to send them to, like unix:///run/events.sock or udp://localhost:5140.
+func EventSink(address string) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		s, err := openSink(address)
+		if err != nil {
+			return err
+		}
+		l.sink = s
+		return nil
+	}
+}
+
+// checkMetricCollisions applies the collision policy and the metric prefix of
+// its program directory to the metrics of the program name before they are
+// added to the store.
+func (l *MasterControl) checkMetricCollisions(name, prefix string, ms []*metrics.Metric) error {
+	for _, m := range ms {
+		if l.collisionPolicy == CollisionNamespace {
+			m.Name = programNamespace(name) + "_" + m.Name
+		}
+		m.Name = prefix + m.Name
+	}
+	for _, m := range ms {
+		if m.Hidden {
+			continue
+		}
+		others := l.ms.ExportingPrograms(m.Name, name)
+		if len(others) == 0 {
+			continue
+		}
+		if l.collisionPolicy == CollisionReject {
+			return errors.Errorf("metric %q in %s is already exported by %s", m.Name, name, strings.Join(others, ", "))
+		}
+		glog.Warningf("Metric %q in %s is also exported by %s", m.Name, name, strings.Join(others, ", "))
+	}
+	return nil
+}
+
+// programNamespace returns a metric name prefix made from a program name, by
+// removing the file extension and replacing characters that aren't allowed in
+// metric names.
+func programNamespace(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, strings.TrimSuffix(name, fileExt))
+}
+
 // OmitMetricSource instructs the Loader to not annotate metrics with their program source when added to the metric store.
 func OmitMetricSource(l *MasterControl) error {
 	l.omitMetricSource = true
@@ -336,22 +881,33 @@ func NewLoader(programPath string, store *metrics.Store, lines <-chan *logline.L
 		return nil, errors.New("loader needs a store and lines")
 	}
 	l := &MasterControl{
-		ms:            store,
-		fs:            fs,
-		w:             w,
-		programPath:   programPath,
-		handles:       make(map[string]*vmHandle),
-		programErrors: make(map[string]error),
-		watcherDone:   make(chan struct{}),
-		VMsDone:       make(chan struct{}),
+		ms:              store,
+		fs:              fs,
+		w:               w,
+		programPath:     programPath,
+		handles:         make(map[string]*vmHandle),
+		paused:          make(map[string]bool),
+		overBudget:      make(map[string]bool),
+		programErrors:   make(map[string]error),
+		packages:        make(map[string]bool),
+		watcherDone:     make(chan struct{}),
+		VMsDone:         make(chan struct{}),
+		collisionPolicy: CollisionWarn,
+		loadPolicy:      LoadPermissive,
 	}
 	if err := l.SetOption(options...); err != nil {
 		return nil, err
 	}
+	if l.cache != nil {
+		l.cache.build = l.mtailVersion + "\x00" + l.mtailRevision
+	}
 	handle, eventsChan := l.w.Events()
 	l.eventsHandle = handle
 	go l.processEvents(eventsChan)
 	go l.processLines(lines)
+	if l.anomalyInterval > 0 {
+		go l.watchMatchRates()
+	}
 	return l, nil
 }
 
@@ -366,8 +922,11 @@ func (l *MasterControl) SetOption(options ...func(*MasterControl) error) error {
 }
 
 type vmHandle struct {
-	lines chan *logline.LogLine
-	done  chan struct{}
+	sent    int64    // number of lines sent to the program; accessed atomically
+	vm      *VM      // nil for external programs
+	sources []string // glob patterns of the logs sent to the program, or all if empty
+	lines   chan *logline.LogLine
+	done    chan struct{}
 }
 
 // processEvents manages program lifecycle triggered by events from the
@@ -407,11 +966,34 @@ func (l *MasterControl) processLines(lines <-chan *logline.LogLine) {
 	// Copy all input LogLines to each VM's LogLine input channel.
 	for logline := range lines {
 		LineCount.Add(1)
+		if l.recent != nil {
+			l.recent.add(logline)
+		}
+		if l.sourceLines != nil {
+			l.sourceLines.add(logline)
+		}
+		start := time.Now()
+		atomic.StoreInt64(&l.dispatchStart, start.UnixNano())
+		var overBudget []string
 		l.handleMu.RLock()
-		for prog := range l.handles {
-			l.handles[prog].lines <- logline
+		for prog, h := range l.handles {
+			if l.paused[prog] || !h.wants(logline.Filename) {
+				continue
+			}
+			h.lines <- logline
+			atomic.AddInt64(&h.sent, 1)
+			progLines.Add(prog, 1)
+			if l.pauseOverBudget > 0 && h.vm != nil && h.vm.OverBudget() >= l.pauseOverBudget {
+				overBudget = append(overBudget, prog)
+			}
 		}
 		l.handleMu.RUnlock()
+		atomic.AddInt64(&l.linesRead, 1)
+		atomic.StoreInt64(&l.dispatchStart, 0)
+		dispatchSeconds.Add(time.Since(start).Seconds())
+		for _, prog := range overBudget {
+			l.pauseForBudget(prog)
+		}
 	}
 	// When lines is closed, the tailer has shut down which signals that it's
 	// time to shut down the program loader.
@@ -428,20 +1010,199 @@ func (l *MasterControl) processLines(lines <-chan *logline.LogLine) {
 		<-l.handles[prog].done
 		delete(l.handles, prog)
 	}
+	progsLoaded.Set(0)
+	if l.sink != nil {
+		if err := l.sink.close(); err != nil {
+			glog.Infof("error closing event sink: %s", err)
+		}
+	}
+}
+
+// DispatchTime returns how long the loader has been waiting for the running
+// programs to accept the current line, or zero if it is waiting for input.  A
+// program that is stuck, or that can't keep up with the log volume, causes
+// this to grow, and the tailer to block.
+func (l *MasterControl) DispatchTime() time.Duration {
+	start := atomic.LoadInt64(&l.dispatchStart)
+	if start == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, start))
+}
+
+// LinesProcessed returns the number of lines the loader has read from its
+// input, and whether the programs have finished processing all the lines sent
+// to them.  The lines sent to external programs are taken to be processed.
+// Once the count reaches the number of lines given to the loader and done is
+// true, every program has seen the effects of every line.
+func (l *MasterControl) LinesProcessed() (n int64, done bool) {
+	n = atomic.LoadInt64(&l.linesRead)
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	for _, h := range l.handles {
+		if h.vm != nil && h.vm.LinesProcessed() < atomic.LoadInt64(&h.sent) {
+			return n, false
+		}
+	}
+	return n, true
+}
+
+// ProgramErrors returns the names of programs whose last compile attempt
+// failed, and the errors.
+func (l *MasterControl) ProgramErrors() map[string]error {
+	l.programErrorMu.RLock()
+	defer l.programErrorMu.RUnlock()
+	errs := make(map[string]error)
+	for name, err := range l.programErrors {
+		if err != nil {
+			errs[name] = err
+		}
+	}
+	return errs
 }
 
 // UnloadProgram removes the named program from the watcher to prevent future
-// updates, and terminates any currently running VM goroutine.
+// updates, and terminates any currently running VM goroutine.  Removing a
+// program package, or its manifest, unloads the package; removing another of
+// its files reloads it, which leaves it running as it was if the file was
+// needed.
 func (l *MasterControl) UnloadProgram(pathname string) {
+	if dir := l.packageOf(pathname); dir != "" {
+		if filepath.Clean(pathname) == dir || filepath.Base(pathname) == packageManifest {
+			l.unloadPackage(dir)
+			return
+		}
+		if err := l.loadPackage(dir); err != nil {
+			glog.Info(err)
+		}
+		return
+	}
+	l.unload(pathname, l.programName(pathname))
+}
+
+// unload removes pathname from the watcher, and terminates the program name
+// loaded from it.
+func (l *MasterControl) unload(pathname, name string) {
 	if err := l.w.Remove(pathname); err != nil {
 		glog.V(2).Infof("Remove watch on %s failed: %s", pathname, err)
 	}
-	name := filepath.Base(pathname)
+	l.programErrorMu.Lock()
+	delete(l.programErrors, name)
+	l.countSkipped()
+	l.programErrorMu.Unlock()
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
 	if handle, ok := l.handles[name]; ok {
 		close(handle.lines)
 		<-handle.done
 		delete(l.handles, name)
+		progsLoaded.Set(int64(len(l.handles)))
+		l.auditUnload(name)
+	}
+	l.ms.SetHidden(name, nil)
+	delete(l.paused, name)
+	delete(l.overBudget, name)
+}
+
+// WriteDiagnostics writes the state of the loader and its programs as plain
+// text to the io.Writer w, for a diagnostic dump.
+func (l *MasterControl) WriteDiagnostics(w io.Writer) error {
+	programs := l.Programs()
+	errs := l.ProgramErrors()
+	fmt.Fprintf(w, "loader: %d programs running, %d failed to load, %s waiting for the programs to accept a line\n", len(programs), len(errs), l.DispatchTime())
+	for _, p := range programs {
+		state := "running"
+		switch {
+		case p.OverBudget:
+			state = "paused over budget"
+		case p.Paused:
+			state = "paused"
+		}
+		// The counters of a program that hasn't yet counted anything are unset.
+		counts := []interface{}{p.Name, state}
+		for _, m := range []*expvar.Map{progLines, progRuntimeErrors, ProgLoads, ProgLoadErrors} {
+			n := "0"
+			if v := m.Get(p.Name); v != nil {
+				n = v.String()
+			}
+			counts = append(counts, n)
+		}
+		fmt.Fprintf(w, "program %s %s lines %s runtime errors %s loads %s load errors %s\n", counts...)
+	}
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "program %s failed to load: %s\n", name, errs[name])
+	}
+	return nil
+}
+
+// ProgramState describes whether a loaded program is receiving log lines.
+type ProgramState struct {
+	Name       string `json:"name"`
+	Paused     bool   `json:"paused"`
+	OverBudget bool   `json:"over_budget,omitempty"` // paused for exceeding its budgets
+}
+
+// Programs returns the state of each loaded program, sorted by name.
+func (l *MasterControl) Programs() []ProgramState {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	states := make([]ProgramState, 0, len(l.handles))
+	for name := range l.handles {
+		states = append(states, ProgramState{name, l.paused[name], l.overBudget[name]})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// PauseProgram stops sending log lines to the named program, without
+// unloading it, so that its metrics keep their values.  The program stays
+// paused if it is reloaded, until ResumeProgram is called.
+func (l *MasterControl) PauseProgram(name string) error {
+	return l.setPaused(name, true)
+}
+
+// ResumeProgram starts sending log lines to the named program again after
+// PauseProgram.  The lines logged while it was paused are not sent.
+func (l *MasterControl) ResumeProgram(name string) error {
+	return l.setPaused(name, false)
+}
+
+func (l *MasterControl) setPaused(name string, paused bool) error {
+	l.handleMu.Lock()
+	defer l.handleMu.Unlock()
+	if _, ok := l.handles[name]; !ok {
+		return errors.Errorf("no program named %q is loaded", name)
+	}
+	if paused {
+		l.paused[name] = true
+		glog.Infof("Paused %s", name)
+	} else {
+		delete(l.paused, name)
+		delete(l.overBudget, name)
+		if h := l.handles[name]; h.vm != nil {
+			h.vm.resetOverBudget()
+		}
+		glog.Infof("Resumed %s", name)
+	}
+	return nil
+}
+
+// pauseForBudget pauses the named program for having abandoned too many lines
+// for exceeding its budgets.
+func (l *MasterControl) pauseForBudget(name string) {
+	l.handleMu.Lock()
+	defer l.handleMu.Unlock()
+	h, ok := l.handles[name]
+	if !ok || l.paused[name] {
+		return
 	}
+	l.paused[name] = true
+	l.overBudget[name] = true
+	progsPausedOverBudget.Add(name, 1)
+	glog.Warningf("Paused %s after it abandoned %d lines for exceeding its budgets", name, h.vm.OverBudget())
 }
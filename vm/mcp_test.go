@@ -4,12 +4,21 @@
 package vm
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	go_cmp "github.com/google/go-cmp/cmp"
 	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
 	"github.com/google/mtail/watcher"
 	"github.com/spf13/afero"
 )
@@ -25,7 +34,7 @@ func TestNewLoader(t *testing.T) {
 	}
 	done := make(chan struct{})
 	outLines := make(chan *logline.LogLine)
-	handle := &vmHandle{outLines, done}
+	handle := &vmHandle{lines: outLines, done: done}
 	l.handleMu.Lock()
 	l.handles["test"] = handle
 	l.handleMu.Unlock()
@@ -38,6 +47,39 @@ func TestNewLoader(t *testing.T) {
 	<-outLines
 }
 
+func TestDispatchTime(t *testing.T) {
+	w := watcher.NewFakeWatcher()
+	inLines := make(chan *logline.LogLine)
+	l, err := NewLoader("", metrics.NewStore(), inLines, w, afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if d := l.DispatchTime(); d != 0 {
+		t.Errorf("dispatch time while idle: %s", d)
+	}
+	done := make(chan struct{})
+	outLines := make(chan *logline.LogLine)
+	l.handleMu.Lock()
+	l.handles["stuck"] = &vmHandle{lines: outLines, done: done}
+	l.handleMu.Unlock()
+	inLines <- logline.NewLogLine("f", "line")
+	time.Sleep(10 * time.Millisecond)
+	if d := l.DispatchTime(); d < 10*time.Millisecond {
+		t.Errorf("dispatch time while blocked: %s", d)
+	}
+	<-outLines
+	go func() {
+		for range outLines {
+		}
+		close(done)
+	}()
+	close(inLines)
+	<-l.VMsDone
+	if d := l.DispatchTime(); d != 0 {
+		t.Errorf("dispatch time after line accepted: %s", d)
+	}
+}
+
 func TestCompileAndRun(t *testing.T) {
 	var testProgram = "/$/ {}\n"
 	store := metrics.NewStore()
@@ -199,3 +241,424 @@ func TestLoadProg(t *testing.T) {
 		}
 	}
 }
+
+func TestMetricCollisions(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		wantErr  bool
+		expected []string
+	}{
+		{CollisionWarn, false, []string{"foo"}},
+		{CollisionReject, true, []string{"foo"}},
+		{CollisionNamespace, false, []string{"a_foo", "b_prog_foo"}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			store := metrics.NewStore()
+			l, err := NewLoader("", store, make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), CompileOnly, MetricCollisions(tc.policy))
+			if err != nil {
+				t.Fatalf("couldn't create loader: %s", err)
+			}
+			if err := l.CompileAndRun("a.mtail", strings.NewReader("counter foo\n/x/ {\n  foo++\n}\n")); err != nil {
+				t.Fatal(err)
+			}
+			err = l.CompileAndRun("b-prog.mtail", strings.NewReader("counter foo\n/x/ {\n  foo++\n}\n"))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("second program load error: %v, want error %v", err, tc.wantErr)
+			}
+			var names []string
+			for name := range store.Metrics {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if diff := go_cmp.Diff(tc.expected, names); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestTimerQuantiles(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), CompileOnly, TimerQuantiles([]float64{0.5, 0.99}))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("t.mtail", strings.NewReader("timer t init\ngauge g\n/(\\d+)/ {\n  t = $1\n  g = $1\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"t": true, "g": false} {
+		m := store.Metrics[name][0]
+		if got := len(m.Quantiles) > 0; got != want {
+			t.Errorf("%s: quantiles %v", name, m.Quantiles)
+		}
+		if want && datum.GetQuantiles(m.LabelValues[0].Value) == nil {
+			t.Errorf("%s: initialised datum does not estimate quantiles", name)
+		}
+	}
+	if _, err := NewLoader("", store, nil, watcher.NewFakeWatcher(), afero.NewMemMapFs(), TimerQuantiles([]float64{1})); err == nil {
+		t.Error("quantile of 1 accepted")
+	}
+}
+
+func TestRefreshedMetric(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), CompileOnly)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("t.mtail", strings.NewReader("gauge queue refresh 1m\ngauge g\n/(\\d+)/ {\n  queue = $1\n  g = $1\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]time.Duration{"queue": time.Minute, "g": 0} {
+		if got := store.Metrics[name][0].Refresh; got != want {
+			t.Errorf("%s: refresh %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestDescribedMetric(t *testing.T) {
+	store := metrics.NewStore()
+	l, err := NewLoader("", store, make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), CompileOnly)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("t.mtail", strings.NewReader("counter requests_total \"Total HTTP requests\" unit \"requests\" by code\ngauge g\n/(\\d+)/ {\n  requests_total[$1]++\n  g = $1\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	m := store.Metrics["requests_total"][0]
+	if m.Description != "Total HTTP requests" || m.Unit != "requests" {
+		t.Errorf("requests_total: description %q unit %q, want %q unit %q", m.Description, m.Unit, "Total HTTP requests", "requests")
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"Description":"Total HTTP requests","Unit":"requests"`) {
+		t.Errorf("JSON doesn't have the description and unit: %s", b)
+	}
+	if m := store.Metrics["g"][0]; m.Description != "" || m.Unit != "" {
+		t.Errorf("g: description %q unit %q, want none", m.Description, m.Unit)
+	}
+}
+
+func TestHiddenMetricsNotExported(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	prog := "hidden gauge last by id\ncounter total\n/(\\d+)/ {\n  total += $1 - last[\"x\"]\n  last[\"x\"] = $1\n}\n"
+	if err := l.CompileAndRun("h.mtail", strings.NewReader(prog)); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"3", "5"} {
+		lines <- logline.NewLogLine("f", line)
+	}
+	close(lines)
+	<-l.VMsDone
+	if _, ok := store.Metrics["last"]; ok {
+		t.Error("hidden metric exported")
+	}
+	if got := datum.GetInt(store.Metrics["total"][0].LabelValues[0].Value); got != 5 {
+		t.Errorf("total is %d, want 5", got)
+	}
+}
+
+func TestHiddenMetricsExpire(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	prog := "hidden gauge open by id\ncounter total\n/(\\w+)/ {\n  open[$1] = 1\n  total += open[$1]\n  del open[$1] after 1m\n}\n"
+	if err := l.CompileAndRun("h.mtail", strings.NewReader(prog)); err != nil {
+		t.Fatal(err)
+	}
+	l.handleMu.Lock()
+	open := l.handles["h.mtail"].vm.m[0]
+	l.handleMu.Unlock()
+	lines <- logline.NewLogLine("f", "a")
+	close(lines)
+	<-l.VMsDone
+	if len(open.LabelValues) != 1 {
+		t.Fatalf("open has %d datums, want 1", len(open.LabelValues))
+	}
+	store.Gc()
+	if len(open.LabelValues) != 1 {
+		t.Errorf("open has %d datums before it expires, want 1", len(open.LabelValues))
+	}
+	store.SetClock(func() time.Time { return time.Now().Add(2 * time.Minute) })
+	store.Gc()
+	if len(open.LabelValues) != 0 {
+		t.Errorf("open has %d datums after it expires, want 0", len(open.LabelValues))
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "load_policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, prog := range map[string]string{
+		"good.mtail": "counter foo\n/x/ {\n  foo++\n}\n",
+		"bad.mtail":  "counter foo\n/x/ {\n  bar++\n}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(prog), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		policy  string
+		wantErr bool
+	}{
+		{LoadPermissive, false},
+		{LoadStrict, true},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			l, err := NewLoader(dir, metrics.NewStore(), make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewOsFs(), LoadPolicy(tc.policy))
+			if err != nil {
+				t.Fatalf("couldn't create loader: %s", err)
+			}
+			err = l.LoadAllPrograms()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("LoadAllPrograms() error: %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "bad.mtail") {
+				t.Errorf("LoadAllPrograms() error %q doesn't name the failed program", err)
+			}
+			if got := ProgsSkipped.Value(); got != 1 {
+				t.Errorf("programs skipped: %d, want 1", got)
+			}
+			var b bytes.Buffer
+			if err := l.WriteStatusHTML(&b); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(b.String(), "1 programs failed to load") {
+				t.Errorf("status page doesn't show the skipped program:\n%s", b.String())
+			}
+		})
+	}
+	if _, err := NewLoader("", metrics.NewStore(), make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), LoadPolicy("bogus")); err == nil {
+		t.Error("unknown load policy accepted")
+	}
+}
+
+func TestPauseProgram(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("count.mtail", strings.NewReader("counter lines\n/count/ {\n  lines++\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.PauseProgram("missing.mtail"); err == nil {
+		t.Error("paused a program that isn't loaded")
+	}
+	// The loader receives a line only once the previous one is dispatched,
+	// so a line that isn't counted follows each counted line to make sure
+	// it is dispatched before the program is paused or resumed.
+	lines <- logline.NewLogLine("log", "count one")
+	lines <- logline.NewLogLine("log", "skip")
+	if err := l.PauseProgram("count.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := go_cmp.Diff([]ProgramState{{Name: "count.mtail", Paused: true}}, l.Programs()); diff != "" {
+		t.Errorf("program states differ:\n%s", diff)
+	}
+	lines <- logline.NewLogLine("log", "count two")
+	lines <- logline.NewLogLine("log", "skip")
+	if err := l.ResumeProgram("count.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	lines <- logline.NewLogLine("log", "count three")
+	close(lines)
+	<-l.VMsDone
+	d, err := store.Metrics["lines"][0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := datum.GetInt(d); v != 2 {
+		t.Errorf("lines = %d, want 2", v)
+	}
+}
+
+func TestPauseOverBudget(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/count.mtail", []byte("counter lines\n/count/ {\n  lines++\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), fs, InstructionBudget(1), PauseOverBudget(2))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.LoadProgram("/count.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	// Each line is abandoned.  A line is received only once the previous one
+	// has been dispatched, and a program receives a line only once it has
+	// finished with the previous one, so the third line sees that the first
+	// two were abandoned, and the fourth is received after the program is
+	// paused.
+	for i := 0; i < 4; i++ {
+		lines <- logline.NewLogLine("log", "count")
+	}
+	if diff := go_cmp.Diff([]ProgramState{{Name: "count.mtail", Paused: true, OverBudget: true}}, l.Programs()); diff != "" {
+		t.Errorf("program states differ:\n%s", diff)
+	}
+	var b bytes.Buffer
+	if err := l.WriteStatusHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "paused: over budget") {
+		t.Errorf("status page doesn't flag the program:\n%s", b.String())
+	}
+	if err := l.ResumeProgram("count.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	if diff := go_cmp.Diff([]ProgramState{{Name: "count.mtail"}}, l.Programs()); diff != "" {
+		t.Errorf("program states differ after resuming:\n%s", diff)
+	}
+	close(lines)
+	<-l.VMsDone
+}
+
+func TestMaxMetrics(t *testing.T) {
+	l, err := NewLoader("", metrics.NewStore(), make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), MaxMetrics(1))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("one.mtail", strings.NewReader("counter a\n/a/ {\n  a++\n}\n")); err != nil {
+		t.Errorf("program within the metric limit failed to load: %s", err)
+	}
+	if err := l.CompileAndRun("two.mtail", strings.NewReader("counter b\ncounter c\n/b/ {\n  b++\n  c++\n}\n")); err == nil {
+		t.Error("program over the metric limit loaded")
+	}
+}
+
+func TestOneShotParallelism(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewMemMapFs(), OneShotParallelism(3), Coverage)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	prog := `counter lines by file
+gauge last by file
+/(?P<n>\d+)/ {
+  lines[getfilename()]++
+  last[getfilename()] = $n
+}
+`
+	if err := l.CompileAndRun("files.mtail", strings.NewReader(prog)); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"a.log", "b.log", "c.log", "d.log"}
+	// Interleave the lines of the files, which are each processed in order.
+	for i := 1; i <= 100; i++ {
+		for _, f := range files {
+			lines <- logline.NewLogLine(f, strconv.Itoa(i))
+		}
+	}
+	close(lines)
+	<-l.VMsDone
+
+	for _, name := range []string{"lines", "last"} {
+		m := store.Metrics[name][0]
+		for _, f := range files {
+			d, err := m.GetDatum(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := datum.GetInt(d); v != 100 {
+				t.Errorf("%s[%s] = %d, want 100", name, f, v)
+			}
+		}
+	}
+	if got := l.CoverageReport()[0].Lines; got != 400 {
+		t.Errorf("coverage counted %d lines, want 400", got)
+	}
+}
+
+func TestOneShotParallelismInvalid(t *testing.T) {
+	if _, err := NewLoader("", metrics.NewStore(), make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(), OneShotParallelism(0)); err == nil {
+		t.Error("expected error for zero parallelism")
+	}
+}
+
+func TestLoaderEngineVars(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", metrics.NewStore(), lines, watcher.NewFakeWatcher(), afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	for _, name := range []string{"one.mtail", "two.mtail"} {
+		if err := l.CompileAndRun(name, strings.NewReader("counter c\n/x/ {\n  c++\n}\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := progsLoaded.Value(); got != 2 {
+		t.Errorf("prog_loaded = %d, want 2", got)
+	}
+	before := progLines.Get("vars.mtail")
+	if before != nil {
+		t.Fatalf("unexpected lines for an unloaded program: %s", before)
+	}
+	if err := l.CompileAndRun("vars.mtail", strings.NewReader("counter c\n/x/ {\n  c++\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	lines <- logline.NewLogLine("log", "x")
+	lines <- logline.NewLogLine("log", "y")
+	close(lines)
+	<-l.VMsDone
+	if got := progLines.Get("vars.mtail").String(); got != "2" {
+		t.Errorf("prog_lines_total = %s, want 2", got)
+	}
+	if got := progsLoaded.Value(); got != 0 {
+		t.Errorf("prog_loaded = %d after shutdown, want 0", got)
+	}
+	if dispatchSeconds.Value() <= 0 {
+		t.Errorf("line_dispatch_seconds_total = %g, want positive", dispatchSeconds.Value())
+	}
+}
+
+func TestLinesProcessed(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("p.mtail", strings.NewReader("counter total\n/x/ {\n  total++\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"x", "y", "x"} {
+		lines <- logline.NewLogLine("f", line)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, done := l.LinesProcessed()
+		if n > 3 {
+			t.Fatalf("%d lines processed, want 3", n)
+		}
+		if n == 3 && done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d lines processed, done %v, after 5s", n, done)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Once done, the effects of every line are in the store.
+	if got := datum.GetInt(store.Metrics["total"][0].LabelValues[0].Value); got != 2 {
+		t.Errorf("total is %d, want 2", got)
+	}
+	close(lines)
+	<-l.VMsDone
+}
@@ -11,8 +11,9 @@ import (
 
 // object describes a built object of data and bytecode
 type object struct {
-	prog []instr           // The emitted program.
-	str  []string          // Static strings.
-	re   []*regexp.Regexp  // Static regular expressions.
-	m    []*metrics.Metric // Metrics accessible to this program.
+	prog  []instr           // The emitted program.
+	str   []string          // Static strings.
+	re    []*regexp.Regexp  // Static regular expressions.
+	rePos []string          // Source position of each regular expression, if known.
+	m     []*metrics.Metric // Metrics accessible to this program.
 }
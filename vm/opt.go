@@ -0,0 +1,309 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+
+	"github.com/golang/glog"
+)
+
+// Optimise performs peephole optimisation of the bytecode in obj, folding
+// constant expressions, threading jumps, eliminating code that cannot be
+// reached, and removing redundant writes to the matched flag.  The passes are
+// repeated until the program stops shrinking.
+func Optimise(obj *object) {
+	passes := []func([]instr, []bool) []instr{
+		foldConstants,
+		foldBranches,
+		threadJumps,
+		removeUnreachable,
+		coalesceSetmatched,
+	}
+	for {
+		before := len(obj.prog)
+		for _, pass := range passes {
+			obj.prog = pass(obj.prog, jumpTargets(obj.prog))
+		}
+		if len(obj.prog) == before {
+			break
+		}
+	}
+}
+
+// jumpTargets returns a table marking each instruction offset that is the
+// destination of a jump.  The table has one extra entry for the offset just
+// past the end of the program.
+func jumpTargets(prog []instr) []bool {
+	targets := make([]bool, len(prog)+1)
+	for _, i := range prog {
+		if isJump(i.op) {
+			targets[i.opnd.(int)] = true
+		}
+	}
+	return targets
+}
+
+func isJump(op opcode) bool {
+	switch op {
+	case jmp, jm, jnm:
+		return true
+	}
+	return false
+}
+
+// compact returns prog with all instructions not marked keep removed, and all
+// jump destinations rewritten to the new offsets.  A jump to a removed
+// instruction is redirected to the next instruction kept, so passes must
+// only remove instructions that have no effect when jumped over.
+func compact(prog []instr, keep []bool) []instr {
+	newIndex := make([]int, len(prog)+1)
+	n := 0
+	for i := range prog {
+		newIndex[i] = n
+		if keep[i] {
+			n++
+		}
+	}
+	newIndex[len(prog)] = n
+	if n == len(prog) {
+		return prog
+	}
+	out := make([]instr, 0, n)
+	for i, in := range prog {
+		if !keep[i] {
+			continue
+		}
+		if isJump(in.op) {
+			in.opnd = newIndex[in.opnd.(int)]
+		}
+		out = append(out, in)
+	}
+	return out
+}
+
+func keepAll(prog []instr) []bool {
+	keep := make([]bool, len(prog))
+	for i := range keep {
+		keep[i] = true
+	}
+	return keep
+}
+
+// foldConstants evaluates arithmetic and comparisons on constant operands at
+// compile time, replacing the sequence with a push of the result.
+func foldConstants(prog []instr, targets []bool) []instr {
+	keep := keepAll(prog)
+	for i := 0; i < len(prog); i++ {
+		if prog[i].op != push {
+			continue
+		}
+		// Unary operations on a constant.
+		if i+1 < len(prog) && !targets[i+1] {
+			if r, ok := foldUnary(prog[i+1], prog[i].opnd); ok {
+				glog.V(2).Infof("folding %v %v to %v", prog[i], prog[i+1], r)
+				prog[i].opnd = r
+				keep[i+1] = false
+				i++
+				continue
+			}
+		}
+		// Binary operations on two constants.
+		if i+2 < len(prog) && prog[i+1].op == push && !targets[i+1] && !targets[i+2] {
+			if r, ok := foldBinary(prog[i+2], prog[i].opnd, prog[i+1].opnd); ok {
+				glog.V(2).Infof("folding %v %v %v to %v", prog[i], prog[i+1], prog[i+2], r)
+				prog[i].opnd = r
+				keep[i+1] = false
+				keep[i+2] = false
+				i += 2
+			}
+		}
+	}
+	return compact(prog, keep)
+}
+
+func foldUnary(i instr, a interface{}) (interface{}, bool) {
+	switch a := a.(type) {
+	case int64:
+		switch i.op {
+		case neg:
+			return ^a, true
+		case i2f:
+			return float64(a), true
+		}
+	case bool:
+		if i.op == not {
+			return !a, true
+		}
+	}
+	return nil, false
+}
+
+func foldBinary(i instr, a, b interface{}) (interface{}, bool) {
+	switch a := a.(type) {
+	case int64:
+		b, ok := b.(int64)
+		if !ok {
+			return nil, false
+		}
+		switch i.op {
+		case iadd:
+			return a + b, true
+		case isub:
+			return a - b, true
+		case imul:
+			return a * b, true
+		case idiv:
+			if b != 0 {
+				return a / b, true
+			}
+		case imod:
+			if b != 0 {
+				return a % b, true
+			}
+		case ipow:
+			return int64(math.Pow(float64(a), float64(b))), true
+		case shl:
+			return a << uint(b), true
+		case shr:
+			return a >> uint(b), true
+		case and:
+			return a & b, true
+		case or:
+			return a | b, true
+		case xor:
+			return a ^ b, true
+		case icmp, cmp:
+			if r, err := compareInt(a, b, i.opnd.(int)); err == nil {
+				return r, true
+			}
+		}
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return nil, false
+		}
+		switch i.op {
+		case fadd:
+			return a + b, true
+		case fsub:
+			return a - b, true
+		case fmul:
+			return a * b, true
+		case fdiv:
+			return a / b, true
+		case fmod:
+			return math.Mod(a, b), true
+		case fpow:
+			return math.Pow(a, b), true
+		case fcmp, cmp:
+			if r, err := compareFloat(a, b, i.opnd.(int)); err == nil {
+				return r, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// foldBranches resolves conditional jumps on constant booleans, either to an
+// unconditional jump or to nothing.
+func foldBranches(prog []instr, targets []bool) []instr {
+	keep := keepAll(prog)
+	for i := 0; i+1 < len(prog); i++ {
+		b, ok := prog[i].opnd.(bool)
+		if prog[i].op != push || !ok || targets[i+1] {
+			continue
+		}
+		switch prog[i+1].op {
+		case jm, jnm:
+			if b == (prog[i+1].op == jm) {
+				prog[i] = instr{jmp, prog[i+1].opnd}
+			} else {
+				keep[i] = false
+			}
+			keep[i+1] = false
+			i++
+		}
+	}
+	return compact(prog, keep)
+}
+
+// threadJumps retargets jumps whose destination is another unconditional
+// jump, and replaces a push of a constant boolean that is only consumed by a
+// conditional jump with a jump to wherever that conditional jump would go.
+func threadJumps(prog []instr, _ []bool) []instr {
+	for i := range prog {
+		if isJump(prog[i].op) {
+			dest := prog[i].opnd.(int)
+			// Bound the search in case of a cycle.
+			for n := 0; n < len(prog) && dest < len(prog) && prog[dest].op == jmp; n++ {
+				dest = prog[dest].opnd.(int)
+			}
+			prog[i].opnd = dest
+			continue
+		}
+		b, ok := prog[i].opnd.(bool)
+		if prog[i].op != push || !ok || i+1 >= len(prog) {
+			continue
+		}
+		// Find the conditional jump that consumes this boolean.
+		next := i + 1
+		if prog[next].op == jmp {
+			next = prog[next].opnd.(int)
+		}
+		if next >= len(prog) {
+			continue
+		}
+		switch prog[next].op {
+		case jm, jnm:
+			dest := next + 1
+			if b == (prog[next].op == jm) {
+				dest = prog[next].opnd.(int)
+			}
+			prog[i] = instr{jmp, dest}
+		}
+	}
+	return prog
+}
+
+// removeUnreachable removes instructions that control can never reach, and
+// jumps to the immediately following instruction.
+func removeUnreachable(prog []instr, _ []bool) []instr {
+	reachable := make([]bool, len(prog))
+	work := []int{0}
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		for ; pc < len(prog) && !reachable[pc]; pc++ {
+			reachable[pc] = true
+			if isJump(prog[pc].op) {
+				work = append(work, prog[pc].opnd.(int))
+				if prog[pc].op == jmp {
+					break
+				}
+			}
+			if prog[pc].op == stop {
+				break
+			}
+		}
+	}
+	for i := range prog {
+		if prog[i].op == jmp && prog[i].opnd.(int) == i+1 {
+			reachable[i] = false
+		}
+	}
+	return compact(prog, reachable)
+}
+
+// coalesceSetmatched removes a write to the matched flag that is immediately
+// overwritten by the next instruction.
+func coalesceSetmatched(prog []instr, _ []bool) []instr {
+	keep := keepAll(prog)
+	for i := 0; i+1 < len(prog); i++ {
+		if prog[i].op == setmatched && prog[i+1].op == setmatched {
+			keep[i] = false
+		}
+	}
+	return compact(prog, keep)
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+)
+
+var optimiserTests = []struct {
+	name string
+	prog []instr
+	want []instr
+}{
+	{"fold int add",
+		[]instr{
+			{push, int64(1)},
+			{push, int64(2)},
+			{iadd, nil},
+		},
+		[]instr{
+			{push, int64(3)},
+		}},
+	{"fold nested arithmetic",
+		[]instr{
+			{push, int64(2)},
+			{push, int64(3)},
+			{imul, nil},
+			{push, int64(4)},
+			{iadd, nil},
+		},
+		[]instr{
+			{push, int64(10)},
+		}},
+	{"fold float",
+		[]instr{
+			{push, int64(1)},
+			{i2f, nil},
+			{push, 1.5},
+			{fadd, nil},
+		},
+		[]instr{
+			{push, 2.5},
+		}},
+	{"no fold of divide by zero",
+		[]instr{
+			{push, int64(1)},
+			{push, int64(0)},
+			{idiv, nil},
+		},
+		[]instr{
+			{push, int64(1)},
+			{push, int64(0)},
+			{idiv, nil},
+		}},
+	{"no fold of jump target",
+		[]instr{
+			{match, 0},
+			{jnm, 3},
+			{push, int64(1)},
+			{push, int64(2)},
+			{iadd, nil},
+		},
+		[]instr{
+			{match, 0},
+			{jnm, 3},
+			{push, int64(1)},
+			{push, int64(2)},
+			{iadd, nil},
+		}},
+	{"fold not",
+		[]instr{
+			{push, true},
+			{not, nil},
+			{jnm, 4},
+			{setmatched, false},
+		},
+		[]instr{}},
+	{"remove unreachable",
+		[]instr{
+			{jmp, 3},
+			{mload, 0},
+			{dload, 0},
+			{setmatched, true},
+		},
+		[]instr{
+			{setmatched, true},
+		}},
+	{"remove after stop",
+		[]instr{
+			{stop, nil},
+			{setmatched, true},
+		},
+		[]instr{
+			{stop, nil},
+		}},
+	{"thread jumps",
+		[]instr{
+			{match, 0},
+			{jnm, 4},
+			{mload, 0},
+			{jmp, 5},
+			{jmp, 6},
+			{dload, 0},
+			{setmatched, true},
+		},
+		[]instr{
+			{match, 0},
+			{jnm, 4},
+			{mload, 0},
+			{dload, 0},
+			{setmatched, true},
+		}},
+	{"coalesce setmatched",
+		[]instr{
+			{setmatched, false},
+			{setmatched, true},
+		},
+		[]instr{
+			{setmatched, true},
+		}},
+}
+
+func TestOptimise(t *testing.T) {
+	for _, tc := range optimiserTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			obj := &object{prog: tc.prog}
+			Optimise(obj)
+			if diff := go_cmp.Diff(tc.want, obj.prog, go_cmp.AllowUnexported(instr{})); diff != "" {
+				t.Error(diff)
+				t.Logf("Expected:\n%s\nReceived:\n%s", tc.want, obj.prog)
+			}
+		})
+	}
+}
+
+var optimiserProgramTests = []struct {
+	name   string
+	source string
+	prog   []instr
+}{
+	{"constant true condition",
+		"counter foo\n1 > 0 {\n  foo++\n}\n",
+		[]instr{
+			{setmatched, false},
+			{mload, 0},
+			{dload, 0},
+			{inc, nil},
+			{setmatched, true}}},
+	{"constant false condition",
+		"counter foo\n1 < 0 {\n  foo++\n}\n",
+		[]instr{}},
+	{"constant else",
+		"counter foo\ncounter bar\n1 == 0 {\n  foo++\n} else {\n  bar++\n}\n",
+		[]instr{
+			{mload, 1},
+			{dload, 0},
+			{inc, nil}}},
+	{"constant arithmetic",
+		"gauge foo\n/(\\d+)/ {\n  foo = 60 * 60 * $1\n}\n",
+		[]instr{
+			{match, 0},
+			{jnm, 11},
+			{setmatched, false},
+			{mload, 0},
+			{dload, 0},
+			{push, int64(3600)},
+			{push, 0},
+			{capref, 1},
+			{imul, nil},
+			{iset, nil},
+			{setmatched, true}}},
+	{"unoptimisable",
+		"counter line_count\n/$/ { line_count++\n }\n",
+		[]instr{
+			{match, 0},
+			{jnm, 7},
+			{setmatched, false},
+			{mload, 0},
+			{dload, 0},
+			{inc, nil},
+			{setmatched, true}}},
+}
+
+func TestOptimiseProgram(t *testing.T) {
+	for _, tc := range optimiserProgramTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ast, err := Parse(tc.name, strings.NewReader(tc.source))
+			if err != nil {
+				t.Fatalf("Parse error: %s", err)
+			}
+			if err = Check(ast); err != nil {
+				t.Fatalf("Check error: %s", err)
+			}
+			obj, err := CodeGen(tc.name, ast)
+			if err != nil {
+				t.Fatalf("Codegen error:\n%s", err)
+			}
+			Optimise(obj)
+			if diff := go_cmp.Diff(tc.prog, obj.prog, go_cmp.AllowUnexported(instr{})); diff != "" {
+				t.Error(diff)
+				t.Logf("Expected:\n%s\nReceived:\n%s", tc.prog, obj.prog)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+// A program package is a directory of mtail program files with a manifest
+// naming the program to run, the files included in it, and the logs it reads.
+// The files are compiled together into one program, named after the
+// directory, so that a library of programs can be shared between teams and
+// installed or upgraded as a unit: if any file of a package fails to load,
+// the package keeps running as it was.
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// packageManifest is the name of the file that makes a directory a program
+// package.
+const packageManifest = "MANIFEST"
+
+// programPackage is the manifest of a program package.
+type programPackage struct {
+	program  string   // the file of the package's program
+	includes []string // files compiled before the program, in order
+	requires string   // if set, the minimum mtail version the package runs on
+	logs     []string // if set, glob patterns of the logs whose lines are sent to the package
+}
+
+// parsePackageManifest parses a manifest read from r.  Blank lines and lines
+// starting with # are ignored, and the others are one of
+//
+//	program FILE
+//	include FILE
+//	requires VERSION
+//	logs PATTERN
+//
+// where the program is given once, and include and logs any number of times.
+// Files are relative to the package directory.
+func parsePackageManifest(name string, r io.Reader) (*programPackage, error) {
+	p := &programPackage{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected a keyword and one value, not %q", name, n, line)
+		}
+		switch key, value := fields[0], fields[1]; key {
+		case "program", "include":
+			if filepath.IsAbs(value) || strings.HasPrefix(filepath.Clean(value), "..") || filepath.Base(value) == packageManifest {
+				return nil, errors.Errorf("%s:%d: %s %q is not a program file in the package", name, n, key, value)
+			}
+			if key == "include" {
+				p.includes = append(p.includes, value)
+				continue
+			}
+			if p.program != "" {
+				return nil, errors.Errorf("%s:%d: more than one program", name, n)
+			}
+			p.program = value
+		case "requires":
+			if _, _, err := parseVersion(value); err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", name, n)
+			}
+			p.requires = value
+		case "logs":
+			if _, err := filepath.Match(value, ""); err != nil {
+				return nil, errors.Wrapf(err, "%s:%d: bad logs pattern %q", name, n, value)
+			}
+			p.logs = append(p.logs, value)
+		default:
+			return nil, errors.Errorf("%s:%d: unknown keyword %q", name, n, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.program == "" {
+		return nil, errors.Errorf("%s: no program", name)
+	}
+	return p, nil
+}
+
+// parseVersion returns the numbered parts of a version like v3.0.0-rc12, and
+// whether it is a prerelease.
+func parseVersion(v string) ([]int, bool, error) {
+	s := strings.TrimPrefix(v, "v")
+	var prerelease bool
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		prerelease = s[i] == '-'
+		s = s[:i]
+	}
+	var parts []int
+	for _, f := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return nil, false, errors.Errorf("bad version %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, prerelease, nil
+}
+
+// versionAtLeast reports whether version is the same as or later than min.
+// A prerelease comes before the release of the same number.
+func versionAtLeast(version, min string) (bool, error) {
+	v, vpre, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	m, mpre, err := parseVersion(min)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < len(v) || i < len(m); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(m) {
+			b = m[i]
+		}
+		if a != b {
+			return a > b, nil
+		}
+	}
+	return !vpre || mpre, nil
+}
+
+// MtailVersion sets the version of mtail that the requirements of program
+// packages are checked against.  If it isn't set, the requirements aren't
+// checked.
+func MtailVersion(version string) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		l.mtailVersion = version
+		return nil
+	}
+}
+
+// MtailRevision sets the git revision mtail was built from.  Together with
+// the version, it keys the bytecode cache, so that programs cached by
+// another build of mtail are compiled again.
+func MtailRevision(revision string) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		l.mtailRevision = revision
+		return nil
+	}
+}
+
+// packageSource is the source of a package's program: the included files
+// followed by the program, concatenated so they are compiled together.
+type packageSource struct {
+	io.Reader
+	name  string   // the package's name
+	files []string // the files of the source, in order
+	lines []int    // the line of the source each file starts on
+}
+
+// readPackage reads the manifest of the package in dir, and the files it
+// names.
+func (l *MasterControl) readPackage(dir string) (*programPackage, *packageSource, error) {
+	name := l.programName(dir)
+	manifest := filepath.Join(dir, packageManifest)
+	f, err := l.fs.Open(manifest)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to read package %q", dir)
+	}
+	p, err := parsePackageManifest(manifest, f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.requires != "" {
+		if l.mtailVersion == "" {
+			glog.V(1).Infof("Not checking that package %s requires mtail %s, as the version of mtail is unknown", name, p.requires)
+		} else if ok, err := versionAtLeast(l.mtailVersion, p.requires); err != nil {
+			glog.V(1).Infof("Not checking that package %s requires mtail %s: %s", name, p.requires, err)
+		} else if !ok {
+			return nil, nil, errors.Errorf("package %s requires mtail %s, but this is %s", name, p.requires, l.mtailVersion)
+		}
+	}
+	src := &packageSource{name: name}
+	var b bytes.Buffer
+	line := 0
+	for _, file := range append(p.includes, p.program) {
+		f, err := l.fs.Open(filepath.Join(dir, file))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read package %s", name)
+		}
+		text, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read package %s", name)
+		}
+		if len(text) > 0 && text[len(text)-1] != '\n' {
+			text = append(text, '\n')
+		}
+		src.files = append(src.files, file)
+		src.lines = append(src.lines, line)
+		line += bytes.Count(text, []byte("\n"))
+		b.Write(text)
+	}
+	src.Reader = &b
+	return p, src, nil
+}
+
+// positionErrors changes the positions of the compile errors in errs from
+// lines of the source to lines of the package's files.
+func (s *packageSource) positionErrors(errs error) error {
+	el, ok := errs.(ErrorList)
+	if !ok {
+		return errs
+	}
+	for _, e := range el {
+		s.reposition(&e.pos)
+	}
+	return el
+}
+
+// reposition changes pos from a line of the source to a line of the file of
+// the package it is in.
+func (s *packageSource) reposition(pos *position) {
+	i := len(s.lines) - 1
+	for i > 0 && pos.line < s.lines[i] {
+		i--
+	}
+	pos.filename = filepath.Join(s.name, s.files[i])
+	pos.line -= s.lines[i]
+}
+
+// isPackage reports whether the directory dir is a program package.
+func (l *MasterControl) isPackage(dir string) bool {
+	fi, err := l.fs.Stat(filepath.Join(dir, packageManifest))
+	return err == nil && !fi.IsDir()
+}
+
+// packageOf returns the directory of the loaded package that pathname is, or
+// is a file of, or the empty string if it is neither.
+func (l *MasterControl) packageOf(pathname string) string {
+	l.programErrorMu.RLock()
+	defer l.programErrorMu.RUnlock()
+	for _, p := range []string{filepath.Clean(pathname), filepath.Dir(pathname)} {
+		if l.packages[p] {
+			return p
+		}
+	}
+	return ""
+}
+
+// packageFor returns the directory of the program package that pathname is,
+// or is a file of, or the empty string if it is neither.
+func (l *MasterControl) packageFor(pathname string) string {
+	if dir := l.packageOf(pathname); dir != "" {
+		return dir
+	}
+	for _, p := range []string{filepath.Clean(pathname), filepath.Dir(pathname)} {
+		if l.isPackage(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// loadPackage loads or reloads the program package in dir, and starts
+// watching it for changes.  If the package fails to load, any previous
+// version of it keeps running.
+func (l *MasterControl) loadPackage(dir string) error {
+	name := l.programName(dir)
+	d := l.dirFor(dir)
+	l.programErrorMu.Lock()
+	defer l.programErrorMu.Unlock()
+	if !l.packages[dir] {
+		if err := l.w.Add(dir, l.eventsHandle); err != nil {
+			glog.Infof("Failed to add watch on %q but continuing: %s", dir, err)
+		}
+		l.packages[dir] = true
+	}
+	p, src, err := l.readPackage(dir)
+	if err != nil {
+		ProgLoadErrors.Add(name, 1)
+	} else {
+		pd := &ProgramDir{Path: filepath.Dir(dir)}
+		if d != nil {
+			c := *d
+			pd = &c
+		}
+		if len(p.logs) > 0 {
+			pd.Logs = p.logs
+		}
+		err = l.compileAndRun(name, src, pd)
+	}
+	l.programErrors[name] = err
+	l.countSkipped()
+	if err != nil {
+		if l.errorsAbort {
+			return err
+		}
+		glog.Infof("Errors loading package %s:\n%s", name, err)
+	}
+	return nil
+}
+
+// unloadPackage stops the program of the package in dir, if it was loaded.
+func (l *MasterControl) unloadPackage(dir string) {
+	l.programErrorMu.Lock()
+	delete(l.packages, dir)
+	l.programErrorMu.Unlock()
+	l.unload(dir, l.programName(dir))
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestParsePackageManifest(t *testing.T) {
+	p, err := parsePackageManifest("MANIFEST", strings.NewReader(`# The web team's programs.
+program requests.mtail
+include patterns.mtail
+
+include lib/syslog.mtail
+requires v3.0.0-rc12
+logs /var/log/nginx/*
+logs /var/log/apache2/*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &programPackage{
+		program:  "requests.mtail",
+		includes: []string{"patterns.mtail", "lib/syslog.mtail"},
+		requires: "v3.0.0-rc12",
+		logs:     []string{"/var/log/nginx/*", "/var/log/apache2/*"},
+	}
+	if diff := go_cmp.Diff(expected, p, go_cmp.AllowUnexported(programPackage{})); diff != "" {
+		t.Errorf("manifest differs:\n%s", diff)
+	}
+
+	for _, manifest := range []string{
+		"",
+		"include patterns.mtail\n",
+		"program a.mtail\nprogram b.mtail\n",
+		"program\n",
+		"program a.mtail b.mtail\n",
+		"program /etc/mtail/a.mtail\n",
+		"program ../a.mtail\n",
+		"program a.mtail\ninclude MANIFEST\n",
+		"program a.mtail\nrequires three\n",
+		"program a.mtail\nlogs [\n",
+		"program a.mtail\nversion 1\n",
+	} {
+		if _, err := parsePackageManifest("MANIFEST", strings.NewReader(manifest)); err == nil {
+			t.Errorf("expected error parsing manifest %q", manifest)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	for _, tc := range []struct {
+		version, min string
+		expected     bool
+	}{
+		{"v3.0.0", "v3.0.0", true},
+		{"v3.0.1", "v3.0.0", true},
+		{"3.1", "v3.0.9", true},
+		{"v3.0.0", "v3.0.1", false},
+		{"v3.0.0", "v3.0", true},
+		{"v3", "v3.0.1", false},
+		{"v3.0.0-rc12", "v3.0.0", false},
+		{"v3.0.0", "v3.0.0-rc12", true},
+		{"v3.0.0-rc12", "v3.0.0-rc5", true},
+		{"v10.0.0", "v9.9.9", true},
+	} {
+		got, err := versionAtLeast(tc.version, tc.min)
+		if err != nil {
+			t.Errorf("versionAtLeast(%q, %q) error: %s", tc.version, tc.min, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("versionAtLeast(%q, %q) = %v, want %v", tc.version, tc.min, got, tc.expected)
+		}
+	}
+	if _, err := versionAtLeast("devel", "v3.0.0"); err == nil {
+		t.Error("expected error comparing an unnumbered version")
+	}
+}
+
+const (
+	testManifest = `# The web team's request counters.
+program requests.mtail
+include patterns.mtail
+requires v3.0.0
+logs /var/log/nginx/*
+`
+	testPatterns = `const METHOD /(?P<method>GET|POST)/
+`
+	testRequests = `counter requests by method
+/^/ + METHOD + / / {
+  requests[$method]++
+}
+`
+)
+
+func writePackage(t *testing.T, fs afero.Fs, files map[string]string) {
+	for name, text := range files {
+		if err := afero.WriteFile(fs, "/progs/web/"+name, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadPackage(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	writePackage(t, fs, map[string]string{
+		"MANIFEST":       testManifest,
+		"patterns.mtail": testPatterns,
+		"requests.mtail": testRequests,
+		"unused.mtail":   "this is not a program\n",
+	})
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	w := watcher.NewFakeWatcher()
+	l, err := NewLoader("/progs", store, lines, w, fs, MtailVersion("v3.1.0"))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.LoadProgram("/progs/web"); err != nil {
+		t.Fatal(err)
+	}
+	if errs := l.ProgramErrors(); len(errs) > 0 {
+		t.Fatalf("package failed to load: %v", errs)
+	}
+	if diff := go_cmp.Diff([]ProgramState{{Name: "web"}}, l.Programs()); diff != "" {
+		t.Errorf("programs differ:\n%s", diff)
+	}
+
+	// A broken include fails the whole package, which keeps running.
+	writePackage(t, fs, map[string]string{"patterns.mtail": testPatterns + "counter (\n"})
+	if err := l.LoadProgram("/progs/web/patterns.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	err = l.ProgramErrors()["web"]
+	if err == nil || !strings.Contains(err.Error(), "web/patterns.mtail:2:") {
+		t.Errorf("error %v doesn't give the position in the include", err)
+	}
+	if got := len(l.Programs()); got != 1 {
+		t.Errorf("%d programs loaded, want 1", got)
+	}
+
+	lines <- logline.NewLogLine("/var/log/nginx/access.log", "GET /")
+	lines <- logline.NewLogLine("/var/log/nginx/access.log", "POST /form")
+	lines <- logline.NewLogLine("/var/log/nginx/access.log", "GET /index.html")
+	lines <- logline.NewLogLine("/var/log/syslog", "GET /")
+
+	// Removing the manifest unloads the package.
+	if err := fs.Remove("/progs/web/MANIFEST"); err != nil {
+		t.Fatal(err)
+	}
+	l.UnloadProgram("/progs/web/MANIFEST")
+	if got := len(l.Programs()); got != 0 {
+		t.Errorf("%d programs loaded after removing the manifest, want 0", got)
+	}
+	close(lines)
+	<-l.VMsDone
+
+	got := map[string]int64{}
+	for _, lv := range store.Metrics["requests"][0].LabelValues {
+		got[lv.Labels[0]] = datum.GetInt(lv.Value)
+	}
+	if diff := go_cmp.Diff(map[string]int64{"GET": 2, "POST": 1}, got); diff != "" {
+		t.Errorf("requests differ:\n%s", diff)
+	}
+}
+
+func TestLoadPackageRequiresVersion(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	writePackage(t, fs, map[string]string{
+		"MANIFEST":       strings.Replace(testManifest, "v3.0.0", "v4.0.0", 1),
+		"patterns.mtail": testPatterns,
+		"requests.mtail": testRequests,
+	})
+	l, err := NewLoader("/progs", metrics.NewStore(), make(chan *logline.LogLine), watcher.NewFakeWatcher(), fs, MtailVersion("v3.1.0"))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.LoadProgram("/progs/web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ProgramErrors()["web"]; err == nil || !strings.Contains(err.Error(), "requires mtail v4.0.0") {
+		t.Errorf("expected error for a package requiring a later mtail, got %v", err)
+	}
+	if got := len(l.Programs()); got != 0 {
+		t.Errorf("%d programs loaded, want 0", got)
+	}
+}
@@ -1,22 +1,29 @@
+// Code generated by goyacc -v y.output -o parser.go -p mtail parser.y. DO NOT EDIT.
+
 //line parser.y:5
 package vm
 
 import __yyfmt__ "fmt"
 
 //line parser.y:5
+
 import (
+	"time"
+
 	"github.com/golang/glog"
 	"github.com/google/mtail/metrics"
 )
 
-//line parser.y:14
+//line parser.y:16
 type mtailSymType struct {
 	yys      int
 	intVal   int64
 	floatVal float64
+	duration time.Duration
 	op       int
 	text     string
 	texts    []string
+	tuples   [][]string
 	flag     bool
 	n        astNode
 	kind     metrics.Kind
@@ -27,59 +34,68 @@ const COUNTER = 57347
 const GAUGE = 57348
 const TIMER = 57349
 const TEXT = 57350
-const AS = 57351
-const BY = 57352
-const CONST = 57353
-const HIDDEN = 57354
-const DEF = 57355
-const DEL = 57356
-const NEXT = 57357
-const OTHERWISE = 57358
-const ELSE = 57359
-const BUILTIN = 57360
-const REGEX = 57361
-const STRING = 57362
-const CAPREF = 57363
-const CAPREF_NAMED = 57364
-const ID = 57365
-const DECO = 57366
-const INTLITERAL = 57367
-const FLOATLITERAL = 57368
-const INC = 57369
-const DEC = 57370
-const DIV = 57371
-const MOD = 57372
-const MUL = 57373
-const MINUS = 57374
-const PLUS = 57375
-const POW = 57376
-const SHL = 57377
-const SHR = 57378
-const LT = 57379
-const GT = 57380
-const LE = 57381
-const GE = 57382
-const EQ = 57383
-const NE = 57384
-const BITAND = 57385
-const XOR = 57386
-const BITOR = 57387
-const NOT = 57388
-const AND = 57389
-const OR = 57390
-const ADD_ASSIGN = 57391
-const ASSIGN = 57392
-const CONCAT = 57393
-const MATCH = 57394
-const NOT_MATCH = 57395
-const LCURLY = 57396
-const RCURLY = 57397
-const LPAREN = 57398
-const RPAREN = 57399
-const LSQUARE = 57400
-const RSQUARE = 57401
-const COMMA = 57402
-const NL = 57403
+const AFTER = 57351
+const AS = 57352
+const BY = 57353
+const CONST = 57354
+const HIDDEN = 57355
+const DEF = 57356
+const DEL = 57357
+const NEXT = 57358
+const OTHERWISE = 57359
+const ELSE = 57360
+const STOP = 57361
+const INIT = 57362
+const WINDOW = 57363
+const KEEP = 57364
+const REFRESH = 57365
+const UNIT = 57366
+const BUILTIN = 57367
+const REGEX = 57368
+const STRING = 57369
+const CAPREF = 57370
+const CAPREF_NAMED = 57371
+const ID = 57372
+const DECO = 57373
+const INTLITERAL = 57374
+const FLOATLITERAL = 57375
+const DURATIONLITERAL = 57376
+const INC = 57377
+const DEC = 57378
+const DIV = 57379
+const MOD = 57380
+const MUL = 57381
+const MINUS = 57382
+const PLUS = 57383
+const POW = 57384
+const SHL = 57385
+const SHR = 57386
+const LT = 57387
+const GT = 57388
+const LE = 57389
+const GE = 57390
+const EQ = 57391
+const NE = 57392
+const BITAND = 57393
+const XOR = 57394
+const BITOR = 57395
+const NOT = 57396
+const AND = 57397
+const OR = 57398
+const ADD_ASSIGN = 57399
+const ASSIGN = 57400
+const CONCAT = 57401
+const MATCH = 57402
+const NOT_MATCH = 57403
+const LCURLY = 57404
+const RCURLY = 57405
+const LPAREN = 57406
+const RPAREN = 57407
+const LSQUARE = 57408
+const RSQUARE = 57409
+const COMMA = 57410
+const NL = 57411
+const DECLARATION = 57412
 
 var mtailToknames = [...]string{
 	"$end",
@@ -90,6 +106,7 @@ var mtailToknames = [...]string{
 	"GAUGE",
 	"TIMER",
 	"TEXT",
+	"AFTER",
 	"AS",
 	"BY",
 	"CONST",
@@ -99,6 +116,12 @@ var mtailToknames = [...]string{
 	"NEXT",
 	"OTHERWISE",
 	"ELSE",
+	"STOP",
+	"INIT",
+	"WINDOW",
+	"KEEP",
+	"REFRESH",
+	"UNIT",
 	"BUILTIN",
 	"REGEX",
 	"STRING",
@@ -108,6 +131,7 @@ var mtailToknames = [...]string{
 	"DECO",
 	"INTLITERAL",
 	"FLOATLITERAL",
+	"DURATIONLITERAL",
 	"INC",
 	"DEC",
 	"DIV",
@@ -143,6 +167,7 @@ var mtailToknames = [...]string{
 	"RSQUARE",
 	"COMMA",
 	"NL",
+	"DECLARATION",
 }
 var mtailStatenames = [...]string{}
 
@@ -150,9 +175,9 @@ const mtailEofCode = 1
 const mtailErrCode = 2
 const mtailInitialStackSize = 16
 
-//line parser.y:581
+//line parser.y:676
 
-//  tokenpos returns the position of the current token.
+// tokenpos returns the position of the current token.
 func tokenpos(mtaillex mtailLexer) position {
 	return mtaillex.(*parser).t.pos
 }
@@ -170,138 +195,154 @@ var mtailExca = [...]int{
 	-2, 0,
 	-1, 2,
 	1, 1,
-	13, 105,
-	24, 105,
-	29, 105,
-	-2, 87,
-	-1, 103,
-	13, 105,
-	24, 105,
-	29, 105,
-	-2, 87,
+	14, 121,
+	31, 121,
+	37, 121,
+	-2, 90,
+	-1, 106,
+	14, 121,
+	31, 121,
+	37, 121,
+	-2, 90,
 }
 
 const mtailPrivate = 57344
 
-const mtailLast = 218
+const mtailLast = 246
 
 var mtailAct = [...]int{
 
-	19, 119, 46, 42, 26, 25, 41, 40, 24, 39,
-	27, 47, 20, 117, 13, 86, 102, 44, 18, 23,
-	30, 53, 33, 31, 32, 43, 52, 35, 36, 146,
-	144, 145, 145, 155, 12, 82, 26, 25, 122, 83,
-	90, 10, 22, 49, 11, 9, 14, 16, 30, 85,
-	33, 31, 32, 43, 81, 35, 36, 2, 34, 43,
-	30, 153, 33, 31, 32, 43, 28, 35, 36, 59,
-	101, 50, 51, 109, 74, 75, 38, 152, 49, 108,
-	77, 76, 84, 118, 118, 128, 34, 100, 38, 79,
-	80, 15, 50, 51, 63, 65, 64, 121, 34, 120,
-	93, 92, 126, 133, 25, 26, 25, 103, 96, 97,
-	95, 99, 125, 98, 127, 138, 25, 25, 107, 18,
-	134, 137, 136, 143, 142, 141, 148, 147, 139, 140,
-	135, 88, 89, 110, 60, 132, 131, 111, 67, 68,
-	69, 70, 71, 72, 112, 61, 154, 113, 114, 115,
-	59, 157, 116, 1, 156, 151, 12, 106, 150, 37,
-	105, 87, 123, 10, 22, 124, 11, 9, 14, 73,
-	30, 45, 33, 31, 32, 43, 94, 35, 36, 30,
-	91, 33, 31, 32, 43, 48, 35, 36, 55, 56,
-	57, 58, 62, 78, 66, 17, 149, 129, 38, 130,
-	54, 8, 7, 104, 6, 29, 21, 38, 34, 5,
-	4, 3, 0, 15, 0, 0, 0, 34,
+	167, 20, 122, 48, 44, 27, 26, 43, 42, 25,
+	41, 28, 49, 21, 120, 14, 180, 181, 156, 46,
+	24, 155, 154, 155, 168, 105, 55, 173, 54, 88,
+	172, 84, 19, 13, 125, 85, 51, 29, 27, 26,
+	83, 11, 23, 92, 12, 9, 15, 2, 10, 76,
+	77, 87, 79, 78, 31, 169, 34, 32, 33, 45,
+	61, 36, 37, 38, 31, 176, 34, 32, 33, 45,
+	104, 36, 37, 38, 52, 53, 112, 52, 53, 81,
+	82, 51, 160, 40, 101, 159, 121, 121, 65, 67,
+	66, 128, 132, 35, 95, 94, 102, 45, 16, 106,
+	124, 90, 91, 35, 178, 182, 130, 177, 26, 27,
+	26, 111, 98, 99, 97, 175, 129, 100, 131, 148,
+	26, 26, 90, 91, 144, 147, 146, 153, 152, 151,
+	158, 157, 149, 150, 145, 113, 19, 165, 161, 114,
+	69, 70, 71, 72, 73, 74, 115, 13, 143, 116,
+	117, 118, 171, 17, 119, 11, 23, 170, 12, 9,
+	15, 110, 10, 164, 126, 103, 163, 127, 31, 1,
+	34, 32, 33, 45, 179, 36, 37, 38, 89, 31,
+	75, 34, 32, 33, 45, 96, 36, 37, 38, 86,
+	39, 31, 62, 34, 32, 33, 45, 40, 36, 37,
+	38, 109, 93, 47, 108, 50, 64, 35, 40, 63,
+	80, 68, 16, 18, 166, 61, 135, 174, 35, 123,
+	40, 141, 140, 57, 58, 59, 60, 162, 133, 134,
+	35, 142, 136, 56, 137, 139, 8, 7, 138, 107,
+	6, 30, 22, 5, 4, 3,
 }
 var mtailPact = [...]int{
 
-	-1000, -1000, 152, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	36, 2, -1000, 24, -11, -1000, -40, 183, 121, 51,
-	-1000, -1000, -1000, 101, -1000, 22, 31, 54, 21, -23,
-	-17, -1000, -1000, -1000, 161, -1000, -1000, 104, 161, 68,
-	-1000, -1000, 79, -1000, -1000, 104, -1000, 70, -45, -1000,
-	-1000, -1000, -1000, -1000, 137, -1000, -1000, -1000, -1000, -1000,
-	56, -11, -45, -1000, -1000, -1000, -45, -1000, -1000, -1000,
-	-1000, -1000, -1000, -45, -1000, -1000, -45, -45, -45, -1000,
-	-1000, -45, 161, 42, -19, 45, 40, -1000, -1000, -1000,
-	-1000, -45, -1000, -1000, -45, -1000, -1000, -1000, -1000, 21,
-	-11, 161, -1000, 30, 126, -1000, -1000, 84, -11, -1000,
-	161, 161, 2, 161, 161, 161, 36, -29, 51, -1000,
-	-1000, -28, -1000, 161, 161, -1000, 51, -1000, -1000, -1000,
-	-1000, 135, 57, 32, -1000, 101, 54, -1000, -1000, 45,
-	45, 68, -1000, -1000, -1000, 161, -1000, 79, -1000, -27,
-	-1000, -1000, -1000, -1000, 51, 131, -1000, -1000,
+	-1000, -1000, 143, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, 67, 39, -1000, 19, -26, -1000, -43, 218, 178,
+	37, -1000, -1000, -1000, 95, -1000, -11, -5, 36, -1,
+	-35, -29, -1000, -1000, -1000, 166, -1000, -1000, -1000, 66,
+	166, 54, -1000, -1000, 75, -1000, -1000, 87, -1000, 147,
+	-44, -1000, -1000, -1000, -1000, -1000, 174, -1000, -1000, -1000,
+	-1000, -1000, 81, -26, -44, -1000, -1000, -1000, -44, -1000,
+	-1000, -1000, -1000, -1000, -1000, -44, -1000, -1000, -44, -44,
+	-44, -1000, -1000, -44, 166, 154, -31, 22, 23, -1000,
+	-1000, -1000, -1000, -44, -1000, -1000, -44, -1000, -1000, -1000,
+	-1000, -1, 57, -26, 166, -1000, 29, 211, -1000, -1000,
+	122, -26, -1000, 166, 166, 39, 166, 166, 166, 67,
+	-45, 37, -1000, -1000, -47, -1000, 166, 166, -1000, -1000,
+	37, -1000, -1000, -1000, -1000, -1000, 51, 48, -1000, 111,
+	136, 110, -42, 18, -1000, 95, 36, -1000, -1000, 22,
+	22, 54, -1000, -1000, -1000, 166, -1000, 75, -1000, 130,
+	-1000, -1000, -38, -1000, -1000, -1000, -41, -1000, 88, -1000,
+	37, 31, 77, -42, -51, -1000, -1000, -1000, -1000, -1000,
+	-1000, 78, -1000,
 }
 var mtailPgo = [...]int{
 
-	0, 57, 211, 13, 11, 210, 209, 47, 2, 3,
-	9, 159, 1, 206, 19, 10, 0, 14, 205, 6,
-	66, 8, 204, 203, 202, 201, 7, 12, 200, 199,
-	197, 196, 195, 194, 193, 192, 185, 180, 176, 169,
-	161, 153, 70, 15, 118,
+	0, 47, 245, 14, 12, 244, 243, 153, 3, 4,
+	10, 190, 2, 242, 20, 11, 1, 15, 241, 7,
+	37, 9, 240, 239, 237, 236, 8, 13, 233, 229,
+	228, 227, 0, 217, 216, 214, 213, 211, 210, 206,
+	205, 202, 185, 180, 178, 169, 70, 29, 161,
 }
 var mtailR1 = [...]int{
 
-	0, 41, 1, 1, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 5, 5, 5, 6, 6, 4, 7,
-	13, 13, 13, 17, 17, 17, 17, 36, 36, 16,
-	16, 35, 35, 35, 14, 14, 33, 33, 33, 33,
-	33, 33, 15, 15, 34, 34, 10, 10, 27, 27,
-	27, 39, 39, 21, 20, 20, 20, 37, 37, 9,
-	9, 38, 38, 38, 38, 12, 12, 11, 11, 40,
-	40, 8, 8, 8, 8, 8, 8, 8, 8, 8,
-	18, 18, 19, 3, 3, 26, 22, 32, 32, 23,
-	23, 23, 23, 28, 28, 28, 28, 30, 31, 31,
-	31, 31, 29, 24, 25, 43, 44, 42, 42,
+	0, 45, 1, 1, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 5, 5, 5, 6, 6,
+	4, 7, 13, 13, 13, 17, 17, 17, 17, 40,
+	40, 16, 16, 39, 39, 39, 14, 14, 37, 37,
+	37, 37, 37, 37, 15, 15, 38, 38, 10, 10,
+	27, 27, 27, 43, 43, 21, 20, 20, 20, 41,
+	41, 9, 9, 42, 42, 42, 42, 12, 12, 11,
+	11, 44, 44, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 18, 18, 19, 3, 3, 26, 22,
+	36, 36, 23, 23, 23, 23, 23, 23, 23, 23,
+	23, 23, 28, 28, 28, 28, 30, 34, 34, 35,
+	35, 32, 33, 33, 31, 31, 31, 31, 29, 24,
+	25, 47, 48, 46, 46,
 }
 var mtailR2 = [...]int{
 
 	0, 1, 0, 2, 1, 1, 1, 1, 1, 1,
-	3, 2, 1, 4, 2, 2, 1, 2, 3, 1,
-	1, 4, 4, 1, 1, 4, 4, 1, 1, 1,
-	4, 1, 1, 1, 1, 4, 1, 1, 1, 1,
-	1, 1, 1, 4, 1, 1, 1, 4, 1, 4,
-	4, 1, 1, 1, 1, 4, 4, 1, 1, 1,
-	4, 1, 1, 1, 1, 1, 2, 1, 2, 1,
-	1, 1, 3, 4, 1, 1, 1, 3, 1, 1,
-	1, 4, 1, 1, 3, 5, 3, 0, 1, 2,
-	2, 1, 1, 1, 1, 1, 1, 2, 1, 1,
-	3, 3, 2, 4, 3, 0, 0, 0, 1,
+	1, 3, 2, 4, 1, 4, 2, 2, 1, 2,
+	3, 1, 1, 4, 4, 1, 1, 4, 4, 1,
+	1, 1, 4, 1, 1, 1, 1, 4, 1, 1,
+	1, 1, 1, 1, 1, 4, 1, 1, 1, 4,
+	1, 4, 4, 1, 1, 1, 1, 4, 4, 1,
+	1, 1, 4, 1, 1, 1, 1, 1, 2, 1,
+	2, 1, 1, 1, 3, 4, 1, 1, 1, 3,
+	1, 1, 1, 1, 4, 1, 1, 3, 5, 3,
+	0, 1, 2, 2, 2, 3, 5, 3, 2, 3,
+	1, 1, 1, 1, 1, 1, 2, 1, 2, 1,
+	3, 3, 1, 3, 1, 1, 3, 3, 2, 4,
+	3, 0, 0, 0, 1,
 }
 var mtailChk = [...]int{
 
-	-1000, -41, -1, -2, -5, -6, -22, -24, -25, 15,
-	11, 14, 4, -17, 16, 61, -7, -32, -43, -16,
-	-27, -13, 12, -14, -21, -8, -12, -15, -20, -18,
-	18, 21, 22, 20, 56, 25, 26, -11, 46, -10,
-	-26, -19, -9, 23, -19, -11, -8, -4, -36, 54,
-	47, 48, -4, 61, -28, 5, 6, 7, 8, 29,
-	13, 24, -35, 43, 45, 44, -33, 37, 38, 39,
-	40, 41, 42, -39, 52, 53, 50, 49, -34, 35,
-	36, 33, 58, 56, -7, -17, -43, -40, 27, 28,
-	-12, -37, 33, 32, -38, 31, 29, 30, 34, -20,
-	17, -42, 61, -1, -23, 23, 20, -44, 23, -4,
-	-42, -42, -42, -42, -42, -42, -42, -3, -16, -12,
-	57, -3, 57, -42, -42, -4, -16, -27, 55, -30,
-	-29, 10, 9, 19, -4, -14, -15, -21, -8, -17,
-	-17, -10, -26, -19, 59, 60, 57, -9, -12, -31,
-	23, 20, 20, 29, -16, 60, 23, 20,
+	-1000, -45, -1, -2, -5, -6, -22, -24, -25, 16,
+	19, 12, 15, 4, -17, 17, 69, -7, -36, -47,
+	-16, -27, -13, 13, -14, -21, -8, -12, -15, -20,
+	-18, 25, 28, 29, 27, 64, 32, 33, 34, -11,
+	54, -10, -26, -19, -9, 30, -19, -11, -8, -4,
+	-40, 62, 55, 56, -4, 69, -28, 5, 6, 7,
+	8, 37, 14, 31, -39, 51, 53, 52, -37, 45,
+	46, 47, 48, 49, 50, -43, 60, 61, 58, 57,
+	-38, 43, 44, 41, 66, 64, -7, -17, -47, -44,
+	35, 36, -12, -41, 41, 40, -42, 39, 37, 38,
+	42, -20, 9, 18, -46, 69, -1, -23, 30, 27,
+	-48, 30, -4, -46, -46, -46, -46, -46, -46, -46,
+	-3, -16, -12, 65, -3, 65, -46, -46, 34, -4,
+	-16, -27, 63, -30, -29, -34, 21, 23, 27, 24,
+	11, 10, 20, 26, -4, -14, -15, -21, -8, -17,
+	-17, -10, -26, -19, 67, 68, 65, -9, -12, 34,
+	34, 27, -31, 30, 27, 27, -35, -32, 66, 37,
+	-16, 22, 68, 68, -33, 27, 34, 30, 27, -32,
+	67, 68, 27,
 }
 var mtailDef = [...]int{
 
 	2, -2, -2, 3, 4, 5, 6, 7, 8, 9,
-	0, 0, 12, 20, 0, 16, 0, 0, 0, 23,
-	24, 19, 88, 29, 48, 67, 59, 34, 53, 71,
-	0, 74, 75, 76, 105, 78, 79, 65, 0, 42,
-	54, 80, 46, 82, 105, 11, 67, 14, 107, 2,
-	27, 28, 15, 17, 0, 93, 94, 95, 96, 106,
-	0, 0, 107, 31, 32, 33, 107, 36, 37, 38,
-	39, 40, 41, 107, 51, 52, 107, 107, 107, 44,
-	45, 107, 0, 0, 0, 20, 0, 68, 69, 70,
-	66, 107, 57, 58, 107, 61, 62, 63, 64, 10,
-	0, 105, 108, -2, 86, 91, 92, 0, 0, 104,
-	0, 0, 105, 105, 105, 0, 105, 0, 83, 59,
-	72, 0, 77, 0, 0, 13, 25, 26, 18, 89,
-	90, 0, 0, 0, 103, 30, 35, 49, 50, 21,
-	22, 43, 55, 56, 81, 0, 73, 47, 60, 97,
-	98, 99, 102, 85, 84, 0, 100, 101,
+	10, 0, 0, 14, 22, 0, 18, 0, 0, 0,
+	25, 26, 21, 91, 31, 50, 69, 61, 36, 55,
+	73, 0, 76, 77, 78, 121, 80, 81, 82, 67,
+	0, 44, 56, 83, 48, 85, 121, 12, 69, 16,
+	123, 2, 29, 30, 17, 19, 0, 102, 103, 104,
+	105, 122, 0, 0, 123, 33, 34, 35, 123, 38,
+	39, 40, 41, 42, 43, 123, 53, 54, 123, 123,
+	123, 46, 47, 123, 0, 0, 0, 22, 0, 70,
+	71, 72, 68, 123, 59, 60, 123, 63, 64, 65,
+	66, 11, 0, 0, 121, 124, -2, 89, 100, 101,
+	0, 0, 120, 0, 0, 121, 121, 121, 0, 121,
+	0, 86, 61, 74, 0, 79, 0, 0, 13, 15,
+	27, 28, 20, 92, 93, 94, 0, 0, 98, 0,
+	0, 0, 107, 0, 119, 32, 37, 51, 52, 23,
+	24, 45, 57, 58, 84, 0, 75, 49, 62, 95,
+	97, 99, 106, 114, 115, 118, 108, 109, 0, 88,
+	87, 0, 0, 0, 0, 112, 96, 116, 117, 110,
+	111, 0, 113,
 }
 var mtailTok1 = [...]int{
 
@@ -315,6 +356,7 @@ var mtailTok2 = [...]int{
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
 	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
 	52, 53, 54, 55, 56, 57, 58, 59, 60, 61,
+	62, 63, 64, 65, 66, 67, 68, 69, 70,
 }
 var mtailTok3 = [...]int{
 	0,
@@ -325,7 +367,7 @@ var mtailErrorMessages = [...]struct {
 	token int
 	msg   string
 }{
-	{107, 4, "unexpected end of file"},
+	{110, 4, "unexpected end of file"},
 }
 
 //line yaccpar:1
@@ -661,19 +703,19 @@ mtaildefault:
 
 	case 1:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:76
+		//line parser.y:88
 		{
 			mtaillex.(*parser).root = mtailDollar[1].n
 		}
 	case 2:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-		//line parser.y:83
+		//line parser.y:95
 		{
 			mtailVAL.n = &stmtlistNode{}
 		}
 	case 3:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:87
+		//line parser.y:99
 		{
 			mtailVAL.n = mtailDollar[1].n
 			if mtailDollar[2].n != nil {
@@ -682,67 +724,79 @@ mtaildefault:
 		}
 	case 4:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:97
+		//line parser.y:109
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 5:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:99
+		//line parser.y:111
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 6:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:101
+		//line parser.y:113
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 7:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:103
+		//line parser.y:115
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 8:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:105
+		//line parser.y:117
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 9:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:107
+		//line parser.y:119
 		{
 			mtailVAL.n = &nextNode{tokenpos(mtaillex)}
 		}
 	case 10:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+		//line parser.y:123
+		{
+			mtailVAL.n = &stopNode{tokenpos(mtaillex)}
+		}
+	case 11:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:111
+		//line parser.y:127
 		{
 			mtailVAL.n = &patternFragmentDefNode{id: mtailDollar[2].n, expr: mtailDollar[3].n}
 		}
-	case 11:
+	case 12:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:115
+		//line parser.y:131
 		{
-			mtailVAL.n = &delNode{tokenpos(mtaillex), mtailDollar[2].n}
+			mtailVAL.n = &delNode{tokenpos(mtaillex), mtailDollar[2].n, 0}
 		}
-	case 12:
+	case 13:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+		//line parser.y:135
+		{
+			mtailVAL.n = &delNode{tokenpos(mtaillex), mtailDollar[2].n, mtailDollar[4].duration}
+		}
+	case 14:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:119
+		//line parser.y:139
 		{
 			mtailVAL.n = &errorNode{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 13:
+	case 15:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:126
+		//line parser.y:146
 		{
 			mtailVAL.n = &condNode{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil}
 		}
-	case 14:
+	case 16:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:130
+		//line parser.y:150
 		{
 			if mtailDollar[1].n != nil {
 				mtailVAL.n = &condNode{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
@@ -750,574 +804,665 @@ mtaildefault:
 				mtailVAL.n = mtailDollar[2].n
 			}
 		}
-	case 15:
+	case 17:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:138
+		//line parser.y:158
 		{
 			o := &otherwiseNode{tokenpos(mtaillex)}
 			mtailVAL.n = &condNode{o, mtailDollar[2].n, nil, nil}
 		}
-	case 16:
+	case 18:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:146
+		//line parser.y:166
 		{
 			mtailVAL.n = nil
 		}
-	case 17:
+	case 19:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:148
+		//line parser.y:168
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 18:
+	case 20:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:153
+		//line parser.y:173
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 19:
+	case 21:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:160
+		//line parser.y:180
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 20:
+	case 22:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:165
+		//line parser.y:185
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 21:
+	case 23:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:169
+		//line parser.y:189
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 22:
+	case 24:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:173
+		//line parser.y:193
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 23:
+	case 25:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:180
+		//line parser.y:200
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 24:
+	case 26:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:182
+		//line parser.y:202
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 25:
+	case 27:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:184
+		//line parser.y:204
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 26:
+	case 28:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:188
+		//line parser.y:208
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 27:
+	case 29:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:195
+		//line parser.y:215
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 28:
+	case 30:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:197
+		//line parser.y:217
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 29:
+	case 31:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:202
+		//line parser.y:222
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 30:
+	case 32:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:204
+		//line parser.y:224
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 31:
+	case 33:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:211
+		//line parser.y:231
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 32:
+	case 34:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:213
+		//line parser.y:233
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 33:
+	case 35:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:215
+		//line parser.y:235
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 34:
+	case 36:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:220
+		//line parser.y:240
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 35:
+	case 37:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:222
+		//line parser.y:242
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 36:
+	case 38:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:229
+		//line parser.y:249
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 37:
+	case 39:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:231
+		//line parser.y:251
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 38:
+	case 40:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:233
+		//line parser.y:253
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 39:
+	case 41:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:235
+		//line parser.y:255
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 40:
+	case 42:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:237
+		//line parser.y:257
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 41:
+	case 43:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:239
+		//line parser.y:259
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 42:
+	case 44:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:244
+		//line parser.y:264
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 43:
+	case 45:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:246
+		//line parser.y:266
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 44:
+	case 46:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:253
+		//line parser.y:273
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 45:
+	case 47:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:255
+		//line parser.y:275
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 46:
+	case 48:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:260
+		//line parser.y:280
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 47:
+	case 49:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:262
+		//line parser.y:282
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 48:
+	case 50:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:269
+		//line parser.y:289
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 49:
+	case 51:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:271
+		//line parser.y:291
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 50:
+	case 52:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:275
+		//line parser.y:295
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 51:
+	case 53:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:282
+		//line parser.y:302
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 52:
+	case 54:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:284
+		//line parser.y:304
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 53:
+	case 55:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:289
+		//line parser.y:309
 		{
 			mtailVAL.n = &patternExprNode{expr: mtailDollar[1].n}
 		}
-	case 54:
+	case 56:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:296
+		//line parser.y:316
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 55:
+	case 57:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:298
+		//line parser.y:318
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: CONCAT}
 		}
-	case 56:
+	case 58:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:302
+		//line parser.y:322
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: CONCAT}
 		}
-	case 57:
+	case 59:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:309
+		//line parser.y:329
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 58:
+	case 60:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:311
+		//line parser.y:331
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 59:
+	case 61:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:316
+		//line parser.y:336
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 60:
+	case 62:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:318
+		//line parser.y:338
 		{
 			mtailVAL.n = &binaryExprNode{lhs: mtailDollar[1].n, rhs: mtailDollar[4].n, op: mtailDollar[2].op}
 		}
-	case 61:
+	case 63:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:325
+		//line parser.y:345
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 62:
+	case 64:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:327
+		//line parser.y:347
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 63:
+	case 65:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:329
+		//line parser.y:349
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 64:
+	case 66:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:331
+		//line parser.y:351
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 65:
+	case 67:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:336
+		//line parser.y:356
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 66:
+	case 68:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:338
+		//line parser.y:358
 		{
 			mtailVAL.n = &unaryExprNode{pos: tokenpos(mtaillex), expr: mtailDollar[2].n, op: mtailDollar[1].op}
 		}
-	case 67:
+	case 69:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:345
+		//line parser.y:365
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 68:
+	case 70:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:347
+		//line parser.y:367
 		{
 			mtailVAL.n = &unaryExprNode{pos: tokenpos(mtaillex), expr: mtailDollar[1].n, op: mtailDollar[2].op}
 		}
-	case 69:
+	case 71:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:354
+		//line parser.y:374
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 70:
+	case 72:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:356
+		//line parser.y:376
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 71:
+	case 73:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:361
+		//line parser.y:381
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 72:
+	case 74:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:363
+		//line parser.y:383
 		{
 			mtailVAL.n = &builtinNode{pos: tokenpos(mtaillex), name: mtailDollar[1].text, args: nil}
 		}
-	case 73:
+	case 75:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:367
+		//line parser.y:387
 		{
 			mtailVAL.n = &builtinNode{pos: tokenpos(mtaillex), name: mtailDollar[1].text, args: mtailDollar[3].n}
 		}
-	case 74:
+	case 76:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:371
+		//line parser.y:391
 		{
 			mtailVAL.n = &caprefNode{tokenpos(mtaillex), mtailDollar[1].text, false, nil}
 		}
-	case 75:
+	case 77:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:375
+		//line parser.y:395
 		{
 			mtailVAL.n = &caprefNode{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
 		}
-	case 76:
+	case 78:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:379
+		//line parser.y:399
 		{
 			mtailVAL.n = &stringConstNode{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 77:
+	case 79:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:383
+		//line parser.y:403
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 78:
+	case 80:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:387
+		//line parser.y:407
 		{
 			mtailVAL.n = &intConstNode{tokenpos(mtaillex), mtailDollar[1].intVal}
 		}
-	case 79:
+	case 81:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:391
+		//line parser.y:411
 		{
 			mtailVAL.n = &floatConstNode{tokenpos(mtaillex), mtailDollar[1].floatVal}
 		}
-	case 80:
+	case 82:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+		//line parser.y:415
+		{
+			mtailVAL.n = &durationConstNode{tokenpos(mtaillex), mtailDollar[1].duration}
+		}
+	case 83:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:398
+		//line parser.y:422
 		{
 			mtailVAL.n = &indexedExprNode{lhs: mtailDollar[1].n, index: &exprlistNode{}}
 		}
-	case 81:
+	case 84:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:402
+		//line parser.y:426
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*indexedExprNode).index.(*exprlistNode).children = append(
 				mtailVAL.n.(*indexedExprNode).index.(*exprlistNode).children,
 				mtailDollar[3].n.(*exprlistNode).children...)
 		}
-	case 82:
+	case 85:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:412
+		//line parser.y:436
 		{
 			mtailVAL.n = &idNode{tokenpos(mtaillex), mtailDollar[1].text, nil, false}
 		}
-	case 83:
+	case 86:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:419
+		//line parser.y:443
 		{
 			mtailVAL.n = &exprlistNode{}
 			mtailVAL.n.(*exprlistNode).children = append(mtailVAL.n.(*exprlistNode).children, mtailDollar[1].n)
 		}
-	case 84:
+	case 87:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:424
+		//line parser.y:448
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*exprlistNode).children = append(mtailVAL.n.(*exprlistNode).children, mtailDollar[3].n)
 		}
-	case 85:
+	case 88:
 		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
-		//line parser.y:432
+		//line parser.y:456
 		{
 			mp := markedpos(mtaillex)
 			tp := tokenpos(mtaillex)
 			pos := MergePosition(&mp, &tp)
 			mtailVAL.n = &patternConstNode{pos: *pos, pattern: mtailDollar[4].text}
 		}
-	case 86:
+	case 89:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:442
+		//line parser.y:466
 		{
 			mtailVAL.n = mtailDollar[3].n
 			d := mtailVAL.n.(*declNode)
 			d.kind = mtailDollar[2].kind
 			d.hidden = mtailDollar[1].flag
 		}
-	case 87:
+	case 90:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-		//line parser.y:452
+		//line parser.y:476
 		{
 			mtailVAL.flag = false
 		}
-	case 88:
+	case 91:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:456
+		//line parser.y:480
 		{
 			mtailVAL.flag = true
 		}
-	case 89:
+	case 92:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:463
+		//line parser.y:487
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*declNode).keys = mtailDollar[2].texts
 		}
-	case 90:
+	case 93:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:468
+		//line parser.y:492
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*declNode).exportedName = mtailDollar[2].text
 		}
-	case 91:
+	case 94:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+		//line parser.y:497
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*declNode).inits = append(mtailVAL.n.(*declNode).inits, mtailDollar[2].tuples...)
+		}
+	case 95:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		//line parser.y:502
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*declNode).window = mtailDollar[3].duration
+		}
+	case 96:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+		//line parser.y:507
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*declNode).window = mtailDollar[3].duration
+			mtailVAL.n.(*declNode).keep = mtailDollar[5].duration
+		}
+	case 97:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		//line parser.y:513
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*declNode).refresh = mtailDollar[3].duration
+		}
+	case 98:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+		//line parser.y:518
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*declNode).description = mtailDollar[2].text
+		}
+	case 99:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		//line parser.y:523
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*declNode).unit = mtailDollar[3].text
+		}
+	case 100:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:473
+		//line parser.y:528
 		{
 			mtailVAL.n = &declNode{pos: tokenpos(mtaillex), name: mtailDollar[1].text}
 		}
-	case 92:
+	case 101:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:477
+		//line parser.y:532
 		{
 			mtailVAL.n = &declNode{pos: tokenpos(mtaillex), name: mtailDollar[1].text}
 		}
-	case 93:
+	case 102:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:484
+		//line parser.y:539
 		{
 			mtailVAL.kind = metrics.Counter
 		}
-	case 94:
+	case 103:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:488
+		//line parser.y:543
 		{
 			mtailVAL.kind = metrics.Gauge
 		}
-	case 95:
+	case 104:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:492
+		//line parser.y:547
 		{
 			mtailVAL.kind = metrics.Timer
 		}
-	case 96:
+	case 105:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:496
+		//line parser.y:551
 		{
 			mtailVAL.kind = metrics.Text
 		}
-	case 97:
+	case 106:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:503
+		//line parser.y:558
 		{
 			mtailVAL.texts = mtailDollar[2].texts
 		}
-	case 98:
+	case 107:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+		//line parser.y:565
+		{
+			mtailVAL.tuples = [][]string{nil}
+		}
+	case 108:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+		//line parser.y:569
+		{
+			mtailVAL.tuples = mtailDollar[2].tuples
+		}
+	case 109:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+		//line parser.y:576
+		{
+			mtailVAL.tuples = [][]string{mtailDollar[1].texts}
+		}
+	case 110:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		//line parser.y:580
+		{
+			mtailVAL.tuples = append(mtailDollar[1].tuples, mtailDollar[3].texts)
+		}
+	case 111:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		//line parser.y:587
+		{
+			mtailVAL.texts = mtailDollar[2].texts
+		}
+	case 112:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+		//line parser.y:594
+		{
+			mtailVAL.texts = []string{mtailDollar[1].text}
+		}
+	case 113:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+		//line parser.y:598
+		{
+			mtailVAL.texts = append(mtailDollar[1].texts, mtailDollar[3].text)
+		}
+	case 114:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:510
+		//line parser.y:605
 		{
 			mtailVAL.texts = make([]string, 0)
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
 		}
-	case 99:
+	case 115:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-		//line parser.y:515
+		//line parser.y:610
 		{
 			mtailVAL.texts = make([]string, 0)
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
 		}
-	case 100:
+	case 116:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:520
+		//line parser.y:615
 		{
 			mtailVAL.texts = mtailDollar[1].texts
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 101:
+	case 117:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:525
+		//line parser.y:620
 		{
 			mtailVAL.texts = mtailDollar[1].texts
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 102:
+	case 118:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-		//line parser.y:533
+		//line parser.y:628
 		{
 			mtailVAL.text = mtailDollar[2].text
 		}
-	case 103:
+	case 119:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-		//line parser.y:540
+		//line parser.y:635
 		{
 			mtailVAL.n = &decoDefNode{pos: markedpos(mtaillex), name: mtailDollar[3].text, block: mtailDollar[4].n}
 		}
-	case 104:
+	case 120:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-		//line parser.y:547
+		//line parser.y:642
 		{
 			mtailVAL.n = &decoNode{markedpos(mtaillex), mtailDollar[2].text, mtailDollar[3].n, nil, nil}
 		}
-	case 105:
+	case 121:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-		//line parser.y:557
+		//line parser.y:652
 		{
 			glog.V(2).Infof("position marked at %v", tokenpos(mtaillex))
 			mtaillex.(*parser).pos = tokenpos(mtaillex)
 		}
-	case 106:
+	case 122:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-		//line parser.y:567
+		//line parser.y:662
 		{
 			mtaillex.(*parser).inRegex()
 		}
@@ -5,6 +5,8 @@
 package vm
 
 import (
+    "time"
+
     "github.com/google/mtail/metrics"
     "github.com/golang/glog"
 )
@@ -15,9 +17,11 @@ import (
 {
     intVal int64
     floatVal float64
+    duration time.Duration
     op int
     text string
     texts []string
+    tuples [][]string
     flag bool
     n astNode
     kind metrics.Kind
@@ -29,7 +33,8 @@ import (
 %type <n> declaration declarator definition decoration_statement regex_pattern match_expr
 %type <kind> type_spec
 %type <text> as_spec
-%type <texts> by_spec by_expr_list
+%type <texts> by_spec by_expr_list init_tuple init_value_list
+%type <tuples> init_spec init_tuple_list
 %type <flag> hide_spec
 %type <op> rel_op shift_op bitwise_op logical_op add_op mul_op match_op postfix_op
 // Tokens and types are defined here.
@@ -38,7 +43,7 @@ import (
 // Types
 %token COUNTER GAUGE TIMER TEXT
 // Reserved words
-%token AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE
+%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP INIT WINDOW KEEP REFRESH UNIT
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
@@ -50,6 +55,7 @@ import (
 %token <text> DECO
 %token <intVal> INTLITERAL
 %token <floatVal> FLOATLITERAL
+%token <duration> DURATIONLITERAL
 // Operators, in order of precedence
 %token <op> INC DEC
 %token <op> DIV MOD MUL MINUS PLUS POW
@@ -64,6 +70,12 @@ import (
 %token COMMA
 %token NL
 
+// A string after a declaration is its description, not the start of another
+// statement: DECLARATION marks the precedence of a complete declaration as
+// lower than that of a STRING, so the string is shifted.
+%nonassoc DECLARATION
+%nonassoc STRING
+
 %start start
 
 // The %error directive takes a list of tokens describing a parser state in error, and an error message.
@@ -107,13 +119,21 @@ stmt
   {
     $$ = &nextNode{tokenpos(mtaillex)}
   }
+  | STOP
+  {
+    $$ = &stopNode{tokenpos(mtaillex)}
+  }
   | CONST id_expr concat_expr
   {
     $$ = &patternFragmentDefNode{id: $2, expr: $3}
   }
   | DEL postfix_expr
   {
-    $$ = &delNode{tokenpos(mtaillex), $2}
+    $$ = &delNode{tokenpos(mtaillex), $2, 0}
+  }
+  | DEL postfix_expr AFTER DURATIONLITERAL
+  {
+    $$ = &delNode{tokenpos(mtaillex), $2, $4}
   }
   | INVALID
   {
@@ -391,6 +411,10 @@ primary_expr
   {
     $$ = &floatConstNode{tokenpos(mtaillex), $1}
   }
+  | DURATIONLITERAL
+  {
+    $$ = &durationConstNode{tokenpos(mtaillex), $1}
+  }
   ;
 
 indexed_expr
@@ -438,7 +462,7 @@ regex_pattern
   ;
 
 declaration
-  : hide_spec type_spec declarator
+  : hide_spec type_spec declarator %prec DECLARATION
   {
     $$ = $3
     d := $$.(*declNode)
@@ -469,6 +493,37 @@ declarator
     $$ = $1
     $$.(*declNode).exportedName = $2
   }
+  | declarator init_spec
+  {
+    $$ = $1
+    $$.(*declNode).inits = append($$.(*declNode).inits, $2...)
+  }
+  | declarator WINDOW DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*declNode).window = $3
+  }
+  | declarator WINDOW DURATIONLITERAL KEEP DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*declNode).window = $3
+    $$.(*declNode).keep = $5
+  }
+  | declarator REFRESH DURATIONLITERAL
+  {
+    $$ = $1
+    $$.(*declNode).refresh = $3
+  }
+  | declarator STRING
+  {
+    $$ = $1
+    $$.(*declNode).description = $2
+  }
+  | declarator UNIT STRING
+  {
+    $$ = $1
+    $$.(*declNode).unit = $3
+  }
   | ID
   {
     $$ = &declNode{pos: tokenpos(mtaillex), name: $1}
@@ -505,6 +560,46 @@ by_spec
   }
   ;
 
+init_spec
+  : INIT
+  {
+    $$ = [][]string{nil}
+  }
+  | INIT init_tuple_list
+  {
+    $$ = $2
+  }
+  ;
+
+init_tuple_list
+  : init_tuple
+  {
+    $$ = [][]string{$1}
+  }
+  | init_tuple_list COMMA init_tuple
+  {
+    $$ = append($1, $3)
+  }
+  ;
+
+init_tuple
+  : LSQUARE init_value_list RSQUARE
+  {
+    $$ = $2
+  }
+  ;
+
+init_value_list
+  : STRING
+  {
+    $$ = []string{$1}
+  }
+  | init_value_list COMMA STRING
+  {
+    $$ = append($1, $3)
+  }
+  ;
+
 by_expr_list
   : ID
   {
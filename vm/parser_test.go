@@ -38,12 +38,33 @@ var parserTests = []struct {
 	{"declare gauge",
 		"gauge foo\n"},
 
+	{"declare initialized gauge",
+		"gauge foo init\n"},
+
+	{"declare initialized dimensioned counter",
+		"counter foo by bar, baz init [\"a\", \"b\"], [\"a\", \"c\"]\n"},
+
 	{"declare timer",
 		"timer foo\n"},
 
+	{"declare windowed counter",
+		"counter foo by bar window 1m\n"},
+
+	{"declare windowed counter with keep",
+		"counter foo window 1m keep 1h\n"},
+
+	{"declare refreshed gauge",
+		"gauge foo by bar refresh 1m0s\n"},
+
 	{"declare text",
 		"text stringy\n"},
 
+	{"declare described counter",
+		"counter requests_total \"Total HTTP requests\" unit \"requests\" by code\n"},
+
+	{"declare gauge with unit",
+		"gauge latency unit \"seconds\"\n"},
+
 	{"simple pattern action",
 		"/foo/ {}\n"},
 
@@ -236,6 +257,11 @@ foo = 3.14
 	{"simple else clause",
 		"/foo/ {} else {}"},
 
+	{"stop",
+		`/foo/ {
+  stop
+}`},
+
 	{"nested else clause",
 		"/foo/ { / bar/ {}  } else { /quux/ {} else {} }"},
 
@@ -250,8 +276,23 @@ foo = 3.14
   del foo[$1]
 }`},
 
+	{"delete after",
+		`counter foo by bar
+/foo/ {
+  del foo[$1] after 1h
+}`},
+
 	{"getfilename", `
 getfilename()
+`},
+
+	{"rate and ewma", `
+counter c
+gauge r
+/foo/ {
+  r = rate(c, 5m)
+  r = ewma(c, 1h30m)
+}
 `},
 
 	{"indexed expression arg list", `
@@ -383,6 +424,11 @@ var parserInvalidPrograms = []parserInvalidProgram{
 	0[$1]++
 	}`,
 		[]string{"index of non-terminal 2:2:3: syntax error: unexpected LSQUARE, expecting NL"}},
+
+	{"bad duration",
+		"counter foo by a\n// {\n  del foo[$1] after 3parsecs\n}\n",
+		[]string{"bad duration:3:21-28: bad duration '3parsecs': time: unknown unit \"parsecs\" in duration \"3parsecs\"",
+			"bad duration:3:21-28: syntax error: unexpected INVALID, expecting DURATIONLITERAL"}},
 }
 
 func TestParseInvalidPrograms(t *testing.T) {
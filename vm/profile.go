@@ -0,0 +1,108 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// profiling is set non-zero while the loader is collecting a profile, so that
+// VMs only pay for timing their work when someone is looking.
+var profiling int32
+
+// vmProfile accumulates the time a VM spends processing lines, and matching
+// each of its regular expressions, while profiling is enabled.
+type vmProfile struct {
+	sync.Mutex
+	lines     int64
+	lineTime  time.Duration
+	matches   []int64
+	matchTime []time.Duration
+}
+
+func (p *vmProfile) reset(numRegexps int) {
+	p.Lock()
+	defer p.Unlock()
+	p.lines, p.lineTime = 0, 0
+	p.matches = make([]int64, numRegexps)
+	p.matchTime = make([]time.Duration, numRegexps)
+}
+
+func (p *vmProfile) addLine(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.lines++
+	p.lineTime += d
+}
+
+func (p *vmProfile) addMatch(index int, d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if index < len(p.matches) {
+		p.matches[index]++
+		p.matchTime[index] += d
+	}
+}
+
+// ProfileEntry describes the CPU time attributed to a program, or to one of
+// the regular expressions in a program, over a profiling window.
+type ProfileEntry struct {
+	Program string
+	Regexp  string // Empty for the entry describing the whole program.
+	Count   int64  // Number of lines processed, or matches attempted.
+	Time    time.Duration
+}
+
+// Profile enables profiling of all running programs for the duration d, or
+// until ctx is done, and returns the time spent by each program and each
+// regular expression, most expensive first.  Only one profile is collected
+// at a time; concurrent callers wait their turn.
+func (l *MasterControl) Profile(ctx context.Context, d time.Duration) []ProfileEntry {
+	l.profileMu.Lock()
+	defer l.profileMu.Unlock()
+
+	vms := l.runningVMs()
+	for _, v := range vms {
+		v.profile.reset(len(v.re))
+	}
+	atomic.StoreInt32(&profiling, 1)
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+	atomic.StoreInt32(&profiling, 0)
+
+	var entries []ProfileEntry
+	for _, v := range vms {
+		v.profile.Lock()
+		entries = append(entries, ProfileEntry{v.name, "", v.profile.lines, v.profile.lineTime})
+		for i, re := range v.re {
+			if v.profile.matches[i] > 0 {
+				entries = append(entries, ProfileEntry{v.name, re.String(), v.profile.matches[i], v.profile.matchTime[i]})
+			}
+		}
+		v.profile.Unlock()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time > entries[j].Time
+	})
+	return entries
+}
+
+// runningVMs returns the virtual machines currently running programs.
+func (l *MasterControl) runningVMs() []*VM {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	vms := make([]*VM, 0, len(l.handles))
+	for _, h := range l.handles {
+		if h.vm != nil {
+			vms = append(vms, h.vm)
+		}
+	}
+	return vms
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestProfile(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	w := watcher.NewFakeWatcher()
+	l, err := NewLoader("", store, lines, w, afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	defer close(lines)
+	if err := l.CompileAndRun("prof", strings.NewReader("counter foo\n/a/ {\n  foo++\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan []ProfileEntry)
+	go func() {
+		result <- l.Profile(ctx, time.Minute)
+	}()
+	for atomic.LoadInt32(&profiling) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	const n = 10
+	for i := 0; i < n; i++ {
+		lines <- logline.NewLogLine("test", "a")
+	}
+	cancel()
+	entries := <-result
+
+	if atomic.LoadInt32(&profiling) != 0 {
+		t.Error("profiling still enabled")
+	}
+	var prog, re *ProfileEntry
+	for i := range entries {
+		switch entries[i].Regexp {
+		case "":
+			prog = &entries[i]
+		case "a":
+			re = &entries[i]
+		}
+	}
+	// The last line may still be in flight when the profile ends.
+	if prog == nil || prog.Program != "prof" || prog.Count < n-1 {
+		t.Errorf("unexpected program entry %+v in %+v", prog, entries)
+	}
+	if re == nil || re.Count < n-1 {
+		t.Errorf("unexpected regexp entry %+v in %+v", re, entries)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProgramDir describes a directory of programs, and the settings applied to
+// the programs loaded from it, so that several teams can each own a directory
+// of programs on a shared host.
+type ProgramDir struct {
+	Path              string        // The directory, or a single program.
+	MetricPrefix      string        // Prepended to the name of each metric exported by its programs.
+	Logs              []string      // Glob patterns of the logs whose lines are sent to its programs, or all logs if empty.
+	MaxLabelValues    int           // If positive, replaces the loader's limit on the label value sets of each metric.
+	LineBudget        time.Duration // If positive, replaces the loader's limit on the time spent on one line.
+	InstructionBudget int           // If positive, replaces the loader's limit on the instructions executed on one line.
+	MaxMetrics        int           // If positive, replaces the loader's limit on the metrics of each program.
+}
+
+// ParseProgramDir parses a program directory from a spec of the form
+// DIR[,KEY=VALUE...], where each KEY is one of prefix, logs, max_label_values,
+// line_budget, max_instructions, or max_metrics.  logs may be given more than
+// once.
+func ParseProgramDir(spec string) (ProgramDir, error) {
+	parts := strings.Split(spec, ",")
+	d := ProgramDir{Path: parts[0]}
+	if d.Path == "" {
+		return d, errors.Errorf("no program directory in %q", spec)
+	}
+	for _, setting := range parts[1:] {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return d, errors.Errorf("program directory setting %q in %q is not KEY=VALUE", setting, spec)
+		}
+		var err error
+		switch key, value := kv[0], kv[1]; key {
+		case "prefix":
+			d.MetricPrefix = value
+		case "logs":
+			if _, err = filepath.Match(value, ""); err != nil {
+				return d, errors.Wrapf(err, "bad logs pattern %q in %q", value, spec)
+			}
+			d.Logs = append(d.Logs, value)
+		case "max_label_values":
+			if d.MaxLabelValues, err = strconv.Atoi(value); err != nil {
+				return d, errors.Wrapf(err, "bad max_label_values in %q", spec)
+			}
+		case "line_budget":
+			if d.LineBudget, err = time.ParseDuration(value); err != nil {
+				return d, errors.Wrapf(err, "bad line_budget in %q", spec)
+			}
+		case "max_instructions":
+			if d.InstructionBudget, err = strconv.Atoi(value); err != nil {
+				return d, errors.Wrapf(err, "bad max_instructions in %q", spec)
+			}
+		case "max_metrics":
+			if d.MaxMetrics, err = strconv.Atoi(value); err != nil {
+				return d, errors.Wrapf(err, "bad max_metrics in %q", spec)
+			}
+		default:
+			return d, errors.Errorf("unknown program directory setting %q in %q", key, spec)
+		}
+	}
+	return d, nil
+}
+
+// ProgramDirs loads programs from each of the directories, as well as from
+// the program path given to NewLoader, with their settings.  The programs of
+// each directory are named by the directory's basename and their own, like
+// team/errors.mtail, so the basenames of the directories must differ.
+func ProgramDirs(dirs ...ProgramDir) func(*MasterControl) error {
+	return func(l *MasterControl) error {
+		for i := range dirs {
+			if dirs[i].Path == "" {
+				return errors.New("program directory with no path")
+			}
+			for _, d := range l.programDirs {
+				if dirBase(d) == dirBase(&dirs[i]) {
+					return errors.Errorf("program directories %q and %q have the same name", d.Path, dirs[i].Path)
+				}
+			}
+			l.programDirs = append(l.programDirs, &dirs[i])
+		}
+		return nil
+	}
+}
+
+// dirBase returns the name the programs of the program directory d are
+// named within.  A single program is named within its parent directory.
+func dirBase(d *ProgramDir) string {
+	p := filepath.Clean(d.Path)
+	if filepath.Ext(p) == fileExt || filepath.Ext(p) == externalFileExt {
+		p = filepath.Dir(p)
+	}
+	return filepath.Base(p)
+}
+
+// programName returns the name of the program, or program package, at
+// programPath.  Programs loaded from the program path given to NewLoader are
+// named by their basename; those loaded from the further program directories
+// by the directory's basename and their own, so that programs of the same
+// name in different directories are kept apart.
+func (l *MasterControl) programName(programPath string) string {
+	name := filepath.Base(programPath)
+	d := l.dirFor(programPath)
+	if d == nil || d.Path == l.programPath {
+		return name
+	}
+	return dirBase(d) + "/" + name
+}
+
+// dirs returns every program directory of the loader.
+func (l *MasterControl) dirs() []*ProgramDir {
+	if l.programPath == "" {
+		return l.programDirs
+	}
+	return append([]*ProgramDir{{Path: l.programPath}}, l.programDirs...)
+}
+
+// dirFor returns the program directory that the program at programPath is
+// loaded from, or nil if it isn't in one.
+func (l *MasterControl) dirFor(programPath string) *ProgramDir {
+	for _, d := range l.dirs() {
+		p := filepath.Clean(d.Path)
+		if p == filepath.Clean(programPath) || p == filepath.Dir(programPath) {
+			return d
+		}
+	}
+	return nil
+}
+
+// wants reports whether the program should be sent the lines of the log
+// named filename.
+func (h *vmHandle) wants(filename string) bool {
+	if len(h.sources) == 0 {
+		return true
+	}
+	for _, pattern := range h.sources {
+		if matched, _ := filepath.Match(pattern, filename); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	go_cmp "github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/google/mtail/watcher"
+	"github.com/spf13/afero"
+)
+
+func TestParseProgramDir(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		want    ProgramDir
+		wantErr bool
+	}{
+		{spec: "/etc/mtail", want: ProgramDir{Path: "/etc/mtail"}},
+		{
+			spec: "/etc/mtail/web,prefix=web_,logs=/var/log/nginx/*,logs=/var/log/php.log,max_label_values=100,line_budget=10ms",
+			want: ProgramDir{
+				Path:           "/etc/mtail/web",
+				MetricPrefix:   "web_",
+				Logs:           []string{"/var/log/nginx/*", "/var/log/php.log"},
+				MaxLabelValues: 100,
+				LineBudget:     10 * time.Millisecond,
+			},
+		},
+		{spec: "", wantErr: true},
+		{spec: ",prefix=web_", wantErr: true},
+		{spec: "/etc/mtail,prefix", wantErr: true},
+		{spec: "/etc/mtail,colour=blue", wantErr: true},
+		{spec: "/etc/mtail,logs=[", wantErr: true},
+		{spec: "/etc/mtail,max_label_values=many", wantErr: true},
+		{spec: "/etc/mtail,line_budget=10", wantErr: true},
+		{spec: "/etc/mtail,max_instructions=1000,max_metrics=20", want: ProgramDir{Path: "/etc/mtail", InstructionBudget: 1000, MaxMetrics: 20}},
+		{spec: "/etc/mtail,max_instructions=lots", wantErr: true},
+		{spec: "/etc/mtail,max_metrics=-", wantErr: true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := ParseProgramDir(tc.spec)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseProgramDir(%q) error: %v, want error %v", tc.spec, err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := go_cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseProgramDir(%q) differs:\n%s", tc.spec, diff)
+			}
+		})
+	}
+}
+
+func TestProgramDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "program_dirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	web, db := filepath.Join(dir, "web"), filepath.Join(dir, "db")
+	for _, d := range []string{web, db} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(d, "requests.mtail"), []byte("counter requests\n/GET/ {\n  requests++\n}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(db, "queries.mtail"), []byte("counter queries\n/GET/ {\n  queries++\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader("", store, lines, watcher.NewFakeWatcher(), afero.NewOsFs(),
+		ProgramDirs(
+			ProgramDir{Path: web, MetricPrefix: "web_", Logs: []string{"/var/log/nginx/*"}},
+			ProgramDir{Path: db, MetricPrefix: "db_", Logs: []string{"/var/log/db.log"}}))
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.LoadAllPrograms(); err != nil {
+		t.Fatal(err)
+	}
+	// The programs named requests.mtail in web and db are kept apart.
+	if diff := go_cmp.Diff([]ProgramState{{Name: "db/queries.mtail"}, {Name: "db/requests.mtail"}, {Name: "web/requests.mtail"}}, l.Programs()); diff != "" {
+		t.Errorf("programs differ:\n%s", diff)
+	}
+	// Removing one doesn't unload the other.
+	l.UnloadProgram(filepath.Join(db, "requests.mtail"))
+	if diff := go_cmp.Diff([]ProgramState{{Name: "db/queries.mtail"}, {Name: "web/requests.mtail"}}, l.Programs()); diff != "" {
+		t.Errorf("programs differ after unloading db/requests.mtail:\n%s", diff)
+	}
+
+	lines <- logline.NewLogLine("/var/log/nginx/access.log", "GET /")
+	lines <- logline.NewLogLine("/var/log/nginx/access.log", "GET /index.html")
+	lines <- logline.NewLogLine("/var/log/db.log", "GET users")
+	close(lines)
+	<-l.VMsDone
+
+	for name, want := range map[string]int64{"web_requests": 2, "db_queries": 1} {
+		ms, ok := store.Metrics[name]
+		if !ok {
+			t.Errorf("metric %s not in the store", name)
+			continue
+		}
+		d, err := ms[0].GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := datum.GetInt(d); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+	if got := store.Metrics["web_requests"][0].Program; got != "web/requests.mtail" {
+		t.Errorf("web_requests exported by %q, want web/requests.mtail", got)
+	}
+}
+
+func TestProgramDirsSameName(t *testing.T) {
+	_, err := NewLoader("", metrics.NewStore(), make(chan *logline.LogLine), watcher.NewFakeWatcher(), afero.NewMemMapFs(),
+		ProgramDirs(ProgramDir{Path: "/a/team"}, ProgramDir{Path: "/b/team/"}))
+	if err == nil {
+		t.Error("program directories with the same name accepted")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"regexp"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+var (
+	// regexCacheHits counts the regular expression compilations avoided by
+	// finding the pattern already compiled for another program.
+	regexCacheHits = expvar.NewInt("regex_cache_hits_total")
+	// regexCacheSize is the number of compiled patterns in the cache.
+	regexCacheSize = expvar.NewInt("regex_cache_size")
+)
+
+// maxCachedRegexps bounds the number of patterns kept compiled for programs
+// loaded later.  Patterns of programs that have been unloaded or replaced are
+// evicted once the cache is full, so they don't stay in memory for the life
+// of the process.
+const maxCachedRegexps = 1024
+
+// regexCache holds compiled regular expressions shared by all programs, so
+// that a pattern common to many programs, like a timestamp prefix, is only
+// compiled once, and is held in memory once.  A *regexp.Regexp is safe for
+// concurrent use by multiple VMs.  Each VM still evaluates the patterns it
+// matches against a line itself.
+type regexCache struct {
+	sync.Mutex
+	re *lru.Cache // *regexp.Regexp by pattern
+}
+
+func newRegexCache(size int) *regexCache {
+	return &regexCache{re: lru.New(size)}
+}
+
+var sharedRegexps = newRegexCache(maxCachedRegexps)
+
+// compile returns the compiled regular expression for pattern, compiling and
+// caching it if this is the first time it has been seen.
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.Lock()
+	defer c.Unlock()
+	if re, ok := c.re.Get(pattern); ok {
+		regexCacheHits.Add(1)
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.re.Add(pattern, re)
+	regexCacheSize.Set(int64(c.re.Len()))
+	return re, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegexCacheSharedAcrossPrograms(t *testing.T) {
+	var objs []*object
+	for _, name := range []string{"a", "b"} {
+		ast, err := Parse(name, strings.NewReader("counter "+name+"\n/^(\\d+) shared prefix/ {\n  "+name+"++\n}\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Check(ast); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := CodeGen(name, ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, obj)
+	}
+	if objs[0].re[0] != objs[1].re[0] {
+		t.Errorf("regexp not shared: %p != %p", objs[0].re[0], objs[1].re[0])
+	}
+}
+
+func TestRegexCacheInvalidPattern(t *testing.T) {
+	c := newRegexCache(2)
+	if _, err := c.compile("("); err == nil {
+		t.Error("expected error from invalid pattern")
+	}
+	if c.re.Len() != 0 {
+		t.Errorf("invalid pattern cached: %d patterns", c.re.Len())
+	}
+}
+
+func TestRegexCacheEviction(t *testing.T) {
+	c := newRegexCache(2)
+	a, err := c.compile("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pattern := range []string{"b", "a", "c"} {
+		if _, err := c.compile(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.re.Len() != 2 {
+		t.Errorf("%d patterns cached, want 2", c.re.Len())
+	}
+	// The least recently used pattern, b, was evicted; a was kept.
+	if _, ok := c.re.Get("b"); ok {
+		t.Error("b still cached")
+	}
+	if re, _ := c.compile("a"); re != a {
+		t.Errorf("a recompiled: %p != %p", re, a)
+	}
+}
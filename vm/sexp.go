@@ -176,8 +176,13 @@ func (s *Sexp) VisitBefore(n astNode) Visitor {
 	case *floatConstNode:
 		s.emit(strconv.FormatFloat(v.f, 'g', -1, 64))
 
+	case *durationConstNode:
+		s.emit(v.d.String())
+
 	case *nextNode:
 		s.emit("next")
+	case *stopNode:
+		s.emit("stop")
 	case *otherwiseNode:
 		s.emit("otherwise")
 	case *delNode:
@@ -0,0 +1,206 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// eventsEmitted counts the events written to the sink by each program.
+	eventsEmitted = expvar.NewMap("prog_events_emitted_total")
+	// eventsDropped counts the events each program emitted that couldn't be
+	// written to the sink, or that were emitted with no sink configured.
+	eventsDropped = expvar.NewMap("prog_events_dropped_total")
+)
+
+// sinkTimeout bounds the time spent connecting to a socket sink, or writing an
+// event to it, so that a stuck receiver can't hold up shutdown for long.
+const sinkTimeout = 5 * time.Second
+
+// sinkQueueLength is the number of events that can wait to be written to the
+// sink.  Events emitted while the queue is full are dropped, so that a slow or
+// missing receiver never stalls the programs.
+const sinkQueueLength = 1024
+
+// sinkMaxBackoff is the longest wait before connecting to a socket sink again
+// after a failure.
+const sinkMaxBackoff = time.Minute
+
+// sink receives the events emitted by programs.  Events are written to a
+// file, one per line, or sent to a socket: one per line on a stream socket,
+// and one per datagram on a packet socket.  Events are queued, and written by
+// a goroutine that owns the file or connection.
+type sink struct {
+	address string // the address the sink was opened with
+	network string // the socket network, or empty for a file
+	addr    string // the socket address, or the file path
+
+	mu     sync.Mutex // guards closed, and sends to events
+	closed bool
+	events chan sinkEvent // events waiting to be written
+	done   chan struct{}  // closed when the writer goroutine has stopped
+	err    error          // the error closing the file or connection, once done
+
+	// Owned by the writer goroutine once it has started.
+	w       io.WriteCloser // the open file or connection, or nil if it needs (re)opening
+	backoff time.Duration  // wait before connecting again after the last failure
+	retry   time.Time      // no connection is attempted before this time
+}
+
+// sinkEvent is an event emitted by the program named prog.
+type sinkEvent struct {
+	prog  string
+	event string
+}
+
+// openSink opens the sink at address, which is either the path of a file to
+// append to, or a URL like tcp://host:port, udp://host:port, unix:///path or
+// unixgram:///path.  A socket sink is connected again after a failed write,
+// waiting longer after each consecutive failure.
+func openSink(address string) (*sink, error) {
+	s := &sink{address: address, addr: address}
+	if u, err := url.Parse(address); err == nil {
+		switch u.Scheme {
+		case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+			s.network, s.addr = u.Scheme, u.Host
+		case "unix", "unixgram":
+			s.network, s.addr = u.Scheme, u.Path
+		case "", "file":
+			if u.Scheme == "file" {
+				s.addr = u.Path
+			}
+		default:
+			return nil, errors.Errorf("unsupported event sink type %q in %q", u.Scheme, address)
+		}
+	}
+	if s.addr == "" {
+		return nil, errors.Errorf("no path or address in event sink %q", address)
+	}
+	if err := s.open(); err != nil {
+		if s.network == "" {
+			return nil, err
+		}
+		// The receiver may not be listening yet; connect on the first event.
+		s.w = nil
+	}
+	s.events = make(chan sinkEvent, sinkQueueLength)
+	s.done = make(chan struct{})
+	go s.run()
+	return s, nil
+}
+
+func (s *sink) open() (err error) {
+	if s.network == "" {
+		s.w, err = os.OpenFile(s.addr, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	} else {
+		s.w, err = net.DialTimeout(s.network, s.addr, sinkTimeout)
+	}
+	return errors.Wrapf(err, "event sink %s", s.address)
+}
+
+// packet returns true if each event is sent in its own datagram.
+func (s *sink) packet() bool {
+	switch s.network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// write queues the event emitted by the program named prog to be written to
+// the sink.  If the queue is full, the event is dropped and an error
+// returned.
+func (s *sink) write(prog, event string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.Errorf("event sink %s is closed", s.address)
+	}
+	select {
+	case s.events <- sinkEvent{prog, event}:
+		return nil
+	default:
+		return errors.Errorf("event sink %s is full", s.address)
+	}
+}
+
+// run writes the queued events to the sink until the queue is closed.
+func (s *sink) run() {
+	defer close(s.done)
+	for e := range s.events {
+		if err := s.send(e.event); err != nil {
+			glog.V(1).Infof("%s: %s", e.prog, err)
+			eventsDropped.Add(e.prog, 1)
+			continue
+		}
+		eventsEmitted.Add(e.prog, 1)
+	}
+	if s.w != nil {
+		s.err = s.w.Close()
+		s.w = nil
+	}
+}
+
+// send writes event to the sink, connecting first if the last write to a
+// socket failed and the backoff since has passed.
+func (s *sink) send(event string) error {
+	if s.w == nil {
+		if time.Now().Before(s.retry) {
+			return errors.Errorf("event sink %s is disconnected", s.address)
+		}
+		if err := s.open(); err != nil {
+			s.failed()
+			return err
+		}
+	}
+	if !s.packet() {
+		event += "\n"
+	}
+	if c, ok := s.w.(net.Conn); ok {
+		c.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	}
+	if _, err := io.WriteString(s.w, event); err != nil {
+		if s.network != "" {
+			s.w.Close()
+			s.w = nil
+			s.failed()
+		}
+		return errors.Wrapf(err, "event sink %s", s.address)
+	}
+	s.backoff = 0
+	return nil
+}
+
+// failed schedules the next attempt to connect, doubling the wait after each
+// consecutive failure.
+func (s *sink) failed() {
+	if s.backoff *= 2; s.backoff == 0 {
+		s.backoff = time.Second
+	} else if s.backoff > sinkMaxBackoff {
+		s.backoff = sinkMaxBackoff
+	}
+	s.retry = time.Now().Add(s.backoff)
+}
+
+// close writes the queued events, and closes the file or connection.
+func (s *sink) close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return s.err
+}
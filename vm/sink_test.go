@@ -0,0 +1,133 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+)
+
+func TestEmitToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events")
+	s, err := openSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &object{str: []string{"event"}, prog: []instr{{str, 0}, {emit, 1}, {str, 0}, {emit, 1}}}
+	v := New("emitfile", obj, true, nil)
+	v.sink = s
+	v.processLine(logline.NewLogLine(testFilename, "line"))
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "event\nevent\n" {
+		t.Errorf("sink file contains %q", b)
+	}
+	if got := expvar.Get("prog_events_emitted_total").(*expvar.Map).Get("emitfile").String(); got != "2" {
+		t.Errorf("events emitted %s, want 2", got)
+	}
+}
+
+func TestEmitToSocket(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := openSink("udp://" + c.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	obj := &object{str: []string{"event"}, prog: []instr{{str, 0}, {emit, 1}}}
+	v := New("emitsocket", obj, true, nil)
+	v.sink = s
+	v.processLine(logline.NewLogLine(testFilename, "line"))
+	b := make([]byte, 100)
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "event" {
+		t.Errorf("sink received %q", b[:n])
+	}
+}
+
+func TestEmitWithoutSink(t *testing.T) {
+	obj := &object{str: []string{"event"}, prog: []instr{{str, 0}, {emit, 1}}}
+	v := New("emitnone", obj, true, nil)
+	v.processLine(logline.NewLogLine(testFilename, "line"))
+	if got := expvar.Get("prog_events_dropped_total").(*expvar.Map).Get("emitnone").String(); got != "1" {
+		t.Errorf("events dropped %s, want 1", got)
+	}
+}
+
+func TestOpenSinkErrors(t *testing.T) {
+	for _, address := range []string{"ftp://host/", "tcp://", "/nonexistent/dir/events"} {
+		if _, err := openSink(address); err == nil {
+			t.Errorf("openSink(%q) succeeded", address)
+		} else if !strings.Contains(err.Error(), address) {
+			t.Errorf("openSink(%q) error %q doesn't name the sink", address, err)
+		}
+	}
+}
+
+func TestEmitToFullSink(t *testing.T) {
+	// A sink whose queue has no room, and nothing writing from it.
+	s := &sink{address: "full", events: make(chan sinkEvent)}
+	obj := &object{str: []string{"event"}, prog: []instr{{str, 0}, {emit, 1}}}
+	v := New("emitfull", obj, true, nil)
+	v.sink = s
+	v.processLine(logline.NewLogLine(testFilename, "line"))
+	if got := expvar.Get("prog_events_dropped_total").(*expvar.Map).Get("emitfull").String(); got != "1" {
+		t.Errorf("events dropped %s, want 1", got)
+	}
+}
+
+func TestSinkReconnectBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := "tcp://" + l.Addr().String()
+	l.Close()
+	s, err := openSink(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	// Nothing is listening, so the first send fails to connect, and the
+	// next waits for the backoff rather than trying again straight away.
+	s.mu.Lock()
+	s.closed = true
+	close(s.events)
+	s.mu.Unlock()
+	<-s.done
+	if err := s.send("a"); err == nil {
+		t.Fatal("send to a closed port succeeded")
+	}
+	if s.backoff != time.Second {
+		t.Errorf("backoff %s, want 1s", s.backoff)
+	}
+	if err := s.send("b"); err == nil || !strings.Contains(err.Error(), "disconnected") {
+		t.Errorf("send during backoff: %v, want disconnected", err)
+	}
+}
@@ -184,29 +184,43 @@ func IsComplete(t Type) bool {
 
 // Builtin types
 var (
-	Undef   = &TypeOperator{"Undef", []Type{}}
-	Error   = &TypeOperator{"Error", []Type{}}
-	None    = &TypeOperator{"None", []Type{}}
-	Bool    = &TypeOperator{"Bool", []Type{}}
-	Int     = &TypeOperator{"Int", []Type{}}
-	Float   = &TypeOperator{"Float", []Type{}}
-	String  = &TypeOperator{"String", []Type{}}
-	Pattern = &TypeOperator{"Pattern", []Type{}}
+	Undef    = &TypeOperator{"Undef", []Type{}}
+	Error    = &TypeOperator{"Error", []Type{}}
+	None     = &TypeOperator{"None", []Type{}}
+	Bool     = &TypeOperator{"Bool", []Type{}}
+	Int      = &TypeOperator{"Int", []Type{}}
+	Float    = &TypeOperator{"Float", []Type{}}
+	String   = &TypeOperator{"String", []Type{}}
+	Pattern  = &TypeOperator{"Pattern", []Type{}}
+	Duration = &TypeOperator{"Duration", []Type{}}
 )
 
 // Builtins is a mapping of the builtin language functions to their type definitions.
 var Builtins = map[string]Type{
-	"int":         Function(NewTypeVariable(), Int),
-	"bool":        Function(NewTypeVariable(), Bool),
-	"float":       Function(NewTypeVariable(), Float),
-	"string":      Function(NewTypeVariable(), String),
-	"timestamp":   Function(Int),
-	"len":         Function(String, Int),
-	"settime":     Function(Int, None),
-	"strptime":    Function(String, String, None),
-	"strtol":      Function(String, Int, Int),
-	"tolower":     Function(String, String),
-	"getfilename": Function(String),
+	"int":          Function(NewTypeVariable(), Int),
+	"bool":         Function(NewTypeVariable(), Bool),
+	"float":        Function(NewTypeVariable(), Float),
+	"duration":     Function(String, Float),
+	"bytesize":     Function(String, Int),
+	"string":       Function(NewTypeVariable(), String),
+	"timestamp":    Function(Int),
+	"len":          Function(String, Int),
+	"settime":      Function(Int, None),
+	"strptime":     Function(String, String, None),
+	"strtol":       Function(String, Int, Int),
+	"tolower":      Function(String, String),
+	"getfilename":  Function(String),
+	"getpod":       Function(String),
+	"getnamespace": Function(String),
+	"getcontainer": Function(String),
+	"getenv":       Function(String, String),
+	"hostname":     Function(String),
+	"parseip":      Function(String, String),
+	"cidrmatch":    Function(String, String, Bool),
+	GeoIPCountry:   Function(String, String),
+	"emit":         Function(String, None),
+	"rate":         Function(NewTypeVariable(), Duration, Float),
+	"ewma":         Function(NewTypeVariable(), Duration, Float),
 }
 
 // FreshType returns a new type from the provided type scheme, replacing any
@@ -0,0 +1,62 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// byteUnits maps the lowercased suffixes of byte sizes to their multipliers.
+// Decimal units are powers of 1000, and binary units, with an "i", are
+// powers of 1024.
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"m":   1e6,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"g":   1e9,
+	"gb":  1e9,
+	"gib": 1 << 30,
+	"t":   1e12,
+	"tb":  1e12,
+	"tib": 1 << 40,
+	"p":   1e15,
+	"pb":  1e15,
+	"pib": 1 << 50,
+}
+
+// parseByteSize parses a size like "512", "4.5MB" or "2 GiB" into a number of
+// bytes, rounded to the nearest byte.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "bad byte size %q", s)
+	}
+	mult, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, errors.Errorf("bad byte size %q: unknown unit %q", s, strings.TrimSpace(s[i:]))
+	}
+	// math.Round is new in Go 1.10.  An int64 can't hold MaxInt64 as a
+	// float64, which rounds up to 2^63.
+	b := math.Floor(n*mult + 0.5)
+	if math.IsNaN(b) || math.IsInf(b, 0) || b >= math.MaxInt64 {
+		return 0, errors.Errorf("byte size %q out of range", s)
+	}
+	return int64(b), nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+var byteSizeTests = []struct {
+	in   string
+	want int64
+	ok   bool
+}{
+	{"512", 512, true},
+	{"512B", 512, true},
+	{"4.5MB", 4500000, true},
+	{"4.5 mb", 4500000, true},
+	{"1k", 1000, true},
+	{"1KiB", 1024, true},
+	{"2 GiB", 2 << 30, true},
+	{"1.5T", 1500000000000, true},
+	{"0.5B", 1, true},
+	{"", 0, false},
+	{"MB", 0, false},
+	{"12 parsecs", 0, false},
+	{"1.2.3K", 0, false},
+	{"10000PiB", 0, false},
+	{"8192PiB", 0, false},
+	{"8191PiB", 9222246136947933184, true},
+	{strings.Repeat("9", 300) + "PB", 0, false},
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range byteSizeTests {
+		got, err := parseByteSize(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseByteSize(%q) error %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseByteSize(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
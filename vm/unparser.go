@@ -181,9 +181,39 @@ func (u *Unparser) VisitBefore(n astNode) Visitor {
 			u.emit("text ")
 		}
 		u.emit(v.name)
+		if v.description != "" {
+			u.emit(" " + strconv.Quote(v.description))
+		}
+		if v.unit != "" {
+			u.emit(" unit " + strconv.Quote(v.unit))
+		}
 		if len(v.keys) > 0 {
 			u.emit(" by " + strings.Join(v.keys, ", "))
 		}
+		if v.window > 0 {
+			u.emit(" window " + v.window.String())
+			if v.keep > 0 {
+				u.emit(" keep " + v.keep.String())
+			}
+		}
+		if v.refresh > 0 {
+			u.emit(" refresh " + v.refresh.String())
+		}
+		if len(v.inits) > 0 {
+			u.emit(" init")
+			sep := " "
+			for _, labels := range v.inits {
+				if len(labels) == 0 {
+					continue
+				}
+				quoted := make([]string, len(labels))
+				for j, l := range labels {
+					quoted[j] = strconv.Quote(l)
+				}
+				u.emit(sep + "[" + strings.Join(quoted, ", ") + "]")
+				sep = ", "
+			}
+		}
 
 	case *unaryExprNode:
 		switch v.op {
@@ -209,6 +239,9 @@ func (u *Unparser) VisitBefore(n astNode) Visitor {
 	case *floatConstNode:
 		u.emit(strconv.FormatFloat(v.f, 'g', -1, 64))
 
+	case *durationConstNode:
+		u.emit(v.d.String())
+
 	case *decoDefNode:
 		u.emit(fmt.Sprintf("def %s {", v.name))
 		u.newline()
@@ -228,12 +261,18 @@ func (u *Unparser) VisitBefore(n astNode) Visitor {
 	case *nextNode:
 		u.emit("next")
 
+	case *stopNode:
+		u.emit("stop")
+
 	case *otherwiseNode:
 		u.emit("otherwise")
 
 	case *delNode:
 		u.emit("del ")
 		Walk(u, v.n)
+		if v.expiry > 0 {
+			u.emit(" after " + v.expiry.String())
+		}
 		u.newline()
 
 	case *convNode:
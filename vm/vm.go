@@ -9,10 +9,14 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"net"
+	"os"
 	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 
@@ -42,19 +46,48 @@ type VM struct {
 	name string
 	prog []instr
 
-	re  []*regexp.Regexp  // Regular expression constants
-	str []string          // String constants
-	m   []*metrics.Metric // Metrics accessible to this program.
+	re    []*regexp.Regexp  // Regular expression constants
+	rePos []string          // Source position of each regular expression, if known.
+	str   []string          // String constants
+	m     []*metrics.Metric // Metrics accessible to this program.
 
 	timeMemos *lru.Cache // memo of time string parse results
+	histories *histories // past values of datums, for rate and ewma
 
 	t *thread // Current thread of execution
 
 	input *logline.LogLine // Log line input to this round of execution.
 
+	profile     *vmProfile  // Time spent by this VM, and its workers, while profiling is enabled.
+	coverage    *vmCoverage // If set, the lines matched by each regular expression.
+	lineMatched bool        // Whether a regular expression has matched the current line, while coverage is enabled.
+
+	workers []*VM // If set, copies of this VM that each process all the lines of some of the log files, in parallel.
+
+	lineBudget        time.Duration // Time after which processing of a line is abandoned, if nonzero.
+	instructionBudget int           // Instructions after which processing of a line is abandoned, if nonzero.
+	overBudget        int64         // Count of lines abandoned for exceeding a budget; accessed atomically.
+	processed         int64         // Count of lines processed, including those abandoned; accessed atomically.
+
+	sink *sink // Destination of the events emitted by the program, if set.
+
+	updates sync.Locker // Held while processing each line, if set, so metric store snapshots see whole lines.
+
+	dryRun        bool  // If set, the program is being tried out, and its errors and events are not counted.
+	runtimeErrors int64 // Count of runtime errors; accessed atomically.
+
+	lastMatch int64 // Wall time in Unix nanoseconds of the last successful match against an input line; accessed atomically.
+	matches   int64 // Count of successful matches against input lines; accessed atomically.
+
 	terminate bool // Flag to stop the VM on this line of input.
 	abort     bool // Flag to abort the VM.
 
+	hostname string // Hostname of the machine, once looked up.
+
+	networks map[string]*net.IPNet // Networks matched by cidrmatch, by their CIDR notation, once parsed.
+
+	enrichers map[string]Enricher // Databases looked up by the enrichment builtins, by builtin name.
+
 	syslogUseCurrentYear bool           // Overwrite zero years with the current year in a strptime.
 	loc                  *time.Location // Override local timezone with provided, if not empty
 }
@@ -74,7 +107,10 @@ func (t *thread) Pop() (value interface{}) {
 
 // Log a runtime error and terminate the program
 func (v *VM) errorf(format string, args ...interface{}) {
-	progRuntimeErrors.Add(v.name, 1)
+	atomic.AddInt64(&v.runtimeErrors, 1)
+	if !v.dryRun {
+		progRuntimeErrors.Add(v.name, 1)
+	}
 	glog.Infof(v.name+": Runtime error: "+format+"\n", args...)
 	glog.Infof("VM stack:\n%s", debug.Stack())
 	glog.Infof("Dumping vm state")
@@ -90,6 +126,20 @@ func (v *VM) errorf(format string, args ...interface{}) {
 	v.terminate = true
 }
 
+// popLabelValues pops n label values of the metric m off the stack.  If m is
+// windowed, the label value of the time window of the current timestamp is
+// added.
+func (t *thread) popLabelValues(m *metrics.Metric, n int) []string {
+	keys := make([]string, n, n+1)
+	for j := n - 1; j >= 0; j-- {
+		keys[j] = t.Pop().(string)
+	}
+	if m.Window > 0 {
+		keys = append(keys, m.WindowStart(t.time))
+	}
+	return keys
+}
+
 func (t *thread) PopInt() (int64, error) {
 	val := t.Pop()
 	switch n := val.(type) {
@@ -296,14 +346,34 @@ func (v *VM) execute(t *thread, i instr) {
 		// Store the results in the operandth element of the stack,
 		// where i.opnd == the matched re index
 		index := i.opnd.(int)
+		if atomic.LoadInt32(&profiling) != 0 {
+			start := time.Now()
+			defer func() { v.profile.addMatch(index, time.Since(start)) }()
+		}
 		t.matches[index] = v.re[index].FindStringSubmatch(v.input.Line)
+		if t.matches[index] != nil {
+			atomic.StoreInt64(&v.lastMatch, time.Now().UnixNano())
+			atomic.AddInt64(&v.matches, 1)
+			if v.coverage != nil {
+				v.coverage.addMatch(index)
+				v.lineMatched = true
+			}
+		}
 		t.Push(t.matches[index] != nil)
 
 	case smatch:
 		// match regex against item on the stack
 		index := i.opnd.(int)
 		line := t.Pop().(string)
+		if atomic.LoadInt32(&profiling) != 0 {
+			start := time.Now()
+			defer func() { v.profile.addMatch(index, time.Since(start)) }()
+		}
 		t.matches[index] = v.re[index].FindStringSubmatch(line)
+		if t.matches[index] != nil && v.coverage != nil {
+			v.coverage.addMatch(index)
+			v.lineMatched = true
+		}
 		t.Push(t.matches[index] != nil)
 
 	case cmp:
@@ -572,15 +642,7 @@ func (v *VM) execute(t *thread, i instr) {
 		//fmt.Printf("Stack: %v\n", t.stack)
 		m := t.Pop().(*metrics.Metric)
 		//fmt.Printf("Metric: %v\n", m)
-		index := i.opnd.(int)
-		keys := make([]string, index)
-		//fmt.Printf("keys: %v\n", keys)
-		for a := index - 1; a >= 0; a-- {
-			s := t.Pop().(string)
-			//fmt.Printf("s: %v\n", s)
-			keys[a] = s
-			//fmt.Printf("Keys: %v\n", keys)
-		}
+		keys := t.popLabelValues(m, i.opnd.(int))
 		//fmt.Printf("Keys: %v\n", keys)
 		d, err := m.GetDatum(keys...)
 		if err != nil {
@@ -605,17 +667,21 @@ func (v *VM) execute(t *thread, i instr) {
 
 	case del:
 		m := t.Pop().(*metrics.Metric)
-		index := i.opnd.(int)
-		keys := make([]string, index)
-		for j := index - 1; j >= 0; j-- {
-			s := t.Pop().(string)
-			keys[j] = s
-		}
+		keys := t.popLabelValues(m, i.opnd.(int))
 		err := m.RemoveDatum(keys...)
 		if err != nil {
 			v.errorf("del (RemoveDatum) failed: %s", err)
 		}
 
+	case expire:
+		m := t.Pop().(*metrics.Metric)
+		keys := t.popLabelValues(m, i.opnd.(int))
+		expiry := t.Pop().(time.Duration)
+		err := m.ExpireDatum(expiry, keys...)
+		if err != nil {
+			v.errorf("expire (ExpireDatum) failed: %s", err)
+		}
+
 	case tolower:
 		// Lowercase a string from TOS, and push result back.
 		s := t.Pop().(string)
@@ -658,6 +724,29 @@ func (v *VM) execute(t *thread, i instr) {
 		}
 		t.Push(float64(i))
 
+	case f2i:
+		f, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		t.Push(int64(f))
+
+	case s2d:
+		str := t.Pop().(string)
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		t.Push(d.Seconds())
+
+	case s2b:
+		str := t.Pop().(string)
+		b, err := parseByteSize(str)
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		t.Push(b)
+
 	case i2s:
 		i, err := t.PopInt()
 		if err != nil {
@@ -679,9 +768,127 @@ func (v *VM) execute(t *thread, i instr) {
 		// Only match if the matched flag is false.
 		t.Push(!t.matched)
 
+	case stop:
+		// Skip the rest of the program for this line.
+		v.terminate = true
+
+	case emit:
+		// Events emitted with no sink configured, or while its queue is
+		// full, are counted and dropped.  The sink counts the rest once
+		// they are written.
+		event := t.Pop().(string)
+		if v.dryRun {
+			break
+		}
+		if v.sink == nil {
+			eventsDropped.Add(v.name, 1)
+			break
+		}
+		if err := v.sink.write(v.name, event); err != nil {
+			glog.V(1).Infof("%s: %s", v.name, err)
+			eventsDropped.Add(v.name, 1)
+		}
+
+	case rate, ewma:
+		// Pop the window and the datum, and push the rate or average of its
+		// values as of the current timestamp.
+		window := t.Pop().(time.Duration)
+		d := t.Pop().(datum.Datum)
+		value, ok := datumValue(d)
+		if !ok {
+			v.errorf("%s of non-numeric datum %v", opNames[i.op], d)
+			return
+		}
+		key := historyKey{t.pc, d}
+		v.histories.Lock()
+		h, ok := v.histories.c.Get(key)
+		var result float64
+		if i.op == rate {
+			if !ok {
+				counter, _ := i.opnd.(bool)
+				h = &rateHistory{counter: counter}
+				v.histories.c.Add(key, h)
+			}
+			result = h.(*rateHistory).rate(t.time, value, window)
+		} else {
+			if !ok {
+				h = &ewmaHistory{}
+				v.histories.c.Add(key, h)
+			}
+			result = h.(*ewmaHistory).average(t.time, value, window)
+		}
+		v.histories.Unlock()
+		t.Push(result)
+
 	case getfilename:
 		t.Push(v.input.Filename)
 
+	case getpod, getnamespace, getcontainer:
+		// Empty if the input isn't a Kubernetes container log.
+		pod, namespace, container, _ := logline.ContainerLabels(v.input.Filename)
+		switch i.op {
+		case getpod:
+			t.Push(pod)
+		case getnamespace:
+			t.Push(namespace)
+		default:
+			t.Push(container)
+		}
+
+	case getenv:
+		// Empty if the variable isn't set.  The checker has already refused
+		// other names, so this only guards hand-built or stale bytecode.
+		name := t.Pop().(string)
+		if !strings.HasPrefix(name, getenvPrefix) {
+			t.Push("")
+			return
+		}
+		t.Push(os.Getenv(name))
+
+	case hostname:
+		if v.hostname == "" {
+			h, err := os.Hostname()
+			if err != nil {
+				v.errorf("hostname failed: %s", err)
+				return
+			}
+			v.hostname = h
+		}
+		t.Push(v.hostname)
+
+	case parseip:
+		// Empty if the string isn't an IP address.
+		if ip := parseIP(t.Pop().(string)); ip != nil {
+			t.Push(ip.String())
+		} else {
+			t.Push("")
+		}
+
+	case cidrmatch:
+		cidr := t.Pop().(string)
+		ip := parseIP(t.Pop().(string))
+		n, err := v.network(cidr)
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(ip != nil && n.Contains(ip))
+
+	case enrich:
+		// Empty if no database is configured for the builtin.
+		key := t.Pop().(string)
+		e, ok := v.enrichers[i.opnd.(string)]
+		if !ok {
+			t.Push("")
+			break
+		}
+		val, err := e.Lookup(key)
+		if err != nil {
+			v.errorf("%s: %s", i.opnd, err)
+			return
+		}
+		t.Push(val)
+
 	case cat:
 		s1 := t.Pop().(string)
 		s2 := t.Pop().(string)
@@ -696,19 +903,53 @@ func (v *VM) execute(t *thread, i instr) {
 // fetch-execute cycle on the VM bytecode with the line as input to the
 // program, until termination.
 func (v *VM) processLine(line *logline.LogLine) {
+	if atomic.LoadInt32(&profiling) != 0 {
+		start := time.Now()
+		defer func() { v.profile.addLine(time.Since(start)) }()
+	}
+	if v.coverage != nil {
+		v.lineMatched = false
+		defer func() { v.coverage.addLine(line, v.lineMatched) }()
+	}
+	if v.updates != nil {
+		v.updates.Lock()
+		defer v.updates.Unlock()
+	}
 	t := new(thread)
 	t.matched = false
+	// Start with the time recorded by the log format, if any.
+	t.time = line.Time
 	v.t = t
 	v.input = line
 	t.stack = make([]interface{}, 0)
 	t.matches = make(map[int][]string, len(v.re))
+	var start time.Time
+	if v.lineBudget > 0 {
+		start = time.Now()
+	}
+	executed := 0
 	for {
 		if t.pc >= len(v.prog) {
 			return
 		}
+		if v.instructionBudget > 0 && executed >= v.instructionBudget {
+			instructionBudgetExceeded.Add(v.name, 1)
+			atomic.AddInt64(&v.overBudget, 1)
+			glog.V(1).Infof("%s: abandoned line after %d instructions: %q", v.name, executed, line.Line)
+			return
+		}
 		i := v.prog[t.pc]
 		t.pc++
 		v.execute(t, i)
+		executed++
+		// Regular expression matches are the only instructions that can take
+		// a long time, so only check the budget after them.
+		if v.lineBudget > 0 && (i.op == match || i.op == smatch) && time.Since(start) > v.lineBudget {
+			lineBudgetExceeded.Add(v.name, 1)
+			atomic.AddInt64(&v.overBudget, 1)
+			glog.V(1).Infof("%s: abandoned line after %s: %q", v.name, time.Since(start), line.Line)
+			return
+		}
 		if v.terminate || v.abort {
 			// Terminate only stops this invocation on this line of input; reset the terminate flag.
 			v.terminate = false
@@ -725,23 +966,158 @@ func (v *VM) Run(_ uint32, lines <-chan *logline.LogLine, shutdown chan<- struct
 
 	glog.Infof("Starting program %s", v.name)
 	close(started)
-	for line := range lines {
-		// TODO(jaq): measure and export the processLine runtime per VM as a histo.
-		v.processLine(line)
+	if len(v.workers) > 0 {
+		v.runWorkers(lines)
+	} else {
+		for line := range lines {
+			// TODO(jaq): measure and export the processLine runtime per VM as a histo.
+			v.processLine(line)
+			atomic.AddInt64(&v.processed, 1)
+		}
 	}
 	glog.Infof("Stopping program %s", v.name)
 }
 
+// workerLines is the number of lines queued for each worker of a VM.
+const workerLines = 1000
+
+// setParallelism sets the VM to process lines with n workers, which share
+// its program, metrics, and settings.  Each log file is assigned to one
+// worker, so that its lines are processed in order, but the lines of
+// different log files may be processed in any order.  It must be called
+// after the VM is configured, and before it is run.
+func (v *VM) setParallelism(n int) {
+	if n < 2 {
+		return
+	}
+	v.workers = make([]*VM, n)
+	for i := range v.workers {
+		w := New(v.name, &object{prog: v.prog, str: v.str, re: v.re, rePos: v.rePos, m: v.m}, v.syslogUseCurrentYear, v.loc)
+		w.lineBudget, w.instructionBudget = v.lineBudget, v.instructionBudget
+		w.sink, w.updates, w.coverage = v.sink, v.updates, v.coverage
+		w.histories, w.profile = v.histories, v.profile
+		w.enrichers = v.enrichers
+		v.workers[i] = w
+	}
+}
+
+// runWorkers sends each line to the worker assigned its log file, until the
+// input closes and the workers have processed every line.
+func (v *VM) runWorkers(lines <-chan *logline.LogLine) {
+	var wg sync.WaitGroup
+	queues := make([]chan *logline.LogLine, len(v.workers))
+	for i, w := range v.workers {
+		queues[i] = make(chan *logline.LogLine, workerLines)
+		wg.Add(1)
+		go func(w *VM, queue <-chan *logline.LogLine) {
+			defer wg.Done()
+			for line := range queue {
+				w.processLine(line)
+				atomic.AddInt64(&w.processed, 1)
+			}
+		}(w, queues[i])
+	}
+	assigned := make(map[string]int)
+	for line := range lines {
+		i, ok := assigned[line.Filename]
+		if !ok {
+			i = len(assigned) % len(queues)
+			assigned[line.Filename] = i
+		}
+		queues[i] <- line
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+// SetLineBudget sets the time the VM may spend processing a single line
+// before it abandons the line.  A budget of zero means no limit.
+func (v *VM) SetLineBudget(d time.Duration) {
+	v.lineBudget = d
+}
+
+// SetInstructionBudget sets the number of instructions the VM may execute
+// on a single line before it abandons the line.  A budget of zero means no
+// limit.
+func (v *VM) SetInstructionBudget(n int) {
+	v.instructionBudget = n
+}
+
+// OverBudget returns the number of lines the VM has abandoned for exceeding
+// its line or instruction budget.
+func (v *VM) OverBudget() int64 {
+	n := atomic.LoadInt64(&v.overBudget)
+	for _, w := range v.workers {
+		n += w.OverBudget()
+	}
+	return n
+}
+
+// LinesProcessed returns the number of lines the VM has finished processing.
+func (v *VM) LinesProcessed() int64 {
+	n := atomic.LoadInt64(&v.processed)
+	for _, w := range v.workers {
+		n += w.LinesProcessed()
+	}
+	return n
+}
+
+// RuntimeErrors returns the number of runtime errors the VM has had.
+func (v *VM) RuntimeErrors() int64 {
+	n := atomic.LoadInt64(&v.runtimeErrors)
+	for _, w := range v.workers {
+		n += w.RuntimeErrors()
+	}
+	return n
+}
+
+func (v *VM) resetOverBudget() {
+	atomic.StoreInt64(&v.overBudget, 0)
+	for _, w := range v.workers {
+		w.resetOverBudget()
+	}
+}
+
+// matchCount returns the number of times a line has matched a regular
+// expression in this program.
+func (v *VM) matchCount() int64 {
+	n := atomic.LoadInt64(&v.matches)
+	for _, w := range v.workers {
+		n += w.matchCount()
+	}
+	return n
+}
+
+// LastMatch returns the time that a line last matched a regular expression in
+// this program, or the zero time if no line has matched yet.
+func (v *VM) LastMatch() time.Time {
+	ns := atomic.LoadInt64(&v.lastMatch)
+	for _, w := range v.workers {
+		if wns := atomic.LoadInt64(&w.lastMatch); wns > ns {
+			ns = wns
+		}
+	}
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
 // New creates a new virtual machine with the given name, and compiler
 // artifacts for executable and data segments.
 func New(name string, obj *object, syslogUseCurrentYear bool, loc *time.Location) *VM {
 	return &VM{
 		name:                 name,
 		re:                   obj.re,
+		rePos:                obj.rePos,
 		str:                  obj.str,
 		m:                    obj.m,
 		prog:                 obj.prog,
 		timeMemos:            lru.New(64),
+		histories:            newHistories(),
+		profile:              &vmProfile{},
 		syslogUseCurrentYear: syslogUseCurrentYear,
 		loc:                  loc,
 	}
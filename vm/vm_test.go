@@ -4,7 +4,9 @@
 package vm
 
 import (
+	"os"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -425,6 +427,69 @@ var instructions = []struct {
 		[]interface{}{3.1},
 		[]interface{}{"3.1"},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"f2i",
+		instr{f2i, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{3.9},
+		[]interface{}{int64(3)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"s2d",
+		instr{s2d, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"1m30s"},
+		[]interface{}{90.0},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"s2d millis",
+		instr{s2d, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"250ms"},
+		[]interface{}{0.25},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"s2b",
+		instr{s2b, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"4.5MB"},
+		[]interface{}{int64(4500000)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseip",
+		instr{parseip, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"[2001:DB8::0001]:443"},
+		[]interface{}{"2001:db8::1"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseip not an ip",
+		instr{parseip, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"example.com"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cidrmatch",
+		instr{cidrmatch, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"10.1.2.3:8080", "10.0.0.0/8"},
+		[]interface{}{true},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cidrmatch outside",
+		instr{cidrmatch, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"192.0.2.1", "10.0.0.0/8"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"cidrmatch not an ip",
+		instr{cidrmatch, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"-", "10.0.0.0/8"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"cat",
 		instr{cat, 0},
 		[]*regexp.Regexp{},
@@ -501,7 +566,189 @@ func TestInstrs(t *testing.T) {
 	}
 }
 
+func TestStop(t *testing.T) {
+	obj := &object{prog: []instr{{stop, nil}, {setmatched, true}}}
+	v := New("stop", obj, true, nil)
+	v.processLine(logline.NewLogLine(testFilename, "aaaab"))
+	if v.t.pc != 1 {
+		t.Errorf("program did not stop, pc is %d", v.t.pc)
+	}
+	if v.t.matched {
+		t.Error("instruction after stop was executed")
+	}
+	if v.terminate {
+		t.Error("terminate flag not reset")
+	}
+}
+
+func TestLastMatch(t *testing.T) {
+	obj := &object{re: []*regexp.Regexp{regexp.MustCompile("b$")}, prog: []instr{{match, 0}}}
+	v := New("lastmatch", obj, true, nil)
+	v.processLine(logline.NewLogLine(testFilename, "aaaa"))
+	if !v.LastMatch().IsZero() {
+		t.Errorf("last match set without a match: %v", v.LastMatch())
+	}
+	before := time.Now()
+	v.processLine(logline.NewLogLine(testFilename, "aaaab"))
+	if v.LastMatch().Before(before) {
+		t.Errorf("last match not updated: %v before %v", v.LastMatch(), before)
+	}
+}
+
+func TestContainerBuiltins(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		expected []interface{}
+	}{
+		{"/var/log/containers/web-1_prod_nginx-0123abcd.log", []interface{}{"web-1", "prod", "nginx"}},
+		{testFilename, []interface{}{"", "", ""}},
+	} {
+		obj := &object{prog: []instr{{getpod, nil}, {getnamespace, nil}, {getcontainer, nil}}}
+		v := New("container", obj, true, nil)
+		v.processLine(logline.NewLogLine(tc.filename, "line"))
+		if diff := go_cmp.Diff(tc.expected, v.t.stack); diff != "" {
+			t.Errorf("%s: %s", tc.filename, diff)
+		}
+	}
+}
+
+func TestLineTime(t *testing.T) {
+	obj := &object{prog: []instr{{timestamp, nil}}}
+	v := New("linetime", obj, true, nil)
+	line := logline.NewLogLine(testFilename, "line")
+	line.Time = time.Unix(1527225825, 0)
+	v.processLine(line)
+	if diff := go_cmp.Diff([]interface{}{int64(1527225825)}, v.t.stack); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestLineBudget(t *testing.T) {
+	obj := &object{re: []*regexp.Regexp{regexp.MustCompile("a")}, prog: []instr{{match, 0}, {setmatched, true}}}
+	v := New("budget", obj, true, nil)
+	v.SetLineBudget(time.Nanosecond)
+	before := lineBudgetExceeded.Get("budget")
+	v.processLine(logline.NewLogLine(testFilename, "aaaab"))
+	if v.t.matched {
+		t.Error("instruction after budget exceeded was executed")
+	}
+	if after := lineBudgetExceeded.Get("budget"); after == nil || (before != nil && after.String() == before.String()) {
+		t.Errorf("exceeded budget not counted: %v", after)
+	}
+}
+
+func TestInstructionBudget(t *testing.T) {
+	obj := &object{re: []*regexp.Regexp{regexp.MustCompile("a")}, prog: []instr{{match, 0}, {setmatched, true}}}
+	v := New("instructions", obj, true, nil)
+	v.SetInstructionBudget(1)
+	before := instructionBudgetExceeded.Get("instructions")
+	v.processLine(logline.NewLogLine(testFilename, "a"))
+	if v.t.matched {
+		t.Error("instruction after budget exceeded was executed")
+	}
+	if after := instructionBudgetExceeded.Get("instructions"); after == nil || (before != nil && after.String() == before.String()) {
+		t.Errorf("exceeded budget not counted: %v", after)
+	}
+	if got := v.OverBudget(); got != 1 {
+		t.Errorf("OverBudget() = %d, want 1", got)
+	}
+	// A program that finishes within its budget isn't abandoned.
+	v.SetInstructionBudget(2)
+	v.processLine(logline.NewLogLine(testFilename, "a"))
+	if !v.t.matched {
+		t.Error("program within budget was abandoned")
+	}
+	if got := v.OverBudget(); got != 1 {
+		t.Errorf("OverBudget() = %d, want 1", got)
+	}
+}
+
+func TestGetenvHostname(t *testing.T) {
+	os.Setenv("MTAIL_TEST_CLUSTER", "west")
+	defer os.Unsetenv("MTAIL_TEST_CLUSTER")
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	os.Setenv("TEST_CLUSTER", "east")
+	defer os.Unsetenv("TEST_CLUSTER")
+	obj := &object{str: []string{"MTAIL_TEST_CLUSTER", "MTAIL_TEST_UNSET", "TEST_CLUSTER"},
+		prog: []instr{{str, 0}, {getenv, 1}, {str, 1}, {getenv, 1}, {str, 2}, {getenv, 1}, {hostname, 0}}}
+	v := New("env", obj, true, nil)
+	v.processLine(logline.NewLogLine(testFilename, "line"))
+	if diff := go_cmp.Diff([]interface{}{"west", "", "", host}, v.t.stack); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestWindowedMetric(t *testing.T) {
+	prog := `counter requests by code window 1m keep 2m
+/^(\S+) (\d+)$/ {
+  strptime($1, "2006-01-02T15:04:05Z07:00")
+  requests[$2]++
+}
+`
+	v, err := Compile("window", strings.NewReader(prog), false, false, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"2018-06-01T12:00:00Z 200",
+		"2018-06-01T12:00:30Z 200",
+		"2018-06-01T12:01:00Z 200",
+		"2018-06-01T12:02:20Z 200",
+	} {
+		v.processLine(logline.NewLogLine(testFilename, line))
+	}
+	m := v.m[0]
+	if diff := go_cmp.Diff([]string{"code", metrics.WindowKey}, m.Keys); diff != "" {
+		t.Errorf("keys differ: %s", diff)
+	}
+	// The first window started 2m before the last, so is expired.
+	want := map[string]int64{
+		"200 2018-06-01T12:01:00Z": 1,
+		"200 2018-06-01T12:02:00Z": 1,
+	}
+	got := make(map[string]int64)
+	for _, lv := range m.LabelValues {
+		got[strings.Join(lv.Labels, " ")] = datum.GetInt(lv.Value)
+	}
+	if diff := go_cmp.Diff(want, got); diff != "" {
+		t.Errorf("windows differ: %s", diff)
+	}
+}
+
 // makeVM is a helper method for construction a single-instruction VM
+func TestParallelWorkersShareState(t *testing.T) {
+	prog := `counter hits
+gauge hits_rate
+/^(\S+)$/ {
+  strptime($1, "2006-01-02T15:04:05Z07:00")
+  hits++
+  hits_rate = rate(hits, 1m)
+}
+`
+	v, err := Compile("parallel", strings.NewReader(prog), false, false, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.setParallelism(2)
+	// The lines of each file go to a different worker.
+	v.workers[0].processLine(logline.NewLogLine("a.log", "2018-06-01T12:00:00Z"))
+	v.workers[1].processLine(logline.NewLogLine("b.log", "2018-06-01T12:00:30Z"))
+	// One history of hits, not one per worker, so the second line has a
+	// rate.
+	if got := datum.GetFloat(v.m[1].LabelValues[0].Value); got == 0 {
+		t.Error("hits_rate is 0, want the rate since the first worker's line")
+	}
+
+	v.workers[0].processLine(logline.NewLogLine("a.log", "bogus"))
+	v.workers[1].processLine(logline.NewLogLine("b.log", "bogus"))
+	if got := v.RuntimeErrors(); got != 2 {
+		t.Errorf("%d runtime errors, want 2", got)
+	}
+}
+
 func makeVM(i instr, m []*metrics.Metric) *VM {
 	obj := &object{m: m, prog: []instr{i}}
 	v := New("test", obj, true, nil)
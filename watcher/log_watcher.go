@@ -9,6 +9,8 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/golang/glog"
@@ -18,8 +20,17 @@ import (
 var (
 	eventCount = expvar.NewMap("log_watcher_event_count")
 	errorCount = expvar.NewInt("log_watcher_error_count")
+	// watchLimitExceeded counts the paths that couldn't be watched because
+	// the inotify watch limit was reached, so are polled instead.
+	watchLimitExceeded = expvar.NewInt("log_watcher_watch_limit_exceeded_total")
+	// polledPaths is the number of paths being polled for changes.
+	polledPaths = expvar.NewInt("log_watcher_polled_paths")
 )
 
+// defaultPollInterval is the interval between polls of the paths that
+// couldn't be watched.
+const defaultPollInterval = time.Second
+
 // LogWatcher implements a Watcher for watching real filesystems.
 type LogWatcher struct {
 	*fsnotify.Watcher
@@ -31,6 +42,16 @@ type LogWatcher struct {
 	watched   map[string]chan Event // Names of paths being watched
 
 	runDone chan struct{} // Channel to respond to Close
+
+	addWatch func(string) error // Adds a watch to the fsnotify Watcher.
+
+	pollMu       sync.Mutex           // protects `polled'
+	polled       map[string]pollState // Paths that couldn't be watched, so are polled
+	pollInterval time.Duration        // Interval between polls of the polled paths
+	pollOnce     sync.Once            // Starts the poller when the first path is polled
+	pollStop     chan struct{}        // Closed to stop the poller
+	pollDone     chan struct{}        // Closed when the poller has stopped
+	limitOnce    sync.Once            // Warns the first time the watch limit is reached
 }
 
 // NewLogWatcher returns a new LogWatcher, or returns an error.
@@ -44,7 +65,12 @@ func NewLogWatcher() (*LogWatcher, error) {
 		events:  make([]chan Event, 0),
 		watched: make(map[string]chan Event),
 		runDone: make(chan struct{}),
+
+		polled:       make(map[string]pollState),
+		pollInterval: defaultPollInterval,
+		pollStop:     make(chan struct{}),
 	}
+	w.addWatch = f.Add
 	go w.run()
 	return w, nil
 }
@@ -114,6 +140,7 @@ func (w *LogWatcher) run() {
 
 // Close shuts down the LogWatcher.  It is safe to call this from multiple clients because
 func (w *LogWatcher) Close() (err error) {
+	w.stopPolling()
 	err = w.Watcher.Close()
 	<-w.runDone
 	return
@@ -135,11 +162,15 @@ func (w *LogWatcher) Add(path string, handle int) error {
 		return errors.Wrapf(err, "Failed to lookup absolutepath of %q", path)
 	}
 	glog.V(2).Infof("Adding a watch on resolved path %q", absPath)
-	err = w.Watcher.Add(absPath)
+	err = w.addWatch(absPath)
 	if err != nil {
-		if os.IsPermission(err) {
+		switch {
+		case os.IsPermission(err):
 			glog.V(2).Infof("Skipping permission denied error on adding a watch.")
-		} else {
+		case err == syscall.ENOSPC:
+			// The inotify watch limit, fs.inotify.max_user_watches, is reached.
+			w.pollInstead(absPath)
+		default:
 			return errors.Wrapf(err, "Failed to create a new watch on %q", absPath)
 		}
 	}
@@ -151,6 +182,26 @@ func (w *LogWatcher) Add(path string, handle int) error {
 	return nil
 }
 
+// Remove removes a path from the list of watched items.
+func (w *LogWatcher) Remove(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lookup absolutepath of %q", path)
+	}
+	w.watchedMu.Lock()
+	delete(w.watched, absPath)
+	w.watchedMu.Unlock()
+	w.pollMu.Lock()
+	if _, ok := w.polled[absPath]; ok {
+		delete(w.polled, absPath)
+		polledPaths.Add(-1)
+		w.pollMu.Unlock()
+		return nil
+	}
+	w.pollMu.Unlock()
+	return w.Watcher.Remove(absPath)
+}
+
 // IsWatching indicates if the path is being watched. It includes both
 // filenames and directories.
 func (w *LogWatcher) IsWatching(path string) bool {
@@ -165,3 +216,135 @@ func (w *LogWatcher) IsWatching(path string) bool {
 	w.watchedMu.RUnlock()
 	return ok
 }
+
+// pollState is the state of a polled path when it was last polled.
+type pollState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+	names   map[string]bool // The entries of a directory.
+}
+
+// statPath returns the current state of the path.
+func statPath(path string) pollState {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return pollState{}
+	}
+	s := pollState{exists: true, size: fi.Size(), modTime: fi.ModTime()}
+	if fi.IsDir() {
+		s.names = make(map[string]bool)
+		f, err := os.Open(path)
+		if err != nil {
+			return s
+		}
+		names, _ := f.Readdirnames(-1)
+		f.Close()
+		for _, name := range names {
+			s.names[name] = true
+		}
+	}
+	return s
+}
+
+// changes returns the events that describe how a path changed between two
+// polls.
+func changes(path string, prev, cur pollState) []Event {
+	switch {
+	case !prev.exists && cur.exists:
+		return []Event{{Create, path}}
+	case prev.exists && !cur.exists:
+		return []Event{{Delete, path}}
+	case !cur.exists:
+		return nil
+	}
+	var events []Event
+	if cur.names != nil {
+		for name := range cur.names {
+			if !prev.names[name] {
+				events = append(events, Event{Create, filepath.Join(path, name)})
+			}
+		}
+		for name := range prev.names {
+			if !cur.names[name] {
+				events = append(events, Event{Delete, filepath.Join(path, name)})
+			}
+		}
+		return events
+	}
+	if cur.size != prev.size || !cur.modTime.Equal(prev.modTime) {
+		events = append(events, Event{Update, path})
+	}
+	return events
+}
+
+// pollInstead polls the path for changes, because it couldn't be watched.
+func (w *LogWatcher) pollInstead(path string) {
+	watchLimitExceeded.Add(1)
+	w.limitOnce.Do(func() {
+		glog.Warningf("The inotify watch limit was reached watching %q, so it and any further paths that can't be watched are polled every %s instead.  Raise the fs.inotify.max_user_watches sysctl to watch them.", path, w.pollInterval)
+	})
+	glog.V(1).Infof("Polling %q instead of watching it", path)
+	w.pollMu.Lock()
+	if _, ok := w.polled[path]; !ok {
+		w.polled[path] = statPath(path)
+		polledPaths.Add(1)
+	}
+	w.pollMu.Unlock()
+	w.pollOnce.Do(func() {
+		w.pollDone = make(chan struct{})
+		go w.poll()
+	})
+}
+
+// poll sends events for the changes to the polled paths, until the watcher
+// is closed.
+func (w *LogWatcher) poll() {
+	defer close(w.pollDone)
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.pollStop:
+			return
+		case <-ticker.C:
+		}
+		w.pollMu.Lock()
+		paths := make([]string, 0, len(w.polled))
+		for path := range w.polled {
+			paths = append(paths, path)
+		}
+		w.pollMu.Unlock()
+		for _, path := range paths {
+			w.pollMu.Lock()
+			prev, ok := w.polled[path]
+			w.pollMu.Unlock()
+			if !ok {
+				continue
+			}
+			cur := statPath(path)
+			for _, e := range changes(path, prev, cur) {
+				w.sendEvent(e)
+			}
+			w.pollMu.Lock()
+			if _, ok := w.polled[path]; ok {
+				w.polled[path] = cur
+			}
+			w.pollMu.Unlock()
+		}
+	}
+}
+
+// stopPolling stops the poller, if it was started.
+func (w *LogWatcher) stopPolling() {
+	w.pollOnce.Do(func() {})
+	select {
+	case <-w.pollStop:
+		return
+	default:
+		close(w.pollStop)
+	}
+	if w.pollDone != nil {
+		<-w.pollDone
+	}
+}
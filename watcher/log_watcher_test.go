@@ -217,6 +217,120 @@ func TestLogWatcherAddError(t *testing.T) {
 	}
 }
 
+func TestLogWatcherRemove(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping log watcher test in short mode")
+	}
+
+	workdir, err := ioutil.TempDir("", "log_watcher_test")
+	if err != nil {
+		t.Fatalf("could not create temporary working directory: %s", err)
+	}
+
+	defer func() {
+		err = os.RemoveAll(workdir)
+		if err != nil {
+			t.Fatalf("could not remove temp dir %s: %s:", workdir, err)
+		}
+	}()
+
+	w, err := NewLogWatcher()
+	if err != nil {
+		t.Fatalf("couldn't create a watcher: %s\n", err)
+	}
+	defer func() {
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	handle, _ := w.Events()
+	if err = w.Add(workdir, handle); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Remove(workdir); err != nil {
+		t.Fatal(err)
+	}
+	if w.IsWatching(workdir) {
+		t.Errorf("still watching %s after removal", workdir)
+	}
+	// Adding it again must watch it again, not skip it as already watched.
+	if err = w.Add(workdir, handle); err != nil {
+		t.Fatal(err)
+	}
+	if !w.IsWatching(workdir) {
+		t.Errorf("not watching %s after adding it again", workdir)
+	}
+}
+
+func TestLogWatcherPollsOverWatchLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping log watcher test in short mode")
+	}
+
+	workdir, err := ioutil.TempDir("", "log_watcher_test")
+	if err != nil {
+		t.Fatalf("could not create temporary working directory: %s", err)
+	}
+	defer os.RemoveAll(workdir)
+
+	w, err := NewLogWatcher()
+	if err != nil {
+		t.Fatalf("couldn't create a watcher: %s\n", err)
+	}
+	defer func() {
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// Pretend that the inotify watch limit has been reached.
+	w.addWatch = func(string) error { return syscall.ENOSPC }
+	w.pollInterval = 10 * time.Millisecond
+	exceeded, polled := watchLimitExceeded.Value(), polledPaths.Value()
+
+	handle, eventsChannel := w.Events()
+	if err = w.Add(workdir, handle); err != nil {
+		t.Fatal(err)
+	}
+	logfile := filepath.Join(workdir, "logfile")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expectEvent := func(want Event) {
+		select {
+		case e := <-eventsChannel:
+			if diff := cmp.Diff(want, e); diff != "" {
+				t.Error(diff)
+			}
+		case <-time.After(deadline):
+			t.Errorf("didn't receive %v before timeout", want)
+		}
+	}
+	expectEvent(Event{Create, logfile})
+
+	if err = w.Add(logfile, handle); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("hi\n"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(Event{Update, logfile})
+
+	if got := watchLimitExceeded.Value() - exceeded; got != 2 {
+		t.Errorf("watch limit exceeded %d times, want 2", got)
+	}
+	if got := polledPaths.Value() - polled; got != 2 {
+		t.Errorf("%d paths polled, want 2", got)
+	}
+	if err = w.Remove(logfile); err != nil {
+		t.Fatal(err)
+	}
+	if got := polledPaths.Value() - polled; got != 1 {
+		t.Errorf("%d paths polled after removal, want 1", got)
+	}
+}
+
 func TestLogWatcherAddWhilePermissionDenied(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping log watcher test in short mode")